@@ -0,0 +1,307 @@
+// Package audit keeps an append-only record of every resource the cleanup stopped, removed or
+// pruned, one JSON entry per line. Each entry holds the hash of the previous one, so that
+// editing, removing or reordering entries breaks the chain Verify checks. The log is rotated
+// once it grows too large, and the chain continues across the rotated files. It implements
+// cleanup.Auditor.
+package audit
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+const (
+	// DefaultMaxSize is the size past which the log is rotated, in bytes.
+	DefaultMaxSize = 100 << 20
+
+	// DefaultMaxFiles is the number of rotated files kept besides the current one.
+	DefaultMaxFiles = 10
+)
+
+// Entry is a destructive action recorded in the log.
+type Entry struct {
+	// Seq numbers the entries from 1, across rotated files.
+	Seq  uint64    `json:"seq"`
+	Time time.Time `json:"time"`
+
+	// JobID is the job owning the resource, empty for resources pruned under disk pressure.
+	JobID  string            `json:"jobId,omitempty"`
+	Kind   cleanup.Kind      `json:"kind"`
+	ID     string            `json:"id"`
+	Name   string            `json:"name,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+
+	// Rule is why the resource was attributed to the job, or pruned.
+	Rule   string         `json:"rule"`
+	Action cleanup.Action `json:"action"`
+	Result cleanup.Result `json:"result"`
+	Error  string         `json:"error,omitempty"`
+
+	// PrevHash is the hash of the previous entry, empty for the first one.
+	PrevHash string `json:"prevHash"`
+
+	// Hash is the SHA-256 of the entry without it, hex-encoded.
+	Hash string `json:"hash"`
+}
+
+// computeHash returns the hash of the entry, computed over its JSON encoding without the hash.
+func (e Entry) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode audit entry %d: %w", e.Seq, err)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// Log appends entries to an audit log file. It is safe for concurrent use.
+type Log struct {
+	mu       sync.Mutex
+	path     string
+	maxSize  int64
+	maxFiles int
+	file     *os.File
+	size     int64
+	seq      uint64
+	lastHash string
+	logger   *slog.Logger
+}
+
+// Open opens the audit log for appending, continuing the chain of its last entry, and creates
+// it if it does not exist yet.
+//
+// Parameters:
+// - path: The path of the current log file. Rotated files are named after it, path.1 being the
+// most recent.
+// - maxSize: The size past which the log is rotated, in bytes, DefaultMaxSize if not positive.
+// - maxFiles: The number of rotated files kept, DefaultMaxFiles if not positive.
+// - logger: Receives the failures to record an entry, nil to use slog.Default().
+//
+// Returns:
+// - *Log: The open log.
+// - error: An error if the log could not be read or opened.
+func Open(path string, maxSize int64, maxFiles int, logger *slog.Logger) (*Log, error) {
+	if maxSize <= 0 {
+		maxSize = DefaultMaxSize
+	}
+	if maxFiles <= 0 {
+		maxFiles = DefaultMaxFiles
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	l := &Log{path: filepath.Clean(path), maxSize: maxSize, maxFiles: maxFiles, logger: logger}
+
+	// The last entry is in the most recent file that has one
+	for _, name := range newestFirst(Files(l.path)) {
+		entries, err := readFile(name)
+		if err != nil {
+			return nil, err
+		}
+		if len(entries) > 0 {
+			last := entries[len(entries)-1]
+			l.seq, l.lastHash = last.Seq, last.Hash
+			break
+		}
+	}
+
+	if err := l.open(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the current file for appending.
+func (l *Log) open() error {
+	file, err := os.OpenFile(l.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log %s: %w", l.path, err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("failed to open audit log %s: %w", l.path, err)
+	}
+	l.file, l.size = file, info.Size()
+	return nil
+}
+
+// Audited records the action, logging failures since the cleanup goes on regardless.
+func (l *Log) Audited(action cleanup.AuditedAction) {
+	entry := Entry{
+		JobID:  action.JobID,
+		Kind:   action.Kind,
+		ID:     action.Item.ID,
+		Name:   action.Item.Name,
+		Labels: action.Item.Labels,
+		Rule:   action.Item.Reason,
+		Action: action.Action,
+		Result: action.Result,
+	}
+	if action.Err != nil {
+		entry.Error = action.Err.Error()
+	}
+	if _, err := l.Append(entry); err != nil {
+		l.logger.Error("Failed to record audit entry", cleanup.LogJobID, action.JobID, cleanup.LogResourceKind, action.Kind, cleanup.LogResourceID, action.Item.ID, cleanup.ErrorAttr(err))
+	}
+}
+
+// Append chains the entry to the previous one and writes it, rotating the log first if it
+// would grow past its maximum size. The entry is synced to disk before Append returns.
+//
+// Parameters:
+// - entry: The entry to record. Its sequence number and hashes are set by Append, and its time
+// when not set.
+//
+// Returns:
+// - Entry: The entry as recorded.
+// - error: An error if the entry could not be written.
+func (l *Log) Append(entry Entry) (Entry, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return entry, fmt.Errorf("audit log %s is closed", l.path)
+	}
+
+	if entry.Time.IsZero() {
+		entry.Time = time.Now()
+	}
+	entry.Time = entry.Time.UTC()
+	entry.Seq = l.seq + 1
+	entry.PrevHash = l.lastHash
+	hash, err := entry.computeHash()
+	if err != nil {
+		return entry, err
+	}
+	entry.Hash = hash
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return entry, fmt.Errorf("failed to encode audit entry %d: %w", entry.Seq, err)
+	}
+	line = append(line, '\n')
+
+	if l.size > 0 && l.size+int64(len(line)) > l.maxSize {
+		if err := l.rotate(); err != nil {
+			return entry, err
+		}
+	}
+
+	n, err := l.file.Write(line)
+	l.size += int64(n)
+	if err != nil {
+		return entry, fmt.Errorf("failed to write audit log %s: %w", l.path, err)
+	}
+	if err := l.file.Sync(); err != nil {
+		return entry, fmt.Errorf("failed to sync audit log %s: %w", l.path, err)
+	}
+
+	l.seq, l.lastHash = entry.Seq, entry.Hash
+	return entry, nil
+}
+
+// rotate shifts the rotated files, dropping the oldest, moves the current file to path.1 and
+// opens a new one.
+func (l *Log) rotate() error {
+	if err := l.file.Close(); err != nil {
+		return fmt.Errorf("failed to close audit log %s: %w", l.path, err)
+	}
+	l.file = nil
+
+	if err := os.Remove(rotatedName(l.path, l.maxFiles)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to remove oldest audit log: %w", err)
+	}
+	for i := l.maxFiles - 1; i >= 1; i-- {
+		if err := os.Rename(rotatedName(l.path, i), rotatedName(l.path, i+1)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to rotate audit log: %w", err)
+		}
+	}
+	if err := os.Rename(l.path, rotatedName(l.path, 1)); err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return l.open()
+}
+
+// Close closes the log file.
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+// rotatedName returns the name of the i-th most recent rotated file.
+func rotatedName(path string, i int) string {
+	return fmt.Sprintf("%s.%d", path, i)
+}
+
+// Files returns the existing files of the log at path, oldest first: the rotated files from the
+// oldest to path.1, then the current file.
+func Files(path string) []string {
+	var files []string
+	for i := 1; ; i++ {
+		name := rotatedName(path, i)
+		if _, err := os.Stat(name); err != nil {
+			break
+		}
+		files = append([]string{name}, files...)
+	}
+	if _, err := os.Stat(path); err == nil {
+		files = append(files, path)
+	}
+	return files
+}
+
+// newestFirst returns the files in reverse order.
+func newestFirst(files []string) []string {
+	reversed := make([]string, len(files))
+	for i, name := range files {
+		reversed[len(files)-1-i] = name
+	}
+	return reversed
+}
+
+// readFile decodes the entries of a log file.
+func readFile(name string) ([]Entry, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read audit log %s: %w", name, err)
+	}
+	defer file.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16<<20)
+	for line := 1; scanner.Scan(); line++ {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry Entry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			return nil, fmt.Errorf("failed to decode line %d of audit log %s: %w", line, name, err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read audit log %s: %w", name, err)
+	}
+	return entries, nil
+}
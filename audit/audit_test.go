@@ -0,0 +1,195 @@
+package audit
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+// testTime is the time of the first entry recorded by the tests, the next ones a minute apart.
+var testTime = time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC)
+
+// appendEntries records removals of containers of the jobs, in turn, a minute apart.
+func appendEntries(t *testing.T, log *Log, jobIDs ...string) {
+	t.Helper()
+
+	for i, jobID := range jobIDs {
+		_, err := log.Append(Entry{
+			Time:   testTime.Add(time.Duration(i) * time.Minute),
+			JobID:  jobID,
+			Kind:   cleanup.KindContainers,
+			ID:     "container-" + jobID,
+			Labels: map[string]string{"com.gitlab.ci.job.id": jobID},
+			Rule:   "label com.gitlab.ci.job.id=" + jobID,
+			Action: cleanup.ActionRemove,
+			Result: cleanup.ResultSucceeded,
+		})
+		require.NoError(t, err)
+	}
+}
+
+// TestLogChainsEntriesAcrossReopening tests that the chain continues from the last entry when
+// the log is reopened.
+func TestLogChainsEntriesAcrossReopening(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path, 0, 0, nil)
+	require.NoError(t, err)
+
+	log.Audited(cleanup.AuditedAction{
+		JobID:  "1234",
+		Kind:   cleanup.KindVolumes,
+		Item:   cleanup.PlanItem{ID: "job-cache", Name: "job-cache", Reason: "label com.gitlab.ci.job.id=1234", Labels: map[string]string{"com.gitlab.ci.job.id": "1234"}},
+		Action: cleanup.ActionRemove,
+		Result: cleanup.ResultFailed,
+		Err:    errors.New("volume is in use"),
+	})
+	require.NoError(t, log.Close())
+
+	log, err = Open(path, 0, 0, nil)
+	require.NoError(t, err)
+	appendEntries(t, log, "5678")
+	require.NoError(t, log.Close())
+
+	entries, err := Query(path, Filter{})
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	assert.Equal(t, uint64(1), entries[0].Seq)
+	assert.Equal(t, "", entries[0].PrevHash)
+	assert.Equal(t, cleanup.KindVolumes, entries[0].Kind)
+	assert.Equal(t, "label com.gitlab.ci.job.id=1234", entries[0].Rule)
+	assert.Equal(t, cleanup.ResultFailed, entries[0].Result)
+	assert.Equal(t, "volume is in use", entries[0].Error)
+	assert.Equal(t, uint64(2), entries[1].Seq)
+	assert.Equal(t, entries[0].Hash, entries[1].PrevHash)
+
+	verification, err := Verify(path)
+	require.NoError(t, err)
+	assert.Equal(t, Verification{Files: 1, Entries: 2, First: 1, Last: 2}, verification)
+}
+
+// TestLogRotates tests that the log is rotated past its maximum size, dropping the oldest files,
+// and that the chain still verifies across the files kept.
+func TestLogRotates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path, 400, 2, nil)
+	require.NoError(t, err)
+	appendEntries(t, log, "1", "2", "3", "4", "5", "6")
+	require.NoError(t, log.Close())
+
+	files := Files(path)
+	assert.Equal(t, []string{path + ".2", path + ".1", path}, files)
+	_, err = os.Stat(path + ".3")
+	assert.ErrorIs(t, err, os.ErrNotExist)
+
+	verification, err := Verify(path)
+	require.NoError(t, err)
+	assert.Equal(t, 3, verification.Files)
+	assert.Equal(t, uint64(6), verification.Last)
+	assert.True(t, verification.Truncated)
+	assert.Equal(t, int(verification.Last-verification.First+1), verification.Entries)
+}
+
+func TestVerifyDetectsTampering(t *testing.T) {
+	testCases := []struct {
+		name   string
+		tamper func(lines []string) []string
+		err    string
+	}{
+		{
+			name: "Edited entry",
+			tamper: func(lines []string) []string {
+				lines[1] = strings.Replace(lines[1], "container-2", "container-9", 1)
+				return lines
+			},
+			err: "entry 2 of",
+		},
+		{
+			name: "Removed entry",
+			tamper: func(lines []string) []string {
+				return append(lines[:1], lines[2:]...)
+			},
+			err: "entry 3 of",
+		},
+		{
+			name: "Swapped entries",
+			tamper: func(lines []string) []string {
+				lines[1], lines[2] = lines[2], lines[1]
+				return lines
+			},
+			err: "entry 3 of",
+		},
+		{
+			name: "Removed first entry",
+			tamper: func(lines []string) []string {
+				lines[0] = ""
+				return lines
+			},
+			err: "",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "audit.log")
+			log, err := Open(path, 0, 0, nil)
+			require.NoError(t, err)
+			appendEntries(t, log, "1", "2", "3")
+			require.NoError(t, log.Close())
+
+			data, err := os.ReadFile(path)
+			require.NoError(t, err)
+			lines := tc.tamper(strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"))
+			require.NoError(t, os.WriteFile(path, []byte(strings.Join(lines, "\n")+"\n"), 0o600))
+
+			verification, err := Verify(path)
+			if tc.err == "" {
+				// A chain starting after the first entry cannot be told from a rotated one
+				require.NoError(t, err)
+				assert.True(t, verification.Truncated)
+				return
+			}
+			assert.ErrorIs(t, err, ErrTampered)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	log, err := Open(path, 0, 0, nil)
+	require.NoError(t, err)
+	appendEntries(t, log, "1234", "5678", "1234", "5678")
+	require.NoError(t, log.Close())
+
+	testCases := []struct {
+		name   string
+		filter Filter
+		seqs   []uint64
+	}{
+		{name: "All", filter: Filter{}, seqs: []uint64{1, 2, 3, 4}},
+		{name: "Job", filter: Filter{JobID: "1234"}, seqs: []uint64{1, 3}},
+		{name: "Since", filter: Filter{Since: testTime.Add(2 * time.Minute)}, seqs: []uint64{3, 4}},
+		{name: "Until", filter: Filter{Until: testTime.Add(2 * time.Minute)}, seqs: []uint64{1, 2}},
+		{name: "Job and time range", filter: Filter{JobID: "5678", Since: testTime.Add(time.Minute), Until: testTime.Add(3 * time.Minute)}, seqs: []uint64{2}},
+		{name: "Nothing", filter: Filter{JobID: "9999"}, seqs: nil},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			entries, err := Query(path, tc.filter)
+			require.NoError(t, err)
+			var seqs []uint64
+			for _, entry := range entries {
+				seqs = append(seqs, entry.Seq)
+			}
+			assert.Equal(t, tc.seqs, seqs)
+		})
+	}
+}
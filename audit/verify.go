@@ -0,0 +1,124 @@
+package audit
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// ErrTampered is the error Verify wraps when the chain of entries is broken.
+var ErrTampered = errors.New("audit log was tampered with")
+
+// Verification is the outcome of a successful Verify.
+type Verification struct {
+	Files   int
+	Entries int
+
+	// First and Last are the sequence numbers of the first and last entries.
+	First uint64
+	Last  uint64
+
+	// Truncated reports whether the oldest entries were dropped by the rotation, so the chain
+	// starts after the first entry ever recorded.
+	Truncated bool
+}
+
+// Verify checks the hash chain of the log at path across its rotated files: every entry must
+// hash to its recorded hash, follow the previous entry's sequence number and hold its hash.
+//
+// Parameters:
+// - path: The path of the current log file.
+//
+// Returns:
+// - Verification: The number of files and entries checked.
+// - error: An error wrapping ErrTampered naming the first broken entry, or an error if the log
+// could not be read.
+func Verify(path string) (Verification, error) {
+	var result Verification
+	var previous *Entry
+	for _, name := range Files(path) {
+		entries, err := readFile(name)
+		if err != nil {
+			return result, err
+		}
+		result.Files++
+
+		for i := range entries {
+			entry := &entries[i]
+			hash, err := entry.computeHash()
+			if err != nil {
+				return result, err
+			}
+
+			switch {
+			case hash != entry.Hash:
+				return result, fmt.Errorf("%w: entry %d of %s does not match its hash", ErrTampered, entry.Seq, name)
+			case previous == nil && entry.Seq == 1 && entry.PrevHash != "":
+				return result, fmt.Errorf("%w: first entry of %s follows another entry", ErrTampered, name)
+			case previous != nil && entry.Seq != previous.Seq+1:
+				return result, fmt.Errorf("%w: entry %d of %s follows entry %d", ErrTampered, entry.Seq, name, previous.Seq)
+			case previous != nil && entry.PrevHash != previous.Hash:
+				return result, fmt.Errorf("%w: entry %d of %s does not hold the hash of entry %d", ErrTampered, entry.Seq, name, previous.Seq)
+			}
+
+			if previous == nil {
+				result.First = entry.Seq
+				result.Truncated = entry.Seq > 1
+			}
+			result.Last = entry.Seq
+			result.Entries++
+			previous = entry
+		}
+	}
+	return result, nil
+}
+
+// Filter selects entries of the log. Zero fields select every entry.
+type Filter struct {
+	JobID string
+
+	// Since selects the entries recorded at or after the time.
+	Since time.Time
+
+	// Until selects the entries recorded before the time.
+	Until time.Time
+}
+
+// Matches reports whether the entry is selected by the filter.
+func (f Filter) Matches(entry Entry) bool {
+	switch {
+	case f.JobID != "" && entry.JobID != f.JobID:
+		return false
+	case !f.Since.IsZero() && entry.Time.Before(f.Since):
+		return false
+	case !f.Until.IsZero() && !entry.Time.Before(f.Until):
+		return false
+	}
+	return true
+}
+
+// Query returns the entries of the log at path selected by the filter, oldest first. The chain
+// is not checked; use Verify for that.
+//
+// Parameters:
+// - path: The path of the current log file.
+// - filter: Selects the entries to return.
+//
+// Returns:
+// - []Entry: The selected entries.
+// - error: An error if the log could not be read.
+func Query(path string, filter Filter) ([]Entry, error) {
+	var selected []Entry
+	for _, name := range Files(path) {
+		entries, err := readFile(name)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range entries {
+			if filter.Matches(entry) {
+				selected = append(selected, entry)
+			}
+		}
+	}
+	return selected, nil
+}
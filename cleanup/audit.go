@@ -0,0 +1,23 @@
+package cleanup
+
+// AuditedAction is a resource stopped, removed or pruned, and how it went.
+type AuditedAction struct {
+	// JobID is the job owning the resource, empty for resources pruned under disk pressure.
+	JobID  string
+	Kind   Kind
+	Item   PlanItem
+	Action Action
+	Result Result
+
+	// Err is the error of a failed action.
+	Err error
+}
+
+// Auditor records every destructive action of the cleanup, such as in a tamper-evident audit
+// log. Dry runs are not recorded, since they act on nothing. Implementations must be safe for
+// concurrent use and report their own errors: failing to record an action never stops the
+// cleanup.
+type Auditor interface {
+	// Audited records an action once it succeeded or failed.
+	Audited(action AuditedAction)
+}
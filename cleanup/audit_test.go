@@ -0,0 +1,73 @@
+package cleanup
+
+import (
+	"context"
+	"sync"
+	"testing"
+
+	"gotest.tools/v3/assert"
+)
+
+// recordingAuditor keeps the actions it is given.
+type recordingAuditor struct {
+	mu      sync.Mutex
+	actions []AuditedAction
+}
+
+func (a *recordingAuditor) Audited(action AuditedAction) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.actions = append(a.actions, action)
+}
+
+func TestCleanUpAudit(t *testing.T) {
+	protection, err := NewProtection([]ProtectionRule{{Name: "^job-cache$"}})
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		name    string
+		dryRun  bool
+		actions []AuditedAction
+	}{
+		{
+			name: "Executed",
+			actions: []AuditedAction{
+				{JobID: "1234", Kind: KindContainers, Item: PlanItem{Name: "job"}, Action: ActionRemove, Result: ResultSucceeded},
+				{JobID: "1234", Kind: KindNetworks, Item: PlanItem{Name: "job-network"}, Action: ActionRemove, Result: ResultFailed},
+				{JobID: "1234", Kind: KindServices, Item: PlanItem{Name: "job-service"}, Action: ActionRemove, Result: ResultSucceeded},
+			},
+		},
+		{
+			name:   "Dry run",
+			dryRun: true,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			daemon, owned := reportedDaemon(t)
+			owned.Failed = false
+			auditor := &recordingAuditor{}
+			opts := testOptions()
+			opts.RemoveRetries = 1
+			opts.DryRun = tc.dryRun
+			opts.Protection = protection
+			opts.Auditor = auditor
+
+			CleanUp(daemon, context.Background(), owned, opts)
+
+			// Protected resources are skipped, so they are not audited
+			assert.Equal(t, len(auditor.actions), len(tc.actions))
+			for i, want := range tc.actions {
+				got := auditor.actions[i]
+				assert.Equal(t, got.JobID, want.JobID)
+				assert.Equal(t, got.Kind, want.Kind)
+				assert.Equal(t, got.Item.Name, want.Item.Name)
+				assert.Assert(t, got.Item.Reason != "", "the rule attributing the resource is audited")
+				assert.Equal(t, got.Action, want.Action)
+				assert.Equal(t, got.Result, want.Result)
+				assert.Equal(t, got.Err != nil, want.Result == ResultFailed)
+			}
+		})
+	}
+}
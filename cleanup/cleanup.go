@@ -7,404 +7,855 @@ package cleanup
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
+	"sort"
 	"strings"
 	"time"
 
 	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
-	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/api/types/swarm"
-	"github.com/docker/docker/api/types/volume"
 	"github.com/docker/docker/client"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/tracing"
 )
 
-// CleanUp performs cleanup tasks for the specified job ID, including stopping and removing containers, networks, and volumes.
+// Options controls how CleanUp acts on the resources owned by a job.
+type Options struct {
+	// DryRun only logs the cleanup plan without stopping or removing anything.
+	DryRun bool
+
+	// Delay is the time to wait before cleaning up containers, so the job's after_script
+	// section can complete.
+	Delay time.Duration
+
+	// PollInterval is the time to wait before retrying the containers left by an attempt.
+	PollInterval time.Duration
+
+	// StopTimeout is the time running containers get to stop before they are killed.
+	StopTimeout time.Duration
+
+	// ContainerRetries is the number of attempts at removing containers. An attempt stops a
+	// running container and removes it right away.
+	ContainerRetries int
+
+	// RemoveRetries is the number of attempts at removing networks and volumes.
+	RemoveRetries int
+
+	// RetryDelay is the time to wait between attempts at removing networks and volumes.
+	RetryDelay time.Duration
+
+	// Kinds lists the kinds of resources to clean up. A nil list cleans up every kind.
+	Kinds []Kind
+
+	// KeepOnFailure leaves every resource of a job whose container exited with a non-zero code.
+	KeepOnFailure bool
+
+	// Protection lists the resources never stopped or removed. The built-in networks are
+	// protected even when it is nil.
+	Protection *Protection
+
+	// Auditor records every resource stopped, removed or pruned, nil to record nothing.
+	Auditor Auditor
+
+	// Logger receives the records of the cleanup, nil to use the logger of the package.
+	Logger *slog.Logger
+}
+
+// DefaultOptions returns the options used by the watcher.
+func DefaultOptions() Options {
+	return Options{
+		Delay:            10 * time.Second,
+		PollInterval:     3 * time.Second,
+		StopTimeout:      10 * time.Second,
+		ContainerRetries: 3,
+		RemoveRetries:    2,
+		RetryDelay:       2 * time.Second,
+	}
+}
+
+// logger returns the logger receiving the records of the cleanup.
+func (o Options) logger() *slog.Logger {
+	if o.Logger != nil {
+		return o.Logger
+	}
+	return Logger()
+}
+
+// Cleans reports whether resources of the kind are cleaned up.
+func (o Options) Cleans(kind Kind) bool {
+	if o.Kinds == nil {
+		return true
+	}
+	for _, k := range o.Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// CleanUp performs cleanup tasks for the specified job, including stopping and removing containers, networks, volumes, services and images.
+// Only the resources owned by the job are touched; anything else on the host survives. The
+// cleanup is traced as a child of the job's span, when it was started.
 //
 // Parameters:
 // - cli: The Docker client instance.
-// - jobID: The job ID associated with the job.
-func CleanUp(cli *client.Client, jobID string) {
-	log.Println("Starting cleanup...")
+// - ctx: The context for API calls and waits, ending the cleanup early when it is done.
+// - owned: The resources recorded for the job.
+// - opts: Options controlling the cleanup.
+//
+// Returns:
+// - *Report: What was done to each resource of the job, or why the cleanup was skipped.
+func CleanUp(cli dockerapi.Client, ctx context.Context, owned *Resources, opts Options) *Report {
+	if owned == nil || owned.JobID == "" {
+		opts.logger().Warn("No job ID provided, skipping cleanup")
+		report := newReport("", opts)
+		report.Skipped = "no job ID provided"
+		return report.finish()
+	}
 
-	if jobID == "" {
-		log.Println("No job ID provided, skipping cleanup.")
-		return
+	logger := opts.logger().With(LogJobID, owned.JobID)
+	logger.Info("Starting cleanup")
+
+	ctx, span := startCleanup(tracing.JobContext(ctx, owned.JobID), owned.JobID, opts)
+	report := newReport(owned.JobID, opts)
+	defer endCleanup(span, report)
+
+	if opts.KeepOnFailure && owned.Failed {
+		logger.Info("Job failed, keeping its resources for inspection")
+		report.Skipped = "job failed, resources kept for inspection"
+		return report.finish()
+	}
+
+	plan, err := BuildPlan(cli, ctx, owned)
+	if err != nil {
+		logger.Error("Failed to plan cleanup", ErrorAttr(err))
+		report.Error = fmt.Sprintf("failed to plan cleanup: %v", err)
+		return report.finish()
+	}
+	return cleanUpPlan(cli, ctx, plan, opts, report)
+}
+
+// startCleanup starts the span of the cleanup of the job.
+func startCleanup(ctx context.Context, jobID string, opts Options) (context.Context, trace.Span) {
+	return tracing.Tracer().Start(ctx, "cleanup", trace.WithAttributes(tracing.JobIDKey.String(jobID), attribute.Bool("cleanup.dry_run", opts.DryRun)))
+}
+
+// endCleanup records the outcome of the report on the span of the cleanup and ends it.
+func endCleanup(span trace.Span, report *Report) {
+	span.SetAttributes(attribute.String("cleanup.summary", report.Summary()))
+	if report.Skipped != "" {
+		span.SetAttributes(attribute.String("cleanup.skipped", report.Skipped))
+	}
+	tracing.End(span, report.Err())
+}
+
+// phase runs a phase of the cleanup, such as CleanupContainers, in a span named after it.
+func phase(ctx context.Context, name string, run func(ctx context.Context) error) error {
+	ctx, span := tracing.Tracer().Start(ctx, name)
+	err := run(ctx)
+	tracing.End(span, err)
+	return err
+}
+
+// CleanUpPlan executes the part of the plan selected by the options, or only logs it in a dry
+// run. Protected resources are never touched.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - plan: The cleanup plan of the job.
+// - opts: Options controlling the cleanup.
+//
+// Returns:
+// - *Report: What was done to each resource of the plan, or would be done in a dry run.
+func CleanUpPlan(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options) *Report {
+	ctx, span := startCleanup(ctx, plan.JobID, opts)
+	report := newReport(plan.JobID, opts)
+	defer endCleanup(span, report)
+	return cleanUpPlan(cli, ctx, plan, opts, report)
+}
+
+// cleanUpPlan works like CleanUpPlan and adds the outcome to the report.
+func cleanUpPlan(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options, report *Report) *Report {
+	plan = plan.Only(opts)
+
+	if opts.DryRun {
+		var b strings.Builder
+		unprotected := plan.unprotected(opts.Protection, report)
+		_ = unprotected.WriteText(&b)
+		report.planned(unprotected)
+		opts.logger().Info("Dry run, nothing will be removed", LogJobID, plan.JobID, "plan", b.String())
+		return report.finish()
+	}
+
+	return execute(cli, ctx, plan, opts, report)
+}
+
+// Execute stops and removes exactly the resources listed in the plan.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - plan: The cleanup plan of the job.
+// - opts: Options controlling the cleanup.
+//
+// Returns:
+// - *Report: What was done to each resource of the plan.
+func Execute(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options) *Report {
+	return execute(cli, ctx, plan, opts, newReport(plan.JobID, opts))
+}
+
+// wait pauses for the duration, or until the context is done.
+//
+// Returns:
+// - error: The context error if ctx ended first.
+func wait(ctx context.Context, d time.Duration) error {
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-time.After(d):
+		return nil
+	}
+}
+
+// stopTimeoutSeconds returns the stop timeout in whole seconds, as the Docker API takes it.
+// Fractions of a second are rounded up, so that a container is never killed before the timeout
+// elapsed, nor right away when the timeout is below a second.
+func stopTimeoutSeconds(timeout time.Duration) int {
+	return int((timeout + time.Second - 1) / time.Second)
+}
+
+// execute works like Execute and adds the outcome to the report.
+func execute(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options, report *Report) *Report {
+	logger := opts.logger().With(LogJobID, plan.JobID)
+	if plan.Empty() {
+		logger.Info("No resources owned by the job, skipping cleanup")
+		return report.finish()
 	}
 
-	ctx := context.Background()
 	removeOptions := container.RemoveOptions{Force: true}
 	stopOptions := container.StopOptions{Timeout: new(int)}
-	*stopOptions.Timeout = 10
+	*stopOptions.Timeout = stopTimeoutSeconds(opts.StopTimeout)
 
 	// Clean up containers
-	containerErr := CleanupContainers(cli, ctx, jobID, removeOptions, stopOptions)
+	containerErr := phase(ctx, "CleanupContainers", func(ctx context.Context) error {
+		return CleanupContainers(cli, ctx, plan, removeOptions, stopOptions, opts, report)
+	})
 
 	// Clean up networks
-	networkErr := CleanupNetworks(cli, ctx, jobID)
+	networkErr := phase(ctx, "CleanupNetworks", func(ctx context.Context) error {
+		return CleanupNetworks(cli, ctx, plan, opts, report)
+	})
 
 	// Clean up volumes
-	volumeErr := CleanupVolumes(cli, ctx, jobID)
+	volumeErr := phase(ctx, "CleanupVolumes", func(ctx context.Context) error {
+		return CleanupVolumes(cli, ctx, plan, opts, report)
+	})
 
 	// Clean up services
-	serviceErr := CleanupServices(cli, ctx, jobID)
+	serviceErr := phase(ctx, "CleanupServices", func(ctx context.Context) error {
+		return CleanupServices(cli, ctx, plan, opts, report)
+	})
+
+	// Clean up images, once the containers created from them are gone
+	imageErr := phase(ctx, "CleanupImages", func(ctx context.Context) error {
+		return CleanupImages(cli, ctx, plan, opts, report)
+	})
 
 	// Logs outputs
-	if containerErr == nil && networkErr == nil && volumeErr == nil && serviceErr == nil {
-		log.Println("No resources found to clean up.")
-	} else {
-		log.Println("Cleanup completed with errors.")
-		if containerErr != nil {
-			log.Printf("Container cleanup error: %v", containerErr)
-		}
-		if networkErr != nil {
-			log.Printf("Network cleanup error: %v", networkErr)
-		}
-		if volumeErr != nil {
-			log.Printf("Volume cleanup error: %v", volumeErr)
-		}
-		if serviceErr != nil {
-			log.Printf("Service cleanup error: %v", serviceErr)
+	report.finish()
+	summary := []any{"summary", report.Summary(), "duration", time.Duration(report.Duration)}
+	if containerErr == nil && networkErr == nil && volumeErr == nil && serviceErr == nil && imageErr == nil {
+		logger.Info("Cleanup completed", summary...)
+		return report
+	}
+	logger.Error("Cleanup completed with errors", summary...)
+	for _, kindErr := range []struct {
+		kind Kind
+		err  error
+	}{
+		{KindContainers, containerErr},
+		{KindNetworks, networkErr},
+		{KindVolumes, volumeErr},
+		{KindServices, serviceErr},
+		{KindImages, imageErr},
+	} {
+		if kindErr.err != nil {
+			logger.Error("Cleanup error", LogResourceKind, kindErr.kind, ErrorAttr(kindErr.err))
 		}
 	}
+	return report
 }
 
-// CleanupContainers stops and removes containers associated with the specified job ID.
+// CleanupContainers stops and removes the containers listed in the plan, except the protected
+// ones.
 //
 // Parameters:
 // - cli: The Docker client instance.
 // - ctx: The context for API calls.
-// - jobID: The job ID associated with the job.
+// - plan: The cleanup plan of the job.
 // - removeOptions: Options for removing containers.
 // - stopOptions: Options for stopping containers.
+// - opts: Options controlling the delays, attempts and protected resources of the cleanup.
+// - report: Receives the outcome of every action, nil to only log it.
 //
 // Returns:
 // - error: An error if container cleanup fails.
-func CleanupContainers(cli *client.Client, ctx context.Context, jobID string, removeOptions container.RemoveOptions, stopOptions container.StopOptions) error {
-	const maxRetries = 3
-	const pollInterval = 3 * time.Second
-	const cleanupDelay = 10 * time.Second
+func CleanupContainers(cli dockerapi.Client, ctx context.Context, plan *Plan, removeOptions container.RemoveOptions, stopOptions container.StopOptions, opts Options, report *Report) error {
+	logger := opts.logger().With(LogJobID, plan.JobID, LogResourceKind, KindContainers)
+	items := unprotected(opts.Protection, KindContainers, plan.RemoveContainers, report)
+	if len(items) == 0 {
+		logger.Debug("No containers found to clean up")
+		return nil
+	}
+
+	pending := make(map[string]struct{}, len(items))
+	byID := make(map[string]PlanItem, len(items))
+	for _, item := range items {
+		pending[item.ID] = struct{}{}
+		byID[item.ID] = item
+	}
 
 	// Wait for a while to ensure the job's after_script section has completed
-	log.Printf("Waiting for %v before starting cleanup...", cleanupDelay)
-	time.Sleep(cleanupDelay)
+	logger.Debug("Waiting before starting cleanup", "delay", opts.Delay)
+	started := time.Now()
+	if err := wait(ctx, opts.Delay); err != nil {
+		err = fmt.Errorf("cleanup interrupted: %w", err)
+		for _, id := range sortedKeys(pending) {
+			report.record(KindContainers, byID[id], ActionRemove, started, 0, err)
+		}
+		return err
+	}
 
-	for retry := 0; retry < maxRetries; retry++ {
+	started = time.Now()
+	lastErrs := make(map[string]error)
+
+	attempts := 0
+	for retry := 0; retry < opts.ContainerRetries && len(pending) > 0; retry++ {
+		attempts = retry + 1
 		containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
 		if err != nil {
-			return fmt.Errorf("failed to list containers: %w", err)
+			err = fmt.Errorf("failed to list containers: %w", err)
+			for _, id := range sortedKeys(pending) {
+				report.record(KindContainers, byID[id], ActionRemove, started, retry+1, err)
+			}
+			return err
 		}
 
-		var activeContainers []types.Container
-		cleaned := false
-
+		present := make(map[string]struct{}, len(pending))
 		for _, container := range containers {
-			if IsJobContainer(container, jobID) || IsComposeContainer(container, jobID) {
-				log.Printf("Checking container %s (State: %s)", container.ID, container.State)
-
-				if container.State == "running" {
-					activeContainers = append(activeContainers, container)
-				} else if container.State == "exited" {
-					log.Printf("Container %s has exited. Proceeding to remove.", container.ID)
-					cleaned = true
-					if err := cli.ContainerRemove(ctx, container.ID, removeOptions); err != nil {
-						log.Printf("Failed to remove container %s: %v", container.ID, err)
-					}
-				}
+			if _, planned := pending[container.ID]; !planned {
+				continue
 			}
-		}
-
-		if len(activeContainers) > 0 {
-			log.Printf("Detected active containers for job %s or related Compose containers. Waiting for them to stop...", jobID)
-			for _, container := range activeContainers {
-				log.Printf("Stopping container %s", container.ID)
-				if err := cli.ContainerStop(ctx, container.ID, stopOptions); err != nil {
-					log.Printf("Failed to stop container %s: %v", container.ID, err)
+			present[container.ID] = struct{}{}
+			containerLogger := logger.With(LogContainerID, container.ID, LogContainerName, byID[container.ID].Name)
+			containerLogger.Debug("Checking container", "state", container.State)
+
+			// A running container is stopped and removed within the same attempt
+			if container.State == "running" {
+				containerLogger.Info("Stopping container", LogAction, ActionStop)
+				stopStarted := time.Now()
+				err := cli.ContainerStop(ctx, container.ID, stopOptions)
+				report.record(KindContainers, byID[container.ID], ActionStop, stopStarted, 1, err)
+				if err != nil {
+					containerLogger.Warn("Failed to stop container", LogAction, ActionStop, ErrorAttr(err))
+					lastErrs[container.ID] = err
+					continue
 				}
 			}
-			time.Sleep(pollInterval)
-		} else {
-			if cleaned {
-				log.Println("Cleanup completed for stopped containers.")
-			} else {
-				log.Println("No containers found to clean up.")
+
+			if err := cli.ContainerRemove(ctx, container.ID, removeOptions); err != nil {
+				containerLogger.Warn("Failed to remove container", LogAction, ActionRemove, ErrorAttr(err))
+				lastErrs[container.ID] = err
+				continue
 			}
-			break
+			containerLogger.Info("Container removed", LogAction, ActionRemove, "state", container.State)
+			report.record(KindContainers, byID[container.ID], ActionRemove, started, retry+1, nil)
+			delete(present, container.ID)
 		}
-	}
 
-	// Check if there are still active containers after all retries
-	activeContainersAfterCleanup := false
-	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
-	if err != nil {
-		return fmt.Errorf("failed to list containers after cleanup: %w", err)
-	}
+		// Containers that disappeared on their own need no further action
+		for _, id := range sortedKeys(pending) {
+			if !listed(containers, id) {
+				report.skip(KindContainers, byID[id], ActionRemove, "already removed")
+			}
+		}
+		pending = present
 
-	for _, container := range containers {
-		if IsJobContainer(container, jobID) || IsComposeContainer(container, jobID) {
-			if container.State == "running" || container.State == "exited" {
-				activeContainersAfterCleanup = true
+		if len(pending) > 0 && retry < opts.ContainerRetries-1 {
+			logger.Debug("Waiting before retrying the containers left", "count", len(pending), "delay", opts.PollInterval)
+			if err := wait(ctx, opts.PollInterval); err != nil {
+				for id := range pending {
+					lastErrs[id] = fmt.Errorf("cleanup interrupted: %w", err)
+				}
 				break
 			}
 		}
 	}
 
-	if activeContainersAfterCleanup {
-		log.Printf("Failed to clean up all containers related to job %s or Docker Compose.", jobID)
+	if len(pending) > 0 {
+		for _, id := range sortedKeys(pending) {
+			err := lastErrs[id]
+			if err == nil {
+				err = fmt.Errorf("container %s still running after %d attempts", id, attempts)
+			}
+			report.record(KindContainers, byID[id], ActionRemove, started, attempts, err)
+		}
+		logger.Error("Failed to clean up all containers of the job", "left", sortedKeys(pending))
+		return fmt.Errorf("containers left behind: %s", strings.Join(sortedKeys(pending), ", "))
 	}
 
+	logger.Debug("Cleanup completed for containers")
 	return nil
 }
 
-// CleanupNetworks removes networks associated with the specified job ID.
+// CleanupNetworks removes the networks listed in the plan, except the built-in and protected ones.
 //
 // Parameters:
 // - cli: The Docker client instance.
 // - ctx: The context for API calls.
-// - jobID: The job ID associated with the job.
+// - plan: The cleanup plan of the job.
+// - opts: Options controlling the attempts and protected resources of the cleanup.
+// - report: Receives the outcome of every action, nil to only log it.
 //
 // Returns:
 // - error: An error if network cleanup fails.
-func CleanupNetworks(cli *client.Client, ctx context.Context, jobID string) error {
-	const maxRetries = 2
-	const retryDelay = 2 * time.Second
-
-	// Create a set to keep track of networks associated with the containers
-	associatedNetworks := make(map[string]struct{})
-
-	for retry := 0; retry < maxRetries; retry++ {
-		containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
-		if err != nil {
-			return fmt.Errorf("failed to list containers: %w", err)
-		}
+func CleanupNetworks(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options, report *Report) error {
+	logger := opts.logger().With(LogJobID, plan.JobID)
+	pending := unprotected(opts.Protection, KindNetworks, plan.Networks, report)
+	if len(pending) == 0 {
+		logger.Debug("No networks found to clean up")
+		return nil
+	}
 
-		// Collect networks associated with containers related to the jobID
-		for _, container := range containers {
-			if IsJobContainer(container, jobID) || IsComposeContainer(container, jobID) {
-				for networkName := range container.NetworkSettings.Networks {
-					associatedNetworks[networkName] = struct{}{}
-				}
+	started := make(map[string]time.Time, len(pending))
+	lastErrs := make(map[string]error, len(pending))
+	attempts := 0
+	for retry := 0; retry < opts.RemoveRetries; retry++ {
+		attempts = retry + 1
+		var failed []PlanItem
+		for _, item := range pending {
+			if retry == 0 {
+				started[item.ID] = time.Now()
 			}
-		}
-
-		networks, err := cli.NetworkList(ctx, network.ListOptions{})
-		if err != nil {
-			return fmt.Errorf("failed to list networks: %w", err)
-		}
-
-		cleaned := false
-		for _, network := range networks {
-			// Check if the network is in the list of associated networks
-			if _, exists := associatedNetworks[network.Name]; !exists {
-				// Network is not associated with any relevant container
-				log.Printf("Removing unused network %s", network.ID)
-				if err := cli.NetworkRemove(ctx, network.ID); err != nil {
-					log.Printf("Failed to remove network %s: %v", network.ID, err)
-				} else {
-					log.Printf("Network %s removed successfully.", network.ID)
-					cleaned = true
-				}
+			itemLogger := logger.With(resourceAttrs(KindNetworks, item)...)
+			if err := cli.NetworkRemove(ctx, item.ID); err != nil && !client.IsErrNotFound(err) {
+				itemLogger.Warn("Failed to remove network", LogAction, ActionRemove, "attempt", retry+1, ErrorAttr(err))
+				lastErrs[item.ID] = err
+				failed = append(failed, item)
+			} else {
+				itemLogger.Info("Network removed", LogAction, ActionRemove)
+				report.record(KindNetworks, item, ActionRemove, started[item.ID], retry+1, nil)
 			}
 		}
 
-		if cleaned {
+		pending = failed
+		if len(pending) == 0 {
+			logger.Debug("Cleanup completed for networks")
 			return nil
 		}
 
-		if retry < maxRetries-1 {
-			log.Printf("No networks found, retrying in %s...", retryDelay)
-			time.Sleep(retryDelay)
-		} else {
-			log.Println("No networks found to clean up.")
-			return nil
+		if retry < opts.RemoveRetries-1 {
+			logger.Info("Networks still in use, retrying", LogResourceKind, KindNetworks, "delay", opts.RetryDelay)
+			if err := wait(ctx, opts.RetryDelay); err != nil {
+				break
+			}
 		}
 	}
 
-	return nil
+	for _, item := range pending {
+		report.record(KindNetworks, item, ActionRemove, started[item.ID], attempts, lastErrs[item.ID])
+	}
+	return fmt.Errorf("networks left behind: %s", strings.Join(itemNames(pending), ", "))
 }
 
-// CleanupVolumes removes volumes associated with the specified job ID.
+// CleanupVolumes removes the volumes listed in the plan, except the protected ones.
 //
 // Parameters:
 // - cli: The Docker client instance.
 // - ctx: The context for API calls.
-// - jobID: The job ID associated with the job.
+// - plan: The cleanup plan of the job.
+// - opts: Options controlling the attempts and protected resources of the cleanup.
+// - report: Receives the outcome of every action, nil to only log it.
 //
 // Returns:
 // - error: An error if volume cleanup fails.
-func CleanupVolumes(cli *client.Client, ctx context.Context, jobID string) error {
-	const maxRetries = 2
-	const retryDelay = 2 * time.Second
-
-	// Create a set to keep track of volumes associated with the containers
-	associatedVolumes := make(map[string]struct{})
+func CleanupVolumes(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options, report *Report) error {
+	logger := opts.logger().With(LogJobID, plan.JobID)
+	pending := unprotected(opts.Protection, KindVolumes, plan.Volumes, report)
+	if len(pending) == 0 {
+		logger.Debug("No volumes found to clean up")
+		return nil
+	}
 
-	for retry := 0; retry < maxRetries; retry++ {
-		containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
-		if err != nil {
-			return fmt.Errorf("failed to list containers: %w", err)
+	started := make(map[string]time.Time, len(pending))
+	lastErrs := make(map[string]error, len(pending))
+	attempts := 0
+	for retry := 0; retry < opts.RemoveRetries; retry++ {
+		attempts = retry + 1
+		var failed []PlanItem
+		for _, item := range pending {
+			if retry == 0 {
+				started[item.ID] = time.Now()
+			}
+			itemLogger := logger.With(resourceAttrs(KindVolumes, item)...)
+			if err := cli.VolumeRemove(ctx, item.Name, true); err != nil && !client.IsErrNotFound(err) {
+				itemLogger.Warn("Failed to remove volume", LogAction, ActionRemove, "attempt", retry+1, ErrorAttr(err))
+				lastErrs[item.ID] = err
+				failed = append(failed, item)
+			} else {
+				itemLogger.Info("Volume removed", LogAction, ActionRemove)
+				report.record(KindVolumes, item, ActionRemove, started[item.ID], retry+1, nil)
+			}
 		}
 
-		// Collect volumes associated with containers related to the jobID
-		for _, container := range containers {
-			if IsJobContainer(container, jobID) || IsComposeContainer(container, jobID) {
-				for _, mount := range container.Mounts {
-					// Add volume name to the map
-					if mount.Name != "" {
-						associatedVolumes[mount.Name] = struct{}{}
-					}
-				}
-			}
+		pending = failed
+		if len(pending) == 0 {
+			logger.Debug("Cleanup completed for volumes")
+			return nil
 		}
 
-		volumes, err := cli.VolumeList(ctx, volume.ListOptions{})
-		if err != nil {
-			return fmt.Errorf("failed to list volumes: %w", err)
-		}
-
-		cleaned := false
-		for _, volume := range volumes.Volumes {
-			// Check if the volume is in the list of associated volumes
-			if _, exists := associatedVolumes[volume.Name]; !exists {
-				// Volume is not associated with any relevant container
-				log.Printf("Removing unused volume %s", volume.Name)
-				if err := cli.VolumeRemove(ctx, volume.Name, true); err != nil {
-					log.Printf("Failed to remove volume %s: %v", volume.Name, err)
-				} else {
-					log.Printf("Volume %s removed successfully.", volume.Name)
-					cleaned = true
-				}
+		if retry < opts.RemoveRetries-1 {
+			logger.Info("Volumes still in use, retrying", LogResourceKind, KindVolumes, "delay", opts.RetryDelay)
+			if err := wait(ctx, opts.RetryDelay); err != nil {
+				break
 			}
 		}
+	}
 
-		if cleaned {
-			log.Println("Cleanup completed for volumes.")
-			return nil
-		}
+	for _, item := range pending {
+		report.record(KindVolumes, item, ActionRemove, started[item.ID], attempts, lastErrs[item.ID])
+	}
+	return fmt.Errorf("volumes left behind: %s", strings.Join(itemNames(pending), ", "))
+}
 
-		if retry < maxRetries-1 {
-			log.Printf("No volumes found, retrying in %s...", retryDelay)
-			time.Sleep(retryDelay)
-		} else {
-			log.Println("No volumes found to clean up.")
-			return nil
+// CleanupServices removes the services listed in the plan, except the protected ones. A service
+// that cannot be removed does not stop the removal of the others.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - plan: The cleanup plan of the job.
+// - opts: Options controlling the protected resources of the cleanup.
+// - report: Receives the outcome of every action, nil to only log it.
+//
+// Returns:
+// - error: An error naming the services left behind.
+func CleanupServices(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options, report *Report) error {
+	logger := opts.logger().With(LogJobID, plan.JobID)
+	items := unprotected(opts.Protection, KindServices, plan.Services, report)
+	if len(items) == 0 {
+		logger.Debug("No services found to clean up")
+		return nil
+	}
+
+	var failed []PlanItem
+	for _, item := range items {
+		itemLogger := logger.With(append(resourceAttrs(KindServices, item), LogAction, ActionRemove)...)
+		started := time.Now()
+		if err := cli.ServiceRemove(ctx, item.ID); err != nil && !client.IsErrNotFound(err) {
+			itemLogger.Error("Failed to remove service", ErrorAttr(err))
+			report.record(KindServices, item, ActionRemove, started, 1, err)
+			failed = append(failed, item)
+			continue
 		}
+		report.record(KindServices, item, ActionRemove, started, 1, nil)
+		itemLogger.Info("Service removed")
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("services left behind: %s", strings.Join(itemNames(failed), ", "))
+	}
+	logger.Debug("Cleanup completed for services")
 	return nil
 }
 
-// CleanupServices stops and removes services associated with the specified job ID.
+// CleanupImages removes the images listed in the plan, except the protected ones and those still
+// used by a container of another job. Images are removed tag by tag, so the daemon only deletes
+// an image once none of its tags is left. Of the images the job did not build, only the tags it
+// added are removed.
 //
 // Parameters:
 // - cli: The Docker client instance.
 // - ctx: The context for API calls.
-// - jobID: The job ID associated with the job.
+// - plan: The cleanup plan of the job.
+// - opts: Options controlling the protected resources of the cleanup.
+// - report: Receives the outcome of every action, nil to only log it.
 //
 // Returns:
-// - error: An error if service cleanup fails.
-func CleanupServices(cli *client.Client, ctx context.Context, jobID string) error {
-	const maxRetries = 3
-	const retryDelay = 3 * time.Second
+// - error: An error if the images could not be listed or some could not be removed.
+func CleanupImages(cli dockerapi.Client, ctx context.Context, plan *Plan, opts Options, report *Report) error {
+	logger := opts.logger().With(LogJobID, plan.JobID)
+	items := unprotected(opts.Protection, KindImages, plan.Images, report)
+	tags := unprotected(opts.Protection, KindImages, plan.ImageTags, report)
+	if len(items) == 0 && len(tags) == 0 {
+		logger.Debug("No images found to clean up")
+		return nil
+	}
 
-	for retry := 0; retry < maxRetries; retry++ {
-		services, err := cli.ServiceList(ctx, types.ServiceListOptions{})
-		if err != nil {
-			return fmt.Errorf("failed to list services: %w", err)
+	started := time.Now()
+	fail := func(err error) error {
+		for _, item := range items {
+			report.record(KindImages, item, ActionRemove, started, 1, err)
 		}
+		for _, item := range tags {
+			report.record(KindImages, item, ActionUntag, started, 1, err)
+		}
+		return err
+	}
+	images, err := cli.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return fail(fmt.Errorf("failed to list images: %w", err))
+	}
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return fail(fmt.Errorf("failed to list containers: %w", err))
+	}
+	byID := make(map[string]image.Summary, len(images))
+	byTag := make(map[string]image.Summary)
+	for _, img := range images {
+		byID[img.ID] = img
+		for _, tag := range img.RepoTags {
+			byTag[tag] = img
+		}
+	}
 
-		cleaned := false
-
-		for _, service := range services {
-			if IsJobService(service, jobID) {
-				log.Printf("Stopping and removing service %s (ID: %s)", service.Spec.Name, service.ID)
+	var failed []PlanItem
+	for _, item := range items {
+		img, exists := byID[item.ID]
+		if !exists {
+			report.skip(KindImages, item, ActionRemove, "already removed")
+			continue
+		}
+		itemLogger := logger.With(append(resourceAttrs(KindImages, item), LogAction, ActionRemove)...)
+		if user, used := imageUser(img, containers); used {
+			itemLogger.Info("Skipping image still used by a container", LogContainerName, user)
+			report.skip(KindImages, item, ActionRemove, "used by container "+user)
+			continue
+		}
+		if reason, protected := protectedTag(opts.Protection, img); protected {
+			itemLogger.Info("Skipping protected image", "reason", reason)
+			report.skip(KindImages, item, ActionRemove, reason)
+			continue
+		}
 
-				// Remove the service
-				if err := cli.ServiceRemove(ctx, service.ID); err != nil {
-					log.Printf("Failed to remove service %s: %v", service.Spec.Name, err)
-					return err
-				} else {
-					log.Printf("Service %s removed successfully.", service.Spec.Name)
-					cleaned = true
-				}
-			}
+		refs := img.RepoTags
+		if len(refs) == 0 {
+			refs = []string{img.ID}
 		}
+		removeStarted := time.Now()
+		removeErr := removeRefs(cli, ctx, refs, image.RemoveOptions{})
+		if removeErr != nil {
+			itemLogger.Warn("Failed to remove image", ErrorAttr(removeErr))
+			failed = append(failed, item)
+		} else {
+			itemLogger.Info("Image removed")
+		}
+		report.record(KindImages, item, ActionRemove, removeStarted, 1, removeErr)
+	}
 
-		if cleaned {
-			log.Println("Service cleanup completed.")
-			return nil
+	for _, item := range tags {
+		img, exists := byTag[item.Name]
+		if !exists {
+			report.skip(KindImages, item, ActionUntag, "already removed")
+			continue
+		}
+		itemLogger := logger.With(append(resourceAttrs(KindImages, item), LogAction, ActionUntag)...)
+		if user, used := tagUser(item.Name, containers); used {
+			itemLogger.Info("Skipping image tag still used by a container", LogContainerName, user)
+			report.skip(KindImages, item, ActionUntag, "used by container "+user)
+			continue
+		}
+		if len(img.RepoTags) == 1 && imageInUse(img, containers) {
+			itemLogger.Info("Skipping last tag of an image still used by a container")
+			report.skip(KindImages, item, ActionUntag, "last tag of an image used by a container")
+			continue
 		}
 
-		if retry < maxRetries-1 {
-			log.Printf("No services found, retrying in %s...", retryDelay)
-			time.Sleep(retryDelay)
+		removeStarted := time.Now()
+		removeErr := removeRefs(cli, ctx, []string{item.Name}, image.RemoveOptions{})
+		if removeErr != nil {
+			itemLogger.Warn("Failed to remove image tag", ErrorAttr(removeErr))
+			failed = append(failed, item)
 		} else {
-			log.Println("No services found to clean up.")
-			return nil
+			itemLogger.Info("Image tag removed")
 		}
+		report.record(KindImages, item, ActionUntag, removeStarted, 1, removeErr)
 	}
 
+	if len(failed) > 0 {
+		return fmt.Errorf("images left behind: %s", strings.Join(itemNames(failed), ", "))
+	}
+	logger.Debug("Cleanup completed for images")
 	return nil
 }
 
-// The function `IsJobContainer` checks if a container is associated with a specific job ID based on
-// its labels and names.
-func IsJobContainer(container types.Container, jobID string) bool {
-	// Check labels for job ID
-	if container.Labels["com.github.ci.job.id"] == jobID {
-		log.Printf("Detected job container %s based on label.", container.ID)
-		return true
+// imageUser returns the name of a container created from the image, if any.
+func imageUser(img image.Summary, containers []types.Container) (string, bool) {
+	refs := append([]string{img.ID}, img.RepoTags...)
+	for _, c := range containers {
+		for _, ref := range refs {
+			if c.ImageID == ref || c.Image == ref {
+				return containerName(c), true
+			}
+		}
+	}
+	return "", false
+}
+
+// containerName returns the name of the listed container, or its ID if it has none.
+func containerName(c types.Container) string {
+	if len(c.Names) > 0 {
+		return strings.TrimPrefix(c.Names[0], "/")
 	}
+	return c.ID
+}
 
-	// Check if the container name matches the jobID
-	containerName := strings.TrimPrefix(container.Names[0], "/")
-	if containerName == jobID {
-		log.Printf("Detected job container %s based on name.", container.ID)
-		return true
+// tagUser returns the name of a container created from the image tag, if any.
+func tagUser(tag string, containers []types.Container) (string, bool) {
+	for _, c := range containers {
+		if c.Image == tag {
+			return containerName(c), true
+		}
 	}
+	return "", false
+}
 
-	if strings.Contains(containerName, jobID) {
-		log.Printf("Detected job container %s based on name containing jobID.", container.ID)
-		return true
+// imageInUse reports whether a container runs the image.
+func imageInUse(img image.Summary, containers []types.Container) bool {
+	_, used := imageUser(img, containers)
+	return used
+}
+
+// removeImage removes every tag of the image, the image being deleted along with its last tag,
+// or the image by ID when it has no tag. Tags already removed are ignored.
+func removeImage(cli dockerapi.Client, ctx context.Context, img image.Summary) error {
+	refs := img.RepoTags
+	if len(refs) == 0 {
+		refs = []string{img.ID}
 	}
+	return removeRefs(cli, ctx, refs, image.RemoveOptions{PruneChildren: true})
+}
 
-	// Check if the container was created within the expected time frame for the job
-	createdTime := time.Unix(container.Created, 0)
-	if time.Since(createdTime) < 24*time.Hour {
-		log.Printf("Container %s created recently and might be related to job %s.", container.ID, jobID)
-		return true
+// removeRefs removes the image references, tags or IDs, in order. References already removed
+// are ignored.
+func removeRefs(cli dockerapi.Client, ctx context.Context, refs []string, options image.RemoveOptions) error {
+	for _, ref := range refs {
+		if _, err := cli.ImageRemove(ctx, ref, options); err != nil && !client.IsErrNotFound(err) {
+			return fmt.Errorf("failed to remove image %s: %w", ref, err)
+		}
 	}
+	return nil
+}
 
+// protectedTag reports whether a protection rule matches any tag of the image.
+func protectedTag(protection *Protection, img image.Summary) (string, bool) {
+	for _, tag := range img.RepoTags {
+		if reason, protected := protection.Protects(KindImages, PlanItem{ID: img.ID, Name: tag, Image: tag, Labels: img.Labels}); protected {
+			return reason, true
+		}
+	}
+	return "", false
+}
+
+// listed reports whether the container is in the list.
+func listed(containers []types.Container, containerID string) bool {
+	for _, c := range containers {
+		if c.ID == containerID {
+			return true
+		}
+	}
 	return false
 }
 
-// The IsComposeContainer function checks if a Docker container is part of a Compose project based on
+// sortedKeys returns the keys of a set in a stable order for error messages.
+func sortedKeys(set map[string]struct{}) []string {
+	keys := make([]string, 0, len(set))
+	for key := range set {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// itemNames returns the names of the plan items for error messages.
+func itemNames(items []PlanItem) []string {
+	names := make([]string, 0, len(items))
+	for _, item := range items {
+		names = append(names, item.Name)
+	}
+	return names
+}
+
+// The function `IsJobContainer` checks if a container is associated with a specific job ID based on
 // its labels and name.
-func IsComposeContainer(container types.Container, jobID string) bool {
-	// Check for Docker Compose project label
-	if projectLabel, exists := container.Labels["com.docker.compose.project"]; exists && projectLabel != "" {
-		log.Printf("Detected Docker Compose container %s related to project %s.", container.ID, projectLabel)
-		return true
+func IsJobContainer(container types.Container, jobID string) bool {
+	_, matched := MatchJobContainer(container, jobID)
+	return matched
+}
+
+// MatchJobContainer works like IsJobContainer and also returns the reason the container matched.
+func MatchJobContainer(container types.Container, jobID string) (string, bool) {
+	return matchJobContainer(container, jobID, JobLabel)
+}
+
+// matchJobContainer works like MatchJobContainer for jobs whose ID is carried by jobLabel.
+func matchJobContainer(container types.Container, jobID, jobLabel string) (string, bool) {
+	if jobID == "" {
+		return "", false
 	}
 
-	// Check for service or project name patterns in container names
-	if strings.Contains(container.Names[0], jobID) {
-		log.Printf("Detected container %s related to jobID %s.", container.ID, jobID)
-		return true
+	// Check labels for job ID
+	if container.Labels[jobLabel] == jobID {
+		Logger().Debug("Detected job container based on label", LogJobID, jobID, LogContainerID, container.ID)
+		return fmt.Sprintf("label %s=%s", jobLabel, jobID), true
 	}
 
-	// Additional checks for Docker Compose networks or services
-	if strings.Contains(container.Names[0], "docker_default") ||
-		strings.Contains(container.Names[0], "_") ||
-		container.Labels["com.docker.compose.service"] != "" {
-		log.Printf("Detected container %s possibly related to Docker Compose.", container.ID)
-		return true
+	// Check if the container name matches the jobID
+	if len(container.Names) > 0 && strings.TrimPrefix(container.Names[0], "/") == jobID {
+		Logger().Debug("Detected job container based on name", LogJobID, jobID, LogContainerID, container.ID)
+		return "container name matches the job ID", true
 	}
 
-	return false
+	return "", false
+}
+
+// The IsComposeContainer function checks if a Docker container is part of a Compose project started
+// for the job, that is a container of a project labeled with the job ID. A project named after
+// the job ID is not enough, since another project can contain the ID in its name: the other
+// containers of a project are attributed to the job once one of them is.
+func IsComposeContainer(container types.Container, jobID string) bool {
+	_, matched := MatchComposeContainer(container, jobID)
+	return matched
+}
+
+// MatchComposeContainer works like IsComposeContainer and also returns the reason the container matched.
+func MatchComposeContainer(container types.Container, jobID string) (string, bool) {
+	return matchComposeContainer(container, jobID, JobLabel)
 }
 
-// IsJobService checks if a service is associated with the specified job ID.
+// matchComposeContainer works like MatchComposeContainer for jobs whose ID is carried by jobLabel.
+func matchComposeContainer(container types.Container, jobID, jobLabel string) (string, bool) {
+	projectLabel := container.Labels[ComposeProjectLabel]
+	if projectLabel == "" || jobID == "" {
+		return "", false
+	}
+
+	if container.Labels[jobLabel] == jobID {
+		Logger().Debug("Detected Docker Compose container of the job", LogJobID, jobID, LogContainerID, container.ID, "compose_project", projectLabel)
+		return fmt.Sprintf("compose project %s of the job", projectLabel), true
+	}
+
+	return "", false
+}
+
+// IsJobService checks if a service is labeled with the specified job ID. A service name containing
+// the ID is not enough, since the ID can be part of an unrelated name.
 //
 // Parameters:
 // - service: The Docker service object.
@@ -413,17 +864,26 @@ func IsComposeContainer(container types.Container, jobID string) bool {
 // Returns:
 // - bool: True if the service is associated with the job ID.
 func IsJobService(service swarm.Service, jobID string) bool {
-	// Check labels for job ID
-	if service.Spec.Labels["com.github.ci.job.id"] == jobID {
-		log.Printf("Detected service %s based on label.", service.Spec.Name)
-		return true
+	_, matched := MatchJobService(service, jobID)
+	return matched
+}
+
+// MatchJobService works like IsJobService and also returns the reason the service matched.
+func MatchJobService(service swarm.Service, jobID string) (string, bool) {
+	return matchJobService(service, jobID, JobLabel)
+}
+
+// matchJobService works like MatchJobService for jobs whose ID is carried by jobLabel.
+func matchJobService(service swarm.Service, jobID, jobLabel string) (string, bool) {
+	if jobID == "" {
+		return "", false
 	}
 
-	// Check if the service name matches the jobID
-	if strings.Contains(service.Spec.Name, jobID) {
-		log.Printf("Detected service %s based on name containing jobID.", service.Spec.Name)
-		return true
+	// Check labels for job ID
+	if service.Spec.Labels[jobLabel] == jobID {
+		Logger().Debug("Detected service based on label", LogJobID, jobID, LogResourceName, service.Spec.Name)
+		return fmt.Sprintf("label %s=%s", jobLabel, jobID), true
 	}
 
-	return false
+	return "", false
 }
@@ -8,6 +8,7 @@ package cleanup
 
 import (
 	"testing"
+	"time"
 
 	"github.com/docker/docker/api/types"
 	"gotest.tools/v3/assert"
@@ -60,6 +61,16 @@ func TestIsJobContainer(t *testing.T) {
 			jobID:    "1234",
 			expected: false,
 		},
+		{
+			name: "Container created recently with non-matching name",
+			container: types.Container{
+				Labels:  map[string]string{},
+				Names:   []string{"/postgres"},
+				Created: time.Now().Unix(),
+			},
+			jobID:    "1234",
+			expected: false,
+		},
 		{
 			name: "Container with no job ID label and name is empty string",
 			container: types.Container{
@@ -87,16 +98,50 @@ func TestIsComposeContainer(t *testing.T) {
 		expected  bool
 	}{
 		{
-			name: "Container with Docker Compose project label",
+			name: "Container with Docker Compose project named after the job",
 			container: types.Container{
 				Labels: map[string]string{
-					"com.docker.compose.project": "example",
+					"com.docker.compose.project": "ci-1234",
 				},
 				Names: []string{"/other"},
 			},
 			jobID:    "1234",
+			expected: false,
+		},
+		{
+			name: "Container with Docker Compose project containing the job ID",
+			container: types.Container{
+				Labels: map[string]string{
+					"com.docker.compose.project": "shop-4217",
+				},
+				Names: []string{"/shop-4217-web-1"},
+			},
+			jobID:    "42",
+			expected: false,
+		},
+		{
+			name: "Container with Docker Compose project label and job ID label",
+			container: types.Container{
+				Labels: map[string]string{
+					"com.docker.compose.project": "example",
+					"com.github.ci.job.id":       "1234",
+				},
+				Names: []string{"/example-app-1"},
+			},
+			jobID:    "1234",
 			expected: true,
 		},
+		{
+			name: "Container with unrelated Docker Compose project label",
+			container: types.Container{
+				Labels: map[string]string{
+					"com.docker.compose.project": "example",
+				},
+				Names: []string{"/other"},
+			},
+			jobID:    "1234",
+			expected: false,
+		},
 		{
 			name: "Container with Compose-related name",
 			container: types.Container{
@@ -104,7 +149,7 @@ func TestIsComposeContainer(t *testing.T) {
 				Names:  []string{"/example_app_1"},
 			},
 			jobID:    "1234",
-			expected: true,
+			expected: false,
 		},
 		{
 			name: "Container without Compose project label and name without underscore",
@@ -0,0 +1,383 @@
+package cleanup
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"job-detection.is/github-gitlab/dockerapi"
+)
+
+const (
+	// DefaultHighWaterMark is the percentage of the data root file system used above which
+	// images and build cache are pruned.
+	DefaultHighWaterMark = 85.0
+
+	// DefaultLowWaterMark is the percentage of the data root file system used that pruning
+	// brings the usage back to.
+	DefaultLowWaterMark = 70.0
+)
+
+// DiskPressure configures the pruning of images and build cache when the file system holding
+// the data root of the daemon fills up.
+type DiskPressure struct {
+	// Interval is the time between two checks of the free space. Zero disables the checks.
+	Interval Duration `json:"interval,omitempty"`
+
+	// HighWaterMark is the percentage of the file system used above which pruning starts.
+	HighWaterMark float64 `json:"highWaterMark,omitempty"`
+
+	// LowWaterMark is the percentage of the file system used at which pruning stops.
+	LowWaterMark float64 `json:"lowWaterMark,omitempty"`
+
+	// DataRoot is the directory whose file system is measured, the daemon's data root by
+	// default. It must be set when the watcher does not see the daemon's file system under the
+	// same path, such as when it runs in a container.
+	DataRoot string `json:"dataRoot,omitempty"`
+
+	// ImageTags lists regular expressions matching the tags of images built by jobs, which are
+	// removed when pruning dangling images is not enough.
+	ImageTags []string `json:"imageTags,omitempty"`
+
+	imageTags []*regexp.Regexp
+}
+
+// Compile validates the settings and compiles the image tag patterns.
+//
+// Returns:
+// - error: An error if the interval is negative, the water marks are not ordered percentages or
+// an image tag pattern is invalid.
+func (p *DiskPressure) Compile() error {
+	if p.Interval < 0 {
+		return errors.New("interval must not be negative")
+	}
+	high, low := p.marks()
+	if high <= 0 || high > 100 || low <= 0 || low > 100 {
+		return errors.New("water marks must be percentages between 0 and 100")
+	}
+	if low >= high {
+		return fmt.Errorf("lowWaterMark %g must be below highWaterMark %g", low, high)
+	}
+
+	p.imageTags = make([]*regexp.Regexp, 0, len(p.ImageTags))
+	for i, pattern := range p.ImageTags {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return fmt.Errorf("invalid image tag pattern %d %q: %w", i, pattern, err)
+		}
+		p.imageTags = append(p.imageTags, re)
+	}
+	return nil
+}
+
+// marks returns the high and low water marks, with their defaults applied.
+func (p *DiskPressure) marks() (float64, float64) {
+	high, low := p.HighWaterMark, p.LowWaterMark
+	if high == 0 {
+		high = DefaultHighWaterMark
+	}
+	if low == 0 {
+		low = DefaultLowWaterMark
+	}
+	return high, low
+}
+
+// matchesTag reports whether a tag of the image matches an image tag pattern, and returns it.
+func (p *DiskPressure) matchesTag(img image.Summary) (string, bool) {
+	for _, tag := range img.RepoTags {
+		for _, re := range p.imageTags {
+			if re.MatchString(tag) {
+				return tag, true
+			}
+		}
+	}
+	return "", false
+}
+
+// DiskSpace is the size and free space of a file system, in bytes.
+type DiskSpace struct {
+	Total uint64
+	Free  uint64
+}
+
+// UsedPercent returns the percentage of the file system in use.
+func (s DiskSpace) UsedPercent() float64 {
+	if s.Total == 0 {
+		return 0
+	}
+	return float64(s.Total-s.Free) * 100 / float64(s.Total)
+}
+
+// above returns the number of bytes to free for the usage to drop to the percentage.
+func (s DiskSpace) above(percent float64) uint64 {
+	used := s.Total - s.Free
+	target := uint64(float64(s.Total) * percent / 100)
+	if used <= target {
+		return 0
+	}
+	return used - target
+}
+
+// MeasureFunc returns the space of the file system holding the path.
+type MeasureFunc func(path string) (DiskSpace, error)
+
+// PruneStep reports what one step of the disk pressure relief removed.
+type PruneStep struct {
+	// Name describes what the step prunes.
+	Name string
+
+	// Removed lists the IDs or tags of the images and build cache records removed.
+	Removed []string
+
+	// Reclaimed is the space freed according to the daemon, in bytes. In a dry run, it is the
+	// space that would have been freed.
+	Reclaimed uint64
+}
+
+// DiskReport reports a check of the free space of the data root and the pruning it triggered.
+type DiskReport struct {
+	DataRoot string
+	Before   DiskSpace
+	After    DiskSpace
+
+	// Triggered reports whether the usage was above the high-water mark.
+	Triggered bool
+
+	Steps []PruneStep
+}
+
+// Reclaimed returns the space freed by all the steps, in bytes.
+func (r *DiskReport) Reclaimed() uint64 {
+	total := uint64(0)
+	for _, step := range r.Steps {
+		total += step.Reclaimed
+	}
+	return total
+}
+
+// RelieveDiskPressure measures the file system holding the data root of the daemon and, when
+// its usage is above the high-water mark, prunes in turn dangling images, the images built by
+// jobs and the build cache, until the usage is back to the low-water mark. Job images are
+// removed oldest first, and neither images used by a container nor protected images are
+// removed.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - pressure: The compiled water marks and job image tags.
+// - opts: Options giving the dry run and the protected images.
+// - measure: Measures the file system, StatFS when nil.
+//
+// Returns:
+// - *DiskReport: The space before and after pruning, and what each step removed.
+// - error: An error if the data root could not be found or measured.
+func RelieveDiskPressure(cli dockerapi.Client, ctx context.Context, pressure *DiskPressure, opts Options, measure MeasureFunc) (*DiskReport, error) {
+	if measure == nil {
+		measure = StatFS
+	}
+
+	root := pressure.DataRoot
+	if root == "" {
+		info, err := cli.Info(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get the data root: %w", err)
+		}
+		root = info.DockerRootDir
+	}
+
+	space, err := measure(root)
+	if err != nil {
+		return nil, fmt.Errorf("failed to measure %s: %w", root, err)
+	}
+	report := &DiskReport{DataRoot: root, Before: space, After: space}
+	high, low := pressure.marks()
+	if space.UsedPercent() < high {
+		return report, nil
+	}
+
+	report.Triggered = true
+	logger := opts.logger().With("data_root", root)
+	logger.Warn("Disk usage above the high-water mark, pruning", "used_percent", space.UsedPercent(), "high_water_mark", high, "low_water_mark", low)
+
+	steps := []struct {
+		name  string
+		kind  Kind
+		prune func(need uint64) (PruneStep, error)
+	}{
+		{"dangling images", KindImages, func(need uint64) (PruneStep, error) { return pruneDanglingImages(cli, ctx, opts) }},
+		{"job images", KindImages, func(need uint64) (PruneStep, error) { return removeJobImages(cli, ctx, pressure, opts, need) }},
+		{"build cache", KindBuildCache, func(need uint64) (PruneStep, error) { return pruneBuildCache(cli, ctx, opts, need) }},
+	}
+
+	need := space.above(low)
+	for _, step := range steps {
+		if need == 0 {
+			break
+		}
+
+		pruned, err := step.prune(need)
+		pruned.Name = step.name
+		if err != nil {
+			logger.Error("Failed to prune", "step", step.name, ErrorAttr(err))
+		}
+		report.Steps = append(report.Steps, pruned)
+		logger.Info("Pruned", "step", step.name, "removed", len(pruned.Removed), "reclaimed", FormatBytes(pruned.Reclaimed))
+
+		// A dry run frees nothing, so the space it would reclaim is counted instead
+		if opts.DryRun {
+			need -= min(need, pruned.Reclaimed)
+			continue
+		}
+		if opts.Auditor != nil {
+			for _, removed := range pruned.Removed {
+				item := PlanItem{ID: removed, Reason: "disk pressure: " + step.name}
+				opts.Auditor.Audited(AuditedAction{Kind: step.kind, Item: item, Action: ActionPrune, Result: ResultSucceeded})
+			}
+		}
+		if space, err = measure(root); err != nil {
+			return report, fmt.Errorf("failed to measure %s: %w", root, err)
+		}
+		report.After = space
+		need = space.above(low)
+	}
+
+	logger.Info("Disk pressure relieved", "reclaimed", FormatBytes(report.Reclaimed()), "used_percent", report.After.UsedPercent())
+	return report, nil
+}
+
+// pruneDanglingImages removes the images without a tag that no container uses and no protection
+// rule matches.
+func pruneDanglingImages(cli dockerapi.Client, ctx context.Context, opts Options) (PruneStep, error) {
+	var step PruneStep
+	images, err := cli.ImageList(ctx, image.ListOptions{Filters: filters.NewArgs(filters.Arg("dangling", "true"))})
+	if err != nil {
+		return step, fmt.Errorf("failed to list images: %w", err)
+	}
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return step, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	for _, img := range images {
+		if _, used := imageUser(img, containers); used {
+			continue
+		}
+		item := PlanItem{ID: img.ID, Name: img.ID, Labels: img.Labels}
+		if reason, protected := opts.Protection.Protects(KindImages, item); protected {
+			opts.logger().Info("Skipping protected image", LogResourceKind, KindImages, LogResourceID, img.ID, "reason", reason)
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := removeImage(cli, ctx, img); err != nil {
+				opts.logger().Warn("Failed to remove image", LogResourceKind, KindImages, LogResourceID, img.ID, ErrorAttr(err))
+				continue
+			}
+		}
+		step.Removed = append(step.Removed, img.ID)
+		step.Reclaimed += uint64(img.Size)
+	}
+	return step, nil
+}
+
+// removeJobImages removes the unused images whose tag matches an image tag pattern, oldest
+// first, until need bytes were reclaimed. Every tag of an image is removed, so that the image
+// is deleted along with its last tag, and images with a protected tag are kept.
+func removeJobImages(cli dockerapi.Client, ctx context.Context, pressure *DiskPressure, opts Options, need uint64) (PruneStep, error) {
+	var step PruneStep
+	if len(pressure.imageTags) == 0 {
+		return step, nil
+	}
+
+	images, err := cli.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return step, fmt.Errorf("failed to list images: %w", err)
+	}
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return step, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	sort.SliceStable(images, func(i, j int) bool { return images[i].Created < images[j].Created })
+	for _, img := range images {
+		if step.Reclaimed >= need {
+			break
+		}
+		tag, matched := pressure.matchesTag(img)
+		if !matched {
+			continue
+		}
+		if _, used := imageUser(img, containers); used {
+			continue
+		}
+		if reason, protected := protectedTag(opts.Protection, img); protected {
+			opts.logger().Info("Skipping protected image", LogResourceKind, KindImages, LogResourceID, img.ID, LogResourceName, tag, "reason", reason)
+			continue
+		}
+
+		if !opts.DryRun {
+			if err := removeImage(cli, ctx, img); err != nil {
+				opts.logger().Warn("Failed to remove image", LogResourceKind, KindImages, LogResourceID, img.ID, LogResourceName, tag, ErrorAttr(err))
+				continue
+			}
+		}
+		step.Removed = append(step.Removed, img.RepoTags...)
+		step.Reclaimed += uint64(img.Size)
+	}
+	return step, nil
+}
+
+// pruneBuildCache removes the build cache records that are not in use, least recently used
+// first, until need bytes were reclaimed.
+func pruneBuildCache(cli dockerapi.Client, ctx context.Context, opts Options, need uint64) (PruneStep, error) {
+	var step PruneStep
+	usage, err := cli.DiskUsage(ctx, types.DiskUsageOptions{Types: []types.DiskUsageObject{types.BuildCacheObject}})
+	if err != nil {
+		return step, fmt.Errorf("failed to get the build cache usage: %w", err)
+	}
+	size := uint64(0)
+	for _, record := range usage.BuildCache {
+		size += uint64(record.Size)
+	}
+	if size == 0 {
+		return step, nil
+	}
+
+	if opts.DryRun {
+		step.Reclaimed = min(need, size)
+		return step, nil
+	}
+
+	// The cache is pruned down to the size it must keep, or entirely if that is not enough
+	prune := types.BuildCachePruneOptions{All: true}
+	if size > need {
+		prune.KeepStorage = int64(size - need)
+	}
+	report, err := cli.BuildCachePrune(ctx, prune)
+	if err != nil {
+		return step, fmt.Errorf("failed to prune the build cache: %w", err)
+	}
+	step.Removed = report.CachesDeleted
+	step.Reclaimed = report.SpaceReclaimed
+	return step, nil
+}
+
+// FormatBytes formats a size in bytes with a binary unit, such as "1.5 GiB".
+func FormatBytes(size uint64) string {
+	const unit = 1024
+	if size < unit {
+		return fmt.Sprintf("%d B", size)
+	}
+	div, exp := uint64(unit), 0
+	for n := size / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(size)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,177 @@
+package cleanup
+
+import (
+	"context"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"gotest.tools/v3/assert"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+// pressuredDaemon returns a daemon holding images and build cache, and a file system of 2000
+// bytes whose usage is 500 bytes plus the data of the daemon.
+func pressuredDaemon(t *testing.T) (*fake.Daemon, MeasureFunc) {
+	t.Helper()
+
+	daemon := fake.NewDaemon()
+	daemon.AddImage("", 150, nil)
+	daemon.AddImage("", 50, map[string]string{"keep": "true"})
+	daemon.AddImage("registry.example.com/ci/app:job-1", 150, nil)
+	daemon.AddImage("registry.example.com/ci/app:job-2", 150, nil)
+	assert.NilError(t, daemon.TagImage("registry.example.com/ci/app:job-2", "registry.example.com/ci/app:main"))
+	daemon.AddImage("registry.example.com/ci/app:job-3", 100, nil)
+	daemon.AddImage("nginx:latest", 50, nil)
+	daemon.AddBuildCache("old", 100, false)
+	daemon.AddBuildCache("recent", 100, false)
+	daemon.AddBuildCache("building", 50, true)
+
+	// A job still running from one of the job images
+	running := daemon.CreateContainer(fake.ContainerSpec{Name: "job-3", Image: "registry.example.com/ci/app:job-3"})
+	assert.NilError(t, daemon.StartContainer(running))
+
+	measure := func(path string) (DiskSpace, error) {
+		assert.Equal(t, path, fake.DataRoot)
+		return DiskSpace{Total: 2000, Free: 2000 - 500 - uint64(daemon.DataSize())}, nil
+	}
+	return daemon, measure
+}
+
+func TestRelieveDiskPressure(t *testing.T) {
+	testCases := []struct {
+		name       string
+		pressure   DiskPressure
+		protect    []ProtectionRule
+		dryRun     bool
+		triggered  bool
+		reclaimed  uint64
+		removed    []string
+		kept       []string
+		cacheAfter int64
+	}{
+		{
+			name:       "Below the high-water mark",
+			pressure:   DiskPressure{HighWaterMark: 75, LowWaterMark: 40, ImageTags: []string{"/ci/app:job-"}},
+			triggered:  false,
+			kept:       []string{"registry.example.com/ci/app:job-1", "registry.example.com/ci/app:job-2"},
+			cacheAfter: 250,
+		},
+		{
+			name:       "Oldest job images first",
+			pressure:   DiskPressure{HighWaterMark: 60, LowWaterMark: 40, ImageTags: []string{"/ci/app:job-"}},
+			triggered:  true,
+			reclaimed:  600,
+			removed:    []string{"registry.example.com/ci/app:job-1", "registry.example.com/ci/app:job-2", "registry.example.com/ci/app:main"},
+			kept:       []string{"registry.example.com/ci/app:job-3", "nginx:latest"},
+			cacheAfter: 150,
+		},
+		{
+			name:       "Dangling images are enough",
+			pressure:   DiskPressure{HighWaterMark: 65, LowWaterMark: 60, ImageTags: []string{"/ci/app:job-"}},
+			triggered:  true,
+			reclaimed:  200,
+			kept:       []string{"registry.example.com/ci/app:job-1", "registry.example.com/ci/app:job-2"},
+			cacheAfter: 250,
+		},
+		{
+			name:       "Protected job images",
+			pressure:   DiskPressure{HighWaterMark: 60, LowWaterMark: 40, ImageTags: []string{"/ci/app:job-"}},
+			protect:    []ProtectionRule{{Image: "job-1$"}},
+			triggered:  true,
+			reclaimed:  550,
+			removed:    []string{"registry.example.com/ci/app:job-2"},
+			kept:       []string{"registry.example.com/ci/app:job-1"},
+			cacheAfter: 50,
+		},
+		{
+			name:       "Protected dangling images",
+			pressure:   DiskPressure{HighWaterMark: 65, LowWaterMark: 60, ImageTags: []string{"/ci/app:job-"}},
+			protect:    []ProtectionRule{{Label: "keep=true"}},
+			triggered:  true,
+			reclaimed:  300,
+			removed:    []string{"registry.example.com/ci/app:job-1"},
+			kept:       []string{"registry.example.com/ci/app:job-2"},
+			cacheAfter: 250,
+		},
+		{
+			name:       "Without job image tags",
+			pressure:   DiskPressure{HighWaterMark: 60, LowWaterMark: 50},
+			triggered:  true,
+			reclaimed:  400,
+			kept:       []string{"registry.example.com/ci/app:job-1", "registry.example.com/ci/app:job-2"},
+			cacheAfter: 50,
+		},
+		{
+			name:       "Dry run",
+			pressure:   DiskPressure{HighWaterMark: 60, LowWaterMark: 40, ImageTags: []string{"/ci/app:job-"}},
+			dryRun:     true,
+			triggered:  true,
+			reclaimed:  600,
+			kept:       []string{"registry.example.com/ci/app:job-1", "registry.example.com/ci/app:job-2"},
+			cacheAfter: 250,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			daemon, measure := pressuredDaemon(t)
+			assert.NilError(t, tc.pressure.Compile())
+			protection, err := NewProtection(tc.protect)
+			assert.NilError(t, err)
+			opts := testOptions()
+			opts.DryRun = tc.dryRun
+			opts.Protection = protection
+
+			report, err := RelieveDiskPressure(daemon, context.Background(), &tc.pressure, opts, measure)
+			assert.NilError(t, err)
+
+			assert.Equal(t, report.Triggered, tc.triggered)
+			assert.Equal(t, report.Reclaimed(), tc.reclaimed)
+			assert.Equal(t, report.Before.Total-report.After.Free, 500+uint64(daemon.DataSize()))
+			for _, ref := range tc.removed {
+				assert.Assert(t, !daemon.HasImage(ref), ref)
+			}
+			for _, ref := range tc.kept {
+				assert.Assert(t, daemon.HasImage(ref), ref)
+			}
+			usage, err := daemon.DiskUsage(context.Background(), types.DiskUsageOptions{})
+			assert.NilError(t, err)
+			cache := int64(0)
+			for _, record := range usage.BuildCache {
+				cache += record.Size
+			}
+			assert.Equal(t, cache, tc.cacheAfter)
+		})
+	}
+}
+
+func TestDiskPressureCompile(t *testing.T) {
+	testCases := []struct {
+		name     string
+		pressure DiskPressure
+		err      string
+	}{
+		{name: "Defaults", pressure: DiskPressure{}},
+		{name: "Low mark only", pressure: DiskPressure{LowWaterMark: 90}, err: "lowWaterMark 90 must be below highWaterMark 85"},
+		{name: "Above 100", pressure: DiskPressure{HighWaterMark: 120}, err: "water marks must be percentages between 0 and 100"},
+		{name: "Negative interval", pressure: DiskPressure{Interval: -1}, err: "interval must not be negative"},
+		{name: "Invalid tag", pressure: DiskPressure{ImageTags: []string{"["}}, err: `invalid image tag pattern 0 "["`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.pressure.Compile()
+			if tc.err == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	assert.Equal(t, FormatBytes(512), "512 B")
+	assert.Equal(t, FormatBytes(1536), "1.5 KiB")
+	assert.Equal(t, FormatBytes(3<<30), "3.0 GiB")
+}
@@ -0,0 +1,207 @@
+package cleanup
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"gotest.tools/v3/assert"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+// testOptions returns the default options without any delay.
+func testOptions() Options {
+	opts := DefaultOptions()
+	opts.Delay = 0
+	opts.PollInterval = 0
+	opts.RetryDelay = 0
+	return opts
+}
+
+// TestExecuteRunsExactlyThePlan checks that the executor removes the planned resources of a job
+// labeled with its ID and nothing else.
+func TestExecuteRunsExactlyThePlan(t *testing.T) {
+	ctx := context.Background()
+	daemon := fake.NewDaemon()
+
+	labels := map[string]string{JobLabel: "1234"}
+	daemon.AddNetwork("job-network", labels)
+	daemon.AddVolume("job-volume", labels)
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "job", Labels: labels, Networks: []string{"job-network"}, Volumes: []string{"job-volume"}})
+	assert.NilError(t, daemon.StartContainer(job))
+
+	other := daemon.CreateContainer(fake.ContainerSpec{Name: "other", Networks: []string{"bridge"}, Volumes: []string{"data"}})
+	assert.NilError(t, daemon.StartContainer(other))
+
+	plan, err := BuildPlan(daemon, ctx, NewResources("1234"))
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.StopContainers), 1)
+	assert.Equal(t, len(plan.RemoveContainers), 1)
+	assert.Equal(t, len(plan.Networks), 1)
+	assert.Equal(t, len(plan.Volumes), 1)
+
+	Execute(daemon, ctx, plan, testOptions())
+
+	assert.Assert(t, !daemon.HasContainer(job))
+	assert.Assert(t, !daemon.HasNetwork("job-network"))
+	assert.Assert(t, !daemon.HasVolume("job-volume"))
+	assert.Equal(t, daemon.ContainerState(other), "running")
+	assert.Assert(t, daemon.HasNetwork("bridge"))
+	assert.Assert(t, daemon.HasVolume("data"))
+}
+
+// TestCleanupContainersWithASingleAttempt checks that a running container is stopped and removed
+// within a single attempt.
+func TestCleanupContainersWithASingleAttempt(t *testing.T) {
+	ctx := context.Background()
+	daemon := fake.NewDaemon()
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "job", Labels: map[string]string{JobLabel: "1234"}})
+	assert.NilError(t, daemon.StartContainer(job))
+
+	plan, err := BuildPlan(daemon, ctx, NewResources("1234"))
+	assert.NilError(t, err)
+	opts := testOptions()
+	opts.ContainerRetries = 1
+	report := Execute(daemon, ctx, plan, opts)
+
+	assert.Assert(t, !report.Failed())
+	assert.Assert(t, !daemon.HasContainer(job))
+	assert.Equal(t, report.Count(ResultSucceeded), 2)
+}
+
+// TestCleanUpLogsToTheOptionsLogger checks that the records of a cleanup reach the logger of its
+// options.
+func TestCleanUpLogsToTheOptionsLogger(t *testing.T) {
+	var out bytes.Buffer
+	opts := testOptions()
+	opts.Logger = slog.New(slog.NewTextHandler(&out, nil))
+
+	CleanUp(fake.NewDaemon(), context.Background(), NewResources("1234"), opts)
+	assert.Assert(t, strings.Contains(out.String(), `msg="Starting cleanup" job_id=1234`), out.String())
+}
+
+// TestCleanUpLeavesProjectsContainingTheJobID checks that a Compose project or service whose name
+// merely contains the job ID is not attributed to the job.
+func TestCleanUpLeavesProjectsContainingTheJobID(t *testing.T) {
+	daemon := fake.NewDaemon()
+
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-build", Labels: map[string]string{JobLabel: "42"}})
+	assert.NilError(t, daemon.StartContainer(job))
+	assert.NilError(t, daemon.ExitContainer(job, 0))
+
+	project := map[string]string{ComposeProjectLabel: "shop-4217"}
+	network := daemon.AddNetwork("shop-4217_default", project)
+	shop := daemon.CreateContainer(fake.ContainerSpec{Name: "shop-4217-web-1", Labels: project, Networks: []string{"shop-4217_default"}})
+	assert.NilError(t, daemon.StartContainer(shop))
+	service := daemon.AddService("shop-4217-worker", nil)
+
+	report := CleanUp(daemon, context.Background(), NewResources("42"), testOptions())
+	assert.NilError(t, report.Err())
+
+	assert.Assert(t, !daemon.HasContainer(job))
+	assert.Equal(t, daemon.ContainerState(shop), "running")
+	assert.Assert(t, daemon.HasNetwork(network))
+	assert.Assert(t, daemon.HasService(service))
+}
+
+// lockedServiceDaemon fails the removal of one service, like a service the daemon refuses to
+// remove.
+type lockedServiceDaemon struct {
+	*fake.Daemon
+	locked string
+}
+
+func (d *lockedServiceDaemon) ServiceRemove(ctx context.Context, serviceID string) error {
+	if serviceID == d.locked {
+		return errdefs.System(errors.New("rpc error: service is locked"))
+	}
+	return d.Daemon.ServiceRemove(ctx, serviceID)
+}
+
+// TestCleanupServicesContinuesPastFailures checks that a service that cannot be removed does not
+// stop the removal of the others.
+func TestCleanupServicesContinuesPastFailures(t *testing.T) {
+	daemon := fake.NewDaemon()
+	labels := map[string]string{JobLabel: "1234"}
+	first := daemon.AddService("job-api", labels)
+	locked := daemon.AddService("job-db", labels)
+	last := daemon.AddService("job-worker", labels)
+	cli := &lockedServiceDaemon{Daemon: daemon, locked: locked}
+
+	plan := &Plan{JobID: "1234", Services: []PlanItem{
+		{ID: first, Name: "job-api"},
+		{ID: locked, Name: "job-db"},
+		{ID: last, Name: "job-worker"},
+	}}
+	report := newReport("1234", testOptions())
+	err := CleanupServices(cli, context.Background(), plan, testOptions(), report)
+	assert.Error(t, err, "services left behind: job-db")
+
+	assert.Assert(t, !daemon.HasService(first))
+	assert.Assert(t, daemon.HasService(locked))
+	assert.Assert(t, !daemon.HasService(last))
+	assert.Equal(t, report.Count(ResultSucceeded), 2)
+	assert.Equal(t, report.Count(ResultFailed), 1)
+}
+
+// TestCleanupImages checks that the images of a job are removed with all their tags, except those
+// still used by a container and the protected ones.
+func TestCleanupImages(t *testing.T) {
+	ctx := context.Background()
+	daemon := fake.NewDaemon()
+
+	built := daemon.AddImage("registry.example.com/ci/app:job-1234", 100, nil)
+	untagged := daemon.AddImage("", 100, nil)
+	used := daemon.AddImage("registry.example.com/ci/app:latest", 100, nil)
+	protected := daemon.AddImage("registry.example.com/ci/base:stable", 100, nil)
+	other := daemon.AddImage("nginx:latest", 100, nil)
+
+	debug := daemon.CreateContainer(fake.ContainerSpec{Name: "debug", Image: "registry.example.com/ci/app:latest"})
+	assert.NilError(t, daemon.StartContainer(debug))
+
+	resources := NewResources("1234")
+	for _, id := range []string{built, untagged, used, protected} {
+		resources.Images[id] = "built by the test"
+	}
+	plan, err := BuildPlan(daemon, ctx, resources)
+	assert.NilError(t, err)
+	assert.Equal(t, len(plan.Images), 4)
+
+	protection, err := NewProtection([]ProtectionRule{{Image: "/ci/base:"}})
+	assert.NilError(t, err)
+	opts := testOptions()
+	opts.Protection = protection
+
+	assert.NilError(t, CleanupImages(daemon, ctx, plan, opts, nil))
+
+	assert.Assert(t, !daemon.HasImage(built))
+	assert.Assert(t, !daemon.HasImage(untagged))
+	assert.Assert(t, daemon.HasImage(used))
+	assert.Assert(t, daemon.HasImage(protected))
+	assert.Assert(t, daemon.HasImage(other))
+}
+
+func TestStopTimeoutSeconds(t *testing.T) {
+	testCases := []struct {
+		timeout  time.Duration
+		expected int
+	}{
+		{0, 0},
+		{time.Nanosecond, 1},
+		{500 * time.Millisecond, 1},
+		{time.Second, 1},
+		{1500 * time.Millisecond, 2},
+		{10 * time.Second, 10},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.timeout.String(), func(t *testing.T) {
+			assert.Equal(t, stopTimeoutSeconds(tc.timeout), tc.expected)
+		})
+	}
+}
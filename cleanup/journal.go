@@ -0,0 +1,31 @@
+package cleanup
+
+// Journal records the lifecycle of jobs outside the process, so that the jobs started or
+// finished while the watcher was down are still cleaned up once it restarts. Implementations
+// must be safe for concurrent use and report their own errors: failing to record a job never
+// stops its detection or cleanup.
+type Journal interface {
+	// Tracked records a container attributed to a running job.
+	Tracked(jobID, jobLabel, containerID, reason string, labels map[string]string)
+
+	// TrackedImage records an image built by or for a running job.
+	TrackedImage(jobID, jobLabel, imageID, reason string)
+
+	// TrackedImageTag records a tag a running job added to an image it did not build.
+	TrackedImageTag(jobID, jobLabel, tag, reason string)
+
+	// Submitted records that the cleanup of the job was requested with the policy.
+	Submitted(owned *Resources, policy Policy)
+
+	// Attempted records that a cleanup of the job started, and returns the number of cleanups
+	// of the job started since it was last completed, this one included, or zero if the job is
+	// not recorded.
+	Attempted(jobID string) int
+
+	// Failed records that the last cleanup of the job left resources behind, so that it is
+	// tried again after a restart.
+	Failed(jobID string)
+
+	// Completed records that the job was cleaned up and can be forgotten.
+	Completed(jobID string)
+}
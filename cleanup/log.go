@@ -0,0 +1,47 @@
+package cleanup
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// Keys of the attributes of log records, shared by the packages of the watcher so that the
+// records of a job can be correlated.
+const (
+	LogJobID         = "job_id"
+	LogContainerID   = "container_id"
+	LogContainerName = "container_name"
+	LogPattern       = "pattern"
+	LogResourceKind  = "resource_kind"
+	LogResourceID    = "resource_id"
+	LogResourceName  = "resource_name"
+	LogAction        = "action"
+	LogError         = "error"
+)
+
+// packageLogger is the logger set with SetLogger.
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger receiving the records of the package. A nil logger restores
+// slog.Default().
+func SetLogger(logger *slog.Logger) {
+	packageLogger.Store(logger)
+}
+
+// Logger returns the logger receiving the records of the package.
+func Logger() *slog.Logger {
+	if logger := packageLogger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
+
+// ErrorAttr returns the attribute logging an error under LogError.
+func ErrorAttr(err error) slog.Attr {
+	return slog.Any(LogError, err)
+}
+
+// resourceAttrs returns the attributes identifying a resource of the kind.
+func resourceAttrs(kind Kind, item PlanItem) []any {
+	return []any{LogResourceKind, kind, LogResourceID, item.ID, LogResourceName, item.Name}
+}
@@ -0,0 +1,491 @@
+package cleanup
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/volume"
+)
+
+const (
+	// JobLabel is the default label carrying the CI job ID on resources created for a job.
+	JobLabel = "com.github.ci.job.id"
+
+	// ComposeProjectLabel is the label Docker Compose sets on every resource of a project.
+	ComposeProjectLabel = "com.docker.compose.project"
+
+	// AnonymousVolumeLabel is the label the daemon sets on volumes it created for a single container.
+	AnonymousVolumeLabel = "com.docker.volume.anonymous"
+)
+
+// Resources is the set of Docker resources owned by a single job. Only the resources
+// recorded here are ever stopped or removed by CleanUp. Each resource maps to the reason it
+// was attributed to the job.
+type Resources struct {
+	JobID string `json:"jobId"`
+	// JobLabel is the label carrying the job ID for the CI provider that started the job.
+	JobLabel        string              `json:"jobLabel"`
+	ComposeProjects map[string]struct{} `json:"composeProjects"`
+	Containers      map[string]string   `json:"containers"`
+	Networks        map[string]string   `json:"networks"`
+	Volumes         map[string]string   `json:"volumes"`
+	Services        map[string]string   `json:"services"`
+	// Images maps the IDs of the images built by or for the job to the reason.
+	Images map[string]string `json:"images"`
+	// ImageTags maps the tags the job added to images it did not build to the reason. Only the
+	// tags are removed, so the images they were added to are kept.
+	ImageTags map[string]string `json:"imageTags"`
+	// Failed reports whether a container of the job exited with a non-zero code.
+	Failed bool `json:"failed"`
+}
+
+// NewResources returns an empty resource set for the specified job ID.
+func NewResources(jobID string) *Resources {
+	return &Resources{
+		JobID:           jobID,
+		JobLabel:        JobLabel,
+		ComposeProjects: make(map[string]struct{}),
+		Containers:      make(map[string]string),
+		Networks:        make(map[string]string),
+		Volumes:         make(map[string]string),
+		Services:        make(map[string]string),
+		Images:          make(map[string]string),
+		ImageTags:       make(map[string]string),
+	}
+}
+
+// AddContainer records a container created for the job, along with the Compose project it
+// belongs to, if any.
+func (r *Resources) AddContainer(containerID, reason string, labels map[string]string) {
+	if _, exists := r.Containers[containerID]; !exists {
+		r.Containers[containerID] = reason
+	}
+	if project := labels[ComposeProjectLabel]; project != "" {
+		r.ComposeProjects[project] = struct{}{}
+	}
+}
+
+// OwnsLabels reports whether a resource carrying the given labels was created for the job,
+// either because it is labeled with the job ID or because it belongs to a Compose project
+// started by the job.
+func (r *Resources) OwnsLabels(labels map[string]string) bool {
+	_, owned := r.labelReason(labels)
+	return owned
+}
+
+// labelReason returns why a resource carrying the given labels is owned by the job.
+func (r *Resources) labelReason(labels map[string]string) (string, bool) {
+	if r.JobID != "" && labels[r.JobLabel] == r.JobID {
+		return fmt.Sprintf("label %s=%s", r.JobLabel, r.JobID), true
+	}
+
+	if project := labels[ComposeProjectLabel]; project != "" {
+		if _, exists := r.ComposeProjects[project]; exists {
+			return fmt.Sprintf("compose project %s started by the job", project), true
+		}
+	}
+
+	return "", false
+}
+
+// HasContainer reports whether the container is owned by the job.
+func (r *Resources) HasContainer(containerID string) bool {
+	_, exists := r.Containers[containerID]
+	return exists
+}
+
+// Empty reports whether no resource is owned by the job.
+func (r *Resources) Empty() bool {
+	return len(r.Containers) == 0 && len(r.Networks) == 0 && len(r.Volumes) == 0 && len(r.Services) == 0 &&
+		len(r.Images) == 0 && len(r.ImageTags) == 0
+}
+
+// Merge adds the resources of other to the set.
+func (r *Resources) Merge(other *Resources) {
+	r.Failed = r.Failed || other.Failed
+	for project := range other.ComposeProjects {
+		r.ComposeProjects[project] = struct{}{}
+	}
+	for _, pair := range []struct{ dst, src map[string]string }{
+		{r.Containers, other.Containers},
+		{r.Networks, other.Networks},
+		{r.Volumes, other.Volumes},
+		{r.Services, other.Services},
+		{r.Images, other.Images},
+		{r.ImageTags, other.ImageTags},
+	} {
+		for key, reason := range pair.src {
+			if _, exists := pair.dst[key]; !exists {
+				pair.dst[key] = reason
+			}
+		}
+	}
+}
+
+// Clone returns a deep copy of the resource set.
+func (r *Resources) Clone() *Resources {
+	clone := NewResources(r.JobID)
+	clone.JobLabel = r.JobLabel
+	clone.Merge(r)
+	return clone
+}
+
+// Claim adds to the set every listed resource that was created by or for the job. Containers
+// are claimed first so that Compose projects they belong to and anonymous volumes they mount
+// are attributed to the job as well.
+//
+// Parameters:
+// - containers: All containers known to the daemon.
+// - networks: All networks known to the daemon.
+// - volumes: All volumes known to the daemon.
+// - services: All services known to the daemon.
+// - images: All images known to the daemon.
+func (r *Resources) Claim(containers []types.Container, networks []network.Summary, volumes []*volume.Volume, services []swarm.Service, images []image.Summary) {
+	// Containers labeled with the job ID attribute their Compose project to the job
+	for _, container := range containers {
+		if reason, ok := matchJobContainer(container, r.JobID, r.JobLabel); ok {
+			r.AddContainer(container.ID, reason, container.Labels)
+		} else if reason, ok := matchComposeContainer(container, r.JobID, r.JobLabel); ok {
+			r.AddContainer(container.ID, reason, container.Labels)
+		}
+	}
+
+	mountedVolumes := make(map[string]struct{})
+	for _, container := range containers {
+		if reason, ok := r.labelReason(container.Labels); ok {
+			r.AddContainer(container.ID, reason, container.Labels)
+		}
+		if r.HasContainer(container.ID) {
+			for _, mount := range container.Mounts {
+				if mount.Name != "" {
+					mountedVolumes[mount.Name] = struct{}{}
+				}
+			}
+		}
+	}
+
+	for _, network := range networks {
+		if reason, ok := r.labelReason(network.Labels); ok {
+			r.Networks[network.Name] = reason
+		}
+	}
+
+	for _, volume := range volumes {
+		if volume == nil {
+			continue
+		}
+		_, mounted := mountedVolumes[volume.Name]
+		_, anonymous := volume.Labels[AnonymousVolumeLabel]
+		if reason, ok := r.labelReason(volume.Labels); ok {
+			r.Volumes[volume.Name] = reason
+		} else if mounted && anonymous {
+			r.Volumes[volume.Name] = "anonymous volume of a job container"
+		}
+	}
+
+	for _, service := range services {
+		if reason, ok := matchJobService(service, r.JobID, r.JobLabel); ok {
+			r.Services[service.ID] = reason
+		} else if reason, ok := r.labelReason(service.Spec.Labels); ok {
+			r.Services[service.ID] = reason
+		}
+	}
+
+	for _, img := range images {
+		if reason, ok := r.labelReason(img.Labels); ok {
+			r.Images[img.ID] = reason
+		}
+	}
+}
+
+// finishedTTL is how long a finished container is remembered to ignore its repeated events.
+const finishedTTL = time.Hour
+
+// pendingTTL is how long the containers created for a job that is not tracked are held, waiting
+// for the job container to start.
+const pendingTTL = time.Hour
+
+// Registry records, for every job tracked by the watcher, the resources created by or for it.
+// Containers created for a job before its job container started are held apart until it starts,
+// so that jobs matching no job pattern are never tracked. It is safe for concurrent use.
+type Registry struct {
+	mu       sync.Mutex
+	jobLabel string
+	journal  Journal
+	jobs     map[string]*Resources
+	started  map[string]time.Time
+	pending  map[string]*pendingJob
+	finished map[string]time.Time
+}
+
+// pendingJob holds the containers created for a job that is not tracked yet.
+type pendingJob struct {
+	since      time.Time
+	containers []pendingContainer
+}
+
+// pendingContainer is a container held until its job is tracked.
+type pendingContainer struct {
+	id     string
+	reason string
+	labels map[string]string
+}
+
+// NewRegistry returns an empty registry for jobs whose resources carry the job ID in jobLabel.
+//
+// Parameters:
+// - jobLabel: The label carrying the job ID on the resources of a job.
+// - journal: Records the containers of running jobs across restarts, nil to keep them in memory only.
+//
+// Returns:
+// - *Registry: The empty registry.
+func NewRegistry(jobLabel string, journal Journal) *Registry {
+	return &Registry{
+		jobLabel: jobLabel,
+		journal:  journal,
+		jobs:     make(map[string]*Resources),
+		started:  make(map[string]time.Time),
+		pending:  make(map[string]*pendingJob),
+		finished: make(map[string]time.Time),
+	}
+}
+
+// Track records the container of a started job, along with the containers created for the job
+// before it started.
+//
+// Parameters:
+// - jobID: The job ID associated with the job.
+// - containerID: The ID of the job container.
+// - labels: The labels of the job container.
+func (r *Registry) Track(jobID, containerID string, labels map[string]string) {
+	r.Restore(jobID, containerID, "job container", labels)
+}
+
+// Restore records a container of a tracked job, such as a container of a job tracked by a
+// previous run of the watcher.
+//
+// Parameters:
+// - jobID: The job ID associated with the job.
+// - containerID: The ID of the container.
+// - reason: Why the container is attributed to the job.
+// - labels: The labels of the container.
+func (r *Registry) Restore(jobID, containerID, reason string, labels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	owned, exists := r.jobs[jobID]
+	if !exists {
+		owned = r.newResources(jobID)
+		r.jobs[jobID] = owned
+		r.started[jobID] = time.Now()
+	}
+	r.record(owned, containerID, reason, labels)
+
+	if held, exists := r.pending[jobID]; exists {
+		delete(r.pending, jobID)
+		for _, c := range held.containers {
+			r.record(owned, c.id, c.reason, c.labels)
+		}
+	}
+}
+
+// Add records a container created for the job, such as a helper or service container. The
+// container is held until the job is tracked, and dropped if it is not tracked within an hour.
+//
+// Parameters:
+// - jobID: The job ID associated with the job.
+// - containerID: The ID of the container.
+// - reason: Why the container is attributed to the job.
+// - labels: The labels of the container.
+func (r *Registry) Add(jobID, containerID, reason string, labels map[string]string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if owned, exists := r.jobs[jobID]; exists {
+		r.record(owned, containerID, reason, labels)
+		return
+	}
+
+	now := time.Now()
+	for id, held := range r.pending {
+		if now.Sub(held.since) > pendingTTL {
+			delete(r.pending, id)
+		}
+	}
+	held, exists := r.pending[jobID]
+	if !exists {
+		held = &pendingJob{since: now}
+		r.pending[jobID] = held
+	}
+	held.containers = append(held.containers, pendingContainer{id: containerID, reason: reason, labels: labels})
+}
+
+// record adds the container to the resources of a tracked job and to the journal.
+func (r *Registry) record(owned *Resources, containerID, reason string, labels map[string]string) {
+	owned.AddContainer(containerID, reason, labels)
+	if r.journal != nil {
+		r.journal.Tracked(owned.JobID, r.jobLabel, containerID, reason, labels)
+	}
+}
+
+// Observe attributes a newly created container to the tracked job that owns it, if any.
+//
+// Parameters:
+// - containerID: The ID of the created container.
+// - labels: The labels of the created container.
+//
+// Returns:
+// - string: The job ID the container was attributed to.
+// - bool: True if a tracked job owns the container.
+func (r *Registry) Observe(containerID string, labels map[string]string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for jobID, owned := range r.jobs {
+		if reason, ok := owned.labelReason(labels); ok {
+			r.record(owned, containerID, reason, labels)
+			return jobID, true
+		}
+	}
+	return "", false
+}
+
+// ObserveImage attributes an image built or tagged while jobs are running to the job that owns
+// it: the job whose ID or Compose project it is labeled with or, when a single job is running,
+// that job. An unlabeled image is only attributed whole to the single running job if it was
+// created after the job started; otherwise only the tag is, so that retagging a base image never
+// removes it. Images built or tagged while several unlabeled jobs run are left alone, since they
+// cannot be attributed safely.
+//
+// Parameters:
+// - imageID: The ID of the image.
+// - tag: The tag added to the image, empty if unknown.
+// - created: When the image was created, zero if unknown.
+// - labels: The labels of the image.
+//
+// Returns:
+// - string: The job ID the image or tag was attributed to.
+// - bool: True if a tracked job owns the image or tag.
+func (r *Registry) ObserveImage(imageID, tag string, created time.Time, labels map[string]string) (string, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for jobID, owned := range r.jobs {
+		if reason, ok := owned.labelReason(labels); ok {
+			r.recordImage(owned, imageID, reason)
+			return jobID, true
+		}
+	}
+	if len(r.jobs) != 1 {
+		return "", false
+	}
+	for jobID, owned := range r.jobs {
+		// Image creation times only have a second resolution
+		if !created.IsZero() && created.Unix() > r.started[jobID].Unix() {
+			r.recordImage(owned, imageID, "built while the job was running")
+			return jobID, true
+		}
+		if tag == "" {
+			return "", false
+		}
+		owned.ImageTags[tag] = "tagged while the job was running"
+		if r.journal != nil {
+			r.journal.TrackedImageTag(jobID, r.jobLabel, tag, owned.ImageTags[tag])
+		}
+		return jobID, true
+	}
+	return "", false
+}
+
+// recordImage adds the image to the resources of a tracked job and to the journal.
+func (r *Registry) recordImage(owned *Resources, imageID, reason string) {
+	owned.Images[imageID] = reason
+	if r.journal != nil {
+		r.journal.TrackedImage(owned.JobID, r.jobLabel, imageID, reason)
+	}
+}
+
+// RestoreImages records the images and image tags of a job tracked by a previous run of the
+// watcher. The job must be tracked again with Restore first.
+//
+// Parameters:
+// - owned: The resources recorded for the job.
+func (r *Registry) RestoreImages(owned *Resources) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	tracked, exists := r.jobs[owned.JobID]
+	if !exists {
+		return
+	}
+	for imageID, reason := range owned.Images {
+		tracked.Images[imageID] = reason
+	}
+	for tag, reason := range owned.ImageTags {
+		tracked.ImageTags[tag] = reason
+	}
+}
+
+// Resources returns a copy of the resources recorded for the job. A job that was never
+// tracked yields an empty set that only label-based ownership can extend.
+func (r *Registry) Resources(jobID string) *Resources {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if owned, exists := r.jobs[jobID]; exists {
+		return owned.Clone()
+	}
+	return r.newResources(jobID)
+}
+
+// Tracks reports whether the registry records resources for the job, which is still running or
+// about to be cleaned up.
+func (r *Registry) Tracks(jobID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, exists := r.jobs[jobID]
+	return exists
+}
+
+// newResources returns an empty resource set for the job, labeled like the registry's jobs.
+func (r *Registry) newResources(jobID string) *Resources {
+	owned := NewResources(jobID)
+	owned.JobLabel = r.jobLabel
+	return owned
+}
+
+// Finish marks the container as finished and reports whether it was not finished before, so the
+// die, kill and destroy events of the same container trigger a single cleanup.
+func (r *Registry) Finish(containerID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := time.Now()
+	for id, finishedAt := range r.finished {
+		if now.Sub(finishedAt) > finishedTTL {
+			delete(r.finished, id)
+		}
+	}
+
+	if _, exists := r.finished[containerID]; exists {
+		return false
+	}
+	r.finished[containerID] = now
+	return true
+}
+
+// Forget drops the resources recorded for the job once it has been cleaned up.
+func (r *Registry) Forget(jobID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	delete(r.jobs, jobID)
+	delete(r.started, jobID)
+	delete(r.pending, jobID)
+}
@@ -0,0 +1,216 @@
+package cleanup
+
+import (
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/volume"
+	"gotest.tools/v3/assert"
+)
+
+// TestClaimLeavesUnrelatedResources checks that only resources created by or for the job are
+// claimed, while unrelated databases, networks and volumes on a shared host survive.
+func TestClaimLeavesUnrelatedResources(t *testing.T) {
+	owned := NewResources("1234")
+	owned.AddContainer("job", "job container", map[string]string{"com.docker.compose.project": "ci-1234"})
+
+	containers := []types.Container{
+		{ID: "job", Names: []string{"/runner-abc-project-1-concurrent-0-build"}, Labels: map[string]string{"com.docker.compose.project": "ci-1234"}, Mounts: []types.MountPoint{{Name: "anon"}}},
+		{ID: "db", Names: []string{"/postgres"}, Labels: map[string]string{"com.docker.compose.project": "shared"}, Mounts: []types.MountPoint{{Name: "pgdata"}}},
+		{ID: "app", Names: []string{"/ci-1234-app-1"}, Labels: map[string]string{"com.docker.compose.project": "ci-1234"}},
+		{ID: "labeled", Names: []string{"/labeled"}, Labels: map[string]string{"com.github.ci.job.id": "1234"}},
+		{ID: "other-job", Names: []string{"/other"}, Labels: map[string]string{"com.github.ci.job.id": "5678"}},
+	}
+	networks := []network.Summary{
+		{ID: "n1", Name: "bridge"},
+		{ID: "n2", Name: "shared_default", Labels: map[string]string{"com.docker.compose.project": "shared"}},
+		{ID: "n3", Name: "ci-1234_default", Labels: map[string]string{"com.docker.compose.project": "ci-1234"}},
+	}
+	volumes := []*volume.Volume{
+		{Name: "pgdata", Labels: map[string]string{"com.docker.compose.project": "shared"}},
+		{Name: "anon", Labels: map[string]string{"com.docker.volume.anonymous": ""}},
+		{Name: "cache", Labels: map[string]string{"com.github.ci.job.id": "1234"}},
+		{Name: "unused-anon", Labels: map[string]string{"com.docker.volume.anonymous": ""}},
+	}
+	services := []swarm.Service{
+		{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "monitoring"}}},
+		{ID: "s3", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "job-1234-web"}}},
+		{ID: "s2", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "svc", Labels: map[string]string{"com.github.ci.job.id": "1234"}}}},
+	}
+
+	owned.Claim(containers, networks, volumes, services, nil)
+
+	assert.DeepEqual(t, owned.Containers, map[string]string{
+		"job":     "job container",
+		"app":     "compose project ci-1234 started by the job",
+		"labeled": "label com.github.ci.job.id=1234",
+	})
+	assert.DeepEqual(t, owned.Networks, map[string]string{"ci-1234_default": "compose project ci-1234 started by the job"})
+	assert.DeepEqual(t, owned.Volumes, map[string]string{
+		"anon":  "anonymous volume of a job container",
+		"cache": "label com.github.ci.job.id=1234",
+	})
+	assert.DeepEqual(t, owned.Services, map[string]string{"s2": "label com.github.ci.job.id=1234"})
+}
+
+func TestOwnsLabels(t *testing.T) {
+	owned := NewResources("1234")
+	owned.AddContainer("job", "job container", map[string]string{"com.docker.compose.project": "example"})
+
+	testCases := []struct {
+		name     string
+		labels   map[string]string
+		expected bool
+	}{
+		{
+			name:     "Labeled with the job ID",
+			labels:   map[string]string{"com.github.ci.job.id": "1234"},
+			expected: true,
+		},
+		{
+			name:     "Compose project started by the job",
+			labels:   map[string]string{"com.docker.compose.project": "example"},
+			expected: true,
+		},
+		{
+			name:     "Labeled with another job ID",
+			labels:   map[string]string{"com.github.ci.job.id": "5678"},
+			expected: false,
+		},
+		{
+			name:     "Unrelated Compose project",
+			labels:   map[string]string{"com.docker.compose.project": "database"},
+			expected: false,
+		},
+		{
+			name:     "No labels",
+			labels:   nil,
+			expected: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Equal(t, tc.expected, owned.OwnsLabels(tc.labels))
+		})
+	}
+}
+
+func TestRegistry(t *testing.T) {
+	registry := NewRegistry(JobLabel, nil)
+	registry.Track("1234", "job", map[string]string{"com.docker.compose.project": "example"})
+
+	jobID, ok := registry.Observe("sidecar", map[string]string{"com.docker.compose.project": "example"})
+	assert.Assert(t, ok)
+	assert.Equal(t, "1234", jobID)
+
+	_, ok = registry.Observe("database", map[string]string{"com.docker.compose.project": "shared"})
+	assert.Assert(t, !ok)
+
+	owned := registry.Resources("1234")
+	assert.DeepEqual(t, owned.Containers, map[string]string{
+		"job":     "job container",
+		"sidecar": "compose project example started by the job",
+	})
+
+	// The returned set is a copy
+	owned.Containers["database"] = "added by the test"
+	assert.Assert(t, !registry.Resources("1234").HasContainer("database"))
+
+	registry.Forget("1234")
+	assert.Assert(t, registry.Resources("1234").Empty())
+}
+
+// TestRegistryHoldsContainersOfUntrackedJobs checks that the containers created for a job are
+// only tracked and journaled once the job container starts, so that jobs matching no pattern
+// are never tracked.
+func TestRegistryHoldsContainersOfUntrackedJobs(t *testing.T) {
+	journal := &recordingJournal{}
+	registry := NewRegistry(JobLabel, journal)
+
+	registry.Add("1234", "service", "created for the job", nil)
+	registry.Add("lint", "lint", "created for the job", nil)
+	assert.Assert(t, !registry.Tracks("1234"))
+	assert.Assert(t, !registry.Tracks("lint"))
+	assert.Assert(t, registry.Resources("1234").Empty())
+	assert.Equal(t, len(journal.calls), 0)
+
+	registry.Track("1234", "job", nil)
+	assert.Assert(t, registry.Tracks("1234"))
+	assert.DeepEqual(t, registry.Resources("1234").Containers, map[string]string{
+		"job":     "job container",
+		"service": "created for the job",
+	})
+	assert.DeepEqual(t, journal.calls, []string{"tracked 1234 job", "tracked 1234 service"})
+
+	// Images are still attributed to the only tracked job
+	jobID, ok := registry.ObserveImage("sha256:built", "app:ci", time.Now().Add(time.Minute), nil)
+	assert.Assert(t, ok)
+	assert.Equal(t, "1234", jobID)
+
+	// A container created once the job is tracked is recorded right away
+	registry.Add("1234", "helper", "created for the job", nil)
+	assert.Assert(t, registry.Resources("1234").HasContainer("helper"))
+
+	// Forgetting a job drops the containers held for it
+	registry.Forget("lint")
+	registry.Track("lint", "lint-job", nil)
+	assert.Assert(t, !registry.Resources("lint").HasContainer("lint"))
+}
+
+func TestRegistryFinish(t *testing.T) {
+	registry := NewRegistry(JobLabel, nil)
+
+	// The die, kill and destroy events of a container trigger a single cleanup
+	assert.Assert(t, registry.Finish("job"))
+	assert.Assert(t, !registry.Finish("job"))
+
+	// Finished containers are remembered after the job is forgotten
+	registry.Forget("job")
+	assert.Assert(t, !registry.Finish("job"))
+	assert.Assert(t, registry.Finish("other"))
+}
+
+func TestRegistryObserveImage(t *testing.T) {
+	registry := NewRegistry(JobLabel, nil)
+	later := time.Now().Add(time.Minute)
+
+	_, ok := registry.ObserveImage("sha256:idle", "idle:ci", later, nil)
+	assert.Assert(t, !ok, "no job is running")
+
+	registry.Track("1234", "job", map[string]string{"com.docker.compose.project": "example"})
+	jobID, ok := registry.ObserveImage("sha256:single", "app:ci", later, nil)
+	assert.Assert(t, ok)
+	assert.Equal(t, "1234", jobID)
+
+	// Only the tag of an image created before the job started is attributed to it
+	jobID, ok = registry.ObserveImage("sha256:base", "myreg/alpine:ci", time.Now().Add(-time.Hour), nil)
+	assert.Assert(t, ok)
+	assert.Equal(t, "1234", jobID)
+	_, ok = registry.ObserveImage("sha256:unknown", "", time.Time{}, nil)
+	assert.Assert(t, !ok, "neither the image nor the tag can be attributed")
+
+	registry.Track("5678", "other", nil)
+	_, ok = registry.ObserveImage("sha256:ambiguous", "ambiguous:ci", later, nil)
+	assert.Assert(t, !ok, "several jobs are running")
+
+	jobID, ok = registry.ObserveImage("sha256:labeled", "", time.Time{}, map[string]string{JobLabel: "5678"})
+	assert.Assert(t, ok)
+	assert.Equal(t, "5678", jobID)
+
+	jobID, ok = registry.ObserveImage("sha256:compose", "", time.Time{}, map[string]string{"com.docker.compose.project": "example"})
+	assert.Assert(t, ok)
+	assert.Equal(t, "1234", jobID)
+
+	assert.DeepEqual(t, registry.Resources("1234").Images, map[string]string{
+		"sha256:single":  "built while the job was running",
+		"sha256:compose": "compose project example started by the job",
+	})
+	assert.DeepEqual(t, registry.Resources("1234").ImageTags, map[string]string{
+		"myreg/alpine:ci": "tagged while the job was running",
+	})
+	assert.Equal(t, len(registry.Resources("5678").Images), 1)
+}
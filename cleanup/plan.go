@@ -0,0 +1,285 @@
+package cleanup
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/volume"
+	"job-detection.is/github-gitlab/dockerapi"
+)
+
+// PlanItem is a single resource the cleanup will act on.
+type PlanItem struct {
+	ID     string            `json:"id"`
+	Name   string            `json:"name"`
+	Reason string            `json:"reason"`
+	Image  string            `json:"image,omitempty"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+// Plan lists every resource the cleanup of a job will stop or remove, with the reason each one
+// was attributed to the job. The executor acts on exactly this list.
+type Plan struct {
+	JobID            string     `json:"jobId"`
+	StopContainers   []PlanItem `json:"stopContainers"`
+	RemoveContainers []PlanItem `json:"removeContainers"`
+	Networks         []PlanItem `json:"networks"`
+	Volumes          []PlanItem `json:"volumes"`
+	Services         []PlanItem `json:"services"`
+	Images           []PlanItem `json:"images"`
+	// ImageTags lists the tags the job added to images it did not build, named by tag.
+	ImageTags []PlanItem `json:"imageTags"`
+}
+
+// Empty reports whether the plan has nothing to stop or remove.
+func (p *Plan) Empty() bool {
+	return len(p.StopContainers) == 0 && len(p.RemoveContainers) == 0 &&
+		len(p.Networks) == 0 && len(p.Volumes) == 0 && len(p.Services) == 0 &&
+		len(p.Images) == 0 && len(p.ImageTags) == 0
+}
+
+// Only returns the plan restricted to the kinds of resources cleaned up with the options.
+func (p *Plan) Only(opts Options) *Plan {
+	only := &Plan{JobID: p.JobID}
+	if opts.Cleans(KindContainers) {
+		only.StopContainers = p.StopContainers
+		only.RemoveContainers = p.RemoveContainers
+	}
+	if opts.Cleans(KindNetworks) {
+		only.Networks = p.Networks
+	}
+	if opts.Cleans(KindVolumes) {
+		only.Volumes = p.Volumes
+	}
+	if opts.Cleans(KindServices) {
+		only.Services = p.Services
+	}
+	if opts.Cleans(KindImages) {
+		only.Images = p.Images
+		only.ImageTags = p.ImageTags
+	}
+	return only
+}
+
+// Resources returns the resources of the plan, so that a cleanup of the job resumed from them
+// acts on the same resources.
+//
+// Parameters:
+// - jobLabel: The label carrying the job ID on the resources of the job.
+//
+// Returns:
+// - *Resources: The resources of the plan, each with its reason.
+func (p *Plan) Resources(jobLabel string) *Resources {
+	owned := NewResources(p.JobID)
+	owned.JobLabel = jobLabel
+	for _, item := range p.RemoveContainers {
+		owned.Containers[item.ID] = item.Reason
+	}
+	for _, item := range p.Networks {
+		owned.Networks[item.Name] = item.Reason
+	}
+	for _, item := range p.Volumes {
+		owned.Volumes[item.Name] = item.Reason
+	}
+	for _, item := range p.Services {
+		owned.Services[item.ID] = item.Reason
+	}
+	for _, item := range p.Images {
+		owned.Images[item.ID] = item.Reason
+	}
+	for _, item := range p.ImageTags {
+		owned.ImageTags[item.Name] = item.Reason
+	}
+	return owned
+}
+
+// WriteText writes a human readable rendering of the plan.
+func (p *Plan) WriteText(w io.Writer) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Cleanup plan for job %s:\n", p.JobID)
+
+	if p.Empty() {
+		b.WriteString("  Nothing to clean up.\n")
+	}
+
+	for _, section := range []struct {
+		title string
+		items []PlanItem
+	}{
+		{"Stop containers", p.StopContainers},
+		{"Remove containers", p.RemoveContainers},
+		{"Remove networks", p.Networks},
+		{"Remove volumes", p.Volumes},
+		{"Remove services", p.Services},
+		{"Remove images", p.Images},
+		{"Remove image tags", p.ImageTags},
+	} {
+		if len(section.items) == 0 {
+			continue
+		}
+		fmt.Fprintf(&b, "  %s:\n", section.title)
+		for _, item := range section.items {
+			if item.Name != "" && item.Name != item.ID {
+				fmt.Fprintf(&b, "    - %s (%s): %s\n", item.Name, item.ID, item.Reason)
+			} else {
+				fmt.Fprintf(&b, "    - %s: %s\n", item.ID, item.Reason)
+			}
+		}
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// NewPlan claims the listed resources owned by the job and returns the plan to clean them up.
+//
+// Parameters:
+// - owned: The resources recorded for the job.
+// - containers: All containers known to the daemon.
+// - networks: All networks known to the daemon.
+// - volumes: All volumes known to the daemon.
+// - services: All services known to the daemon.
+// - images: All images known to the daemon.
+//
+// Returns:
+// - *Plan: The resources to stop and remove.
+func NewPlan(owned *Resources, containers []types.Container, networks []network.Summary, volumes []*volume.Volume, services []swarm.Service, images []image.Summary) *Plan {
+	owned.Claim(containers, networks, volumes, services, images)
+
+	plan := &Plan{JobID: owned.JobID}
+
+	for _, container := range containers {
+		reason, exists := owned.Containers[container.ID]
+		if !exists {
+			continue
+		}
+
+		item := PlanItem{ID: container.ID, Reason: reason, Image: container.Image, Labels: container.Labels}
+		if len(container.Names) > 0 {
+			item.Name = strings.TrimPrefix(container.Names[0], "/")
+		}
+		if container.State == "running" {
+			plan.StopContainers = append(plan.StopContainers, item)
+		}
+		plan.RemoveContainers = append(plan.RemoveContainers, item)
+	}
+
+	for _, network := range networks {
+		if reason, exists := owned.Networks[network.Name]; exists {
+			plan.Networks = append(plan.Networks, PlanItem{ID: network.ID, Name: network.Name, Reason: reason, Labels: network.Labels})
+		}
+	}
+
+	for _, volume := range volumes {
+		if volume == nil {
+			continue
+		}
+		if reason, exists := owned.Volumes[volume.Name]; exists {
+			plan.Volumes = append(plan.Volumes, PlanItem{ID: volume.Name, Name: volume.Name, Reason: reason, Labels: volume.Labels})
+		}
+	}
+
+	for _, service := range services {
+		if reason, exists := owned.Services[service.ID]; exists {
+			item := PlanItem{ID: service.ID, Name: service.Spec.Name, Reason: reason, Labels: service.Spec.Labels}
+			if spec := service.Spec.TaskTemplate.ContainerSpec; spec != nil {
+				item.Image = spec.Image
+			}
+			plan.Services = append(plan.Services, item)
+		}
+	}
+
+	for _, img := range images {
+		if reason, exists := owned.Images[img.ID]; exists {
+			name := img.ID
+			if len(img.RepoTags) > 0 {
+				name = img.RepoTags[0]
+			}
+			plan.Images = append(plan.Images, PlanItem{ID: img.ID, Name: name, Reason: reason, Image: name, Labels: img.Labels})
+			continue
+		}
+		for _, tag := range img.RepoTags {
+			if reason, exists := owned.ImageTags[tag]; exists {
+				plan.ImageTags = append(plan.ImageTags, PlanItem{ID: img.ID, Name: tag, Reason: reason, Image: tag, Labels: img.Labels})
+			}
+		}
+	}
+
+	return plan
+}
+
+// Inventory holds every resource known to the daemon.
+type Inventory struct {
+	Containers []types.Container
+	Networks   []network.Summary
+	Volumes    []*volume.Volume
+	Services   []swarm.Service
+	Images     []image.Summary
+}
+
+// ListResources lists every container, network, volume, service and image known to the daemon.
+// Services are left out when the daemon is not part of a swarm.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+//
+// Returns:
+// - *Inventory: The resources known to the daemon.
+// - error: An error if the containers, networks, volumes or images could not be listed.
+func ListResources(cli dockerapi.Client, ctx context.Context) (*Inventory, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	networks, err := cli.NetworkList(ctx, network.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list networks: %w", err)
+	}
+
+	volumes, err := cli.VolumeList(ctx, volume.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %w", err)
+	}
+
+	// Services are only available when the daemon is part of a swarm
+	services, err := cli.ServiceList(ctx, types.ServiceListOptions{})
+	if err != nil {
+		Logger().Debug("Skipping services", LogResourceKind, KindServices, ErrorAttr(err))
+		services = nil
+	}
+
+	images, err := cli.ImageList(ctx, image.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %w", err)
+	}
+
+	return &Inventory{Containers: containers, Networks: networks, Volumes: volumes.Volumes, Services: services, Images: images}, nil
+}
+
+// BuildPlan lists the resources known to the daemon and returns the plan to clean up those
+// owned by the job, without stopping or removing anything.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - owned: The resources recorded for the job.
+//
+// Returns:
+// - *Plan: The resources to stop and remove.
+// - error: An error if any resource could not be listed.
+func BuildPlan(cli dockerapi.Client, ctx context.Context, owned *Resources) (*Plan, error) {
+	inventory, err := ListResources(cli, ctx)
+	if err != nil {
+		return nil, err
+	}
+	return NewPlan(owned, inventory.Containers, inventory.Networks, inventory.Volumes, inventory.Services, inventory.Images), nil
+}
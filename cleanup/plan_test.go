@@ -0,0 +1,86 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/volume"
+	"gotest.tools/v3/assert"
+)
+
+func TestNewPlan(t *testing.T) {
+	compose := map[string]string{"com.docker.compose.project": "ci-1234"}
+	owned := NewResources("1234")
+	owned.AddContainer("job", "job container", compose)
+
+	containers := []types.Container{
+		{ID: "job", Names: []string{"/runner-build"}, State: "exited", Labels: compose},
+		{ID: "svc", Names: []string{"/ci-1234-db-1"}, State: "running", Labels: compose},
+		{ID: "other", Names: []string{"/postgres"}, State: "running"},
+	}
+	networks := []network.Summary{
+		{ID: "n1", Name: "bridge"},
+		{ID: "n2", Name: "ci-1234_default", Labels: compose},
+	}
+	volumes := []*volume.Volume{
+		{Name: "pgdata"},
+	}
+	services := []swarm.Service{
+		{ID: "s1", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "job-1234-web", Labels: map[string]string{"com.github.ci.job.id": "1234"}}}},
+		{ID: "s2", Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: "job-12345-web"}}},
+	}
+
+	plan := NewPlan(owned, containers, networks, volumes, services, nil)
+
+	assert.DeepEqual(t, plan, &Plan{
+		JobID: "1234",
+		StopContainers: []PlanItem{
+			{ID: "svc", Name: "ci-1234-db-1", Reason: "compose project ci-1234 started by the job", Labels: compose},
+		},
+		RemoveContainers: []PlanItem{
+			{ID: "job", Name: "runner-build", Reason: "job container", Labels: compose},
+			{ID: "svc", Name: "ci-1234-db-1", Reason: "compose project ci-1234 started by the job", Labels: compose},
+		},
+		Networks: []PlanItem{
+			{ID: "n2", Name: "ci-1234_default", Reason: "compose project ci-1234 started by the job", Labels: compose},
+		},
+		Services: []PlanItem{
+			{ID: "s1", Name: "job-1234-web", Reason: "label com.github.ci.job.id=1234", Labels: map[string]string{"com.github.ci.job.id": "1234"}},
+		},
+	})
+}
+
+func TestPlanOutput(t *testing.T) {
+	plan := &Plan{
+		JobID: "1234",
+		RemoveContainers: []PlanItem{
+			{ID: "abc", Name: "runner-build", Reason: "job container"},
+		},
+		Volumes: []PlanItem{
+			{ID: "cache", Name: "cache", Reason: "label com.github.ci.job.id=1234"},
+		},
+	}
+
+	var text strings.Builder
+	assert.NilError(t, plan.WriteText(&text))
+	assert.Equal(t, text.String(), "Cleanup plan for job 1234:\n"+
+		"  Remove containers:\n"+
+		"    - runner-build (abc): job container\n"+
+		"  Remove volumes:\n"+
+		"    - cache: label com.github.ci.job.id=1234\n")
+
+	empty := &Plan{JobID: "1234"}
+	text.Reset()
+	assert.NilError(t, empty.WriteText(&text))
+	assert.Equal(t, text.String(), "Cleanup plan for job 1234:\n  Nothing to clean up.\n")
+
+	data, err := json.Marshal(plan)
+	assert.NilError(t, err)
+	var decoded Plan
+	assert.NilError(t, json.Unmarshal(data, &decoded))
+	assert.DeepEqual(t, &decoded, plan)
+}
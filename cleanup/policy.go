@@ -0,0 +1,174 @@
+package cleanup
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// Kind is a kind of Docker resource the cleanup can remove.
+type Kind string
+
+const (
+	KindContainers Kind = "containers"
+	KindNetworks   Kind = "networks"
+	KindVolumes    Kind = "volumes"
+	KindServices   Kind = "services"
+	KindImages     Kind = "images"
+
+	// KindBuildCache is the build cache of the daemon. It is never cleaned up per job, only
+	// pruned when the disk runs low, so it is not listed in Kinds.
+	KindBuildCache Kind = "buildcache"
+)
+
+// Kinds lists every kind of resource the cleanup can remove.
+var Kinds = []Kind{KindContainers, KindNetworks, KindVolumes, KindServices, KindImages}
+
+// Duration is a time.Duration written in configuration files as a string such as "10s" or "1m30s".
+type Duration time.Duration
+
+// UnmarshalJSON parses a duration string.
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("duration must be a string such as \"10s\": %s", data)
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(parsed)
+	return nil
+}
+
+// MarshalJSON writes the duration as a string.
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+// Policy overrides the options used to clean up the jobs matching a pattern. Fields that are
+// not set keep the value of the options the policy is applied to.
+type Policy struct {
+	// GraceDelay is the time to wait before cleaning up, so the job's after_script can complete.
+	GraceDelay *Duration `json:"graceDelay,omitempty"`
+
+	// StopTimeout is the time running containers get to stop before they are killed.
+	StopTimeout *Duration `json:"stopTimeout,omitempty"`
+
+	// ContainerRetries is the number of attempts at stopping and removing containers.
+	ContainerRetries *int `json:"containerRetries,omitempty"`
+
+	// RemoveRetries is the number of attempts at removing networks and volumes.
+	RemoveRetries *int `json:"removeRetries,omitempty"`
+
+	// RetryDelay is the time to wait between attempts at removing networks and volumes.
+	RetryDelay *Duration `json:"retryDelay,omitempty"`
+
+	// Resources lists the kinds of resources to clean up.
+	Resources []Kind `json:"resources,omitempty"`
+
+	// KeepOnFailure leaves every resource of a job whose container exited with a non-zero code,
+	// so the failure can be investigated.
+	KeepOnFailure *bool `json:"keepOnFailure,omitempty"`
+
+	// Protection lists the resources never stopped or removed. It is set from the protection
+	// rules of the configuration rather than per pattern.
+	Protection *Protection `json:"-"`
+}
+
+// Validate checks that the durations and retry counts are positive and that the resource kinds
+// are known.
+//
+// Returns:
+// - error: An error naming the first invalid field.
+func (p Policy) Validate() error {
+	for name, d := range map[string]*Duration{"graceDelay": p.GraceDelay, "stopTimeout": p.StopTimeout, "retryDelay": p.RetryDelay} {
+		if d != nil && *d < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	for name, retries := range map[string]*int{"containerRetries": p.ContainerRetries, "removeRetries": p.RemoveRetries} {
+		if retries != nil && *retries < 1 {
+			return fmt.Errorf("%s must be at least 1", name)
+		}
+	}
+
+	if p.Resources != nil && len(p.Resources) == 0 {
+		return errors.New("resources must list at least one kind, use keepOnFailure or remove the pattern to clean up nothing")
+	}
+	for _, kind := range p.Resources {
+		if !kind.valid() {
+			return fmt.Errorf("unknown resource kind %q, expected one of %v", kind, Kinds)
+		}
+	}
+	return nil
+}
+
+// Merge returns the policy with the fields set in override replacing its own.
+func (p Policy) Merge(override Policy) Policy {
+	if override.GraceDelay != nil {
+		p.GraceDelay = override.GraceDelay
+	}
+	if override.StopTimeout != nil {
+		p.StopTimeout = override.StopTimeout
+	}
+	if override.ContainerRetries != nil {
+		p.ContainerRetries = override.ContainerRetries
+	}
+	if override.RemoveRetries != nil {
+		p.RemoveRetries = override.RemoveRetries
+	}
+	if override.RetryDelay != nil {
+		p.RetryDelay = override.RetryDelay
+	}
+	if override.Resources != nil {
+		p.Resources = override.Resources
+	}
+	if override.KeepOnFailure != nil {
+		p.KeepOnFailure = override.KeepOnFailure
+	}
+	if override.Protection != nil {
+		p.Protection = override.Protection
+	}
+	return p
+}
+
+// Apply returns the options with the fields set in the policy replacing their values.
+func (p Policy) Apply(opts Options) Options {
+	if p.GraceDelay != nil {
+		opts.Delay = time.Duration(*p.GraceDelay)
+	}
+	if p.StopTimeout != nil {
+		opts.StopTimeout = time.Duration(*p.StopTimeout)
+	}
+	if p.ContainerRetries != nil {
+		opts.ContainerRetries = *p.ContainerRetries
+	}
+	if p.RemoveRetries != nil {
+		opts.RemoveRetries = *p.RemoveRetries
+	}
+	if p.RetryDelay != nil {
+		opts.RetryDelay = time.Duration(*p.RetryDelay)
+	}
+	if p.Resources != nil {
+		opts.Kinds = append([]Kind(nil), p.Resources...)
+	}
+	if p.KeepOnFailure != nil {
+		opts.KeepOnFailure = *p.KeepOnFailure
+	}
+	if p.Protection != nil {
+		opts.Protection = p.Protection
+	}
+	return opts
+}
+
+// valid reports whether the kind is known.
+func (k Kind) valid() bool {
+	for _, kind := range Kinds {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,110 @@
+package cleanup
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"gotest.tools/v3/assert"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	negative := Duration(-time.Second)
+	zero := 0
+	testCases := []struct {
+		name   string
+		policy Policy
+		err    string
+	}{
+		{name: "Empty policy", policy: Policy{}},
+		{name: "Known kinds", policy: Policy{Resources: []Kind{KindContainers, KindImages}}},
+		{name: "Negative duration", policy: Policy{GraceDelay: &negative}, err: "graceDelay must not be negative"},
+		{name: "No retries", policy: Policy{RemoveRetries: &zero}, err: "removeRetries must be at least 1"},
+		{name: "No kinds", policy: Policy{Resources: []Kind{}}, err: "resources must list at least one kind"},
+		{name: "Unknown kind", policy: Policy{Resources: []Kind{"pods"}}, err: `unknown resource kind "pods"`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.policy.Validate()
+			if tc.err == "" {
+				assert.NilError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestPolicyMergeAndApply(t *testing.T) {
+	grace := Duration(time.Minute)
+	stop := Duration(30 * time.Second)
+	retries := 5
+	keep := true
+
+	defaults := Policy{GraceDelay: &grace, Resources: []Kind{KindContainers, KindNetworks}}
+	policy := defaults.Merge(Policy{StopTimeout: &stop, ContainerRetries: &retries, KeepOnFailure: &keep})
+
+	opts := policy.Apply(DefaultOptions())
+	assert.Equal(t, opts.Delay, time.Minute)
+	assert.Equal(t, opts.StopTimeout, 30*time.Second)
+	assert.Equal(t, opts.ContainerRetries, 5)
+	assert.Equal(t, opts.RemoveRetries, DefaultOptions().RemoveRetries)
+	assert.Assert(t, opts.KeepOnFailure)
+	assert.Assert(t, opts.Cleans(KindNetworks))
+	assert.Assert(t, !opts.Cleans(KindVolumes))
+	assert.Assert(t, DefaultOptions().Cleans(KindVolumes))
+}
+
+// TestCleanUpHonorsPolicy checks that only the kinds of resources of the policy are removed, and
+// that nothing is removed for a failed job kept for inspection.
+func TestCleanUpHonorsPolicy(t *testing.T) {
+	keep := true
+	testCases := []struct {
+		name          string
+		policy        Policy
+		failed        bool
+		keptContainer bool
+		keptVolume    bool
+	}{
+		{name: "Default policy", policy: Policy{}},
+		{name: "Containers only", policy: Policy{Resources: []Kind{KindContainers}}, keptVolume: true},
+		{name: "Failed job kept", policy: Policy{KeepOnFailure: &keep}, failed: true, keptContainer: true, keptVolume: true},
+		{name: "Successful job not kept", policy: Policy{KeepOnFailure: &keep}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			daemon := fake.NewDaemon()
+			labels := map[string]string{JobLabel: "1234"}
+			daemon.AddVolume("job-volume", labels)
+			job := daemon.CreateContainer(fake.ContainerSpec{Name: "job", Labels: labels})
+			assert.NilError(t, daemon.StartContainer(job))
+			assert.NilError(t, daemon.ExitContainer(job, 1))
+
+			owned := NewResources("1234")
+			owned.Failed = tc.failed
+			CleanUp(daemon, context.Background(), owned, tc.policy.Apply(testOptions()))
+
+			assert.Equal(t, daemon.HasContainer(job), tc.keptContainer)
+			assert.Equal(t, daemon.HasVolume("job-volume"), tc.keptVolume)
+		})
+	}
+}
+
+func TestPlanOnly(t *testing.T) {
+	daemon := fake.NewDaemon()
+	labels := map[string]string{JobLabel: "1234"}
+	daemon.AddNetwork("job-network", labels)
+	daemon.AddVolume("job-volume", labels)
+	daemon.CreateContainer(fake.ContainerSpec{Name: "job", Labels: labels, Networks: []string{"job-network"}})
+
+	plan, err := BuildPlan(daemon, context.Background(), NewResources("1234"))
+	assert.NilError(t, err)
+
+	only := plan.Only(Options{Kinds: []Kind{KindNetworks}})
+	assert.Equal(t, len(only.RemoveContainers), 0)
+	assert.Equal(t, len(only.Networks), 1)
+	assert.Equal(t, len(only.Volumes), 0)
+}
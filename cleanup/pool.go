@@ -0,0 +1,310 @@
+package cleanup
+
+import (
+	"context"
+	"sync"
+
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/tracing"
+)
+
+// poolEntry is a job known to the pool, either waiting for a worker or being cleaned up.
+type poolEntry struct {
+	// owned holds the resources to clean up on the next run, nil if none is scheduled.
+	owned *Resources
+
+	// plan holds the orphaned resources to collect on the next run instead, nil if none is
+	// scheduled.
+	plan *Plan
+
+	policy  Policy
+	running bool
+}
+
+// Pool cleans up jobs on a bounded number of workers. Jobs are cleaned up in parallel, but a job
+// is never cleaned up by two workers at once: submitting a job that is already waiting merges the
+// resources into the waiting run, and submitting a job being cleaned up schedules another run
+// once the current one is over. It is safe for concurrent use.
+type Pool struct {
+	cli     dockerapi.Client
+	opts    Options
+	journal Journal
+
+	// ctx is the context of the cleanups, canceled when Shutdown gives up waiting for them.
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mu        sync.Mutex
+	cond      *sync.Cond
+	ready     []string
+	jobs      map[string]*poolEntry
+	attempts  map[string]int
+	closed    bool
+	starters  []func(jobID string, opts Options)
+	reporters []func(*Report)
+	wg        sync.WaitGroup
+}
+
+// NewPool starts a pool of workers cleaning up jobs with the given options.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - workers: The maximum number of jobs cleaned up in parallel.
+// - opts: Options controlling the cleanup.
+// - journal: Records the cleanups requested and completed across restarts, nil to keep them in
+// memory only.
+//
+// Returns:
+// - *Pool: The started pool.
+func NewPool(cli dockerapi.Client, workers int, opts Options, journal Journal) *Pool {
+	if workers < 1 {
+		workers = 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &Pool{
+		ctx:      ctx,
+		cancel:   cancel,
+		cli:      cli,
+		opts:     opts,
+		journal:  journal,
+		jobs:     make(map[string]*poolEntry),
+		attempts: make(map[string]int),
+	}
+	p.cond = sync.NewCond(&p.mu)
+
+	p.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go p.work()
+	}
+	return p
+}
+
+// Submit schedules the cleanup of the job's resources. The policy is applied to the pool's
+// options; when the job is already scheduled, the latest policy wins. The request is recorded
+// in the journal even when the pool is shutting down, so the cleanup resumes after a restart.
+//
+// Parameters:
+// - owned: The resources owned by the job.
+// - policy: The cleanup policy of the pattern that matched the job.
+//
+// Returns:
+// - bool: False if the pool is shutting down and the job was not scheduled.
+func (p *Pool) Submit(owned *Resources, policy Policy) bool {
+	if p.journal != nil {
+		p.journal.Submitted(owned, policy)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return false
+	}
+
+	entry, exists := p.jobs[owned.JobID]
+	switch {
+	case !exists:
+		p.jobs[owned.JobID] = &poolEntry{owned: owned.Clone(), policy: policy}
+		p.ready = append(p.ready, owned.JobID)
+		p.cond.Signal()
+	case entry.owned != nil:
+		p.opts.logger().Debug("Cleanup already scheduled, merging resources", LogJobID, owned.JobID)
+		entry.owned.Merge(owned)
+		entry.policy = policy
+	case !entry.running:
+		// The cleanup of the job claims the resources of the plan waiting for a worker
+		p.opts.logger().Debug("Plan already scheduled, replacing it with the cleanup", LogJobID, owned.JobID)
+		entry.owned = owned.Clone()
+		entry.plan = nil
+		entry.policy = policy
+	default:
+		p.opts.logger().Info("Cleanup in progress, scheduling another run", LogJobID, owned.JobID)
+		entry.owned = owned.Clone()
+		entry.policy = policy
+	}
+	return true
+}
+
+// SubmitPlan schedules the collection of the orphaned resources of a job found by the garbage
+// collection, whose report is marked Orphaned. Unlike Submit, the plan is skipped when the
+// job is already scheduled or being cleaned up, since that cleanup handles its resources.
+//
+// Parameters:
+// - plan: The plan to execute.
+// - jobLabel: The label carrying the job ID, recorded in the journal with the resources of the plan.
+// - policy: The cleanup policy of the plan.
+//
+// Returns:
+// - bool: False if the job is already scheduled or being cleaned up, or the pool is shutting down.
+func (p *Pool) SubmitPlan(plan *Plan, jobLabel string, policy Policy) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if _, exists := p.jobs[plan.JobID]; exists || p.closed {
+		return false
+	}
+	if p.journal != nil {
+		p.journal.Submitted(plan.Resources(jobLabel), policy)
+	}
+	p.jobs[plan.JobID] = &poolEntry{plan: plan, policy: policy}
+	p.ready = append(p.ready, plan.JobID)
+	p.cond.Signal()
+	return true
+}
+
+// OnStart registers a function called when a worker takes a job off the queue, with the options
+// its cleanup runs with. It is called from that worker, so it must be safe for concurrent use.
+func (p *Pool) OnStart(fn func(jobID string, opts Options)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.starters = append(p.starters, fn)
+}
+
+// OnReport registers a function called with the report of every cleanup the pool runs. It is
+// called from the worker that ran the cleanup, so it must be safe for concurrent use.
+func (p *Pool) OnReport(fn func(*Report)) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.reporters = append(p.reporters, fn)
+}
+
+// Scheduled reports whether the job is waiting for a worker or being cleaned up.
+func (p *Pool) Scheduled(jobID string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	_, exists := p.jobs[jobID]
+	return exists
+}
+
+// Pending returns the number of jobs waiting for a worker.
+func (p *Pool) Pending() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.ready)
+}
+
+// Shutdown stops accepting jobs and waits for the scheduled cleanups to complete. When ctx ends
+// first, the cleanups still running or waiting are canceled: their waits and API calls end
+// early, and the journal keeps them as failed to be retried after a restart.
+//
+// Returns:
+// - error: The context error if ctx ended before all cleanups completed.
+func (p *Pool) Shutdown(ctx context.Context) error {
+	p.mu.Lock()
+	p.closed = true
+	p.cond.Broadcast()
+	p.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		p.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		p.cancel()
+		return nil
+	case <-ctx.Done():
+		p.cancel()
+		return ctx.Err()
+	}
+}
+
+// work runs scheduled cleanups until the pool is shut down and no job is waiting.
+func (p *Pool) work() {
+	defer p.wg.Done()
+
+	for {
+		p.mu.Lock()
+		for len(p.ready) == 0 && !p.closed {
+			p.cond.Wait()
+		}
+		if len(p.ready) == 0 {
+			p.mu.Unlock()
+			return
+		}
+
+		jobID := p.ready[0]
+		p.ready = p.ready[1:]
+		entry := p.jobs[jobID]
+		owned, plan, policy := entry.owned, entry.plan, entry.policy
+		entry.owned, entry.plan = nil, nil
+		entry.running = true
+		starters := p.starters
+		p.mu.Unlock()
+
+		opts := policy.Apply(p.opts)
+		for _, fn := range starters {
+			fn(jobID, opts)
+		}
+		attempt := p.attempted(jobID)
+		var report *Report
+		if plan != nil {
+			report = CleanUpPlan(p.cli, p.ctx, plan, opts)
+			report.Orphaned = true
+		} else {
+			report = CleanUp(p.cli, p.ctx, owned, opts)
+		}
+		report.Attempt = attempt
+
+		p.mu.Lock()
+		reporters := p.reporters
+		p.mu.Unlock()
+		for _, fn := range reporters {
+			fn(report)
+		}
+
+		p.mu.Lock()
+		entry.running = false
+		rerun := entry.owned != nil
+		if rerun {
+			// Another run was requested while this one was in progress
+			p.ready = append(p.ready, jobID)
+			p.cond.Signal()
+		} else {
+			// The job's span ends with its last cleanup, while the job is still scheduled so
+			// that tracing.EvictJobs does not take it for a dropped job
+			tracing.EndJob(jobID, report.Err())
+			delete(p.jobs, jobID)
+		}
+		p.mu.Unlock()
+
+		if !rerun {
+			p.completed(jobID, report.Failed())
+		}
+	}
+}
+
+// attempted records that a cleanup of the job started, and returns the number of cleanups of the
+// job started since it was last completed, this one included. Without a journal, the attempts
+// are counted in memory, so they survive the job leaving the pool but not a restart.
+func (p *Pool) attempted(jobID string) int {
+	if p.journal != nil {
+		return p.journal.Attempted(jobID)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.attempts[jobID]++
+	return p.attempts[jobID]
+}
+
+// completed records the outcome of the last cleanup of the job. A failed cleanup is kept in the
+// journal, along with its attempts, to be retried.
+func (p *Pool) completed(jobID string, failed bool) {
+	if p.journal == nil {
+		if !failed {
+			p.mu.Lock()
+			delete(p.attempts, jobID)
+			p.mu.Unlock()
+		}
+		return
+	}
+	if failed {
+		p.journal.Failed(jobID)
+	} else {
+		p.journal.Completed(jobID)
+	}
+}
@@ -0,0 +1,317 @@
+package cleanup
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"gotest.tools/v3/assert"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+// gatedDaemon blocks every cleanup on its first API call until released, recording how many
+// cleanups ran and how many ran at once.
+type gatedDaemon struct {
+	*fake.Daemon
+	started chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	calls     int
+	active    int
+	maxActive int
+}
+
+func newGatedDaemon() *gatedDaemon {
+	return &gatedDaemon{
+		Daemon:  fake.NewDaemon(),
+		started: make(chan struct{}, 16),
+		release: make(chan struct{}),
+	}
+}
+
+func (d *gatedDaemon) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	d.mu.Lock()
+	d.calls++
+	d.active++
+	d.maxActive = max(d.maxActive, d.active)
+	d.mu.Unlock()
+
+	d.started <- struct{}{}
+	<-d.release
+
+	d.mu.Lock()
+	d.active--
+	d.mu.Unlock()
+	return d.Daemon.ContainerList(ctx, options)
+}
+
+func waitStarted(t *testing.T, daemon *gatedDaemon) {
+	t.Helper()
+
+	select {
+	case <-daemon.started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a cleanup to start")
+	}
+}
+
+func shutdown(t *testing.T, pool *Pool) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	assert.NilError(t, pool.Shutdown(ctx))
+}
+
+func TestPoolSerializesCleanupsOfAJob(t *testing.T) {
+	daemon := newGatedDaemon()
+	pool := NewPool(daemon, 4, testOptions(), nil)
+
+	assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+	waitStarted(t, daemon)
+
+	// Submitted while the first cleanup runs, coalesced into a single second run
+	for i := 0; i < 3; i++ {
+		assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+	}
+	assert.Equal(t, pool.Pending(), 0)
+
+	close(daemon.release)
+	shutdown(t, pool)
+
+	assert.Equal(t, daemon.calls, 2)
+	assert.Equal(t, daemon.maxActive, 1)
+}
+
+func TestPoolCleansUpJobsInParallel(t *testing.T) {
+	daemon := newGatedDaemon()
+	pool := NewPool(daemon, 2, testOptions(), nil)
+
+	assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+	assert.Assert(t, pool.Submit(NewResources("5678"), Policy{}))
+	assert.Assert(t, pool.Submit(NewResources("9012"), Policy{}))
+
+	// Both workers are busy while the third job waits
+	waitStarted(t, daemon)
+	waitStarted(t, daemon)
+	assert.Equal(t, pool.Pending(), 1)
+
+	close(daemon.release)
+	shutdown(t, pool)
+
+	assert.Equal(t, daemon.calls, 3)
+	assert.Equal(t, daemon.maxActive, 2)
+}
+
+func TestPoolShutdown(t *testing.T) {
+	daemon := newGatedDaemon()
+	pool := NewPool(daemon, 1, testOptions(), nil)
+
+	assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+	waitStarted(t, daemon)
+
+	// The running cleanup outlives the deadline
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Shutdown(ctx), context.DeadlineExceeded)
+	assert.Assert(t, !pool.Submit(NewResources("5678"), Policy{}))
+
+	close(daemon.release)
+	shutdown(t, pool)
+	assert.Equal(t, daemon.calls, 1)
+}
+
+// TestPoolShutdownCancelsWaits checks that a cleanup waiting before removing the containers of
+// the job ends once the shutdown deadline passes, and is journaled as failed.
+func TestPoolShutdownCancelsWaits(t *testing.T) {
+	daemon := fake.NewDaemon()
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "job", Labels: map[string]string{JobLabel: "1234"}})
+	assert.NilError(t, daemon.StartContainer(job))
+	assert.NilError(t, daemon.ExitContainer(job, 0))
+
+	opts := testOptions()
+	opts.Delay = time.Hour
+	journal := &recordingJournal{}
+	pool := NewPool(daemon, 1, opts, journal)
+	reports := make(chan *Report, 1)
+	pool.OnReport(func(r *Report) { reports <- r })
+	assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, pool.Shutdown(ctx), context.DeadlineExceeded)
+
+	select {
+	case report := <-reports:
+		assert.Assert(t, report.Failed())
+		assert.ErrorContains(t, report.Err(), "cleanup interrupted")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cleanup was not canceled")
+	}
+	shutdown(t, pool)
+	assert.Assert(t, daemon.HasContainer(job))
+	assert.DeepEqual(t, journal.calls, []string{"submitted 1234", "attempted 1234", "failed 1234"})
+}
+
+func TestPoolSubmitPlan(t *testing.T) {
+	daemon := newGatedDaemon()
+	daemon.AddVolume("orphan-cache", map[string]string{JobLabel: "5678"})
+	journal := &recordingJournal{}
+	pool := NewPool(daemon, 1, testOptions(), journal)
+	reports := make(map[string]*Report)
+	pool.OnReport(func(report *Report) { reports[report.JobID] = report })
+
+	assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+	waitStarted(t, daemon)
+
+	// The cleanup of the job handles its resources, scheduled or running
+	plan := &Plan{JobID: "5678", Volumes: []PlanItem{{ID: "orphan-cache", Name: "orphan-cache"}}}
+	assert.Assert(t, !pool.SubmitPlan(&Plan{JobID: "1234"}, JobLabel, Policy{}))
+	assert.Assert(t, pool.SubmitPlan(plan, JobLabel, Policy{}))
+	assert.Assert(t, !pool.SubmitPlan(plan, JobLabel, Policy{}))
+
+	close(daemon.release)
+	shutdown(t, pool)
+	assert.Assert(t, !pool.SubmitPlan(&Plan{JobID: "9012"}, JobLabel, Policy{}))
+
+	assert.Assert(t, !daemon.HasVolume("orphan-cache"))
+	assert.Assert(t, !reports["1234"].Orphaned)
+	assert.Assert(t, reports["5678"].Orphaned)
+	assert.DeepEqual(t, journal.calls, []string{
+		"submitted 1234",
+		"attempted 1234",
+		"submitted 5678",
+		"completed 1234",
+		"attempted 5678",
+		"completed 5678",
+	})
+}
+
+// recordingJournal records the calls made to a Journal.
+type recordingJournal struct {
+	mu    sync.Mutex
+	calls []string
+}
+
+func (j *recordingJournal) record(call string) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	j.calls = append(j.calls, call)
+}
+
+func (j *recordingJournal) Tracked(jobID, jobLabel, containerID, reason string, labels map[string]string) {
+	j.record("tracked " + jobID + " " + containerID)
+}
+
+func (j *recordingJournal) TrackedImage(jobID, jobLabel, imageID, reason string) {
+	j.record("tracked image " + jobID + " " + imageID)
+}
+
+func (j *recordingJournal) TrackedImageTag(jobID, jobLabel, tag, reason string) {
+	j.record("tracked tag " + jobID + " " + tag)
+}
+
+func (j *recordingJournal) Submitted(owned *Resources, policy Policy) {
+	j.record("submitted " + owned.JobID)
+}
+
+func (j *recordingJournal) Attempted(jobID string) int {
+	j.record("attempted " + jobID)
+
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var attempts int
+	for _, call := range j.calls {
+		if call == "attempted "+jobID {
+			attempts++
+		}
+	}
+	return attempts
+}
+
+func (j *recordingJournal) Failed(jobID string) { j.record("failed " + jobID) }
+
+func (j *recordingJournal) Completed(jobID string) { j.record("completed " + jobID) }
+
+// TestPoolJournal checks that a job is only completed in the journal once no other run is
+// pending, and that jobs refused on shutdown are still recorded.
+func TestPoolJournal(t *testing.T) {
+	daemon := newGatedDaemon()
+	journal := &recordingJournal{}
+	registry := NewRegistry(JobLabel, journal)
+	pool := NewPool(daemon, 1, testOptions(), journal)
+
+	registry.Track("1234", "job", nil)
+	assert.Assert(t, pool.Submit(registry.Resources("1234"), Policy{}))
+	waitStarted(t, daemon)
+	assert.Assert(t, pool.Submit(registry.Resources("1234"), Policy{}))
+	daemon.release <- struct{}{}
+	waitStarted(t, daemon)
+	daemon.release <- struct{}{}
+	shutdown(t, pool)
+	assert.Assert(t, !pool.Submit(NewResources("5678"), Policy{}))
+
+	assert.DeepEqual(t, journal.calls, []string{
+		"tracked 1234 job",
+		"submitted 1234",
+		"attempted 1234",
+		"submitted 1234",
+		"attempted 1234",
+		"completed 1234",
+		"submitted 5678",
+	})
+}
+
+// TestPoolJournalsFailedCleanups checks that a cleanup leaving resources behind keeps the job in
+// the journal.
+func TestPoolJournalsFailedCleanups(t *testing.T) {
+	daemon := fake.NewDaemon()
+	daemon.AddVolume("job-cache", map[string]string{JobLabel: "1234"})
+	other := daemon.CreateContainer(fake.ContainerSpec{Name: "other", Volumes: []string{"job-cache"}})
+	assert.NilError(t, daemon.StartContainer(other))
+
+	journal := &recordingJournal{}
+	pool := NewPool(daemon, 1, testOptions(), journal)
+	var report *Report
+	pool.OnReport(func(r *Report) { report = r })
+	assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+	shutdown(t, pool)
+
+	assert.DeepEqual(t, journal.calls, []string{
+		"submitted 1234",
+		"attempted 1234",
+		"failed 1234",
+	})
+	assert.Assert(t, report.Failed())
+	assert.Equal(t, report.Attempt, 1)
+	assert.Assert(t, !report.Orphaned)
+}
+
+func TestPoolReports(t *testing.T) {
+	daemon := fake.NewDaemon()
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "job", Labels: map[string]string{JobLabel: "1234"}})
+	assert.NilError(t, daemon.StartContainer(job))
+	assert.NilError(t, daemon.ExitContainer(job, 0))
+
+	pool := NewPool(daemon, 2, testOptions(), nil)
+	var mu sync.Mutex
+	reports := make(map[string]*Report)
+	pool.OnReport(func(report *Report) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports[report.JobID] = report
+	})
+
+	assert.Assert(t, pool.Submit(NewResources("1234"), Policy{}))
+	assert.Assert(t, pool.Submit(NewResources("5678"), Policy{}))
+	shutdown(t, pool)
+
+	assert.Equal(t, len(reports), 2)
+	assert.Equal(t, reports["1234"].Count(ResultSucceeded), 1)
+	assert.Equal(t, reports["1234"].Resources[0].ID, job)
+	assert.Equal(t, reports["5678"].Summary()[:len("nothing to clean up")], "nothing to clean up")
+}
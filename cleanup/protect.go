@@ -0,0 +1,192 @@
+package cleanup
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// BuiltinNetworks lists the networks created by the daemon itself, which are never removed.
+var BuiltinNetworks = []string{"bridge", "host", "none", "ingress", "docker_gwbridge"}
+
+// ProtectionRule protects the resources matching every field it sets. A rule setting no field
+// is invalid.
+type ProtectionRule struct {
+	// Name is a regular expression matched against the resource name.
+	Name string `json:"name,omitempty"`
+
+	// Label protects resources carrying the label, written as key or key=value.
+	Label string `json:"label,omitempty"`
+
+	// ComposeProject protects the resources of the Docker Compose project.
+	ComposeProject string `json:"composeProject,omitempty"`
+
+	// Image is a regular expression matched against the image of containers and services, and
+	// against the tags of images.
+	Image string `json:"image,omitempty"`
+}
+
+// String describes the fields set in the rule, for logs.
+func (r ProtectionRule) String() string {
+	var parts []string
+	if r.Name != "" {
+		parts = append(parts, fmt.Sprintf("name %q", r.Name))
+	}
+	if r.Label != "" {
+		parts = append(parts, fmt.Sprintf("label %q", r.Label))
+	}
+	if r.ComposeProject != "" {
+		parts = append(parts, fmt.Sprintf("compose project %q", r.ComposeProject))
+	}
+	if r.Image != "" {
+		parts = append(parts, fmt.Sprintf("image %q", r.Image))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// protectionRule is a ProtectionRule with its regular expressions compiled.
+type protectionRule struct {
+	ProtectionRule
+	name       *regexp.Regexp
+	image      *regexp.Regexp
+	labelKey   string
+	labelValue string
+	hasValue   bool
+}
+
+// Protection decides which resources the cleanup must never touch, even when they are owned by
+// a finished job. The built-in networks are always protected, including by a nil Protection. It
+// is safe for concurrent use.
+type Protection struct {
+	rules []protectionRule
+}
+
+// NewProtection compiles the protection rules.
+//
+// Parameters:
+// - rules: The rules protecting resources in addition to the built-in networks.
+//
+// Returns:
+// - *Protection: The compiled rules.
+// - error: An error naming the first rule that sets no field or has an invalid regular expression.
+func NewProtection(rules []ProtectionRule) (*Protection, error) {
+	p := &Protection{rules: make([]protectionRule, 0, len(rules))}
+	for i, rule := range rules {
+		if rule == (ProtectionRule{}) {
+			return nil, fmt.Errorf("protection rule %d sets no field", i)
+		}
+
+		compiled := protectionRule{ProtectionRule: rule}
+		var err error
+		if rule.Name != "" {
+			if compiled.name, err = regexp.Compile(rule.Name); err != nil {
+				return nil, fmt.Errorf("invalid name of protection rule %d %q: %w", i, rule.Name, err)
+			}
+		}
+		if rule.Image != "" {
+			if compiled.image, err = regexp.Compile(rule.Image); err != nil {
+				return nil, fmt.Errorf("invalid image of protection rule %d %q: %w", i, rule.Image, err)
+			}
+		}
+		if rule.Label != "" {
+			compiled.labelKey, compiled.labelValue, compiled.hasValue = strings.Cut(rule.Label, "=")
+		}
+		p.rules = append(p.rules, compiled)
+	}
+	return p, nil
+}
+
+// Protects reports whether the resource must be kept and why.
+//
+// Parameters:
+// - kind: The kind of the resource.
+// - item: The resource, as listed in the cleanup plan.
+//
+// Returns:
+// - string: The reason the resource is protected.
+// - bool: True if the resource must not be stopped or removed.
+func (p *Protection) Protects(kind Kind, item PlanItem) (string, bool) {
+	if kind == KindNetworks {
+		for _, name := range BuiltinNetworks {
+			if item.Name == name {
+				return "built-in network", true
+			}
+		}
+	}
+
+	if p == nil {
+		return "", false
+	}
+	for _, rule := range p.rules {
+		if rule.matches(item) {
+			return "protected by " + rule.String(), true
+		}
+	}
+	return "", false
+}
+
+// matches reports whether the resource matches every field set in the rule.
+func (r protectionRule) matches(item PlanItem) bool {
+	if r.name != nil && !r.name.MatchString(item.Name) {
+		return false
+	}
+	if r.image != nil && (item.Image == "" || !r.image.MatchString(item.Image)) {
+		return false
+	}
+	if r.labelKey != "" {
+		value, exists := item.Labels[r.labelKey]
+		if !exists || (r.hasValue && value != r.labelValue) {
+			return false
+		}
+	}
+	if r.ComposeProject != "" && item.Labels[ComposeProjectLabel] != r.ComposeProject {
+		return false
+	}
+	return true
+}
+
+// unprotected returns the items that are not protected, logging every item skipped and adding it
+// to the report.
+func unprotected(protection *Protection, kind Kind, items []PlanItem, report *Report) []PlanItem {
+	kept := make([]PlanItem, 0, len(items))
+	for _, item := range items {
+		if reason, protected := protection.Protects(kind, item); protected {
+			Logger().Info("Skipping protected resource", append(resourceAttrs(kind, item), "reason", reason)...)
+			report.skip(kind, item, ActionRemove, reason)
+			continue
+		}
+		kept = append(kept, item)
+	}
+	return kept
+}
+
+// Unprotected returns the plan without the resources the protection rules keep, logging every
+// resource skipped.
+func (p *Plan) Unprotected(protection *Protection) *Plan {
+	return p.unprotected(protection, nil)
+}
+
+// unprotected works like Unprotected and adds the resources skipped to the report.
+func (p *Plan) unprotected(protection *Protection, report *Report) *Plan {
+	plan := &Plan{
+		JobID:            p.JobID,
+		RemoveContainers: unprotected(protection, KindContainers, p.RemoveContainers, report),
+		Networks:         unprotected(protection, KindNetworks, p.Networks, report),
+		Volumes:          unprotected(protection, KindVolumes, p.Volumes, report),
+		Services:         unprotected(protection, KindServices, p.Services, report),
+		Images:           unprotected(protection, KindImages, p.Images, report),
+		ImageTags:        unprotected(protection, KindImages, p.ImageTags, report),
+	}
+
+	// Protected containers are neither stopped nor removed
+	removed := make(map[string]struct{}, len(plan.RemoveContainers))
+	for _, item := range plan.RemoveContainers {
+		removed[item.ID] = struct{}{}
+	}
+	for _, item := range p.StopContainers {
+		if _, exists := removed[item.ID]; exists {
+			plan.StopContainers = append(plan.StopContainers, item)
+		}
+	}
+	return plan
+}
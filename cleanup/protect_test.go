@@ -0,0 +1,106 @@
+package cleanup
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+func TestProtects(t *testing.T) {
+	protection, err := NewProtection([]ProtectionRule{
+		{Name: "^prod-"},
+		{Label: "keep"},
+		{Label: "tier=database"},
+		{ComposeProject: "monitoring"},
+		{Image: "^registry.example.com/vault:", Name: "-secrets$"},
+	})
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		name      string
+		kind      Kind
+		item      PlanItem
+		protected bool
+	}{
+		{name: "Built-in network", kind: KindNetworks, item: PlanItem{Name: "docker_gwbridge"}, protected: true},
+		{name: "Volume named like a built-in network", kind: KindVolumes, item: PlanItem{Name: "bridge"}, protected: false},
+		{name: "Name", kind: KindVolumes, item: PlanItem{Name: "prod-data"}, protected: true},
+		{name: "Label key", kind: KindContainers, item: PlanItem{Name: "job", Labels: map[string]string{"keep": ""}}, protected: true},
+		{name: "Label value", kind: KindNetworks, item: PlanItem{Name: "db", Labels: map[string]string{"tier": "database"}}, protected: true},
+		{name: "Other label value", kind: KindNetworks, item: PlanItem{Name: "web", Labels: map[string]string{"tier": "web"}}, protected: false},
+		{name: "Compose project", kind: KindServices, item: PlanItem{Name: "grafana", Labels: map[string]string{ComposeProjectLabel: "monitoring"}}, protected: true},
+		{name: "Image and name", kind: KindContainers, item: PlanItem{Name: "ci-secrets", Image: "registry.example.com/vault:1.17"}, protected: true},
+		{name: "Image without name", kind: KindContainers, item: PlanItem{Name: "ci-vault", Image: "registry.example.com/vault:1.17"}, protected: false},
+		{name: "Unprotected", kind: KindContainers, item: PlanItem{Name: "job", Image: "alpine"}, protected: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, protected := protection.Protects(tc.kind, tc.item)
+			assert.Equal(t, protected, tc.protected)
+		})
+	}
+
+	// The built-in networks are protected without any rule
+	_, protected := (*Protection)(nil).Protects(KindNetworks, PlanItem{Name: "host"})
+	assert.Assert(t, protected)
+}
+
+func TestNewProtectionRejectsInvalidRules(t *testing.T) {
+	_, err := NewProtection([]ProtectionRule{{Name: "^prod-"}, {}})
+	assert.ErrorContains(t, err, "protection rule 1 sets no field")
+
+	_, err = NewProtection([]ProtectionRule{{Image: "alpine("}})
+	assert.ErrorContains(t, err, `invalid image of protection rule 0 "alpine("`)
+}
+
+// TestExecuteSkipsProtectedResources checks that resources owned by the job are kept when a
+// protection rule or the built-in protection covers them.
+func TestExecuteSkipsProtectedResources(t *testing.T) {
+	ctx := context.Background()
+	daemon := fake.NewDaemon()
+
+	labels := map[string]string{JobLabel: "1234"}
+	daemon.AddNetwork("job-network", labels)
+	daemon.AddNetwork("ingress", labels)
+	daemon.AddVolume("job-volume", labels)
+	daemon.AddVolume("job-cache", map[string]string{JobLabel: "1234", "keep": "true"})
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "job", Image: "alpine", Labels: labels})
+	assert.NilError(t, daemon.StartContainer(job))
+	vault := daemon.CreateContainer(fake.ContainerSpec{Name: "vault", Image: "vault:1.17", Labels: labels})
+	assert.NilError(t, daemon.StartContainer(vault))
+
+	protection, err := NewProtection([]ProtectionRule{{Label: "keep=true"}, {Image: "^vault:"}})
+	assert.NilError(t, err)
+	opts := testOptions()
+	opts.Protection = protection
+
+	plan, err := BuildPlan(daemon, ctx, NewResources("1234"))
+	assert.NilError(t, err)
+	Execute(daemon, ctx, plan, opts)
+
+	assert.Assert(t, !daemon.HasContainer(job))
+	assert.Equal(t, daemon.ContainerState(vault), "running")
+	assert.Assert(t, !daemon.HasNetwork("job-network"))
+	assert.Assert(t, daemon.HasNetwork("ingress"))
+	assert.Assert(t, !daemon.HasVolume("job-volume"))
+	assert.Assert(t, daemon.HasVolume("job-cache"))
+}
+
+func TestPlanUnprotected(t *testing.T) {
+	plan := &Plan{
+		JobID:            "1234",
+		StopContainers:   []PlanItem{{ID: "a", Name: "prod-api"}, {ID: "b", Name: "job"}},
+		RemoveContainers: []PlanItem{{ID: "a", Name: "prod-api"}, {ID: "b", Name: "job"}},
+		Networks:         []PlanItem{{ID: "n", Name: "bridge"}},
+	}
+	protection, err := NewProtection([]ProtectionRule{{Name: "^prod-"}})
+	assert.NilError(t, err)
+
+	unprotected := plan.Unprotected(protection)
+	assert.DeepEqual(t, unprotected.StopContainers, []PlanItem{{ID: "b", Name: "job"}})
+	assert.DeepEqual(t, unprotected.RemoveContainers, []PlanItem{{ID: "b", Name: "job"}})
+	assert.Equal(t, len(unprotected.Networks), 0)
+}
@@ -0,0 +1,213 @@
+package cleanup
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Action is what the cleanup did, or would do in a dry run, to a resource.
+type Action string
+
+const (
+	ActionStop   Action = "stop"
+	ActionRemove Action = "remove"
+
+	// ActionUntag is the removal of a tag a job added to an image it did not build.
+	ActionUntag Action = "untag"
+
+	// ActionPrune is the removal of unused images and build cache when the disk runs low.
+	ActionPrune Action = "prune"
+)
+
+// Result is the outcome of an action on a resource.
+type Result string
+
+const (
+	// ResultSucceeded means the resource was stopped or removed.
+	ResultSucceeded Result = "succeeded"
+
+	// ResultFailed means the action failed, and the resource was left behind.
+	ResultFailed Result = "failed"
+
+	// ResultSkipped means the resource was left alone on purpose, such as a protected resource
+	// or an image still in use.
+	ResultSkipped Result = "skipped"
+
+	// ResultPlanned means the action would have been taken without a dry run.
+	ResultPlanned Result = "planned"
+)
+
+// Results lists the results in the order reports count them.
+var Results = []Result{ResultSucceeded, ResultFailed, ResultSkipped, ResultPlanned}
+
+// ResourceReport is the outcome of an action of the cleanup on a single resource.
+type ResourceReport struct {
+	Kind   Kind   `json:"kind"`
+	ID     string `json:"id"`
+	Name   string `json:"name"`
+	Action Action `json:"action"`
+	Result Result `json:"result"`
+
+	// Reason explains why the resource was skipped.
+	Reason string `json:"reason,omitempty"`
+
+	// Duration is the time spent on the action, across all its attempts.
+	Duration Duration `json:"duration"`
+
+	// Attempts is the number of times the action was tried, one more than the retries it used.
+	Attempts int `json:"attempts,omitempty"`
+
+	// Error is the last error of a failed action.
+	Error string `json:"error,omitempty"`
+}
+
+// Report is the outcome of the cleanup of a job: every resource acted on, what was done to it
+// and how it went.
+type Report struct {
+	JobID  string `json:"jobId"`
+	DryRun bool   `json:"dryRun"`
+
+	// Skipped explains why the whole cleanup was skipped, such as a failed job whose resources
+	// are kept for inspection.
+	Skipped string `json:"skipped,omitempty"`
+
+	// Error is the error that prevented the cleanup from running, such as a failure to plan it.
+	Error string `json:"error,omitempty"`
+
+	// Attempt is the number of cleanups of the job started since it was last completed, this
+	// one included, as recorded by the journal of the pool or counted by the pool without one.
+	// Zero for a cleanup the pool did not run.
+	Attempt int `json:"attempt,omitempty"`
+
+	// Orphaned reports a collection of orphaned resources of the job, found by the garbage
+	// collection after its cleanup was missed.
+	Orphaned bool `json:"orphaned,omitempty"`
+
+	Started   time.Time        `json:"started"`
+	Duration  Duration         `json:"duration"`
+	Resources []ResourceReport `json:"resources"`
+
+	// auditor records the actions as they are added.
+	auditor Auditor
+}
+
+// newReport starts the report of the cleanup of a job.
+func newReport(jobID string, opts Options) *Report {
+	return &Report{JobID: jobID, DryRun: opts.DryRun, Started: time.Now(), Resources: []ResourceReport{}, auditor: opts.Auditor}
+}
+
+// record adds the outcome of an action started at the given time and tried the given number of
+// times, failed if err is not nil. It does nothing on a nil report, so the cleanup functions can
+// run without one.
+func (r *Report) record(kind Kind, item PlanItem, action Action, started time.Time, attempts int, err error) {
+	if r == nil {
+		return
+	}
+	resource := ResourceReport{
+		Kind:     kind,
+		ID:       item.ID,
+		Name:     item.Name,
+		Action:   action,
+		Result:   ResultSucceeded,
+		Duration: Duration(time.Since(started)),
+		Attempts: attempts,
+	}
+	if err != nil {
+		resource.Result = ResultFailed
+		resource.Error = err.Error()
+	}
+	r.Resources = append(r.Resources, resource)
+
+	if r.auditor != nil {
+		r.auditor.Audited(AuditedAction{JobID: r.JobID, Kind: kind, Item: item, Action: action, Result: resource.Result, Err: err})
+	}
+}
+
+// skip adds a resource left alone for the reason.
+func (r *Report) skip(kind Kind, item PlanItem, action Action, reason string) {
+	if r == nil {
+		return
+	}
+	r.Resources = append(r.Resources, ResourceReport{Kind: kind, ID: item.ID, Name: item.Name, Action: action, Result: ResultSkipped, Reason: reason})
+}
+
+// planned adds the actions a dry run of the plan would take.
+func (r *Report) planned(plan *Plan) {
+	for _, section := range []struct {
+		kind   Kind
+		action Action
+		items  []PlanItem
+	}{
+		{KindContainers, ActionStop, plan.StopContainers},
+		{KindContainers, ActionRemove, plan.RemoveContainers},
+		{KindNetworks, ActionRemove, plan.Networks},
+		{KindVolumes, ActionRemove, plan.Volumes},
+		{KindServices, ActionRemove, plan.Services},
+		{KindImages, ActionRemove, plan.Images},
+		{KindImages, ActionUntag, plan.ImageTags},
+	} {
+		for _, item := range section.items {
+			r.Resources = append(r.Resources, ResourceReport{Kind: section.kind, ID: item.ID, Name: item.Name, Action: section.action, Result: ResultPlanned})
+		}
+	}
+}
+
+// finish records the duration of the cleanup and returns the report.
+func (r *Report) finish() *Report {
+	r.Duration = Duration(time.Since(r.Started))
+	return r
+}
+
+// Count returns the number of actions with the result.
+func (r *Report) Count(result Result) int {
+	count := 0
+	for _, resource := range r.Resources {
+		if resource.Result == result {
+			count++
+		}
+	}
+	return count
+}
+
+// Failed reports whether the cleanup could not run or left resources behind.
+func (r *Report) Failed() bool {
+	return r.Error != "" || r.Count(ResultFailed) > 0
+}
+
+// Err returns the errors of the cleanup joined, or nil if it did not fail.
+func (r *Report) Err() error {
+	var errs []error
+	if r.Error != "" {
+		errs = append(errs, errors.New(r.Error))
+	}
+	for _, resource := range r.Resources {
+		if resource.Result == ResultFailed {
+			errs = append(errs, fmt.Errorf("failed to %s %s %s: %s", resource.Action, strings.TrimSuffix(string(resource.Kind), "s"), resource.Name, resource.Error))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Summary returns the counts of the report on a single line, such as
+// "2 succeeded, 1 failed, 1 skipped in 1.2s".
+func (r *Report) Summary() string {
+	switch {
+	case r.Skipped != "":
+		return "skipped, " + r.Skipped
+	case r.Error != "":
+		return "not run, " + r.Error
+	}
+
+	var counts []string
+	for _, result := range Results {
+		if count := r.Count(result); count > 0 {
+			counts = append(counts, fmt.Sprintf("%d %s", count, result))
+		}
+	}
+	if len(counts) == 0 {
+		counts = append(counts, "nothing to clean up")
+	}
+	return fmt.Sprintf("%s in %s", strings.Join(counts, ", "), time.Duration(r.Duration).Round(time.Millisecond))
+}
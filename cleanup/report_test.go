@@ -0,0 +1,121 @@
+package cleanup
+
+import (
+	"context"
+	"testing"
+
+	"gotest.tools/v3/assert"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+// reportedDaemon returns a daemon running job 1234 with a container, a network still used by
+// another container, a protected volume and a service.
+func reportedDaemon(t *testing.T) (*fake.Daemon, *Resources) {
+	t.Helper()
+
+	daemon := fake.NewDaemon()
+	labels := map[string]string{JobLabel: "1234"}
+	daemon.AddNetwork("job-network", labels)
+	daemon.AddVolume("job-cache", labels)
+	daemon.AddService("job-service", labels)
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "job", Labels: labels, Networks: []string{"job-network"}})
+	assert.NilError(t, daemon.StartContainer(job))
+	assert.NilError(t, daemon.ExitContainer(job, 1))
+
+	debug := daemon.CreateContainer(fake.ContainerSpec{Name: "debug", Networks: []string{"job-network"}})
+	assert.NilError(t, daemon.StartContainer(debug))
+
+	owned := NewResources("1234")
+	owned.Failed = true
+	return daemon, owned
+}
+
+func TestCleanUpReport(t *testing.T) {
+	protection, err := NewProtection([]ProtectionRule{{Name: "^job-cache$"}})
+	assert.NilError(t, err)
+
+	testCases := []struct {
+		name      string
+		dryRun    bool
+		keep      bool
+		skipped   string
+		counts    map[Result]int
+		summary   string
+		resources []ResourceReport
+	}{
+		{
+			name:    "Executed",
+			counts:  map[Result]int{ResultSucceeded: 2, ResultFailed: 1, ResultSkipped: 1},
+			summary: "2 succeeded, 1 failed, 1 skipped in ",
+			resources: []ResourceReport{
+				{Kind: KindContainers, Name: "job", Action: ActionRemove, Result: ResultSucceeded},
+				{Kind: KindNetworks, Name: "job-network", Action: ActionRemove, Result: ResultFailed},
+				{Kind: KindVolumes, Name: "job-cache", Action: ActionRemove, Result: ResultSkipped, Reason: `protected by name "^job-cache$"`},
+				{Kind: KindServices, Name: "job-service", Action: ActionRemove, Result: ResultSucceeded},
+			},
+		},
+		{
+			name:    "Dry run",
+			dryRun:  true,
+			counts:  map[Result]int{ResultSkipped: 1, ResultPlanned: 3},
+			summary: "1 skipped, 3 planned in ",
+			resources: []ResourceReport{
+				{Kind: KindVolumes, Name: "job-cache", Action: ActionRemove, Result: ResultSkipped, Reason: `protected by name "^job-cache$"`},
+				{Kind: KindContainers, Name: "job", Action: ActionRemove, Result: ResultPlanned},
+				{Kind: KindNetworks, Name: "job-network", Action: ActionRemove, Result: ResultPlanned},
+				{Kind: KindServices, Name: "job-service", Action: ActionRemove, Result: ResultPlanned},
+			},
+		},
+		{
+			name:    "Kept on failure",
+			keep:    true,
+			skipped: "job failed, resources kept for inspection",
+			counts:  map[Result]int{},
+			summary: "skipped, job failed, resources kept for inspection",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			daemon, owned := reportedDaemon(t)
+			opts := testOptions()
+			opts.RemoveRetries = 1
+			opts.DryRun = tc.dryRun
+			opts.KeepOnFailure = tc.keep
+			opts.Protection = protection
+
+			report := CleanUp(daemon, context.Background(), owned, opts)
+
+			assert.Equal(t, report.JobID, "1234")
+			assert.Equal(t, report.DryRun, tc.dryRun)
+			assert.Equal(t, report.Skipped, tc.skipped)
+			for _, result := range Results {
+				assert.Equal(t, report.Count(result), tc.counts[result], result)
+			}
+			assert.Equal(t, report.Failed(), tc.counts[ResultFailed] > 0)
+			assert.Assert(t, len(report.Summary()) >= len(tc.summary))
+			assert.Equal(t, report.Summary()[:len(tc.summary)], tc.summary)
+
+			assert.Equal(t, len(report.Resources), len(tc.resources))
+			for i, want := range tc.resources {
+				got := report.Resources[i]
+				assert.Equal(t, got.Kind, want.Kind)
+				assert.Equal(t, got.Name, want.Name)
+				assert.Equal(t, got.Action, want.Action)
+				assert.Equal(t, got.Result, want.Result)
+				assert.Equal(t, got.Reason, want.Reason)
+				assert.Equal(t, got.Error != "", want.Result == ResultFailed)
+			}
+		})
+	}
+}
+
+func TestReportErr(t *testing.T) {
+	report := &Report{JobID: "1234", Resources: []ResourceReport{
+		{Kind: KindNetworks, Name: "job-network", Action: ActionRemove, Result: ResultFailed, Error: "network has active endpoints"},
+		{Kind: KindVolumes, Name: "job-cache", Action: ActionRemove, Result: ResultSucceeded},
+	}}
+	assert.Error(t, report.Err(), "failed to remove network job-network: network has active endpoints")
+	assert.NilError(t, (&Report{JobID: "1234"}).Err())
+	assert.Equal(t, (&Report{JobID: "1234"}).Summary(), "nothing to clean up in 0s")
+}
@@ -0,0 +1,16 @@
+//go:build linux || darwin || freebsd
+
+package cleanup
+
+import "syscall"
+
+// StatFS measures the file system holding the path with statfs. The free space is the space
+// available to unprivileged users, as reported by df.
+func StatFS(path string) (DiskSpace, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return DiskSpace{}, err
+	}
+	blockSize := uint64(stat.Bsize)
+	return DiskSpace{Total: uint64(stat.Blocks) * blockSize, Free: uint64(stat.Bavail) * blockSize}, nil
+}
@@ -0,0 +1,13 @@
+//go:build !linux && !darwin && !freebsd
+
+package cleanup
+
+import (
+	"errors"
+	"runtime"
+)
+
+// StatFS is not supported on this platform, so disk pressure is never detected.
+func StatFS(path string) (DiskSpace, error) {
+	return DiskSpace{}, errors.New("measuring free space is not supported on " + runtime.GOOS)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"job-detection.is/github-gitlab/audit"
+)
+
+// runAudit runs the audit subcommands: verify checks the hash chain of the audit log, and query
+// prints the actions it recorded.
+func runAudit(global *globalOptions, args []string) error {
+	if len(args) == 0 || (args[0] != "verify" && args[0] != "query") {
+		return errors.New("usage: job-detection -audit-log file audit verify|query [-job id] [-since time] [-until time] [-format text|json]")
+	}
+	if global.auditPath == "" {
+		return errors.New("missing required -audit-log global flag")
+	}
+
+	if args[0] == "verify" {
+		flags := newFlagSet("audit verify")
+		if err := parseFlags(flags, args[1:]); err != nil {
+			return err
+		}
+		return verifyAudit(global.auditPath, os.Stdout)
+	}
+
+	var filter audit.Filter
+	flags := newFlagSet("audit query")
+	flags.StringVar(&filter.JobID, "job", "", "Only print the actions on the resources of the job")
+	flags.Func("since", "Only print the actions recorded at or after the time, in RFC 3339 or as a date", func(value string) error {
+		return parseTime(value, &filter.Since)
+	})
+	flags.Func("until", "Only print the actions recorded before the time, in RFC 3339 or as a date", func(value string) error {
+		return parseTime(value, &filter.Until)
+	})
+	format := flags.String("format", "text", "Output format: text or json")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unsupported format %q, expected text or json", *format)
+	}
+
+	return queryAudit(global.auditPath, filter, *format, os.Stdout)
+}
+
+// parseTime parses a time in RFC 3339, or a date in UTC.
+func parseTime(value string, t *time.Time) error {
+	for _, layout := range []string{time.RFC3339, time.DateOnly} {
+		if parsed, err := time.Parse(layout, value); err == nil {
+			*t = parsed
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid time %q, expected RFC 3339 such as 2024-08-01T12:00:00Z or a date such as 2024-08-01", value)
+}
+
+// verifyAudit checks the hash chain of the audit log and reports the entries checked.
+//
+// Parameters:
+// - path: The path of the audit log.
+// - w: Where the result is written.
+//
+// Returns:
+// - error: An error if the log could not be read or its chain is broken.
+func verifyAudit(path string, w io.Writer) error {
+	verification, err := audit.Verify(path)
+	if err != nil {
+		return err
+	}
+	if verification.Entries == 0 {
+		_, err = fmt.Fprintf(w, "Audit log %s has no entries.\n", path)
+		return err
+	}
+
+	fmt.Fprintf(w, "Audit log %s is intact: %d entries in %d files, #%d to #%d.\n", path, verification.Entries, verification.Files, verification.First, verification.Last)
+	if verification.Truncated {
+		fmt.Fprintf(w, "Entries before #%d were dropped by the rotation.\n", verification.First)
+	}
+	return nil
+}
+
+// queryAudit writes the entries of the audit log selected by the filter.
+//
+// Parameters:
+// - path: The path of the audit log.
+// - filter: Selects the entries to write.
+// - format: The output format, text or json.
+// - w: Where the entries are written.
+//
+// Returns:
+// - error: An error if the log could not be read or the entries could not be written.
+func queryAudit(path string, filter audit.Filter, format string, w io.Writer) error {
+	entries, err := audit.Query(path, filter)
+	if err != nil {
+		return err
+	}
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		for _, entry := range entries {
+			if err := encoder.Encode(entry); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for _, entry := range entries {
+		jobID := entry.JobID
+		if jobID == "" {
+			jobID = "-"
+		}
+		name := entry.ID
+		if entry.Name != "" && entry.Name != entry.ID {
+			name = fmt.Sprintf("%s (%s)", entry.Name, entry.ID)
+		}
+		line := fmt.Sprintf("%s #%d job %s: %s %s %s %s, %s", entry.Time.Format(time.RFC3339), entry.Seq, jobID, entry.Action, entry.Kind, name, entry.Result, entry.Rule)
+		if entry.Error != "" {
+			line += ": " + entry.Error
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// runConfig runs the config subcommands. Only validate is supported.
+func runConfig(global *globalOptions, args []string) error {
+	if len(args) == 0 || args[0] != "validate" {
+		return errors.New("usage: job-detection config validate")
+	}
+
+	flags := newFlagSet("config validate")
+	if err := parseFlags(flags, args[1:]); err != nil {
+		return err
+	}
+
+	return validateConfig(global, os.Stdout)
+}
+
+// validateConfig loads the configuration file and reports whether it is valid.
+//
+// Parameters:
+// - global: The global options naming the configuration file.
+// - w: Where the result is written.
+//
+// Returns:
+// - error: An error if the file could not be loaded or is invalid.
+func validateConfig(global *globalOptions, w io.Writer) error {
+	config, err := loadConfig(global)
+	if err != nil {
+		return err
+	}
+
+	for _, warning := range config.Matcher().Warnings() {
+		fmt.Fprintf(w, "Warning: %s.\n", warning)
+	}
+
+	_, err = fmt.Fprintf(w, "Config %s is valid: %d job patterns.\n", global.configPath, len(config.JobPatterns))
+	return err
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/events"
+	"job-detection.is/github-gitlab/provider"
+)
+
+// runInspect shows which job pattern and labels attribute a container to a job.
+func runInspect(global *globalOptions, args []string) error {
+	flags := newFlagSet("inspect")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+	if flags.NArg() != 1 {
+		return errors.New("usage: job-detection inspect <container>")
+	}
+
+	config, err := loadConfig(global)
+	if err != nil {
+		return err
+	}
+
+	cli, err := newClient(global)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	return inspectContainer(cli, context.Background(), flags.Arg(0), config.Matcher(), global.provider, os.Stdout)
+}
+
+// inspectContainer writes the job pattern and labels matching the container.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - containerID: The ID or name of the container to inspect.
+// - matcher: The compiled job patterns to match against the container name.
+// - prov: The CI provider whose job containers are inspected.
+// - w: Where the result is written.
+//
+// Returns:
+// - error: An error if the container could not be inspected.
+func inspectContainer(cli dockerapi.Client, ctx context.Context, containerID string, matcher *events.Matcher, prov provider.Provider, w io.Writer) error {
+	containerJSON, err := cli.ContainerInspect(ctx, containerID)
+	if err != nil {
+		return fmt.Errorf("failed to inspect container %s: %w", containerID, err)
+	}
+
+	var labels map[string]string
+	if containerJSON.Config != nil {
+		labels = containerJSON.Config.Labels
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Container %s (%s):\n", strings.TrimPrefix(containerJSON.Name, "/"), containerJSON.ID)
+	if containerJSON.State != nil {
+		fmt.Fprintf(&b, "  State: %s\n", containerJSON.State.Status)
+	}
+
+	job, identified := prov.Job(containerJSON.ID, containerJSON.Name, labels)
+	if match, matched := matcher.Match(containerJSON.Name); matched {
+		fmt.Fprintf(&b, "  Job pattern: %s\n", match.Pattern)
+		for _, key := range sortedKeys(match.Fields) {
+			fmt.Fprintf(&b, "  Captured %s: %s\n", key, match.Fields[key])
+		}
+		job = match.Apply(job, identified)
+		identified = identified || match.Fields[events.JobField] != ""
+	} else {
+		b.WriteString("  Job pattern: none\n")
+	}
+
+	if identified {
+		fmt.Fprintf(&b, "  %s job: %s\n", prov.DisplayName(), job)
+	} else {
+		fmt.Fprintf(&b, "  %s job: unknown\n", prov.DisplayName())
+	}
+	for _, label := range []string{prov.JobLabel(), cleanup.ComposeProjectLabel} {
+		if value, exists := labels[label]; exists {
+			fmt.Fprintf(&b, "  Label %s: %s\n", label, value)
+		} else {
+			fmt.Fprintf(&b, "  Label %s: not set\n", label)
+		}
+	}
+
+	_, err = io.WriteString(w, b.String())
+	return err
+}
+
+// sortedKeys returns the keys of the map in alphabetical order.
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,238 @@
+// Package main provides the job-detection command. It watches Docker for CI job containers and
+// cleans up the resources they leave behind, and offers one-shot commands to sweep stale jobs,
+// review cleanup plans, inspect containers and validate the configuration.
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/client"
+	"job-detection.is/github-gitlab/audit"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/events"
+	"job-detection.is/github-gitlab/provider"
+	"job-detection.is/github-gitlab/tracing"
+)
+
+// globalOptions holds the flags shared by every command.
+type globalOptions struct {
+	configPath string
+	provider   provider.Provider
+	dockerHost string
+	overrides  events.Overrides
+
+	// auditPath is the audit log recording the resources removed, empty to disable it.
+	auditPath     string
+	auditMaxSize  int64
+	auditMaxFiles int
+
+	// logger receives the records of the commands, as set with -log-format and -log-level.
+	logger *slog.Logger
+}
+
+// command is a subcommand of job-detection.
+type command struct {
+	name    string
+	usage   string
+	summary string
+	run     func(global *globalOptions, args []string) error
+}
+
+var commands = []command{
+	{"watch", "watch [-dry-run] [-workers n]", "Watch Docker events and clean up finished jobs", runWatch},
+	{"sweep", "sweep [-dry-run] [-workers n]", "Clean up the resources of job containers that already exited", runSweep},
+	{"plan", "plan -job id [-format text|json]", "Print the cleanup plan of a job without removing anything", runPlan},
+	{"inspect", "inspect container", "Show which pattern and labels attribute a container to a job", runInspect},
+	{"config", "config validate", "Validate the configuration file", runConfig},
+	{"audit", "audit verify|query [-job id]", "Verify the audit log or print the actions it recorded", runAudit},
+}
+
+// main is the entry point of the application. It:
+// 1. Parses the global flags.
+// 2. Dispatches to the subcommand named by the first remaining argument.
+// 3. Exits with a non-zero status if the subcommand fails.
+func main() {
+	log.SetPrefix("job-detection: ")
+
+	if err := run(os.Args[1:], os.Stderr); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			os.Exit(0)
+		}
+		slog.Error(err.Error())
+		os.Exit(1)
+	}
+}
+
+// run parses the global flags and runs the requested subcommand.
+//
+// Parameters:
+// - args: The command line arguments, without the program name.
+// - stderr: Where usage information and logs are written.
+//
+// Returns:
+// - error: An error if the arguments are invalid or the subcommand failed.
+func run(args []string, stderr io.Writer) error {
+	global := &globalOptions{}
+	var providerName, logFormat, logLevel, traceExporter string
+
+	flags := flag.NewFlagSet("job-detection", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.StringVar(&global.configPath, "config", "patterns/jobPattern.json", "Path of the configuration file")
+	flags.StringVar(&providerName, "provider", "github", "CI provider: "+strings.Join(provider.Names(), " or "))
+	flags.StringVar(&global.dockerHost, "docker-host", "", "Docker daemon address, defaults to DOCKER_HOST")
+	flags.StringVar(&logFormat, "log-format", "text", "Format of the logs: text or json")
+	flags.StringVar(&logLevel, "log-level", "info", "Minimum level of the logs: debug, info, warn or error")
+	flags.StringVar(&global.auditPath, "audit-log", "", "Audit log recording every resource removed, empty to disable")
+	flags.Int64Var(&global.auditMaxSize, "audit-max-size", audit.DefaultMaxSize>>20, "Size in MiB past which the audit log is rotated")
+	flags.IntVar(&global.auditMaxFiles, "audit-max-files", audit.DefaultMaxFiles, "Number of rotated audit log files kept")
+	flags.StringVar(&traceExporter, "trace-exporter", "none", "Exporter of the traces of jobs: "+strings.Join(tracing.Exporters, ", "))
+	overrideFlags(flags, &global.overrides)
+	flags.Usage = func() { writeUsage(flags) }
+
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	logger, err := newLogger(stderr, logFormat, logLevel)
+	if err != nil {
+		return err
+	}
+	slog.SetDefault(logger)
+	cleanup.SetLogger(logger)
+	events.SetLogger(logger)
+	global.logger = logger
+
+	prov, err := provider.Get(providerName)
+	if err != nil {
+		return err
+	}
+	global.provider = prov
+
+	// Spans go to standard error like the logs, so that they never mix with the output of commands
+	shutdownTracing, err := tracing.Setup(context.Background(), traceExporter, stderr)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		// Pending spans are flushed before exiting
+		flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := shutdownTracing(flushCtx); err != nil {
+			logger.Error("Failed to flush traces", cleanup.ErrorAttr(err))
+		}
+	}()
+
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return errors.New("missing command")
+	}
+
+	name := flags.Arg(0)
+	for _, cmd := range commands {
+		if cmd.name == name {
+			return cmd.run(global, flags.Args()[1:])
+		}
+	}
+
+	flags.Usage()
+	return fmt.Errorf("unknown command %q", name)
+}
+
+// writeUsage writes the list of commands, global flags and how settings are overridden.
+func writeUsage(flags *flag.FlagSet) {
+	w := flags.Output()
+	fmt.Fprintln(w, "Usage: job-detection [global flags] <command> [flags]")
+	fmt.Fprintln(w, "\nCommands:")
+	for _, cmd := range commands {
+		fmt.Fprintf(w, "  %-36s %s\n", cmd.usage, cmd.summary)
+	}
+	fmt.Fprintln(w, "\nGlobal flags:")
+	flags.PrintDefaults()
+	fmt.Fprintf(w, "\nEvery flag can be set with a %s variable, such as %s for -workers.\n", envPrefix+"*", envName("workers"))
+	fmt.Fprintln(w, "Flags take precedence over the environment, which takes precedence over the config file.")
+}
+
+// newLogger creates the logger of the watcher.
+//
+// Parameters:
+// - w: Where the records are written.
+// - format: The format of the records, text or json.
+// - level: The minimum level of the records, such as info.
+//
+// Returns:
+// - *slog.Logger: The logger.
+// - error: An error if the format or level is unknown.
+func newLogger(w io.Writer, format, level string) (*slog.Logger, error) {
+	var minLevel slog.Level
+	if err := minLevel.UnmarshalText([]byte(level)); err != nil {
+		return nil, fmt.Errorf("invalid log level %q, use debug, info, warn or error", level)
+	}
+
+	handlerOpts := &slog.HandlerOptions{Level: minLevel}
+	switch format {
+	case "text":
+		return slog.New(slog.NewTextHandler(w, handlerOpts)), nil
+	case "json":
+		return slog.New(slog.NewJSONHandler(w, handlerOpts)), nil
+	default:
+		return nil, fmt.Errorf("invalid log format %q, use text or json", format)
+	}
+}
+
+// loadConfig loads and validates the configuration file named by the global flags.
+func loadConfig(global *globalOptions) (*events.Config, error) {
+	watcher, err := watchConfig(global)
+	if err != nil {
+		return nil, err
+	}
+	return watcher.Config(), nil
+}
+
+// watchConfig loads the configuration file named by the global flags into a watcher that can
+// reload it. The settings given in the environment or on the command line override those of the
+// file, and the default patterns of the provider are used when none is configured.
+func watchConfig(global *globalOptions) (*events.ConfigWatcher, error) {
+	return events.NewConfigWatcher(global.configPath, func(config *events.Config) error {
+		config.Override(global.overrides)
+		if len(config.JobPatterns) == 0 {
+			config.JobPatterns = global.provider.Patterns()
+		}
+		return config.Validate()
+	})
+}
+
+// newClient creates a Docker client for the daemon named by the global flags.
+func newClient(global *globalOptions) (*client.Client, error) {
+	opts := []client.Opt{client.FromEnv, client.WithAPIVersionNegotiation()}
+	if global.dockerHost != "" {
+		opts = append(opts, client.WithHost(global.dockerHost))
+	}
+
+	cli, err := client.NewClientWithOpts(opts...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create Docker client: %w", err)
+	}
+	return cli, nil
+}
+
+// openAudit opens the audit log named by the global flags, or returns nil if it is disabled.
+func openAudit(global *globalOptions) (*audit.Log, error) {
+	if global.auditPath == "" {
+		return nil, nil
+	}
+	return audit.Open(global.auditPath, global.auditMaxSize<<20, global.auditMaxFiles, global.logger)
+}
+
+// newFlagSet returns the flag set of a subcommand, reporting errors instead of exiting.
+func newFlagSet(name string) *flag.FlagSet {
+	return flag.NewFlagSet("job-detection "+name, flag.ContinueOnError)
+}
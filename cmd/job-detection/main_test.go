@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/audit"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+	"job-detection.is/github-gitlab/events"
+	"job-detection.is/github-gitlab/provider"
+)
+
+var testPatterns = []string{"^/runner-.*-project-.*-concurrent-.*-build$"}
+
+func testMatcher(t *testing.T) *events.Matcher {
+	matcher, err := events.NewMatcher(testPatterns)
+	require.NoError(t, err)
+	return matcher
+}
+
+// testOptions returns the default cleanup options without any delay.
+func testOptions() cleanup.Options {
+	opts := cleanup.DefaultOptions()
+	opts.Delay = 0
+	opts.PollInterval = 0
+	opts.RetryDelay = 0
+	return opts
+}
+
+func TestRunRejectsInvalidArguments(t *testing.T) {
+	testCases := []struct {
+		name string
+		args []string
+	}{
+		{name: "No command", args: nil},
+		{name: "Unknown command", args: []string{"clean"}},
+		{name: "Unknown provider", args: []string{"-provider", "jenkins", "watch"}},
+		{name: "Plan without job", args: []string{"plan"}},
+		{name: "Config without subcommand", args: []string{"config"}},
+		{name: "Unknown log format", args: []string{"-log-format", "xml", "watch"}},
+		{name: "Unknown log level", args: []string{"-log-level", "verbose", "watch"}},
+		{name: "Unknown trace exporter", args: []string{"-trace-exporter", "jaeger", "watch"}},
+		{name: "Audit without log", args: []string{"audit", "verify"}},
+		{name: "Audit without subcommand", args: []string{"-audit-log", "audit.log", "audit"}},
+		{name: "Audit query with invalid time", args: []string{"-audit-log", "audit.log", "audit", "query", "-since", "yesterday"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			assert.Error(t, run(tc.args, &bytes.Buffer{}))
+		})
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := newLogger(&out, "json", "warn")
+	require.NoError(t, err)
+
+	logger.Info("Job container started", cleanup.LogJobID, "1234")
+	logger.Warn("Skipping cleanup of the job, shutting down", cleanup.LogJobID, "1234")
+	assert.NotContains(t, out.String(), "Job container started")
+	assert.Contains(t, out.String(), `"level":"WARN","msg":"Skipping cleanup of the job, shutting down","job_id":"1234"`)
+
+	out.Reset()
+	logger, err = newLogger(&out, "text", "debug")
+	require.NoError(t, err)
+	logger.Debug("Container matched job pattern", cleanup.LogPattern, "^/runner-.*-build$")
+	assert.Contains(t, out.String(), `level=DEBUG msg="Container matched job pattern" pattern=^/runner-.*-build$`)
+
+	_, err = newLogger(&out, "xml", "info")
+	assert.ErrorContains(t, err, `invalid log format "xml"`)
+	_, err = newLogger(&out, "json", "verbose")
+	assert.ErrorContains(t, err, `invalid log level "verbose"`)
+}
+
+func TestValidateConfig(t *testing.T) {
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.json")
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(valid, []byte(`{"jobPattern": ["^/runner-.*-build$"]}`), 0o600))
+	require.NoError(t, os.WriteFile(invalid, []byte(`{"jobPattern": ["^/runner-(.*-build$"]}`), 0o600))
+
+	var out bytes.Buffer
+	require.NoError(t, validateConfig(&globalOptions{configPath: valid, provider: provider.GitHub{}}, &out))
+	assert.Contains(t, out.String(), "1 job patterns")
+
+	err := validateConfig(&globalOptions{configPath: invalid, provider: provider.GitHub{}}, &out)
+	assert.ErrorContains(t, err, `invalid job pattern 0 "^/runner-(.*-build$"`)
+}
+
+// TestParseFlagsPrecedence tests that flags take precedence over the environment, which takes
+// precedence over the defaults.
+func TestParseFlagsPrecedence(t *testing.T) {
+	testCases := []struct {
+		name     string
+		args     []string
+		env      string
+		expected int
+		err      string
+	}{
+		{name: "Default", expected: 4},
+		{name: "Environment", env: "8", expected: 8},
+		{name: "Flag over environment", args: []string{"-workers", "2"}, env: "8", expected: 2},
+		{name: "Invalid environment", env: "many", err: `invalid value "many" for JOB_DETECTION_WORKERS`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.env != "" {
+				t.Setenv("JOB_DETECTION_WORKERS", tc.env)
+			}
+			flags := newFlagSet("test")
+			workers := flags.Int("workers", 4, "")
+
+			err := parseFlags(flags, tc.args)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.expected, *workers)
+		})
+	}
+}
+
+// TestConfigOverrides tests that the settings of the config file are overridden by the
+// environment and the flags.
+func TestConfigOverrides(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.yaml")
+	require.NoError(t, os.WriteFile(filename, []byte("jobPatterns: ['^/ci-.*-build$']\ndefaults: {graceDelay: 5s}\n"), 0o600))
+
+	t.Setenv("JOB_DETECTION_CONFIG", filename)
+	t.Setenv("JOB_DETECTION_JOB_PATTERNS", "^/runner-.*-build$ ^/runner-.*-test$")
+	t.Setenv("JOB_DETECTION_GRACE_DELAY", "1m")
+	t.Setenv("JOB_DETECTION_PROVIDER", "gitlab")
+	t.Setenv("JOB_DETECTION_GC", `{"interval": "15m", "ttl": {"volumes": "72h"}}`)
+
+	global := &globalOptions{}
+	var providerName string
+	flags := newFlagSet("test")
+	flags.StringVar(&global.configPath, "config", "patterns/jobPattern.json", "")
+	flags.StringVar(&providerName, "provider", "github", "")
+	overrideFlags(flags, &global.overrides)
+	require.NoError(t, parseFlags(flags, []string{"-grace-delay", "2m", "-keep-on-failure", "-protect", `[{"label": "keep"}]`}))
+	assert.Equal(t, filename, global.configPath)
+	assert.Equal(t, "gitlab", providerName)
+	global.provider = provider.GitHub{}
+
+	config, err := loadConfig(global)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"^/runner-.*-build$", "^/runner-.*-test$"}, config.JobPatterns)
+
+	match, matched := config.Matcher().Match("/runner-abc-build")
+	require.True(t, matched)
+	opts := match.Policy.Apply(cleanup.DefaultOptions())
+	assert.Equal(t, 2*time.Minute, opts.Delay)
+	assert.True(t, opts.KeepOnFailure)
+
+	gc := config.GCSettings()
+	assert.Equal(t, cleanup.Duration(15*time.Minute), gc.Interval)
+	assert.Equal(t, 72*time.Hour, gc.TTLOf(cleanup.KindVolumes))
+	_, protected := config.Protection().Protects(cleanup.KindVolumes, cleanup.PlanItem{Name: "cache", Labels: map[string]string{"keep": "true"}})
+	assert.True(t, protected)
+	assert.Equal(t, cleanup.DiskPressure{}, config.DiskPressureSettings())
+
+	// Unknown keys are rejected, as in the config file
+	flags = newFlagSet("test")
+	overrideFlags(flags, &events.Overrides{})
+	require.ErrorContains(t, parseFlags(flags, []string{"-gc", `{"intervall": "15m"}`}), `unknown field "intervall"`)
+}
+
+func TestInspectContainer(t *testing.T) {
+	daemon := fake.NewDaemon()
+	job := daemon.CreateContainer(fake.ContainerSpec{
+		Name:   "runner-abc-project-1-concurrent-0-build",
+		Labels: map[string]string{cleanup.JobLabel: "1234"},
+	})
+
+	var out bytes.Buffer
+	require.NoError(t, inspectContainer(daemon, context.Background(), job, testMatcher(t), provider.GitHub{}, &out))
+	assert.Contains(t, out.String(), "Job pattern: "+testPatterns[0])
+	assert.Contains(t, out.String(), "GitHub Actions job: 1234")
+	assert.Contains(t, out.String(), "Label com.github.ci.job.id: 1234")
+	assert.Contains(t, out.String(), "Label com.docker.compose.project: not set")
+
+	assert.Error(t, inspectContainer(daemon, context.Background(), "missing", testMatcher(t), provider.GitHub{}, &out))
+}
+
+func TestSweepCleansUpExitedJobs(t *testing.T) {
+	daemon := fake.NewDaemon()
+	exited := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(exited))
+	require.NoError(t, daemon.ExitContainer(exited, 0))
+	running := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-2-concurrent-1-build"})
+	require.NoError(t, daemon.StartContainer(running))
+	other := daemon.CreateContainer(fake.ContainerSpec{Name: "nginx"})
+	require.NoError(t, daemon.StartContainer(other))
+	require.NoError(t, daemon.ExitContainer(other, 0))
+
+	var out bytes.Buffer
+	require.NoError(t, sweep(daemon, context.Background(), provider.GitLab{}, testMatcher(t), testOptions(), 2, &out))
+
+	assert.False(t, daemon.HasContainer(exited))
+	assert.Equal(t, "running", daemon.ContainerState(running))
+	assert.Equal(t, "exited", daemon.ContainerState(other))
+	assert.Contains(t, out.String(), "Swept 1 stale job containers.")
+	assert.Regexp(t, `Cleanup of job \w+: 1 succeeded in `, out.String())
+}
+
+func TestAuditSweptJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	auditLog, err := audit.Open(path, 0, 0, nil)
+	require.NoError(t, err)
+
+	daemon := fake.NewDaemon()
+	labels := map[string]string{"com.gitlab.ci.job.id": "1234"}
+	daemon.AddVolume("job-cache", labels)
+	exited := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build", Labels: labels})
+	require.NoError(t, daemon.StartContainer(exited))
+	require.NoError(t, daemon.ExitContainer(exited, 0))
+
+	opts := testOptions()
+	opts.Auditor = auditLog
+	require.NoError(t, sweep(daemon, context.Background(), provider.GitLab{}, testMatcher(t), opts, 1, &bytes.Buffer{}))
+	require.NoError(t, auditLog.Close())
+
+	var out bytes.Buffer
+	require.NoError(t, verifyAudit(path, &out))
+	assert.Equal(t, fmt.Sprintf("Audit log %s is intact: 2 entries in 1 files, #1 to #2.\n", path), out.String())
+
+	out.Reset()
+	require.NoError(t, queryAudit(path, audit.Filter{JobID: "1234"}, "text", &out))
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	require.Len(t, lines, 2)
+	assert.Regexp(t, `^\S+ #1 job 1234: remove containers runner-abc-project-1-concurrent-0-build \(\w+\) succeeded, `, lines[0])
+	assert.Regexp(t, `^\S+ #2 job 1234: remove volumes job-cache succeeded, label com.gitlab.ci.job.id=1234$`, lines[1])
+
+	out.Reset()
+	require.NoError(t, queryAudit(path, audit.Filter{Since: time.Now().Add(time.Hour)}, "json", &out))
+	assert.Empty(t, out.String())
+}
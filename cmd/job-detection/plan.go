@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/provider"
+)
+
+// runPlan prints the cleanup plan of a job without removing anything, so the resources
+// attributed to the job can be reviewed before a real cleanup runs.
+func runPlan(global *globalOptions, args []string) error {
+	flags := newFlagSet("plan")
+	jobID := flags.String("job", "", "ID of the job to plan the cleanup for")
+	format := flags.String("format", "text", "Output format: text or json")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	if *jobID == "" {
+		return errors.New("missing required -job flag")
+	}
+	if *format != "text" && *format != "json" {
+		return fmt.Errorf("unsupported format %q, expected text or json", *format)
+	}
+
+	config, err := loadConfig(global)
+	if err != nil {
+		return err
+	}
+
+	cli, err := newClient(global)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	return writePlan(cli, context.Background(), global.provider, config.Protection(), *jobID, *format, os.Stdout)
+}
+
+// writePlan builds the cleanup plan of the job from the resources labeled for it and writes it.
+// Protected resources are left out of the plan, as the cleanup skips them.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - prov: The CI provider that ran the job.
+// - protection: The resources never cleaned up.
+// - jobID: The job ID to plan the cleanup for.
+// - format: The output format, text or json.
+// - w: Where the plan is written.
+//
+// Returns:
+// - error: An error if the plan could not be built or written.
+func writePlan(cli dockerapi.Client, ctx context.Context, prov provider.Provider, protection *cleanup.Protection, jobID, format string, w io.Writer) error {
+	owned := cleanup.NewResources(jobID)
+	owned.JobLabel = prov.JobLabel()
+
+	plan, err := cleanup.BuildPlan(cli, ctx, owned)
+	if err != nil {
+		return fmt.Errorf("failed to plan cleanup: %w", err)
+	}
+	plan = plan.Unprotected(protection)
+
+	if format == "json" {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(plan)
+	} else {
+		err = plan.WriteText(w)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to print plan: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/events"
+)
+
+// envPrefix prefixes the environment variables setting flags, such as JOB_DETECTION_WORKERS for
+// -workers.
+const envPrefix = "JOB_DETECTION_"
+
+// parseFlags parses the command line, then sets every flag that was not given on it from its
+// environment variable, if set. Flags thus take precedence over the environment.
+//
+// Parameters:
+// - flags: The flag set to parse.
+// - args: The command line arguments.
+//
+// Returns:
+// - error: An error if an argument or an environment variable is invalid.
+func parseFlags(flags *flag.FlagSet, args []string) error {
+	if err := flags.Parse(args); err != nil {
+		return err
+	}
+
+	given := make(map[string]bool)
+	flags.Visit(func(f *flag.Flag) { given[f.Name] = true })
+
+	var err error
+	flags.VisitAll(func(f *flag.Flag) {
+		if given[f.Name] || err != nil {
+			return
+		}
+		name := envName(f.Name)
+		if value, ok := os.LookupEnv(name); ok {
+			if setErr := flags.Set(f.Name, value); setErr != nil {
+				err = fmt.Errorf("invalid value %q for %s: %w", value, name, setErr)
+			}
+		}
+	})
+	return err
+}
+
+// envName returns the environment variable setting the flag.
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// overrideFlags defines the flags overriding the settings of the configuration file.
+//
+// Parameters:
+// - flags: The flag set to define the flags in.
+// - overrides: Where the values of the flags are stored.
+func overrideFlags(flags *flag.FlagSet, overrides *events.Overrides) {
+	policy := &overrides.Defaults
+
+	flags.Func("job-patterns", "Job patterns separated by spaces, replacing those of the config file", func(value string) error {
+		overrides.JobPatterns = strings.Fields(value)
+		return nil
+	})
+	durationFlag(flags, "grace-delay", "Time to wait before cleaning up a finished job", &policy.GraceDelay)
+	durationFlag(flags, "stop-timeout", "Time running containers get to stop before they are killed", &policy.StopTimeout)
+	intFlag(flags, "container-retries", "Attempts at stopping and removing containers", &policy.ContainerRetries)
+	intFlag(flags, "remove-retries", "Attempts at removing networks and volumes", &policy.RemoveRetries)
+	durationFlag(flags, "retry-delay", "Time between attempts at removing networks and volumes", &policy.RetryDelay)
+	flags.Func("resources", "Kinds of resources to clean up, separated by commas", func(value string) error {
+		policy.Resources = []cleanup.Kind{}
+		for _, kind := range strings.Split(value, ",") {
+			if kind = strings.TrimSpace(kind); kind != "" {
+				policy.Resources = append(policy.Resources, cleanup.Kind(kind))
+			}
+		}
+		return nil
+	})
+	flags.BoolFunc("keep-on-failure", "Keep the resources of jobs whose container exited with a non-zero code", func(value string) error {
+		keep, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		policy.KeepOnFailure = &keep
+		return nil
+	})
+	jsonFlag(flags, "protect", "Protection rules as a JSON list, replacing the protect section of the config file", &overrides.Protect)
+	jsonFlag(flags, "gc", "Garbage collection settings as a JSON object, replacing the gc section of the config file", &overrides.GC)
+	jsonFlag(flags, "disk-pressure", "Disk pressure settings as a JSON object, replacing the diskPressure section of the config file", &overrides.DiskPressure)
+	jsonFlag(flags, "notifications", "Notification settings as a JSON object, replacing the notifications section of the config file", &overrides.Notifications)
+}
+
+// jsonFlag defines a flag setting a section of the configuration from a JSON document. Unknown
+// keys are rejected, as in the config file.
+func jsonFlag(flags *flag.FlagSet, name, usage string, target any) {
+	flags.Func(name, usage, func(value string) error {
+		decoder := json.NewDecoder(strings.NewReader(value))
+		decoder.DisallowUnknownFields()
+		return decoder.Decode(target)
+	})
+}
+
+// durationFlag defines a flag setting a duration of the default policy.
+func durationFlag(flags *flag.FlagSet, name, usage string, target **cleanup.Duration) {
+	flags.Func(name, usage, func(value string) error {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return err
+		}
+		*target = (*cleanup.Duration)(&d)
+		return nil
+	})
+}
+
+// intFlag defines a flag setting a count of the default policy.
+func intFlag(flags *flag.FlagSet, name, usage string, target **int) {
+	flags.Func(name, usage, func(value string) error {
+		n, err := strconv.Atoi(value)
+		if err != nil {
+			return err
+		}
+		*target = &n
+		return nil
+	})
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/events"
+	"job-detection.is/github-gitlab/provider"
+	"job-detection.is/github-gitlab/tracing"
+)
+
+// runSweep cleans up once the resources of every job container that already exited, for jobs
+// that finished while no watcher was running.
+func runSweep(global *globalOptions, args []string) error {
+	flags := newFlagSet("sweep")
+	dryRun := flags.Bool("dry-run", false, "Log the cleanup plans without removing anything")
+	workers := flags.Int("workers", 4, "Maximum number of jobs cleaned up in parallel")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	config, err := loadConfig(global)
+	if err != nil {
+		return err
+	}
+
+	cli, err := newClient(global)
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+
+	auditLog, err := openAudit(global)
+	if err != nil {
+		return err
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+	}
+
+	opts := cleanup.DefaultOptions()
+	opts.DryRun = *dryRun
+	opts.Logger = global.logger
+	if auditLog != nil {
+		opts.Auditor = auditLog
+	}
+	return sweep(tracing.Client(cli), context.Background(), global.provider, config.Matcher(), opts, *workers, os.Stdout)
+}
+
+// sweep submits the cleanup of every exited or dead container matching the job patterns and
+// waits for the cleanups to complete, including what is left of the grace period of jobs that
+// exited recently.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls and for waiting on the cleanups.
+// - prov: The CI provider whose job containers are swept.
+// - matcher: The compiled job patterns to match against container names.
+// - opts: Options controlling the cleanup.
+// - workers: The maximum number of jobs cleaned up in parallel.
+// - w: Where the stale job containers found and the outcome of their cleanups are listed.
+//
+// Returns:
+// - error: An error if the containers could not be listed, the cleanups did not complete or
+// some left resources behind.
+func sweep(cli dockerapi.Client, ctx context.Context, prov provider.Provider, matcher *events.Matcher, opts cleanup.Options, workers int, w io.Writer) error {
+	registry := cleanup.NewRegistry(prov.JobLabel(), nil)
+	pool := cleanup.NewPool(cli, workers, opts, nil)
+
+	var mu sync.Mutex
+	var reports []*cleanup.Report
+	pool.OnReport(func(report *cleanup.Report) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, report)
+	})
+	reconciliation, err := events.Reconcile(cli, ctx, prov, matcher, opts, registry, pool)
+	if err != nil {
+		pool.Shutdown(ctx)
+		return err
+	}
+	for _, job := range reconciliation.Jobs {
+		for _, c := range job.Containers {
+			fmt.Fprintf(w, "Stale job container %s (%s) of job %s is %s.\n", strings.TrimPrefix(c.Name, "/"), c.ID, job.Job, c.State)
+		}
+	}
+
+	if err := pool.Shutdown(ctx); err != nil {
+		return fmt.Errorf("failed to complete cleanups: %w", err)
+	}
+
+	sort.Slice(reports, func(i, j int) bool { return reports[i].JobID < reports[j].JobID })
+	failed := 0
+	for _, report := range reports {
+		fmt.Fprintf(w, "Cleanup of job %s: %s.\n", report.JobID, report.Summary())
+		if report.Failed() {
+			failed++
+		}
+	}
+
+	if _, err := fmt.Fprintf(w, "Swept %d stale job containers.\n", reconciliation.Containers()); err != nil {
+		return err
+	}
+	if failed > 0 {
+		return fmt.Errorf("failed to clean up %d of %d jobs", failed, len(reports))
+	}
+	return nil
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/events"
+	"job-detection.is/github-gitlab/metrics"
+	"job-detection.is/github-gitlab/notify"
+	"job-detection.is/github-gitlab/store"
+	"job-detection.is/github-gitlab/tracing"
+)
+
+// shutdownTimeout bounds how long pending cleanups may run after a termination signal.
+const shutdownTimeout = 2 * time.Minute
+
+// runWatch runs the event daemon. It:
+// 1. Loads the configuration and reloads it when the file changes or on SIGHUP.
+// 2. Creates a Docker client.
+// 3. Monitors Docker events, reconnecting when the stream drops.
+// 4. Resumes the jobs recorded in the state file by a previous run.
+// 5. Cleans up the job containers that exited while no watcher was running.
+// 6. Cleans up finished jobs on a bounded worker pool, recording them in the state file.
+// 7. Collects the orphaned job resources periodically, when enabled in the configuration.
+// 8. Prunes images and build cache when the disk fills up, when enabled in the configuration.
+// 9. Exposes Prometheus metrics over HTTP, when a metrics address is set.
+// 10. Records every resource removed in the audit log, when one is set.
+// 11. Traces each job from its start to its cleanup, when a trace exporter is set.
+// 12. Notifies webhooks of failed cleanups and leaked resources, when enabled in the configuration.
+// 13. Handles system signals (SIGINT, SIGTERM) for graceful shutdown, draining pending cleanups
+// and notifications.
+func runWatch(global *globalOptions, args []string) error {
+	flags := newFlagSet("watch")
+	dryRun := flags.Bool("dry-run", false, "Log the cleanup plan of finished jobs without removing anything")
+	workers := flags.Int("workers", 4, "Maximum number of jobs cleaned up in parallel")
+	statePath := flags.String("state", "job-detection.state.json", "State file recording jobs across restarts, empty to disable")
+	metricsAddr := flags.String("metrics-addr", "", "Address serving Prometheus metrics on /metrics, such as :9090, empty to disable")
+	if err := parseFlags(flags, args); err != nil {
+		return err
+	}
+
+	configWatcher, err := watchConfig(global)
+	if err != nil {
+		return err
+	}
+
+	var journal cleanup.Journal
+	var st *store.Store
+	var recovered int
+	if *statePath != "" {
+		st, err = store.Open(*statePath, global.logger)
+		if err != nil {
+			return err
+		}
+		journal = st
+		recovered = len(st.Jobs())
+	}
+
+	dockerClient, err := newClient(global)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err := dockerClient.Close(); err != nil {
+			global.logger.Error("Error closing Docker client", cleanup.ErrorAttr(err))
+		}
+	}()
+	cli := tracing.Client(dockerClient)
+
+	auditLog, err := openAudit(global)
+	if err != nil {
+		return err
+	}
+	if auditLog != nil {
+		defer auditLog.Close()
+	}
+
+	registry := cleanup.NewRegistry(global.provider.JobLabel(), journal)
+	opts := cleanup.DefaultOptions()
+	opts.DryRun = *dryRun
+	opts.Logger = global.logger
+	if auditLog != nil {
+		opts.Auditor = auditLog
+	}
+	pool := cleanup.NewPool(cli, *workers, opts, journal)
+	notifier := notify.New(func() notify.Config { return configWatcher.Config().NotificationSettings() }, global.logger)
+	pool.OnReport(notifier.ObserveReport)
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if *metricsAddr != "" {
+		addr, err := metrics.Serve(ctx, *metricsAddr, global.logger)
+		if err != nil {
+			return err
+		}
+		metrics.ObservePool(pool)
+		global.logger.Info("Serving metrics", "url", "http://"+addr.String()+"/metrics")
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+	configWatcher.Start(ctx, hup)
+
+	eventCh, stateCh := events.MonitorContainerEvents(cli, ctx, events.DefaultBackoff())
+
+	// Events are buffered while the recorded jobs are resumed
+	if recovered > 0 {
+		submitted, err := events.Recover(cli, ctx, st, configWatcher.Config().Matcher(), registry, pool)
+		if err != nil {
+			global.logger.Error("Failed to recover jobs", "state", *statePath, cleanup.ErrorAttr(err))
+		} else {
+			global.logger.Info("Recovered jobs", "state", *statePath, "jobs", recovered, "submitted", submitted)
+		}
+	}
+
+	// Job containers that exited while no watcher was running never send a die event
+	reconciliation, err := events.Reconcile(cli, ctx, global.provider, configWatcher.Config().Matcher(), opts, registry, pool)
+	if err != nil {
+		global.logger.Error("Failed to reconcile stale job containers", cleanup.ErrorAttr(err))
+	} else {
+		logReconciliation(global.logger, reconciliation)
+	}
+
+	// Resources whose cleanup was missed are collected once they outlive their TTL
+	go events.RunGC(cli, ctx, global.provider, configWatcher.Config, registry, pool)
+
+	// Images and build cache are pruned when the data root runs out of space
+	go events.RunDiskMonitor(cli, ctx, configWatcher.Config, opts)
+
+	go func() {
+		for {
+			select {
+			case event, ok := <-eventCh:
+				if !ok {
+					return
+				}
+				events.HandleEvent(cli, event, global.provider, configWatcher.Config().Matcher(), registry, pool)
+			case change, ok := <-stateCh:
+				if !ok {
+					return
+				}
+				if change.State == events.StateDisconnected {
+					global.logger.Warn(change.String())
+				} else {
+					global.logger.Info(change.String())
+				}
+			}
+		}
+	}()
+
+	<-ctx.Done()
+
+	// Let the cleanups already submitted complete before exiting
+	global.logger.Info("Shutting down, waiting for pending cleanups", "pending", pool.Pending())
+	drainCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := pool.Shutdown(drainCtx); err != nil {
+		global.logger.Error("Failed to complete pending cleanups", cleanup.ErrorAttr(err))
+	}
+	if err := notifier.Shutdown(drainCtx); err != nil {
+		global.logger.Error("Failed to deliver pending notifications", cleanup.ErrorAttr(err))
+	}
+	return nil
+}
+
+// logReconciliation logs the stale jobs found on startup and when their cleanup starts.
+func logReconciliation(logger *slog.Logger, reconciliation events.Reconciliation) {
+	for _, job := range reconciliation.Jobs {
+		switch {
+		case !job.Submitted:
+			logger.Warn("Skipping cleanup of stale job, shutting down", cleanup.LogJobID, job.Job.ID)
+		default:
+			logger.Info("Job finished while the watcher was down, cleaning up", cleanup.LogJobID, job.Job.ID, "job", job.Job.String(), "containers", len(job.Containers), "delay", job.Delay.Round(time.Second).String())
+		}
+	}
+	logger.Info("Reconciled stale job containers", "containers", reconciliation.Containers(), "jobs", len(reconciliation.Jobs))
+}
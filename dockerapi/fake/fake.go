@@ -0,0 +1,700 @@
+// Package fake provides an in-memory Docker daemon implementing dockerapi.Client. It tracks
+// containers, networks, volumes and services, and emits the events a real daemon would, so the
+// watcher and the cleanup can be exercised end to end without a Docker socket.
+package fake
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/mount"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/volume"
+	"github.com/docker/docker/errdefs"
+	"job-detection.is/github-gitlab/dockerapi"
+)
+
+// eventBuffer is the number of events a subscriber may lag behind before the daemon blocks.
+const eventBuffer = 1024
+
+// historySize is the number of past events kept for replay, as in the daemon's events log.
+const historySize = 256
+
+// ContainerSpec describes a container to create on the fake daemon.
+type ContainerSpec struct {
+	Name     string
+	Image    string
+	Labels   map[string]string
+	Networks []string
+	Volumes  []string
+}
+
+// Daemon is an in-memory Docker daemon. It is safe for concurrent use.
+type Daemon struct {
+	mu          sync.Mutex
+	seq         int
+	lastEvent   int64
+	skew        time.Duration
+	containers  []*types.Container
+	networks    []*network.Summary
+	volumes     []*volume.Volume
+	services    []*swarm.Service
+	swarm       bool
+	subscribers map[int]*subscriber
+	history     []events.Message
+	refuse      int
+	exits       map[string]exit
+	images      []*image.Summary
+	buildCache  []*types.BuildCache
+}
+
+// exit records how and when a container exited.
+type exit struct {
+	code int
+	at   time.Time
+}
+
+type subscriber struct {
+	types   map[string]struct{}
+	eventCh chan events.Message
+	errCh   chan error
+	done    chan struct{}
+}
+
+// wants reports whether the subscriber filters in events of the given type.
+func (s *subscriber) wants(eventType events.Type) bool {
+	_, wanted := s.types[string(eventType)]
+	return len(s.types) == 0 || wanted
+}
+
+var _ dockerapi.Client = (*Daemon)(nil)
+
+// NewDaemon returns a daemon holding only the predefined bridge, host and none networks.
+func NewDaemon() *Daemon {
+	d := &Daemon{subscribers: make(map[int]*subscriber), exits: make(map[string]exit)}
+	for _, name := range []string{"bridge", "host", "none"} {
+		d.networks = append(d.networks, &network.Summary{ID: d.newID(name), Name: name, Driver: name, Scope: "local"})
+	}
+	return d
+}
+
+// CreateContainer creates a container in the created state and returns its ID. Volumes that do
+// not exist yet are created, as the daemon does for named volumes.
+func (d *Daemon) CreateContainer(spec ContainerSpec) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := d.newID(spec.Name)
+	c := &types.Container{
+		ID:              id,
+		Names:           []string{"/" + spec.Name},
+		Image:           spec.Image,
+		Created:         time.Now().Unix(),
+		Labels:          copyLabels(spec.Labels),
+		State:           "created",
+		NetworkSettings: &types.SummaryNetworkSettings{Networks: make(map[string]*network.EndpointSettings)},
+	}
+
+	for _, name := range spec.Networks {
+		if n := d.findNetwork(name); n != nil {
+			c.NetworkSettings.Networks[n.Name] = &network.EndpointSettings{NetworkID: n.ID}
+		}
+	}
+
+	for _, name := range spec.Volumes {
+		if d.findVolume(name) == nil {
+			d.volumes = append(d.volumes, &volume.Volume{Name: name, CreatedAt: time.Now().UTC().Format(time.RFC3339), Driver: "local", Scope: "local"})
+			d.publish(events.VolumeEventType, events.ActionCreate, name, map[string]string{"driver": "local"})
+		}
+		c.Mounts = append(c.Mounts, types.MountPoint{Type: mount.TypeVolume, Name: name})
+	}
+
+	d.containers = append(d.containers, c)
+	d.publishContainer(c, events.ActionCreate, nil)
+	return id
+}
+
+// StartContainer moves the container to the running state.
+func (d *Daemon) StartContainer(containerID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.findContainer(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("No such container: %s", containerID))
+	}
+	c.State = "running"
+	c.Status = "Up"
+	d.publishContainer(c, events.ActionStart, nil)
+	return nil
+}
+
+// ExitContainer makes a running container exit with the given code, as when its process ends.
+func (d *Daemon) ExitContainer(containerID string, exitCode int) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.findContainer(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("No such container: %s", containerID))
+	}
+	if c.State != "running" {
+		return errdefs.Conflict(fmt.Errorf("container %s is not running", containerID))
+	}
+	d.exit(c, exitCode)
+	d.publishContainer(c, events.ActionDie, map[string]string{"exitCode": strconv.Itoa(exitCode)})
+	return nil
+}
+
+// AgeContainer moves the exit time of an exited container back by age, as if it exited earlier.
+func (d *Daemon) AgeContainer(containerID string, age time.Duration) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.findContainer(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("No such container: %s", containerID))
+	}
+	exited, ok := d.exits[c.ID]
+	if !ok {
+		return errdefs.Conflict(fmt.Errorf("container %s did not exit", containerID))
+	}
+	exited.at = exited.at.Add(-age)
+	d.exits[c.ID] = exited
+	return nil
+}
+
+// AddNetwork creates a network and returns its ID.
+func (d *Daemon) AddNetwork(name string, labels map[string]string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := d.newID(name)
+	d.networks = append(d.networks, &network.Summary{ID: id, Name: name, Created: time.Now(), Driver: "bridge", Scope: "local", Labels: copyLabels(labels)})
+	d.publish(events.NetworkEventType, events.ActionCreate, id, map[string]string{"name": name, "type": "bridge"})
+	return id
+}
+
+// AddVolume creates a volume.
+func (d *Daemon) AddVolume(name string, labels map[string]string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.volumes = append(d.volumes, &volume.Volume{Name: name, CreatedAt: time.Now().UTC().Format(time.RFC3339), Driver: "local", Scope: "local", Labels: copyLabels(labels)})
+	d.publish(events.VolumeEventType, events.ActionCreate, name, map[string]string{"driver": "local"})
+}
+
+// AddService creates a service and returns its ID. The daemon becomes a swarm manager.
+func (d *Daemon) AddService(name string, labels map[string]string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := d.newID(name)
+	d.swarm = true
+	d.services = append(d.services, &swarm.Service{ID: id, Meta: swarm.Meta{CreatedAt: time.Now()}, Spec: swarm.ServiceSpec{Annotations: swarm.Annotations{Name: name, Labels: copyLabels(labels)}}})
+	d.publish(events.ServiceEventType, events.ActionCreate, id, map[string]string{"name": name})
+	return id
+}
+
+// HasContainer reports whether the container exists.
+func (d *Daemon) HasContainer(containerID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findContainer(containerID) != nil
+}
+
+// ContainerState returns the state of the container, or an empty string if it does not exist.
+func (d *Daemon) ContainerState(containerID string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c := d.findContainer(containerID); c != nil {
+		return c.State
+	}
+	return ""
+}
+
+// HasNetwork reports whether a network with the given name or ID exists.
+func (d *Daemon) HasNetwork(nameOrID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findNetwork(nameOrID) != nil
+}
+
+// HasVolume reports whether the volume exists.
+func (d *Daemon) HasVolume(name string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findVolume(name) != nil
+}
+
+// HasService reports whether the service exists.
+func (d *Daemon) HasService(serviceID string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findService(serviceID) != nil
+}
+
+// Disconnect closes every open event stream with the given error, as when the daemon restarts.
+func (d *Daemon) Disconnect(err error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, sub := range d.subscribers {
+		delete(d.subscribers, key)
+		close(sub.done)
+		sub.errCh <- err
+	}
+}
+
+// RefuseConnections makes the next n event subscriptions fail, as while the daemon is down.
+func (d *Daemon) RefuseConnections(n int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.refuse = n
+}
+
+// SetClockSkew offsets the daemon's clock from the host's, as for a remote daemon. Event
+// timestamps and the system time reported by Info follow the offset clock.
+func (d *Daemon) SetClockSkew(skew time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.skew = skew
+}
+
+// Events subscribes to the events emitted by the daemon. The "type" filter is honored, and past
+// events still in the history are replayed first when options.Since is set.
+func (d *Daemon) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	sub := &subscriber{
+		types:   make(map[string]struct{}),
+		eventCh: make(chan events.Message, eventBuffer),
+		errCh:   make(chan error, 1),
+		done:    make(chan struct{}),
+	}
+	for _, eventType := range options.Filters.Get("type") {
+		sub.types[eventType] = struct{}{}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.refuse > 0 {
+		d.refuse--
+		sub.errCh <- errors.New("Cannot connect to the Docker daemon at unix:///var/run/docker.sock. Is the docker daemon running?")
+		return sub.eventCh, sub.errCh
+	}
+
+	if options.Since != "" {
+		since, err := parseTimestamp(options.Since)
+		if err != nil {
+			sub.errCh <- errdefs.InvalidParameter(err)
+			return sub.eventCh, sub.errCh
+		}
+		for _, message := range d.history {
+			if message.TimeNano >= since && sub.wants(message.Type) {
+				sub.eventCh <- message
+			}
+		}
+	}
+
+	d.seq++
+	key := d.seq
+	d.subscribers[key] = sub
+
+	go func() {
+		select {
+		case <-ctx.Done():
+		case <-sub.done:
+			return
+		}
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		if _, open := d.subscribers[key]; open {
+			delete(d.subscribers, key)
+			sub.errCh <- ctx.Err()
+		}
+	}()
+
+	return sub.eventCh, sub.errCh
+}
+
+// ContainerInspect returns the details of a container.
+func (d *Daemon) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.findContainer(containerID)
+	if c == nil {
+		return types.ContainerJSON{}, errdefs.NotFound(fmt.Errorf("No such container: %s", containerID))
+	}
+
+	return types.ContainerJSON{
+		ContainerJSONBase: &types.ContainerJSONBase{
+			ID:      c.ID,
+			Name:    c.Names[0],
+			Image:   c.Image,
+			Created: time.Unix(c.Created, 0).UTC().Format(time.RFC3339Nano),
+			State:   d.containerState(c),
+		},
+		Config: &container.Config{
+			Image:  c.Image,
+			Labels: copyLabels(c.Labels),
+		},
+	}, nil
+}
+
+// ContainerList returns the running containers, or all of them when options.All is set.
+func (d *Daemon) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var containers []types.Container
+	for _, c := range d.containers {
+		if options.All || c.State == "running" {
+			containers = append(containers, copyContainer(c))
+		}
+	}
+	return containers, nil
+}
+
+// ContainerStop stops a running container.
+func (d *Daemon) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.findContainer(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("No such container: %s", containerID))
+	}
+	if c.State != "running" {
+		return nil
+	}
+	d.exit(c, 143)
+	d.publishContainer(c, events.ActionDie, map[string]string{"exitCode": "143"})
+	d.publishContainer(c, events.ActionStop, nil)
+	return nil
+}
+
+// ContainerRemove removes a container. Running containers are only removed with options.Force.
+func (d *Daemon) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	c := d.findContainer(containerID)
+	if c == nil {
+		return errdefs.NotFound(fmt.Errorf("No such container: %s", containerID))
+	}
+	if c.State == "running" {
+		if !options.Force {
+			return errdefs.Conflict(fmt.Errorf("cannot remove running container %s", containerID))
+		}
+		d.exit(c, 137)
+		d.publishContainer(c, events.ActionKill, map[string]string{"signal": "9"})
+		d.publishContainer(c, events.ActionDie, map[string]string{"exitCode": "137"})
+	}
+
+	for i, candidate := range d.containers {
+		if candidate == c {
+			d.containers = append(d.containers[:i], d.containers[i+1:]...)
+			break
+		}
+	}
+	delete(d.exits, c.ID)
+	d.publishContainer(c, events.ActionDestroy, nil)
+	return nil
+}
+
+// NetworkList returns all networks.
+func (d *Daemon) NetworkList(ctx context.Context, options network.ListOptions) ([]network.Summary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	networks := make([]network.Summary, 0, len(d.networks))
+	for _, n := range d.networks {
+		copied := *n
+		copied.Labels = copyLabels(n.Labels)
+		networks = append(networks, copied)
+	}
+	return networks, nil
+}
+
+// NetworkRemove removes a network that no container is connected to.
+func (d *Daemon) NetworkRemove(ctx context.Context, networkID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	n := d.findNetwork(networkID)
+	if n == nil {
+		return errdefs.NotFound(fmt.Errorf("network %s not found", networkID))
+	}
+	switch n.Name {
+	case "bridge", "host", "none":
+		return errdefs.Forbidden(fmt.Errorf("%s is a pre-defined network and cannot be removed", n.Name))
+	}
+	for _, c := range d.containers {
+		if _, connected := c.NetworkSettings.Networks[n.Name]; connected {
+			return errdefs.Forbidden(fmt.Errorf("error while removing network: network %s id %s has active endpoints", n.Name, n.ID))
+		}
+	}
+
+	for i, candidate := range d.networks {
+		if candidate == n {
+			d.networks = append(d.networks[:i], d.networks[i+1:]...)
+			break
+		}
+	}
+	d.publish(events.NetworkEventType, events.ActionDestroy, n.ID, map[string]string{"name": n.Name, "type": n.Driver})
+	return nil
+}
+
+// VolumeList returns all volumes.
+func (d *Daemon) VolumeList(ctx context.Context, options volume.ListOptions) (volume.ListResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var response volume.ListResponse
+	for _, v := range d.volumes {
+		copied := *v
+		copied.Labels = copyLabels(v.Labels)
+		response.Volumes = append(response.Volumes, &copied)
+	}
+	return response, nil
+}
+
+// VolumeRemove removes a volume that no container mounts. With force, missing volumes are ignored.
+func (d *Daemon) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	v := d.findVolume(volumeID)
+	if v == nil {
+		if force {
+			return nil
+		}
+		return errdefs.NotFound(fmt.Errorf("get %s: no such volume", volumeID))
+	}
+	for _, c := range d.containers {
+		for _, m := range c.Mounts {
+			if m.Name == v.Name {
+				return errdefs.Conflict(fmt.Errorf("remove %s: volume is in use - [%s]", v.Name, c.ID))
+			}
+		}
+	}
+
+	for i, candidate := range d.volumes {
+		if candidate == v {
+			d.volumes = append(d.volumes[:i], d.volumes[i+1:]...)
+			break
+		}
+	}
+	d.publish(events.VolumeEventType, events.ActionDestroy, v.Name, map[string]string{"driver": v.Driver})
+	return nil
+}
+
+// ServiceList returns all services. It fails unless the daemon is a swarm manager.
+func (d *Daemon) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if !d.swarm {
+		return nil, errdefs.Unavailable(errors.New("This node is not a swarm manager. Use \"docker swarm init\" or \"docker swarm join\" to connect this node to swarm and try again."))
+	}
+
+	services := make([]swarm.Service, 0, len(d.services))
+	for _, s := range d.services {
+		copied := *s
+		copied.Spec.Labels = copyLabels(s.Spec.Labels)
+		services = append(services, copied)
+	}
+	return services, nil
+}
+
+// ServiceRemove removes a service.
+func (d *Daemon) ServiceRemove(ctx context.Context, serviceID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	s := d.findService(serviceID)
+	if s == nil {
+		return errdefs.NotFound(fmt.Errorf("service %s not found", serviceID))
+	}
+	for i, candidate := range d.services {
+		if candidate == s {
+			d.services = append(d.services[:i], d.services[i+1:]...)
+			break
+		}
+	}
+	d.publish(events.ServiceEventType, events.ActionRemove, s.ID, map[string]string{"name": s.Spec.Name})
+	return nil
+}
+
+// exit moves the container to the exited state. The caller must hold d.mu.
+func (d *Daemon) exit(c *types.Container, exitCode int) {
+	c.State = "exited"
+	c.Status = fmt.Sprintf("Exited (%d)", exitCode)
+	d.exits[c.ID] = exit{code: exitCode, at: time.Now()}
+}
+
+// containerState returns the state of the container as inspected. The caller must hold d.mu.
+func (d *Daemon) containerState(c *types.Container) *types.ContainerState {
+	state := &types.ContainerState{
+		Status:     c.State,
+		Running:    c.State == "running",
+		FinishedAt: "0001-01-01T00:00:00Z",
+	}
+	if exited, ok := d.exits[c.ID]; ok {
+		state.ExitCode = exited.code
+		state.FinishedAt = exited.at.UTC().Format(time.RFC3339Nano)
+	}
+	return state
+}
+
+// newID returns a unique 64 character identifier. The caller must hold d.mu.
+func (d *Daemon) newID(name string) string {
+	d.seq++
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d", name, d.seq)))
+	return hex.EncodeToString(sum[:])
+}
+
+func (d *Daemon) findContainer(idOrName string) *types.Container {
+	for _, c := range d.containers {
+		if c.ID == idOrName || c.Names[0] == "/"+strings.TrimPrefix(idOrName, "/") {
+			return c
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) findNetwork(idOrName string) *network.Summary {
+	for _, n := range d.networks {
+		if n.ID == idOrName || n.Name == idOrName {
+			return n
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) findVolume(name string) *volume.Volume {
+	for _, v := range d.volumes {
+		if v.Name == name {
+			return v
+		}
+	}
+	return nil
+}
+
+func (d *Daemon) findService(idOrName string) *swarm.Service {
+	for _, s := range d.services {
+		if s.ID == idOrName || s.Spec.Name == idOrName {
+			return s
+		}
+	}
+	return nil
+}
+
+// publishContainer emits a container event whose attributes carry the container labels, name
+// and image, as the daemon does. The caller must hold d.mu.
+func (d *Daemon) publishContainer(c *types.Container, action events.Action, extra map[string]string) {
+	attributes := copyLabels(c.Labels)
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	attributes["name"] = strings.TrimPrefix(c.Names[0], "/")
+	attributes["image"] = c.Image
+	for key, value := range extra {
+		attributes[key] = value
+	}
+	d.publish(events.ContainerEventType, action, c.ID, attributes)
+}
+
+// publish delivers an event to every subscriber interested in its type. The caller must hold d.mu.
+func (d *Daemon) publish(eventType events.Type, action events.Action, actorID string, attributes map[string]string) {
+	now := time.Now().Add(d.skew).UnixNano()
+	if now <= d.lastEvent {
+		now = d.lastEvent + 1
+	}
+	d.lastEvent = now
+
+	message := events.Message{
+		Type:     eventType,
+		Action:   action,
+		Actor:    events.Actor{ID: actorID, Attributes: attributes},
+		Scope:    "local",
+		Time:     now / int64(time.Second),
+		TimeNano: now,
+	}
+	if eventType == events.ContainerEventType {
+		message.ID = actorID
+		message.Status = string(action)
+		message.From = attributes["image"]
+	}
+
+	d.history = append(d.history, message)
+	if len(d.history) > historySize {
+		d.history = d.history[len(d.history)-historySize:]
+	}
+
+	keys := make([]int, 0, len(d.subscribers))
+	for key := range d.subscribers {
+		keys = append(keys, key)
+	}
+	sort.Ints(keys)
+	for _, key := range keys {
+		if sub := d.subscribers[key]; sub.wants(eventType) {
+			sub.eventCh <- message
+		}
+	}
+}
+
+// parseTimestamp parses a "seconds.nanoseconds" timestamp as used by the Since option.
+func parseTimestamp(value string) (int64, error) {
+	seconds, nanoseconds, _ := strings.Cut(value, ".")
+	sec, err := strconv.ParseInt(seconds, 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid timestamp %q: %w", value, err)
+	}
+	var nsec int64
+	if nanoseconds != "" {
+		nanoseconds = (nanoseconds + "000000000")[:9]
+		if nsec, err = strconv.ParseInt(nanoseconds, 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid timestamp %q: %w", value, err)
+		}
+	}
+	return sec*int64(time.Second) + nsec, nil
+}
+
+func copyContainer(c *types.Container) types.Container {
+	copied := *c
+	copied.Names = append([]string(nil), c.Names...)
+	copied.Labels = copyLabels(c.Labels)
+	copied.Mounts = append([]types.MountPoint(nil), c.Mounts...)
+	copied.NetworkSettings = &types.SummaryNetworkSettings{Networks: make(map[string]*network.EndpointSettings)}
+	for name, endpoint := range c.NetworkSettings.Networks {
+		settings := *endpoint
+		copied.NetworkSettings.Networks[name] = &settings
+	}
+	return copied
+}
+
+func copyLabels(labels map[string]string) map[string]string {
+	if labels == nil {
+		return nil
+	}
+	copied := make(map[string]string, len(labels))
+	for key, value := range labels {
+		copied[key] = value
+	}
+	return copied
+}
@@ -0,0 +1,287 @@
+package fake
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/errdefs"
+)
+
+// DataRoot is the data root directory reported by the fake daemon.
+const DataRoot = "/var/lib/docker"
+
+// AddImage adds an image of the given size and returns its ID. An empty reference adds a
+// dangling image, as left behind when a tag moves to a newer build.
+func (d *Daemon) AddImage(ref string, size int64, labels map[string]string) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	id := "sha256:" + d.newID(ref)
+	img := &image.Summary{ID: id, Created: time.Now().Unix(), Size: size, Labels: copyLabels(labels), Containers: -1}
+	if ref != "" {
+		img.RepoTags = []string{ref}
+	}
+	d.images = append(d.images, img)
+
+	// Like the daemon, the event carries the labels of the image
+	attributes := copyLabels(labels)
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	attributes["name"] = ref
+	d.publish(events.ImageEventType, events.ActionTag, id, attributes)
+	return id
+}
+
+// TagImage adds a tag to an image, found by ID or tag, and publishes its tag event.
+func (d *Daemon) TagImage(idOrRef, tag string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img := d.findImage(idOrRef)
+	if img == nil {
+		return errdefs.NotFound(fmt.Errorf("No such image: %s", idOrRef))
+	}
+	img.RepoTags = append(img.RepoTags, tag)
+
+	attributes := copyLabels(img.Labels)
+	if attributes == nil {
+		attributes = make(map[string]string)
+	}
+	attributes["name"] = tag
+	d.publish(events.ImageEventType, events.ActionTag, img.ID, attributes)
+	return nil
+}
+
+// AddBuildCache adds a build cache record of the given size.
+func (d *Daemon) AddBuildCache(id string, size int64, inUse bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	d.buildCache = append(d.buildCache, &types.BuildCache{ID: id, Type: "regular", Size: size, InUse: inUse, CreatedAt: now, LastUsedAt: &now})
+}
+
+// HasImage reports whether the image exists, by ID or tag.
+func (d *Daemon) HasImage(idOrRef string) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.findImage(idOrRef) != nil
+}
+
+// DataSize returns the size of the images and build cache, as used on the data root.
+func (d *Daemon) DataSize() int64 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	size := int64(0)
+	for _, img := range d.images {
+		size += img.Size
+	}
+	for _, record := range d.buildCache {
+		size += record.Size
+	}
+	return size
+}
+
+// ImageList returns the images, only the dangling ones when filtered with dangling=true.
+func (d *Daemon) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	danglingOnly := hasFilter(options.Filters, "dangling", "true")
+	var images []image.Summary
+	for _, img := range d.images {
+		if danglingOnly && len(img.RepoTags) > 0 {
+			continue
+		}
+		copied := *img
+		copied.RepoTags = append([]string(nil), img.RepoTags...)
+		copied.Labels = copyLabels(img.Labels)
+		images = append(images, copied)
+	}
+	return images, nil
+}
+
+// ImageRemove removes an image by ID or tag. Like the daemon, removing one of several tags only
+// untags the image, and an image with several tags is only removed by ID with options.Force.
+// Images used by a container are only removed with options.Force.
+func (d *Daemon) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	img := d.findImage(imageID)
+	if img == nil {
+		return nil, errdefs.NotFound(fmt.Errorf("No such image: %s", imageID))
+	}
+	for i, tag := range img.RepoTags {
+		if tag == imageID && len(img.RepoTags) > 1 {
+			img.RepoTags = append(img.RepoTags[:i:i], img.RepoTags[i+1:]...)
+			return []image.DeleteResponse{{Untagged: tag}}, nil
+		}
+	}
+	if len(img.RepoTags) > 1 && !options.Force {
+		return nil, errdefs.Conflict(fmt.Errorf("conflict: unable to delete %s (must be forced) - image is referenced in multiple repositories", imageID))
+	}
+	if d.imageInUse(img) && !options.Force {
+		return nil, errdefs.Conflict(fmt.Errorf("conflict: unable to remove image %s, it is being used by a container", imageID))
+	}
+	return d.removeImage(img), nil
+}
+
+// ImagesPrune removes the unused dangling images, or every unused image with dangling=false.
+func (d *Daemon) ImagesPrune(ctx context.Context, pruneFilters filters.Args) (image.PruneReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	all := hasFilter(pruneFilters, "dangling", "false")
+	var report image.PruneReport
+	for _, img := range append([]*image.Summary(nil), d.images...) {
+		if (!all && len(img.RepoTags) > 0) || d.imageInUse(img) {
+			continue
+		}
+		report.ImagesDeleted = append(report.ImagesDeleted, d.removeImage(img)...)
+		report.SpaceReclaimed += uint64(img.Size)
+	}
+	return report, nil
+}
+
+// BuildCachePrune removes the build cache records that are not in use, least recently used
+// first, until the cache fits in opts.KeepStorage.
+func (d *Daemon) BuildCachePrune(ctx context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	size := int64(0)
+	for _, record := range d.buildCache {
+		size += record.Size
+	}
+
+	candidates := append([]*types.BuildCache(nil), d.buildCache...)
+	sort.SliceStable(candidates, func(i, j int) bool { return candidates[i].LastUsedAt.Before(*candidates[j].LastUsedAt) })
+
+	report := &types.BuildCachePruneReport{}
+	removed := make(map[string]struct{})
+	for _, record := range candidates {
+		if opts.KeepStorage > 0 && size <= opts.KeepStorage {
+			break
+		}
+		if record.InUse {
+			continue
+		}
+		removed[record.ID] = struct{}{}
+		size -= record.Size
+		report.CachesDeleted = append(report.CachesDeleted, record.ID)
+		report.SpaceReclaimed += uint64(record.Size)
+	}
+
+	kept := d.buildCache[:0]
+	for _, record := range d.buildCache {
+		if _, deleted := removed[record.ID]; !deleted {
+			kept = append(kept, record)
+		}
+	}
+	d.buildCache = kept
+	return report, nil
+}
+
+// Info returns the daemon information, including its data root directory.
+func (d *Daemon) Info(ctx context.Context) (system.Info, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	return system.Info{
+		ID:            "fake",
+		Name:          "fake",
+		Driver:        "overlay2",
+		DockerRootDir: DataRoot,
+		Containers:    len(d.containers),
+		Images:        len(d.images),
+		SystemTime:    time.Now().Add(d.skew).Format(time.RFC3339Nano),
+	}, nil
+}
+
+// DiskUsage returns the space used by the images and the build cache.
+func (d *Daemon) DiskUsage(ctx context.Context, options types.DiskUsageOptions) (types.DiskUsage, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	var usage types.DiskUsage
+	for _, img := range d.images {
+		copied := *img
+		usage.Images = append(usage.Images, &copied)
+		usage.LayersSize += img.Size
+	}
+	for _, record := range d.buildCache {
+		copied := *record
+		usage.BuildCache = append(usage.BuildCache, &copied)
+	}
+	return usage, nil
+}
+
+// findImage returns the image with the ID or tag. The caller must hold d.mu.
+func (d *Daemon) findImage(idOrRef string) *image.Summary {
+	for _, img := range d.images {
+		if img.ID == idOrRef || strings.TrimPrefix(img.ID, "sha256:") == idOrRef {
+			return img
+		}
+		for _, tag := range img.RepoTags {
+			if tag == idOrRef {
+				return img
+			}
+		}
+	}
+	return nil
+}
+
+// imageInUse reports whether a container uses the image. The caller must hold d.mu.
+func (d *Daemon) imageInUse(img *image.Summary) bool {
+	for _, c := range d.containers {
+		if c.ImageID == img.ID || c.Image == img.ID {
+			return true
+		}
+		for _, tag := range img.RepoTags {
+			if c.Image == tag {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// removeImage removes the image and returns what was untagged and deleted. The caller must hold
+// d.mu.
+func (d *Daemon) removeImage(img *image.Summary) []image.DeleteResponse {
+	var deleted []image.DeleteResponse
+	for _, tag := range img.RepoTags {
+		deleted = append(deleted, image.DeleteResponse{Untagged: tag})
+	}
+	deleted = append(deleted, image.DeleteResponse{Deleted: img.ID})
+
+	for i, candidate := range d.images {
+		if candidate == img {
+			d.images = append(d.images[:i], d.images[i+1:]...)
+			break
+		}
+	}
+	d.publish(events.ImageEventType, events.ActionDelete, img.ID, map[string]string{"name": strings.Join(img.RepoTags, ",")})
+	return deleted
+}
+
+// hasFilter reports whether the filters set the field to the value.
+func hasFilter(args filters.Args, field, value string) bool {
+	for _, v := range args.Get(field) {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
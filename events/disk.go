@@ -0,0 +1,34 @@
+package events
+
+import (
+	"context"
+	"time"
+
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+)
+
+// RunDiskMonitor checks the free space of the daemon's data root at the interval of the
+// current configuration, pruning images and build cache when it runs low, until ctx is
+// canceled.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context stopping the monitoring when canceled.
+// - config: Returns the current configuration.
+// - opts: The options of the cleanup, before the default policy applies.
+func RunDiskMonitor(cli dockerapi.Client, ctx context.Context, config func() *Config, opts cleanup.Options) {
+	interval := func() time.Duration { return time.Duration(config().DiskPressureSettings().Interval) }
+	runPeriodically(ctx, interval, func() {
+		current := config()
+		pressure := current.DiskPressureSettings()
+		report, err := cleanup.RelieveDiskPressure(cli, ctx, &pressure, current.Matcher().DefaultPolicy().Apply(opts), nil)
+		if err != nil {
+			Logger().Error("Failed to relieve disk pressure", cleanup.ErrorAttr(err))
+			return
+		}
+		if !report.Triggered {
+			Logger().Debug("Disk usage checked", "data_root", report.DataRoot, "used_percent", report.Before.UsedPercent())
+		}
+	})
+}
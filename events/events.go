@@ -6,90 +6,335 @@
 package events
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
 	"os"
 	"path/filepath"
-	"regexp"
+	"strings"
+	"time"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/events"
-	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
 	"github.com/docker/docker/client"
+	"go.opentelemetry.io/otel/attribute"
 	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/metrics"
+	"job-detection.is/github-gitlab/notify"
+	"job-detection.is/github-gitlab/provider"
+	"job-detection.is/github-gitlab/tracing"
 )
 
+// ConfigVersion is the latest version of the configuration schema. Version 1 only lists the job
+// patterns under jobPattern; version 2 lists them under jobPatterns, each with an optional
+// cleanup policy, and adds the default policy, the protection rules, the garbage collection, the
+// disk pressure and the notification settings.
+const ConfigVersion = 2
+
 // Config holds the configuration for job patterns.
 type Config struct {
-	// JobPatterns contains regular expressions to match container names.
-	JobPatterns []string `json:"jobPattern"`
+	// Version is the version of the configuration schema. A missing version is inferred from the
+	// keys used.
+	Version int `json:"version,omitempty"`
+
+	// Defaults is the cleanup policy of every pattern, before the pattern's own policy applies.
+	Defaults *cleanup.Policy `json:"defaults,omitempty"`
+
+	// Patterns lists the job patterns of a version 2 configuration along with their policies.
+	Patterns []PatternConfig `json:"jobPatterns,omitempty"`
+
+	// JobPatterns contains regular expressions to match container names. In a version 2
+	// configuration it is filled from Patterns when the configuration is compiled.
+	JobPatterns []string `json:"jobPattern,omitempty"`
+
+	// Protect lists the rules protecting resources from every cleanup, in addition to the
+	// built-in networks.
+	Protect []cleanup.ProtectionRule `json:"protect,omitempty"`
+
+	// GC configures the periodic collection of orphaned job resources, disabled when unset.
+	GC *GCConfig `json:"gc,omitempty"`
+
+	// DiskPressure configures the pruning of images and build cache when the disk fills up,
+	// disabled when unset.
+	DiskPressure *cleanup.DiskPressure `json:"diskPressure,omitempty"`
+
+	// Notifications configures the webhooks notified of cleanup failures and leaked resources,
+	// disabled when unset.
+	Notifications *notify.Config `json:"notifications,omitempty"`
+
+	matcher    *Matcher
+	protection *cleanup.Protection
+}
+
+// PatternConfig is a job pattern with the cleanup policy of the jobs it matches. In the
+// configuration file, a pattern without a policy can be written as a plain string.
+type PatternConfig struct {
+	// Pattern is the regular expression matched against container names.
+	Pattern string `json:"pattern"`
+
+	// Policy overrides the default cleanup policy for the jobs matching the pattern.
+	Policy cleanup.Policy `json:"policy,omitempty"`
+}
+
+// UnmarshalJSON decodes a pattern written either as a string or as an object, rejecting
+// unknown keys.
+func (p *PatternConfig) UnmarshalJSON(data []byte) error {
+	if err := json.Unmarshal(data, &p.Pattern); err == nil {
+		return nil
+	}
+
+	type patternConfig PatternConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode((*patternConfig)(p)); err != nil {
+		return err
+	}
+	if p.Pattern == "" {
+		return errors.New("job pattern object without a pattern")
+	}
+	return nil
 }
 
-// LoadConfig loads the configuration from a JSON file.
+// LoadConfig loads the configuration from a JSON, YAML or TOML file, chosen by its extension.
+// Unknown keys are rejected, so that a misspelled setting is not silently ignored.
 //
 // Parameters:
-// - filename: The path to the JSON configuration file.
+// - filename: The path to the configuration file.
 //
 // Returns:
-// - *Config: The configuration structure.
-// - error: An error if the file could not be opened or the JSON could not be decoded.
+// - *Config: The configuration structure, with its job patterns compiled.
+// - error: An error if the file could not be read or decoded, the keys do not match the schema
+// version or a job pattern or policy is invalid.
 func LoadConfig(filename string) (*Config, error) {
 	safeFileName := filepath.Clean(filename)
 
-	file, err := os.Open(safeFileName)
+	data, err := os.ReadFile(safeFileName)
 	if err != nil {
 		return nil, err
 	}
-	defer file.Close()
 
 	var config Config
-	decoder := json.NewDecoder(file)
-	if err := decoder.Decode(&config); err != nil {
+	if err := decodeConfig(safeFileName, data, &config); err != nil {
+		return nil, err
+	}
+
+	if err := config.checkVersion(); err != nil {
+		return nil, err
+	}
+	if err := config.Compile(); err != nil {
 		return nil, err
 	}
+	for _, warning := range config.matcher.Warnings() {
+		Logger().Warn(warning)
+	}
 
 	return &config, nil
 }
 
-// MonitorContainerEvents sets up Docker event monitoring and returns channels for events and errors.
-//
-// Parameters:
-// - cli: The Docker client instance.
+// checkVersion checks that the keys used by the configuration belong to its schema version. A
+// configuration without a version is version 2 if it uses its keys, and version 1 otherwise.
+func (c *Config) checkVersion() error {
+	if c.Version == 0 {
+		c.Version = 1
+		if c.usesVersion2() {
+			c.Version = 2
+		}
+	}
+
+	switch c.Version {
+	case 1:
+		if c.usesVersion2() {
+			return fmt.Errorf("defaults, jobPatterns, protect, gc, diskPressure and notifications require config version %d", ConfigVersion)
+		}
+	case 2:
+		if c.JobPatterns != nil {
+			return errors.New("jobPattern was replaced by jobPatterns in config version 2, use only one of them")
+		}
+	default:
+		return fmt.Errorf("unsupported config version %d, expected 1 or %d", c.Version, ConfigVersion)
+	}
+	return nil
+}
+
+// usesVersion2 reports whether the configuration uses keys introduced in version 2.
+func (c *Config) usesVersion2() bool {
+	return c.Defaults != nil || c.Patterns != nil || c.Protect != nil || c.GC != nil || c.DiskPressure != nil || c.Notifications != nil
+}
+
+// Overrides holds the settings given in the environment or on the command line, which take
+// precedence over the configuration file.
+type Overrides struct {
+	// JobPatterns replaces the job patterns of the file, along with their policies.
+	JobPatterns []string
+
+	// Defaults overrides the fields it sets in the default policy of the file. The policies of
+	// the patterns still take precedence over the default policy.
+	Defaults cleanup.Policy
+
+	// Protect replaces the protection rules of the file when not nil, none if empty.
+	Protect []cleanup.ProtectionRule
+
+	// GC, DiskPressure and Notifications replace the sections of the file when not nil.
+	GC            *GCConfig
+	DiskPressure  *cleanup.DiskPressure
+	Notifications *notify.Config
+}
+
+// Override applies the overrides to the configuration. Compile must be called afterwards.
+func (c *Config) Override(overrides Overrides) {
+	if len(overrides.JobPatterns) > 0 {
+		c.Patterns = nil
+		c.JobPatterns = overrides.JobPatterns
+	}
+
+	var defaults cleanup.Policy
+	if c.Defaults != nil {
+		defaults = *c.Defaults
+	}
+	defaults = defaults.Merge(overrides.Defaults)
+	c.Defaults = &defaults
+
+	// The sections are copied, since compiling them stores their compiled form and every reload
+	// compiles the overrides again
+	if overrides.Protect != nil {
+		c.Protect = overrides.Protect
+	}
+	if overrides.GC != nil {
+		gc := *overrides.GC
+		c.GC = &gc
+	}
+	if overrides.DiskPressure != nil {
+		pressure := *overrides.DiskPressure
+		c.DiskPressure = &pressure
+	}
+	if overrides.Notifications != nil {
+		notifications := *overrides.Notifications
+		notifications.Webhooks = append([]notify.Webhook(nil), notifications.Webhooks...)
+		c.Notifications = &notifications
+	}
+}
+
+// Compile validates the cleanup policies and compiles the job patterns into the matcher
+// returned by Matcher, and the protection rules into the protection returned by Protection and
+// carried by every policy. Patterns listed in JobPatterns only are added to Patterns without a
+// policy of their own.
 //
 // Returns:
-// - <-chan events.Message: Channel for Docker container events.
-// - <-chan error: Channel for errors occurring while monitoring Docker events.
-func MonitorContainerEvents(cli *client.Client) (<-chan events.Message, <-chan error) {
-	eventCh := make(chan events.Message)
-	errCh := make(chan error)
+// - error: An error naming the first invalid pattern, policy, protection rule, gc or disk
+// pressure setting.
+func (c *Config) Compile() error {
+	protection, err := cleanup.NewProtection(c.Protect)
+	if err != nil {
+		return err
+	}
+	if c.GC != nil {
+		if err := c.GC.Validate(); err != nil {
+			return fmt.Errorf("invalid gc settings: %w", err)
+		}
+	}
+	if c.DiskPressure != nil {
+		if err := c.DiskPressure.Compile(); err != nil {
+			return fmt.Errorf("invalid diskPressure settings: %w", err)
+		}
+	}
+	if c.Notifications != nil {
+		if err := c.Notifications.Compile(); err != nil {
+			return fmt.Errorf("invalid notifications settings: %w", err)
+		}
+	}
 
-	go func() {
-		defer close(eventCh)
-		defer close(errCh)
+	if len(c.Patterns) == 0 {
+		c.Patterns = make([]PatternConfig, 0, len(c.JobPatterns))
+		for _, pattern := range c.JobPatterns {
+			c.Patterns = append(c.Patterns, PatternConfig{Pattern: pattern})
+		}
+	}
 
-		ctx := context.Background()
+	var defaults cleanup.Policy
+	if c.Defaults != nil {
+		if err := c.Defaults.Validate(); err != nil {
+			return fmt.Errorf("invalid default policy: %w", err)
+		}
+		defaults = *c.Defaults
+	}
 
-		args := filters.NewArgs()
-		args.Add("type", "container")
-		options := events.ListOptions{
-			Filters: args,
+	c.JobPatterns = make([]string, 0, len(c.Patterns))
+	policies := make([]cleanup.Policy, 0, len(c.Patterns))
+	for i, pattern := range c.Patterns {
+		if err := pattern.Policy.Validate(); err != nil {
+			return fmt.Errorf("invalid policy of job pattern %d %q: %w", i, pattern.Pattern, err)
 		}
+		policy := defaults.Merge(pattern.Policy)
+		policy.Protection = protection
+		c.JobPatterns = append(c.JobPatterns, pattern.Pattern)
+		policies = append(policies, policy)
+	}
+
+	matcher, err := NewMatcher(c.JobPatterns)
+	if err != nil {
+		return err
+	}
+	matcher.policies = policies
+	matcher.defaults = defaults
+	matcher.defaults.Protection = protection
+	c.matcher = matcher
+	c.protection = protection
+	return nil
+}
 
-		eventChan, eventErrChan := cli.Events(ctx, options)
+// Matcher returns the compiled job patterns. It is only set once the configuration was loaded,
+// compiled or validated.
+func (c *Config) Matcher() *Matcher {
+	return c.matcher
+}
 
-		for {
-			select {
-			case event := <-eventChan:
-				eventCh <- event
-			case err := <-eventErrChan:
-				errCh <- fmt.Errorf("error while receiving Docker events: %v", err)
-				return
-			}
-		}
-	}()
+// Protection returns the compiled protection rules. It is only set once the configuration was
+// loaded, compiled or validated.
+func (c *Config) Protection() *cleanup.Protection {
+	return c.protection
+}
+
+// GCSettings returns the garbage collection settings, disabled if the configuration sets none.
+func (c *Config) GCSettings() GCConfig {
+	if c.GC == nil {
+		return GCConfig{}
+	}
+	return *c.GC
+}
 
-	return eventCh, errCh
+// DiskPressureSettings returns the compiled disk pressure settings, disabled if the
+// configuration sets none.
+func (c *Config) DiskPressureSettings() cleanup.DiskPressure {
+	if c.DiskPressure == nil {
+		return cleanup.DiskPressure{}
+	}
+	return *c.DiskPressure
+}
+
+// NotificationSettings returns the compiled notification settings, disabled if the
+// configuration sets none.
+func (c *Config) NotificationSettings() notify.Config {
+	if c.Notifications == nil {
+		return notify.Config{}
+	}
+	return *c.Notifications
+}
+
+// Validate checks that the configuration has at least one job pattern and that every pattern
+// is a valid regular expression.
+//
+// Returns:
+// - error: An error naming the first invalid pattern.
+func (c *Config) Validate() error {
+	if len(c.JobPatterns) == 0 {
+		return errors.New("no job patterns configured")
+	}
+	return c.Compile()
 }
 
 // HandleEvent processes Docker container events and performs actions based on the event type.
@@ -97,63 +342,161 @@ func MonitorContainerEvents(cli *client.Client) (<-chan events.Message, <-chan e
 // Parameters:
 // - cli: The Docker client instance.
 // - event: The Docker container event to handle.
-// - jobPatterns: List of job patterns to match against container names.
+// - prov: The CI provider whose job containers are handled.
+// - matcher: The compiled job patterns to match against container names.
+// - registry: The registry recording the resources owned by each job.
+// - pool: The worker pool cleaning up finished jobs.
 //
 // Actions:
+// - Records containers created for a running job.
 // - Logs messages when containers start or stop.
-// - Initiates cleanup when containers stop.
-func HandleEvent(cli *client.Client, event events.Message, jobPatterns []string) {
-	if !IsJobPattern(cli, event.ID, jobPatterns) {
+// - Submits the cleanup of the job's resources once when containers die, are killed or destroyed.
+func HandleEvent(cli dockerapi.Client, event events.Message, prov provider.Provider, matcher *Matcher, registry *cleanup.Registry, pool *cleanup.Pool) {
+	if event.Type == events.ImageEventType {
+		handleImageEvent(cli, event, registry)
 		return
 	}
 
+	job, identified := prov.Job(event.ID, event.Actor.Attributes["name"], event.Actor.Attributes)
+	logger := eventLogger(event)
+
+	if event.Action == events.ActionCreate {
+		// Helper and service containers created by the runner belong to the job they were created for
+		if identified {
+			registry.Add(job.ID, event.ID, fmt.Sprintf("created by %s for the job", prov.DisplayName()), event.Actor.Attributes)
+			logger.Info("Container created for the job", cleanup.LogJobID, job.ID, "provider", prov.DisplayName())
+			return
+		}
+		if jobID, ok := registry.Observe(event.ID, event.Actor.Attributes); ok {
+			logger.Info("Container created for the job", cleanup.LogJobID, jobID)
+		}
+		return
+	}
+
+	match, matched := matchEvent(cli, event, matcher)
+	if !matched {
+		return
+	}
+	job = match.Apply(job, identified)
+	logger = logger.With(cleanup.LogJobID, job.ID, cleanup.LogPattern, match.Pattern)
+
 	switch event.Action {
-	case "start":
-		log.Printf("GitLab job container %s started.\n", event.ID)
-	case "die":
-		log.Printf("GitLab job container %s finished.\n", event.ID)
-		cleanup.CleanUp(cli, event.ID)
+	case events.ActionStart:
+		logger.Info("Job container started", "job", job.String(), "provider", prov.DisplayName())
+		if !registry.Tracks(job.ID) {
+			metrics.PatternMatched(match.Pattern)
+		}
+		registry.Track(job.ID, event.ID, event.Actor.Attributes)
+		tracing.StartJob(job.ID,
+			tracing.ContainerIDKey.String(event.ID),
+			tracing.ContainerNameKey.String(event.Actor.Attributes["name"]),
+			tracing.PatternKey.String(match.Pattern),
+			attribute.String("job.provider", prov.DisplayName()),
+		)
+	case events.ActionDie, events.ActionKill, events.ActionDestroy:
+		if !registry.Finish(event.ID) {
+			return
+		}
+		logger.Info("Job container finished", "job", job.String(), "provider", prov.DisplayName(), "event", event.Action, "exit_code", event.Actor.Attributes["exitCode"])
+		tracing.AddJobEvent(job.ID, "container finished",
+			tracing.ContainerIDKey.String(event.ID),
+			attribute.String("docker.event.action", string(event.Action)),
+			attribute.String("container.exit_code", event.Actor.Attributes["exitCode"]),
+		)
+		owned := registry.Resources(job.ID)
+		owned.Failed = failed(event)
+		if !pool.Submit(owned, match.Policy) {
+			logger.Warn("Skipping cleanup of the job, shutting down")
+			tracing.EndJob(job.ID, errors.New("cleanup skipped, shutting down"))
+			return
+		}
+		registry.Forget(job.ID)
+	}
+}
+
+// actionBuild is the action of the image events some builders emit for the images they build.
+const actionBuild events.Action = "build"
+
+// handleImageEvent attributes the images built or tagged while jobs are running to the job that
+// built them, so that they are removed with its other resources. Of the images created before
+// the job started, only the tag is attributed.
+func handleImageEvent(cli dockerapi.Client, event events.Message, registry *cleanup.Registry) {
+	if event.Action != events.ActionTag && event.Action != actionBuild {
+		return
+	}
+	tag := event.Actor.Attributes["name"]
+	if jobID, ok := registry.ObserveImage(event.Actor.ID, tag, imageCreated(cli, event.Actor.ID), event.Actor.Attributes); ok {
+		Logger().Info("Image built for the job", cleanup.LogJobID, jobID, cleanup.LogResourceKind, cleanup.KindImages, cleanup.LogResourceID, event.Actor.ID, cleanup.LogResourceName, tag)
 	}
 }
 
+// imageCreated returns when the image was created, or the zero time if it cannot be listed.
+func imageCreated(cli dockerapi.Client, imageID string) time.Time {
+	images, err := cli.ImageList(context.Background(), image.ListOptions{})
+	if err != nil {
+		Logger().Warn("Failed to list images", cleanup.LogResourceID, imageID, cleanup.ErrorAttr(err))
+		return time.Time{}
+	}
+	for _, img := range images {
+		if img.ID == imageID {
+			return time.Unix(img.Created, 0)
+		}
+	}
+	return time.Time{}
+}
+
+// eventLogger returns the logger of the records about the container of the event.
+func eventLogger(event events.Message) *slog.Logger {
+	return Logger().With(cleanup.LogContainerID, event.ID, cleanup.LogContainerName, event.Actor.Attributes["name"])
+}
+
+// failed reports whether the event is the death of a container that exited with a non-zero code.
+func failed(event events.Message) bool {
+	exitCode := event.Actor.Attributes["exitCode"]
+	return exitCode != "" && exitCode != "0"
+}
+
+// ExitedWithFailure reports whether the listed container is dead or exited with a non-zero code,
+// as shown by its status such as "Exited (1) 2 minutes ago".
+func ExitedWithFailure(c types.Container) bool {
+	return c.State == "dead" || !strings.HasPrefix(c.Status, "Exited (0)")
+}
+
+// matchEvent matches the container of the event against the job patterns. The name carried by
+// the event is used when available, since a destroyed container can no longer be inspected.
+func matchEvent(cli dockerapi.Client, event events.Message, matcher *Matcher) (Match, bool) {
+	if name := event.Actor.Attributes["name"]; name != "" {
+		return matcher.Match("/" + name)
+	}
+	return matchContainer(cli, event.ID, matcher)
+}
+
 // IsJobPattern checks if the container name matches any of the specified job patterns.
 //
 // Parameters:
 // - cli: The Docker client instance.
 // - containerID: The ID of the container to inspect.
-// - jobPatterns: List of job patterns to match against container names.
+// - matcher: The compiled job patterns to match against container names.
 //
 // Returns:
 // - bool: True if the container name matches any pattern; otherwise, false.
-func IsJobPattern(cli *client.Client, containerID string, jobPatterns []string) bool {
+func IsJobPattern(cli dockerapi.Client, containerID string, matcher *Matcher) bool {
+	_, matched := matchContainer(cli, containerID, matcher)
+	return matched
+}
+
+// matchContainer inspects the container and matches its name against the job patterns.
+func matchContainer(cli dockerapi.Client, containerID string, matcher *Matcher) (Match, bool) {
 	ctx := context.Background()
 	containerJSON, err := cli.ContainerInspect(ctx, containerID)
 	if err != nil {
 		if client.IsErrNotFound(err) {
-			log.Printf("Container %s not found.", containerID)
-			return false
+			Logger().Debug("Container not found", cleanup.LogContainerID, containerID)
+			return Match{}, false
 		}
-		log.Printf("Failed to inspect container %s: %v", containerID, err)
-		return false
+		Logger().Warn("Failed to inspect container", cleanup.LogContainerID, containerID, cleanup.ErrorAttr(err))
+		return Match{}, false
 	}
 
-	return MatchContainerName(containerJSON.Name, jobPatterns)
-}
-
-// MatchContainerName function checks if a container name matches any of the provided job patterns
-// using regular expressions.
-func MatchContainerName(containerName string, jobPatterns []string) bool {
-	for _, pattern := range jobPatterns {
-		matched, err := regexp.MatchString(pattern, containerName)
-		if err != nil {
-			log.Printf("Failed to match container name %s with pattern %s: %v", containerName, pattern, err)
-			continue
-		}
-
-		if matched {
-			log.Printf("Container %s matched job pattern.\n", containerName)
-			return true
-		}
-	}
-	return false
+	return matcher.Match(containerJSON.Name)
 }
@@ -6,9 +6,16 @@
 package events
 
 import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/provider"
 )
 
 // TestLoadConfig tests the LoadConfig function.
@@ -29,7 +36,385 @@ func TestLoadConfig(t *testing.T) {
 
 	config, err := LoadConfig("../patterns/jobPattern.json")
 	assert.NoError(t, err)
-	assert.Equal(t, expectedConfig, config)
+	assert.Equal(t, expectedConfig.JobPatterns, config.JobPatterns)
+	assert.Equal(t, expectedConfig.JobPatterns, config.Matcher().Patterns())
+}
+
+// TestLoadConfigRejectsInvalidPatterns tests that LoadConfig names the invalid job pattern.
+func TestLoadConfigRejectsInvalidPatterns(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobPattern.json")
+	err := os.WriteFile(filename, []byte(`{"jobPattern": ["^/runner-.*-build$", "^/runner-(.*-test$"]}`), 0o600)
+	assert.NoError(t, err)
+
+	_, err = LoadConfig(filename)
+	assert.ErrorContains(t, err, `invalid job pattern 1 "^/runner-(.*-test$"`)
+}
+
+// TestLoadConfigSchema tests the version 2 schema, where each pattern may carry a cleanup policy
+// merged with the defaults, and that keys unknown to the schema version are rejected.
+func TestLoadConfigSchema(t *testing.T) {
+	testCases := []struct {
+		name     string
+		config   string
+		err      string
+		patterns []string
+	}{
+		{
+			name:     "Version 1",
+			config:   `{"version": 1, "jobPattern": ["^/a$"]}`,
+			patterns: []string{"^/a$"},
+		},
+		{
+			name:     "Version 2 with strings and objects",
+			config:   `{"version": 2, "defaults": {"graceDelay": "5s"}, "jobPatterns": ["^/a$", {"pattern": "^/b$", "policy": {"keepOnFailure": true}}]}`,
+			patterns: []string{"^/a$", "^/b$"},
+		},
+		{
+			name:   "Unknown top-level key",
+			config: `{"version": 2, "jobPatterns": ["^/a$"], "jobPatern": ["^/b$"]}`,
+			err:    `unknown field "jobPatern"`,
+		},
+		{
+			name:   "Unknown policy key",
+			config: `{"version": 2, "jobPatterns": [{"pattern": "^/a$", "policy": {"graceDelays": "5s"}}]}`,
+			err:    `unknown field "graceDelays"`,
+		},
+		{
+			name:   "Unknown pattern key",
+			config: `{"version": 2, "jobPatterns": [{"pattern": "^/a$", "polcy": {}}]}`,
+			err:    `unknown field "polcy"`,
+		},
+		{
+			name:     "Version 2 keys without version",
+			config:   `{"jobPatterns": ["^/a$"]}`,
+			patterns: []string{"^/a$"},
+		},
+		{
+			name:   "Version 2 keys in version 1",
+			config: `{"version": 1, "jobPatterns": ["^/a$"]}`,
+			err:    "defaults, jobPatterns, protect, gc, diskPressure and notifications require config version 2",
+		},
+		{
+			name:   "Both pattern keys",
+			config: `{"jobPattern": ["^/a$"], "jobPatterns": ["^/b$"]}`,
+			err:    "jobPattern was replaced by jobPatterns",
+		},
+		{
+			name:   "Version 1 key in version 2",
+			config: `{"version": 2, "jobPattern": ["^/a$"]}`,
+			err:    "jobPattern was replaced by jobPatterns",
+		},
+		{
+			name:   "Unsupported version",
+			config: `{"version": 3, "jobPatterns": ["^/a$"]}`,
+			err:    "unsupported config version 3",
+		},
+		{
+			name:   "Invalid default policy",
+			config: `{"version": 2, "defaults": {"stopTimeout": "-1s"}, "jobPatterns": ["^/a$"]}`,
+			err:    "invalid default policy: stopTimeout must not be negative",
+		},
+		{
+			name:   "Invalid pattern policy",
+			config: `{"version": 2, "jobPatterns": ["^/a$", {"pattern": "^/b$", "policy": {"resources": ["pods"]}}]}`,
+			err:    `invalid policy of job pattern 1 "^/b$": unknown resource kind "pods"`,
+		},
+		{
+			name:   "Protection rules in version 1",
+			config: `{"version": 1, "jobPattern": ["^/a$"], "protect": [{"name": "^prod-"}]}`,
+			err:    "defaults, jobPatterns, protect, gc, diskPressure and notifications require config version 2",
+		},
+		{
+			name:   "Empty protection rule",
+			config: `{"jobPatterns": ["^/a$"], "protect": [{"name": "^prod-"}, {}]}`,
+			err:    "protection rule 1 sets no field",
+		},
+		{
+			name:   "Unknown protection key",
+			config: `{"jobPatterns": ["^/a$"], "protect": [{"project": "monitoring"}]}`,
+			err:    `unknown field "project"`,
+		},
+		{
+			name:     "Garbage collection",
+			config:   `{"jobPatterns": ["^/a$"], "gc": {"interval": "10m", "ttl": {"containers": "6h", "volumes": "72h"}}}`,
+			patterns: []string{"^/a$"},
+		},
+		{
+			name:   "Garbage collection in version 1",
+			config: `{"version": 1, "jobPattern": ["^/a$"], "gc": {"interval": "10m"}}`,
+			err:    "defaults, jobPatterns, protect, gc, diskPressure and notifications require config version 2",
+		},
+		{
+			name:   "Garbage collection of images",
+			config: `{"jobPatterns": ["^/a$"], "gc": {"interval": "10m", "ttl": {"images": "6h"}}}`,
+			err:    `invalid gc settings: unknown ttl resource kind "images"`,
+		},
+		{
+			name:   "Zero garbage collection ttl",
+			config: `{"jobPatterns": ["^/a$"], "gc": {"interval": "10m", "ttl": {"networks": "0s"}}}`,
+			err:    "invalid gc settings: ttl of networks must be positive",
+		},
+		{
+			name:   "Negative garbage collection interval",
+			config: `{"jobPatterns": ["^/a$"], "gc": {"interval": "-1m"}}`,
+			err:    "invalid gc settings: interval must not be negative",
+		},
+		{
+			name:     "Disk pressure",
+			config:   `{"jobPatterns": ["^/a$"], "diskPressure": {"interval": "5m", "highWaterMark": 90, "lowWaterMark": 60, "imageTags": ["^ci/.*:job-"]}}`,
+			patterns: []string{"^/a$"},
+		},
+		{
+			name:   "Inverted water marks",
+			config: `{"jobPatterns": ["^/a$"], "diskPressure": {"interval": "5m", "highWaterMark": 50, "lowWaterMark": 60}}`,
+			err:    "invalid diskPressure settings: lowWaterMark 60 must be below highWaterMark 50",
+		},
+		{
+			name:   "Invalid image tag pattern",
+			config: `{"jobPatterns": ["^/a$"], "diskPressure": {"imageTags": ["^ci/(.*"]}}`,
+			err:    `invalid diskPressure settings: invalid image tag pattern 0 "^ci/(.*"`,
+		},
+		{
+			name:     "Notifications",
+			config:   `{"jobPatterns": ["^/a$"], "notifications": {"retries": 5, "retryDelay": "2s", "webhooks": [{"url": "https://hooks.slack.com/services/T0/B0/x", "format": "slack", "events": ["cleanup_failed", "leak_detected"]}]}}`,
+			patterns: []string{"^/a$"},
+		},
+		{
+			name:   "Notifications in version 1",
+			config: `{"version": 1, "jobPattern": ["^/a$"], "notifications": {}}`,
+			err:    "defaults, jobPatterns, protect, gc, diskPressure and notifications require config version 2",
+		},
+		{
+			name:   "Unknown notification event",
+			config: `{"jobPatterns": ["^/a$"], "notifications": {"webhooks": [{"url": "https://example.com/hook", "events": ["cleanup_succeeded"]}]}}`,
+			err:    `invalid notifications settings: invalid webhook 0: unknown event "cleanup_succeeded"`,
+		},
+		{
+			name:   "Invalid webhook url",
+			config: `{"jobPatterns": ["^/a$"], "notifications": {"webhooks": [{"url": "example.com/hook"}]}}`,
+			err:    `invalid notifications settings: invalid webhook 0: url "example.com/hook" must be an http or https URL`,
+		},
+		{
+			name:   "Invalid duration",
+			config: `{"version": 2, "defaults": {"retryDelay": 2}, "jobPatterns": ["^/a$"]}`,
+			err:    "duration must be a string",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "config.json")
+			assert.NoError(t, os.WriteFile(filename, []byte(tc.config), 0o600))
+
+			config, err := LoadConfig(filename)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.patterns, config.JobPatterns)
+			assert.Equal(t, tc.patterns, config.Matcher().Patterns())
+		})
+	}
+}
+
+// TestLoadConfigFormats tests that JSON, YAML and TOML files are decoded by extension into the
+// same schema, with unknown keys rejected in every format.
+func TestLoadConfigFormats(t *testing.T) {
+	testCases := []struct {
+		name     string
+		filename string
+		config   string
+		err      string
+	}{
+		{
+			name:     "JSON",
+			filename: "config.json",
+			config:   `{"version": 2, "defaults": {"graceDelay": "5s"}, "jobPatterns": ["^/a$", {"pattern": "^/b$", "policy": {"keepOnFailure": true}}]}`,
+		},
+		{
+			name:     "YAML",
+			filename: "config.yaml",
+			config: `version: 2
+defaults:
+  graceDelay: 5s
+jobPatterns:
+  - ^/a$
+  - pattern: ^/b$
+    policy:
+      keepOnFailure: true
+`,
+		},
+		{
+			name:     "YML",
+			filename: "config.yml",
+			config:   "jobPatterns: ['^/a$', {pattern: '^/b$', policy: {keepOnFailure: true}}]\ndefaults: {graceDelay: 5s}\n",
+		},
+		{
+			name:     "TOML",
+			filename: "config.toml",
+			config: `version = 2
+jobPatterns = ["^/a$", { pattern = "^/b$", policy = { keepOnFailure = true } }]
+
+[defaults]
+graceDelay = "5s"
+`,
+		},
+		{
+			name:     "Unknown YAML key",
+			filename: "config.yaml",
+			config:   "jobPatterns: ['^/a$']\ndefault: {graceDelay: 5s}\n",
+			err:      `unknown field "default"`,
+		},
+		{
+			name:     "Unknown TOML key",
+			filename: "config.toml",
+			config:   "jobPatterns = ['^/a$']\n[defaults]\ngrace_delay = '5s'\n",
+			err:      `unknown field "grace_delay"`,
+		},
+		{
+			name:     "Invalid YAML",
+			filename: "config.yaml",
+			config:   "jobPatterns: [",
+			err:      "failed to parse YAML",
+		},
+		{
+			name:     "Unsupported extension",
+			filename: "config.ini",
+			config:   "jobPatterns = ^/a$",
+			err:      `unsupported config format ".ini"`,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), tc.filename)
+			assert.NoError(t, os.WriteFile(filename, []byte(tc.config), 0o600))
+
+			config, err := LoadConfig(filename)
+			if tc.err != "" {
+				assert.ErrorContains(t, err, tc.err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, []string{"^/a$", "^/b$"}, config.JobPatterns)
+
+			match, matched := config.Matcher().Match("/b")
+			assert.True(t, matched)
+			opts := match.Policy.Apply(cleanup.DefaultOptions())
+			assert.Equal(t, 5*time.Second, opts.Delay)
+			assert.True(t, opts.KeepOnFailure)
+		})
+	}
+}
+
+// TestConfigOverride tests that overridden patterns replace those of the file and that the
+// overridden defaults apply below the policies of the patterns.
+func TestConfigOverride(t *testing.T) {
+	grace := cleanup.Duration(time.Minute)
+	stop := cleanup.Duration(time.Second)
+	patternStop := cleanup.Duration(time.Hour)
+	defaultStop := cleanup.Duration(30 * time.Second)
+
+	config := &Config{
+		Defaults: &cleanup.Policy{StopTimeout: &defaultStop},
+		Patterns: []PatternConfig{{Pattern: "^/a$", Policy: cleanup.Policy{StopTimeout: &patternStop}}},
+	}
+	config.Override(Overrides{Defaults: cleanup.Policy{GraceDelay: &grace, StopTimeout: &stop}})
+	assert.NoError(t, config.Compile())
+
+	match, matched := config.Matcher().Match("/a")
+	assert.True(t, matched)
+	opts := match.Policy.Apply(cleanup.DefaultOptions())
+	assert.Equal(t, time.Minute, opts.Delay)
+	assert.Equal(t, time.Hour, opts.StopTimeout)
+
+	config.Override(Overrides{JobPatterns: []string{"^/b$"}})
+	assert.NoError(t, config.Compile())
+	assert.Equal(t, []string{"^/b$"}, config.JobPatterns)
+	match, matched = config.Matcher().Match("/b")
+	assert.True(t, matched)
+	assert.Equal(t, time.Second, match.Policy.Apply(cleanup.DefaultOptions()).StopTimeout)
+}
+
+// TestMatchPolicy tests that a match carries the policy of its pattern merged with the defaults.
+func TestMatchPolicy(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(filename, []byte(`{
+		"version": 2,
+		"defaults": {"graceDelay": "5s", "stopTimeout": "30s"},
+		"jobPatterns": [
+			{"pattern": "^/ci-.*-build$", "policy": {"graceDelay": "1m", "resources": ["containers"]}},
+			"^/ci-.*-test$"
+		]
+	}`), 0o600)
+	assert.NoError(t, err)
+
+	config, err := LoadConfig(filename)
+	assert.NoError(t, err)
+
+	build, matched := config.Matcher().Match("/ci-web-build")
+	assert.True(t, matched)
+	opts := build.Policy.Apply(cleanup.DefaultOptions())
+	assert.Equal(t, time.Minute, opts.Delay)
+	assert.Equal(t, 30*time.Second, opts.StopTimeout)
+	assert.Equal(t, []cleanup.Kind{cleanup.KindContainers}, opts.Kinds)
+
+	test, matched := config.Matcher().Match("/ci-web-test")
+	assert.True(t, matched)
+	opts = test.Policy.Apply(cleanup.DefaultOptions())
+	assert.Equal(t, 5*time.Second, opts.Delay)
+	assert.Nil(t, opts.Kinds)
+}
+
+// TestLoadConfigProtection tests that the protection rules are carried by the policy of every
+// pattern.
+func TestLoadConfigProtection(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(filename, []byte(`{
+		"jobPatterns": ["^/a$", {"pattern": "^/b$", "policy": {"graceDelay": "1s"}}],
+		"protect": [{"name": "^prod-"}, {"composeProject": "monitoring"}]
+	}`), 0o600)
+	assert.NoError(t, err)
+
+	config, err := LoadConfig(filename)
+	assert.NoError(t, err)
+
+	for _, name := range []string{"/a", "/b"} {
+		match, matched := config.Matcher().Match(name)
+		assert.True(t, matched)
+		opts := match.Policy.Apply(cleanup.DefaultOptions())
+		_, protected := opts.Protection.Protects(cleanup.KindVolumes, cleanup.PlanItem{Name: "prod-data"})
+		assert.True(t, protected, name)
+	}
+	_, protected := config.Protection().Protects(cleanup.KindNetworks, cleanup.PlanItem{Name: "grafana", Labels: map[string]string{cleanup.ComposeProjectLabel: "monitoring"}})
+	assert.True(t, protected)
+}
+
+// TestMatcherWarnings tests that patterns anchored on a first character other than a slash are
+// reported, since Docker container names always start with one.
+func TestMatcherWarnings(t *testing.T) {
+	testCases := []struct {
+		pattern string
+		warned  bool
+	}{
+		{pattern: "^/runner-.*-build$", warned: false},
+		{pattern: "^\\/runner-.*-build$", warned: false},
+		{pattern: "runner-.*-build$", warned: false},
+		{pattern: "^.*-build$", warned: false},
+		{pattern: "^(/ci|/runner)-.*$", warned: false},
+		{pattern: "^runner-.*-build$", warned: true},
+		{pattern: "^(?P<project>[a-z]+)-build$", warned: true},
+		{pattern: "^(ci|runner)-.*$", warned: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.pattern, func(t *testing.T) {
+			matcher, err := NewMatcher([]string{tc.pattern})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.warned, len(matcher.Warnings()) > 0, matcher.Warnings())
+		})
+	}
 }
 
 // TestIsJobPattern tests the IsJobPattern function.
@@ -112,3 +497,120 @@ func TestMatchContainerName(t *testing.T) {
 		})
 	}
 }
+
+// TestMatchJob tests that the MatchJob function returns the pattern that matched along with the
+// values of its named capture groups.
+func TestMatchJob(t *testing.T) {
+	jobPatterns := []string{
+		"^/runner-.*-project-(?P<project>\\d+)-concurrent-\\d+-.*-(?P<stage>build|test)$",
+		"^/ci-(?P<job>\\d+)(-(?P<service>\\w+))?$",
+	}
+
+	testCases := []struct {
+		name          string
+		containerName string
+		expected      Match
+		matched       bool
+	}{
+		{
+			name:          "Capture project and stage",
+			containerName: "/runner-123-project-456-concurrent-7-0-test",
+			expected: Match{
+				Pattern: jobPatterns[0],
+				Fields:  map[string]string{"project": "456", "stage": "test"},
+			},
+			matched: true,
+		},
+		{
+			name:          "Optional group that did not participate",
+			containerName: "/ci-1234",
+			expected: Match{
+				Pattern: jobPatterns[1],
+				Fields:  map[string]string{"job": "1234"},
+			},
+			matched: true,
+		},
+		{
+			name:          "Optional group that participated",
+			containerName: "/ci-1234-redis",
+			expected: Match{
+				Pattern: jobPatterns[1],
+				Fields:  map[string]string{"job": "1234", "service": "redis"},
+			},
+			matched: true,
+		},
+		{
+			name:          "No match",
+			containerName: "/postgres",
+			matched:       false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			match, matched := MatchJob(tc.containerName, jobPatterns)
+			assert.Equal(t, tc.matched, matched)
+			assert.Equal(t, tc.expected, match)
+		})
+	}
+}
+
+// TestMatchApply tests that captured fields extend the job and that the captured job ID is only
+// used for jobs the provider could not identify.
+func TestMatchApply(t *testing.T) {
+	match := Match{Fields: map[string]string{"job": "1234", "stage": "build", "project": "7"}}
+
+	job := match.Apply(provider.Job{ID: "container"}, false)
+	assert.Equal(t, provider.Job{ID: "1234", Fields: map[string]string{"stage": "build", "project": "7"}}, job)
+
+	job = match.Apply(provider.Job{ID: "5678", Fields: map[string]string{"project": "42"}}, true)
+	assert.Equal(t, provider.Job{ID: "5678", Fields: map[string]string{"stage": "build", "project": "42"}}, job)
+}
+
+// BenchmarkMatcher measures the cost per event of matching a container name against the job
+// patterns of the repository, compiled once.
+func BenchmarkMatcher(b *testing.B) {
+	config, err := LoadConfig("../patterns/jobPattern.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { SetLogger(nil) })
+
+	for _, bc := range benchmarkNames {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				config.Matcher().Match(bc.containerName)
+			}
+		})
+	}
+}
+
+// BenchmarkMatchJob measures the same matching when the patterns are compiled on every event.
+func BenchmarkMatchJob(b *testing.B) {
+	config, err := LoadConfig("../patterns/jobPattern.json")
+	if err != nil {
+		b.Fatal(err)
+	}
+	SetLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+	b.Cleanup(func() { SetLogger(nil) })
+
+	for _, bc := range benchmarkNames {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				MatchJob(bc.containerName, config.JobPatterns)
+			}
+		})
+	}
+}
+
+var benchmarkNames = []struct {
+	name          string
+	containerName string
+}{
+	{name: "First pattern", containerName: "/runner-abc123-project-42-concurrent-0-3f9c2a7d-build"},
+	{name: "Last pattern", containerName: "/runner-abc123-project-42-concurrent-0-3f9c2a7d-security"},
+	{name: "No match", containerName: "/postgres"},
+}
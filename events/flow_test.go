@@ -0,0 +1,484 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+	"job-detection.is/github-gitlab/provider"
+	"job-detection.is/github-gitlab/tracing"
+)
+
+var flowPatterns = []string{"^/runner-.*-project-.*-concurrent-.*-build$"}
+
+// runUntilDie forwards the events of the fake daemon to HandleEvent until the die event of the
+// specified container has been handled, including the cleanup it triggers.
+func runUntilDie(t *testing.T, daemon dockerapi.Client, eventCh <-chan events.Message, prov provider.Provider, matcher *Matcher, registry *cleanup.Registry, opts cleanup.Options, containerID string) {
+	t.Helper()
+
+	pool := cleanup.NewPool(daemon, 2, opts, nil)
+	timeout := time.After(10 * time.Second)
+	for {
+		select {
+		case event := <-eventCh:
+			HandleEvent(daemon, event, prov, matcher, registry, pool)
+			if event.Action == events.ActionDie && event.ID == containerID {
+				ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+				defer cancel()
+				require.NoError(t, pool.Shutdown(ctx))
+				return
+			}
+		case <-timeout:
+			t.Fatalf("Timed out waiting for container %s to die", containerID)
+		}
+	}
+}
+
+// newMatcher compiles the job patterns without any cleanup policy.
+func newMatcher(t *testing.T, jobPatterns []string) *Matcher {
+	t.Helper()
+
+	matcher, err := NewMatcher(jobPatterns)
+	require.NoError(t, err)
+	return matcher
+}
+
+// testOptions returns the default cleanup options without any delay.
+func testOptions() cleanup.Options {
+	opts := cleanup.DefaultOptions()
+	opts.Delay = 0
+	opts.PollInterval = 0
+	opts.RetryDelay = 0
+	return opts
+}
+
+// dryRun returns the options with the dry run enabled.
+func dryRun(opts cleanup.Options) cleanup.Options {
+	opts.DryRun = true
+	return opts
+}
+
+// monitor starts monitoring the events of the fake daemon until the test ends.
+func monitor(t *testing.T, daemon *fake.Daemon) <-chan events.Message {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	eventCh, stateCh := MonitorContainerEvents(daemon, ctx, DefaultBackoff())
+	go func() {
+		for range stateCh {
+		}
+	}()
+	return eventCh
+}
+
+// sharedHost returns a daemon already running resources unrelated to any job.
+func sharedHost() *fake.Daemon {
+	daemon := fake.NewDaemon()
+	daemon.AddNetwork("shared_default", map[string]string{"com.docker.compose.project": "shared"})
+	daemon.AddVolume("cache", nil)
+	db := daemon.CreateContainer(fake.ContainerSpec{
+		Name:     "postgres",
+		Labels:   map[string]string{"com.docker.compose.project": "shared"},
+		Networks: []string{"shared_default"},
+		Volumes:  []string{"pgdata"},
+	})
+	_ = daemon.StartContainer(db)
+	return daemon
+}
+
+func assertSharedHostIntact(t *testing.T, daemon *fake.Daemon) {
+	t.Helper()
+
+	assert.Equal(t, "running", daemon.ContainerState("postgres"))
+	assert.True(t, daemon.HasNetwork("shared_default"))
+	assert.True(t, daemon.HasNetwork("bridge"))
+	assert.True(t, daemon.HasVolume("pgdata"))
+	assert.True(t, daemon.HasVolume("cache"))
+}
+
+func TestFlowCleansUpJobResources(t *testing.T) {
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	daemon.AddVolume("anon", map[string]string{"com.docker.volume.anonymous": ""})
+	daemon.AddNetwork("ci-job_default", map[string]string{"com.docker.compose.project": "ci-job"})
+	job := daemon.CreateContainer(fake.ContainerSpec{
+		Name:     "runner-abc-project-1-concurrent-0-build",
+		Labels:   map[string]string{"com.docker.compose.project": "ci-job"},
+		Networks: []string{"ci-job_default"},
+		Volumes:  []string{"anon"},
+	})
+	require.NoError(t, daemon.StartContainer(job))
+
+	// A sidecar of the job's Compose project, created after the job started
+	sidecar := daemon.CreateContainer(fake.ContainerSpec{
+		Name:     "ci-job-redis-1",
+		Labels:   map[string]string{"com.docker.compose.project": "ci-job"},
+		Networks: []string{"ci-job_default"},
+	})
+	require.NoError(t, daemon.StartContainer(sidecar))
+
+	// A service labeled with the job ID and an unrelated one
+	jobService := daemon.AddService("job-service", map[string]string{"com.gitlab.ci.job.id": job})
+	otherService := daemon.AddService("monitoring", nil)
+
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), job)
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.False(t, daemon.HasContainer(sidecar))
+	assert.False(t, daemon.HasNetwork("ci-job_default"))
+	assert.False(t, daemon.HasVolume("anon"))
+	assert.False(t, daemon.HasService(jobService))
+	assert.True(t, daemon.HasService(otherService))
+	assertSharedHostIntact(t, daemon)
+	assert.True(t, registry.Resources(job).Empty())
+}
+
+func TestFlowDryRunKeepsResources(t *testing.T) {
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(job))
+	require.NoError(t, daemon.ExitContainer(job, 1))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, dryRun(testOptions()), job)
+
+	assert.Equal(t, "exited", daemon.ContainerState(job))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestFlowIgnoresNonJobContainers(t *testing.T) {
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	other := daemon.CreateContainer(fake.ContainerSpec{Name: "nginx"})
+	require.NoError(t, daemon.StartContainer(other))
+	require.NoError(t, daemon.ExitContainer(other, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), other)
+
+	assert.Equal(t, "exited", daemon.ContainerState(other))
+	assertSharedHostIntact(t, daemon)
+}
+
+// TestFlowDoesNotTrackUnmatchedJobs checks that a job whose containers match no job pattern is
+// neither tracked nor cleaned up.
+func TestFlowDoesNotTrackUnmatchedJobs(t *testing.T) {
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	labels := map[string]string{"com.gitlab.ci.job.id": "1234"}
+	lint := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-lint", Labels: labels})
+	require.NoError(t, daemon.StartContainer(lint))
+	require.NoError(t, daemon.ExitContainer(lint, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), lint)
+
+	assert.False(t, registry.Tracks("1234"))
+	assert.Equal(t, "exited", daemon.ContainerState(lint))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestFlowCleansUpResourcesLabeledWithTheJobID(t *testing.T) {
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	labels := map[string]string{"com.gitlab.ci.job.id": "1234"}
+	daemon.AddNetwork("job-network", labels)
+	daemon.AddVolume("job-cache", labels)
+	job := daemon.CreateContainer(fake.ContainerSpec{
+		Name:     "runner-abc-project-1-concurrent-0-build",
+		Labels:   labels,
+		Networks: []string{"job-network"},
+	})
+	require.NoError(t, daemon.StartContainer(job))
+
+	// Labeled for another job of the same runner
+	daemon.AddVolume("other-cache", map[string]string{"com.gitlab.ci.job.id": "5678"})
+
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), job)
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.False(t, daemon.HasNetwork("job-network"))
+	assert.False(t, daemon.HasVolume("job-cache"))
+	assert.True(t, daemon.HasVolume("other-cache"))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestFlowGroupsGitLabRunnerContainersByJob(t *testing.T) {
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	runnerLabels := func(jobID string) map[string]string {
+		return map[string]string{"com.gitlab.gitlab-runner.job.id": jobID, "com.gitlab.gitlab-runner.pipeline.id": "567"}
+	}
+
+	// The helper, service and build containers of job 1234
+	predefined := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-xyz12-project-42-concurrent-0-3f9c2a7d-predefined", Labels: runnerLabels("1234")})
+	require.NoError(t, daemon.StartContainer(predefined))
+	require.NoError(t, daemon.ExitContainer(predefined, 0))
+	service := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-xyz12-project-42-concurrent-0-3f9c2a7d-postgres-0", Labels: runnerLabels("1234")})
+	require.NoError(t, daemon.StartContainer(service))
+	build := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-xyz12-project-42-concurrent-0-3f9c2a7d-build", Labels: runnerLabels("1234")})
+	require.NoError(t, daemon.StartContainer(build))
+
+	// The service of job 5678, running on another concurrent slot
+	otherService := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-xyz12-project-42-concurrent-1-8e4b1c0a-postgres-0", Labels: runnerLabels("5678")})
+	require.NoError(t, daemon.StartContainer(otherService))
+
+	require.NoError(t, daemon.ExitContainer(build, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), build)
+
+	assert.False(t, daemon.HasContainer(build))
+	assert.False(t, daemon.HasContainer(predefined))
+	assert.False(t, daemon.HasContainer(service))
+	assert.Equal(t, "running", daemon.ContainerState(otherService))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestFlowScopesCleanupToTheCapturedJobID(t *testing.T) {
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitHub{}.JobLabel(), nil)
+	patterns := []string{"^/ci-(?P<project>\\w+)-(?P<job>\\d+)-build$"}
+
+	daemon.AddVolume("job-cache", map[string]string{"com.github.ci.job.id": "1234"})
+	daemon.AddVolume("other-cache", map[string]string{"com.github.ci.job.id": "5678"})
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "ci-web-1234-build"})
+	require.NoError(t, daemon.StartContainer(job))
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitHub{}, newMatcher(t, patterns), registry, testOptions(), job)
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.False(t, daemon.HasVolume("job-cache"))
+	assert.True(t, daemon.HasVolume("other-cache"))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestFlowKeepsResourcesOfFailedJobsWithThePolicy(t *testing.T) {
+	keep := true
+	config := &Config{
+		Version: ConfigVersion,
+		Patterns: []PatternConfig{
+			{Pattern: "^/runner-.*-build$", Policy: cleanup.Policy{KeepOnFailure: &keep}},
+			{Pattern: "^/runner-.*-test$"},
+		},
+	}
+	require.NoError(t, config.Compile())
+
+	testCases := []struct {
+		name     string
+		suffix   string
+		exitCode int
+		kept     bool
+	}{
+		{name: "Failed job with keepOnFailure", suffix: "build", exitCode: 1, kept: true},
+		{name: "Successful job with keepOnFailure", suffix: "build", exitCode: 0, kept: false},
+		{name: "Failed job without keepOnFailure", suffix: "test", exitCode: 1, kept: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			daemon := sharedHost()
+			eventCh := monitor(t, daemon)
+			registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+			job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-" + tc.suffix})
+			require.NoError(t, daemon.StartContainer(job))
+			require.NoError(t, daemon.ExitContainer(job, tc.exitCode))
+			runUntilDie(t, daemon, eventCh, provider.GitLab{}, config.Matcher(), registry, testOptions(), job)
+
+			assert.Equal(t, tc.kept, daemon.HasContainer(job))
+			assertSharedHostIntact(t, daemon)
+		})
+	}
+}
+
+func TestFlowRemovesImagesBuiltByTheJob(t *testing.T) {
+	daemon := sharedHost()
+	base := daemon.AddImage("registry.example.com/ci/base:stable", 100, nil)
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build", Image: "registry.example.com/ci/base:stable"})
+	require.NoError(t, daemon.StartContainer(job))
+
+	// An image built by the job, and a long-running container created from another one
+	built := daemon.AddImage("registry.example.com/ci/app:job-1", 100, nil)
+	served := daemon.AddImage("registry.example.com/ci/app:preview", 100, map[string]string{"com.gitlab.ci.job.id": job})
+	preview := daemon.CreateContainer(fake.ContainerSpec{Name: "preview", Image: "registry.example.com/ci/app:preview"})
+	require.NoError(t, daemon.StartContainer(preview))
+
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), job)
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.False(t, daemon.HasImage(built))
+	assert.True(t, daemon.HasImage(served))
+	assert.True(t, daemon.HasImage(base))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestFlowKeepsImagesRetaggedByTheJob(t *testing.T) {
+	daemon := sharedHost()
+	base := daemon.AddImage("alpine:3", 100, nil)
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build", Image: "alpine:3"})
+	require.NoError(t, daemon.StartContainer(job))
+
+	// The job pushes the base image to its own registry
+	require.NoError(t, daemon.TagImage("alpine:3", "myreg/alpine:ci"))
+
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), job)
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.True(t, daemon.HasImage(base))
+	assert.True(t, daemon.HasImage("alpine:3"))
+	assert.False(t, daemon.HasImage("myreg/alpine:ci"))
+	assertSharedHostIntact(t, daemon)
+}
+
+// syncBuffer is a buffer safe for the concurrent writes of the loggers.
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+// records decodes the JSON records written to the buffer.
+func (b *syncBuffer) records(t *testing.T) []map[string]any {
+	t.Helper()
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	var records []map[string]any
+	decoder := json.NewDecoder(&b.buf)
+	for decoder.More() {
+		var record map[string]any
+		require.NoError(t, decoder.Decode(&record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func TestFlowLogsJobScopedRecords(t *testing.T) {
+	var out syncBuffer
+	logger := slog.New(slog.NewJSONHandler(&out, nil))
+	SetLogger(logger)
+	cleanup.SetLogger(logger)
+	t.Cleanup(func() {
+		SetLogger(nil)
+		cleanup.SetLogger(nil)
+	})
+
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	labels := map[string]string{"com.gitlab.ci.job.id": "1234"}
+	daemon.AddNetwork("job-network", labels)
+	job := daemon.CreateContainer(fake.ContainerSpec{
+		Name:     "runner-abc-project-1-concurrent-0-build",
+		Labels:   labels,
+		Networks: []string{"job-network"},
+	})
+	require.NoError(t, daemon.StartContainer(job))
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), job)
+
+	byMessage := make(map[string]map[string]any)
+	for _, record := range out.records(t) {
+		byMessage[record["msg"].(string)] = record
+	}
+
+	finished := byMessage["Job container finished"]
+	require.NotNil(t, finished)
+	assert.Equal(t, "1234", finished[cleanup.LogJobID])
+	assert.Equal(t, job, finished[cleanup.LogContainerID])
+	assert.Equal(t, "runner-abc-project-1-concurrent-0-build", finished[cleanup.LogContainerName])
+	assert.Equal(t, flowPatterns[0], finished[cleanup.LogPattern])
+
+	completed := byMessage["Cleanup completed"]
+	require.NotNil(t, completed)
+	assert.Equal(t, "INFO", completed["level"])
+	assert.Equal(t, "1234", completed[cleanup.LogJobID])
+
+	// Per-container records are only logged at the debug level
+	assert.NotContains(t, byMessage, "Container matched job pattern")
+}
+
+func TestFlowTracesJobLifecycle(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	daemon := sharedHost()
+	eventCh := monitor(t, daemon)
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+
+	labels := map[string]string{"com.gitlab.ci.job.id": "1234"}
+	daemon.AddNetwork("job-network", labels)
+	job := daemon.CreateContainer(fake.ContainerSpec{
+		Name:     "runner-abc-project-1-concurrent-0-build",
+		Labels:   labels,
+		Networks: []string{"job-network"},
+	})
+	require.NoError(t, daemon.StartContainer(job))
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, tracing.Client(daemon), eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), job)
+
+	spans := exporter.GetSpans()
+	byName := make(map[string]tracetest.SpanStub)
+	for _, span := range spans {
+		if _, exists := byName[span.Name]; !exists {
+			byName[span.Name] = span
+		}
+	}
+
+	jobSpan, exists := byName["job"]
+	require.True(t, exists, "the job span ended with its cleanup")
+	assert.Contains(t, jobSpan.Attributes, tracing.JobIDKey.String("1234"))
+	assert.Contains(t, jobSpan.Attributes, tracing.PatternKey.String(flowPatterns[0]))
+	assert.Equal(t, "container finished", jobSpan.Events[0].Name)
+
+	// Each span is a child of the previous one
+	parent := jobSpan
+	for _, name := range []string{"cleanup", "CleanupContainers", "docker.ContainerRemove"} {
+		span, exists := byName[name]
+		require.True(t, exists, name)
+		assert.Equal(t, parent.SpanContext.SpanID(), span.Parent.SpanID(), name)
+		parent = span
+	}
+	for _, name := range []string{"CleanupNetworks", "CleanupVolumes", "CleanupServices", "CleanupImages"} {
+		assert.Equal(t, byName["cleanup"].SpanContext.SpanID(), byName[name].Parent.SpanID(), name)
+	}
+	assert.Equal(t, byName["CleanupNetworks"].SpanContext.SpanID(), byName["docker.NetworkRemove"].Parent.SpanID())
+}
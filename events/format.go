@@ -0,0 +1,47 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// decodeConfig decodes the configuration file in the format given by its extension: .json,
+// .yaml, .yml or .toml. YAML and TOML documents are converted to JSON first, so that every format
+// follows the same schema and rejects the same unknown keys.
+func decodeConfig(filename string, data []byte, config *Config) error {
+	switch ext := strings.ToLower(filepath.Ext(filename)); ext {
+	case ".json":
+	case ".yaml", ".yml":
+		var document any
+		if err := yaml.Unmarshal(data, &document); err != nil {
+			return fmt.Errorf("failed to parse YAML: %w", err)
+		}
+		converted, err := json.Marshal(document)
+		if err != nil {
+			return fmt.Errorf("failed to convert YAML: %w", err)
+		}
+		data = converted
+	case ".toml":
+		var document map[string]any
+		if err := toml.Unmarshal(data, &document); err != nil {
+			return fmt.Errorf("failed to parse TOML: %w", err)
+		}
+		converted, err := json.Marshal(document)
+		if err != nil {
+			return fmt.Errorf("failed to convert TOML: %w", err)
+		}
+		data = converted
+	default:
+		return fmt.Errorf("unsupported config format %q, expected .json, .yaml, .yml or .toml", ext)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(config)
+}
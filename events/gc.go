@@ -0,0 +1,275 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/provider"
+	"job-detection.is/github-gitlab/tracing"
+)
+
+// DefaultGCTTL is how old an orphaned resource must be to be collected when the TTL of its kind
+// is not configured.
+const DefaultGCTTL = 24 * time.Hour
+
+// disabledPoll is how often a disabled periodic task checks whether a reload enabled it.
+const disabledPoll = time.Minute
+
+// GCKinds lists the kinds of resources the garbage collector can collect.
+var GCKinds = []cleanup.Kind{cleanup.KindContainers, cleanup.KindNetworks, cleanup.KindVolumes, cleanup.KindServices}
+
+// GCConfig configures the periodic garbage collection of the resources of jobs whose cleanup
+// was missed, for instance because events were lost.
+type GCConfig struct {
+	// Interval is the time between two collections. Zero disables the garbage collection.
+	Interval cleanup.Duration `json:"interval,omitempty"`
+
+	// TTL is how old an orphaned resource of each kind must be to be collected. Kinds not
+	// listed use DefaultGCTTL.
+	TTL map[cleanup.Kind]cleanup.Duration `json:"ttl,omitempty"`
+}
+
+// Validate checks that the interval is not negative and that every TTL is positive and set
+// for a kind the garbage collector knows.
+func (g *GCConfig) Validate() error {
+	if g.Interval < 0 {
+		return errors.New("interval must not be negative")
+	}
+	for kind, ttl := range g.TTL {
+		known := false
+		for _, k := range GCKinds {
+			known = known || k == kind
+		}
+		if !known {
+			return fmt.Errorf("unknown ttl resource kind %q, expected one of %s", kind, joinKinds(GCKinds))
+		}
+		if ttl <= 0 {
+			return fmt.Errorf("ttl of %s must be positive", kind)
+		}
+	}
+	return nil
+}
+
+// TTLOf returns how old an orphaned resource of the kind must be to be collected.
+func (g *GCConfig) TTLOf(kind cleanup.Kind) time.Duration {
+	if ttl, exists := g.TTL[kind]; exists {
+		return time.Duration(ttl)
+	}
+	return DefaultGCTTL
+}
+
+// joinKinds lists the kinds for error messages.
+func joinKinds(kinds []cleanup.Kind) string {
+	names := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		names = append(names, string(kind))
+	}
+	return strings.Join(names, ", ")
+}
+
+// RunGC collects the orphaned job resources at the interval of the current configuration,
+// until ctx is canceled. A reloaded interval applies after the current one elapsed.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context stopping the garbage collection when canceled.
+// - prov: The CI provider identifying the jobs.
+// - config: Returns the current configuration.
+// - registry: The registry recording the resources of running jobs, which are never collected.
+// - pool: The pool cleaning up the orphaned resources, whose reporters receive the reports.
+func RunGC(cli dockerapi.Client, ctx context.Context, prov provider.Provider, config func() *Config, registry *cleanup.Registry, pool *cleanup.Pool) {
+	interval := func() time.Duration { return time.Duration(config().GCSettings().Interval) }
+	runPeriodically(ctx, interval, func() {
+		current := config()
+		plans, err := CollectGarbage(cli, ctx, prov, current.Matcher(), current.GCSettings(), registry, pool)
+		if err != nil {
+			Logger().Error("Failed to collect orphaned job resources", cleanup.ErrorAttr(err))
+			return
+		}
+		Logger().Info("Garbage collection completed", "jobs", len(plans))
+	})
+}
+
+// runPeriodically calls run every interval until ctx is canceled. The interval is read again
+// after every run, so that a reloaded configuration applies, and run is not called while it is
+// zero.
+func runPeriodically(ctx context.Context, interval func() time.Duration, run func()) {
+	for {
+		wait := interval()
+		if wait <= 0 {
+			wait = disabledPoll
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(wait):
+		}
+
+		if interval() > 0 {
+			run()
+		}
+	}
+}
+
+// CollectGarbage submits the containers, networks, volumes and services of jobs that are older
+// than the TTL of their kind and not used by a running job to the pool. Containers belong to a
+// job through its label or a job pattern, the other resources through the job label. A job is
+// running while the registry tracks it or any of its containers is not exited, and a network or
+// volume is in use while a container that is not exited is attached to it. The resources are
+// cleaned up with the default policy and without grace delay, and jobs the pool is already
+// cleaning up are skipped. The spans of jobs neither running nor cleaned up are ended.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - prov: The CI provider identifying the jobs.
+// - matcher: The compiled job patterns, giving the default policy.
+// - gc: The TTL of each kind of resource.
+// - registry: The registry recording the resources of running jobs.
+// - pool: The pool cleaning up the orphaned resources.
+//
+// Returns:
+// - []*cleanup.Plan: The plans of the jobs submitted to the pool.
+// - error: An error if the resources could not be listed.
+func CollectGarbage(cli dockerapi.Client, ctx context.Context, prov provider.Provider, matcher *Matcher, gc GCConfig, registry *cleanup.Registry, pool *cleanup.Pool) ([]*cleanup.Plan, error) {
+	inventory, err := cleanup.ListResources(cli, ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := matcher.DefaultPolicy()
+	var noDelay cleanup.Duration
+	policy.GraceDelay = &noDelay
+
+	var submitted []*cleanup.Plan
+	for _, plan := range orphanedPlans(inventory, prov, matcher, gc, registry, time.Now()) {
+		if !pool.SubmitPlan(plan, prov.JobLabel(), policy) {
+			Logger().Debug("Job already being cleaned up, skipping its orphaned resources", cleanup.LogJobID, plan.JobID)
+			continue
+		}
+		Logger().Info("Collecting orphaned job resources", cleanup.LogJobID, plan.JobID)
+		submitted = append(submitted, plan)
+	}
+
+	// The spans of jobs dropped before their cleanup was submitted are never ended otherwise
+	evicted := tracing.EvictJobs(func(jobID string) bool { return registry.Tracks(jobID) || pool.Scheduled(jobID) })
+	if evicted > 0 {
+		Logger().Debug("Ended the spans of dropped jobs", "jobs", evicted)
+	}
+	return submitted, nil
+}
+
+// orphanedPlans returns the plans of the resources that are older than the TTL of their kind
+// at now and not used by a running job, sorted by job ID.
+func orphanedPlans(inventory *cleanup.Inventory, prov provider.Provider, matcher *Matcher, gc GCConfig, registry *cleanup.Registry, now time.Time) []*cleanup.Plan {
+	jobLabel := prov.JobLabel()
+	running := make(map[string]bool)
+	attached := make(map[string]bool)
+	mounted := make(map[string]bool)
+	jobIDs := make(map[string]string, len(inventory.Containers))
+	for _, c := range inventory.Containers {
+		active := c.State != "exited" && c.State != "dead"
+		if jobID, ok := containerJob(prov, matcher, c); ok {
+			jobIDs[c.ID] = jobID
+			running[jobID] = running[jobID] || active
+		}
+		if !active {
+			continue
+		}
+		if c.NetworkSettings != nil {
+			for name := range c.NetworkSettings.Networks {
+				attached[name] = true
+			}
+		}
+		for _, mount := range c.Mounts {
+			if mount.Name != "" {
+				mounted[mount.Name] = true
+			}
+		}
+	}
+
+	plans := make(map[string]*cleanup.Plan)
+	expired := func(jobID string, kind cleanup.Kind, createdAt time.Time) (*cleanup.Plan, string, bool) {
+		if jobID == "" || running[jobID] || registry.Tracks(jobID) {
+			return nil, "", false
+		}
+		ttl := gc.TTLOf(kind)
+		if createdAt.IsZero() || now.Sub(createdAt) < ttl {
+			return nil, "", false
+		}
+		plan, exists := plans[jobID]
+		if !exists {
+			plan = &cleanup.Plan{JobID: jobID}
+			plans[jobID] = plan
+		}
+		return plan, fmt.Sprintf("orphaned for more than %s", ttl), true
+	}
+
+	for _, c := range inventory.Containers {
+		if plan, reason, ok := expired(jobIDs[c.ID], cleanup.KindContainers, time.Unix(c.Created, 0)); ok {
+			item := cleanup.PlanItem{ID: c.ID, Reason: reason, Image: c.Image, Labels: c.Labels}
+			if len(c.Names) > 0 {
+				item.Name = strings.TrimPrefix(c.Names[0], "/")
+			}
+			plan.RemoveContainers = append(plan.RemoveContainers, item)
+		}
+	}
+
+	for _, n := range inventory.Networks {
+		if attached[n.Name] {
+			continue
+		}
+		if plan, reason, ok := expired(n.Labels[jobLabel], cleanup.KindNetworks, n.Created); ok {
+			plan.Networks = append(plan.Networks, cleanup.PlanItem{ID: n.ID, Name: n.Name, Reason: reason, Labels: n.Labels})
+		}
+	}
+
+	for _, v := range inventory.Volumes {
+		if v == nil || mounted[v.Name] {
+			continue
+		}
+		createdAt, _ := time.Parse(time.RFC3339, v.CreatedAt)
+		if plan, reason, ok := expired(v.Labels[jobLabel], cleanup.KindVolumes, createdAt); ok {
+			plan.Volumes = append(plan.Volumes, cleanup.PlanItem{ID: v.Name, Name: v.Name, Reason: reason, Labels: v.Labels})
+		}
+	}
+
+	for _, s := range inventory.Services {
+		if plan, reason, ok := expired(s.Spec.Labels[jobLabel], cleanup.KindServices, s.CreatedAt); ok {
+			item := cleanup.PlanItem{ID: s.ID, Name: s.Spec.Name, Reason: reason, Labels: s.Spec.Labels}
+			if spec := s.Spec.TaskTemplate.ContainerSpec; spec != nil {
+				item.Image = spec.Image
+			}
+			plan.Services = append(plan.Services, item)
+		}
+	}
+
+	sorted := make([]*cleanup.Plan, 0, len(plans))
+	for _, plan := range plans {
+		sorted = append(sorted, plan)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].JobID < sorted[j].JobID })
+	return sorted
+}
+
+// containerJob returns the job of a container carrying the job label or matching a job pattern.
+func containerJob(prov provider.Provider, matcher *Matcher, c types.Container) (string, bool) {
+	if len(c.Names) == 0 {
+		return "", false
+	}
+	job, identified := prov.Job(c.ID, c.Names[0], c.Labels)
+	if identified {
+		return job.ID, true
+	}
+	if match, matched := matcher.Match(c.Names[0]); matched {
+		return match.Apply(job, identified).ID, true
+	}
+	return "", false
+}
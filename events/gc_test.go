@@ -0,0 +1,172 @@
+package events
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+	"job-detection.is/github-gitlab/provider"
+	"job-detection.is/github-gitlab/tracing"
+)
+
+// jobLabels returns the labels GitLab sets on the resources of the job.
+func jobLabels(jobID string) map[string]string {
+	return map[string]string{provider.GitLab{}.JobLabel(): jobID}
+}
+
+func TestCollectGarbage(t *testing.T) {
+	daemon := sharedHost()
+	gc := GCConfig{Interval: cleanup.Duration(time.Minute), TTL: map[cleanup.Kind]cleanup.Duration{}}
+	for _, kind := range GCKinds {
+		gc.TTL[kind] = cleanup.Duration(time.Nanosecond)
+	}
+
+	// An orphaned job whose die event was lost
+	daemon.AddNetwork("orphan-net", jobLabels("1234"))
+	daemon.AddVolume("orphan-cache", jobLabels("1234"))
+	orphan := daemon.CreateContainer(fake.ContainerSpec{Name: "job-1234", Labels: jobLabels("1234")})
+	require.NoError(t, daemon.StartContainer(orphan))
+	require.NoError(t, daemon.ExitContainer(orphan, 0))
+
+	// A job container matching the patterns, without any label
+	unlabeled := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(unlabeled))
+	require.NoError(t, daemon.ExitContainer(unlabeled, 0))
+
+	// A running job, one of whose containers already exited
+	daemon.AddVolume("running-cache", jobLabels("5678"))
+	running := daemon.CreateContainer(fake.ContainerSpec{Name: "job-5678", Labels: jobLabels("5678")})
+	require.NoError(t, daemon.StartContainer(running))
+	step := daemon.CreateContainer(fake.ContainerSpec{Name: "job-5678-step", Labels: jobLabels("5678")})
+	require.NoError(t, daemon.StartContainer(step))
+	require.NoError(t, daemon.ExitContainer(step, 0))
+
+	// A job tracked by the watcher
+	daemon.AddNetwork("tracked-net", jobLabels("9999"))
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+	registry.Track("9999", "tracked", nil)
+
+	// A network of a finished job still used by another container
+	daemon.AddNetwork("attached-net", jobLabels("4321"))
+	user := daemon.CreateContainer(fake.ContainerSpec{Name: "debug", Networks: []string{"attached-net"}})
+	require.NoError(t, daemon.StartContainer(user))
+
+	pool := cleanup.NewPool(daemon, 2, testOptions(), nil)
+	var mu sync.Mutex
+	var reports []*cleanup.Report
+	pool.OnReport(func(report *cleanup.Report) {
+		mu.Lock()
+		defer mu.Unlock()
+		reports = append(reports, report)
+	})
+	plans, err := CollectGarbage(daemon, context.Background(), provider.GitLab{}, newMatcher(t, flowPatterns), gc, registry, pool)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, pool.Shutdown(ctx))
+	require.Len(t, reports, 2)
+	for _, report := range reports {
+		assert.True(t, report.Orphaned)
+	}
+
+	require.Len(t, plans, 2)
+	assert.Equal(t, "1234", plans[0].JobID)
+	assert.Len(t, plans[0].RemoveContainers, 1)
+	assert.Len(t, plans[0].Networks, 1)
+	assert.Len(t, plans[0].Volumes, 1)
+
+	assert.False(t, daemon.HasContainer(orphan))
+	assert.False(t, daemon.HasNetwork("orphan-net"))
+	assert.False(t, daemon.HasVolume("orphan-cache"))
+	assert.False(t, daemon.HasContainer(unlabeled))
+
+	assert.Equal(t, "running", daemon.ContainerState(running))
+	assert.True(t, daemon.HasContainer(step))
+	assert.True(t, daemon.HasVolume("running-cache"))
+	assert.True(t, daemon.HasNetwork("tracked-net"))
+	assert.True(t, daemon.HasNetwork("attached-net"))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestCollectGarbageEndsSpansOfDroppedJobs(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+	registry.Track("1234", "tracked", nil)
+	tracing.StartJob("1234")
+	tracing.StartJob("5678")
+
+	pool := cleanup.NewPool(fake.NewDaemon(), 1, testOptions(), nil)
+	_, err := CollectGarbage(fake.NewDaemon(), context.Background(), provider.GitLab{}, newMatcher(t, flowPatterns), GCConfig{}, registry, pool)
+	require.NoError(t, err)
+	require.NoError(t, pool.Shutdown(context.Background()))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes, tracing.JobIDKey.String("5678"))
+
+	tracing.EndJob("1234", nil)
+	assert.Len(t, exporter.GetSpans(), 2)
+}
+
+func TestOrphanedPlansHonorTTLOfEachKind(t *testing.T) {
+	daemon := fake.NewDaemon()
+	daemon.AddNetwork("orphan-net", jobLabels("1234"))
+	daemon.AddVolume("orphan-cache", jobLabels("1234"))
+	daemon.AddService("orphan-service", jobLabels("1234"))
+	orphan := daemon.CreateContainer(fake.ContainerSpec{Name: "job-1234", Labels: jobLabels("1234")})
+	require.NoError(t, daemon.StartContainer(orphan))
+	require.NoError(t, daemon.ExitContainer(orphan, 0))
+
+	inventory, err := cleanup.ListResources(daemon, context.Background())
+	require.NoError(t, err)
+
+	gc := GCConfig{TTL: map[cleanup.Kind]cleanup.Duration{
+		cleanup.KindContainers: cleanup.Duration(time.Hour),
+		cleanup.KindVolumes:    cleanup.Duration(72 * time.Hour),
+	}}
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+	matcher := newMatcher(t, flowPatterns)
+
+	tests := []struct {
+		name       string
+		age        time.Duration
+		containers int
+		networks   int
+		volumes    int
+		services   int
+	}{
+		{"too recent", 30 * time.Minute, 0, 0, 0, 0},
+		{"containers expired", 2 * time.Hour, 1, 0, 0, 0},
+		{"default ttl expired", 25 * time.Hour, 1, 1, 0, 1},
+		{"all expired", 73 * time.Hour, 1, 1, 1, 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			plans := orphanedPlans(inventory, provider.GitLab{}, matcher, gc, registry, time.Now().Add(tc.age))
+			var containers, networks, volumes, services int
+			for _, plan := range plans {
+				containers += len(plan.RemoveContainers)
+				networks += len(plan.Networks)
+				volumes += len(plan.Volumes)
+				services += len(plan.Services)
+			}
+			assert.Equal(t, tc.containers, containers)
+			assert.Equal(t, tc.networks, networks)
+			assert.Equal(t, tc.volumes, volumes)
+			assert.Equal(t, tc.services, services)
+		})
+	}
+}
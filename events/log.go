@@ -0,0 +1,24 @@
+package events
+
+import (
+	"log/slog"
+	"sync/atomic"
+)
+
+// packageLogger is the logger set with SetLogger.
+var packageLogger atomic.Pointer[slog.Logger]
+
+// SetLogger sets the logger receiving the records of the package. A nil logger restores
+// slog.Default(). Records use the attribute keys of the cleanup package, such as
+// cleanup.LogJobID.
+func SetLogger(logger *slog.Logger) {
+	packageLogger.Store(logger)
+}
+
+// Logger returns the logger receiving the records of the package.
+func Logger() *slog.Logger {
+	if logger := packageLogger.Load(); logger != nil {
+		return logger
+	}
+	return slog.Default()
+}
@@ -0,0 +1,217 @@
+package events
+
+import (
+	"fmt"
+	"regexp"
+	"regexp/syntax"
+
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/provider"
+)
+
+// Match is the result of matching a container name against the job patterns.
+type Match struct {
+	// Pattern is the job pattern that matched.
+	Pattern string
+
+	// Fields holds the values of the named capture groups of the pattern, such as job, project
+	// or stage. Groups that did not participate in the match are omitted.
+	Fields map[string]string
+
+	// Policy is the cleanup policy of the pattern, merged with the default policy.
+	Policy cleanup.Policy
+}
+
+// JobField is the capture group whose value is used as the job ID.
+const JobField = "job"
+
+// Apply adds the captured fields to the job. The captured job ID replaces the ID of a job the
+// provider could not identify, while the fields known to the provider are kept.
+//
+// Parameters:
+// - job: The job of the container according to the provider.
+// - identified: True if the provider identified the job of the container.
+//
+// Returns:
+// - provider.Job: The job with the captured fields.
+func (m Match) Apply(job provider.Job, identified bool) provider.Job {
+	if len(m.Fields) == 0 {
+		return job
+	}
+
+	fields := make(map[string]string, len(m.Fields)+len(job.Fields))
+	for key, value := range m.Fields {
+		if key != JobField {
+			fields[key] = value
+		}
+	}
+	for key, value := range job.Fields {
+		fields[key] = value
+	}
+
+	if jobID := m.Fields[JobField]; jobID != "" && !identified {
+		job.ID = jobID
+	}
+	job.Fields = fields
+	return job
+}
+
+// Matcher matches container names against job patterns compiled once, so that handling an
+// event does not compile any regular expression. It is safe for concurrent use.
+type Matcher struct {
+	patterns []*regexp.Regexp
+	// policies holds the cleanup policy of each pattern, if any was configured.
+	policies []cleanup.Policy
+	// defaults is the policy of jobs that no pattern matches anymore.
+	defaults cleanup.Policy
+}
+
+// NewMatcher compiles the job patterns.
+//
+// Parameters:
+// - jobPatterns: List of job patterns to match against container names.
+//
+// Returns:
+// - *Matcher: The compiled job patterns.
+// - error: An error naming the first pattern that is not a valid regular expression.
+func NewMatcher(jobPatterns []string) (*Matcher, error) {
+	m := &Matcher{patterns: make([]*regexp.Regexp, 0, len(jobPatterns))}
+	for i, pattern := range jobPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid job pattern %d %q: %w", i, pattern, err)
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m, nil
+}
+
+// Patterns returns the job patterns in the order they are tried.
+func (m *Matcher) Patterns() []string {
+	patterns := make([]string, 0, len(m.patterns))
+	for _, re := range m.patterns {
+		patterns = append(patterns, re.String())
+	}
+	return patterns
+}
+
+// DefaultPolicy returns the default cleanup policy of the configuration, along with its
+// protection rules. It applies to jobs whose containers can no longer be matched, such as jobs
+// recovered after a restart whose containers are gone.
+func (m *Matcher) DefaultPolicy() cleanup.Policy {
+	return m.defaults
+}
+
+// Warnings describes the job patterns that can never match a container name, since Docker
+// names always start with a slash.
+func (m *Matcher) Warnings() []string {
+	var warnings []string
+	for i, re := range m.patterns {
+		if !matchesLeadingSlash(re.String()) {
+			warnings = append(warnings, fmt.Sprintf("job pattern %d %q can never match a container name, which starts with /", i, re.String()))
+		}
+	}
+	return warnings
+}
+
+// Match matches the container name against the job patterns and returns the first pattern that
+// matched along with its named capture groups.
+//
+// Parameters:
+// - containerName: The container name, with its leading slash.
+//
+// Returns:
+// - Match: The pattern that matched and the captured fields.
+// - bool: True if any pattern matched; otherwise, false.
+func (m *Matcher) Match(containerName string) (Match, bool) {
+	for i, re := range m.patterns {
+		submatches := re.FindStringSubmatchIndex(containerName)
+		if submatches == nil {
+			continue
+		}
+
+		match := Match{Pattern: re.String(), Fields: make(map[string]string)}
+		if i < len(m.policies) {
+			match.Policy = m.policies[i]
+		}
+		for group, name := range re.SubexpNames() {
+			if name != "" && submatches[2*group] >= 0 {
+				match.Fields[name] = containerName[submatches[2*group]:submatches[2*group+1]]
+			}
+		}
+
+		Logger().Debug("Container matched job pattern", cleanup.LogContainerName, containerName, cleanup.LogPattern, match.Pattern)
+		return match, true
+	}
+	return Match{}, false
+}
+
+// MatchContainerName function checks if a container name matches any of the provided job patterns
+// using regular expressions.
+func MatchContainerName(containerName string, jobPatterns []string) bool {
+	_, matched := MatchJob(containerName, jobPatterns)
+	return matched
+}
+
+// MatchJob works like Matcher.Match for patterns that are matched only once. Invalid patterns are
+// logged and skipped.
+func MatchJob(containerName string, jobPatterns []string) (Match, bool) {
+	m := &Matcher{}
+	for _, pattern := range jobPatterns {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			Logger().Warn("Failed to match container name with pattern", cleanup.LogContainerName, containerName, cleanup.LogPattern, pattern, cleanup.ErrorAttr(err))
+			continue
+		}
+		m.patterns = append(m.patterns, re)
+	}
+	return m.Match(containerName)
+}
+
+// matchesLeadingSlash reports whether the pattern may match a name starting with a slash. Only
+// patterns anchored at the start of the name and requiring another first character are ruled out.
+func matchesLeadingSlash(pattern string) bool {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return true
+	}
+
+	if re.Op != syntax.OpConcat || len(re.Sub) < 2 || re.Sub[0].Op != syntax.OpBeginText {
+		return true
+	}
+	return firstMayBeSlash(re.Sub[1])
+}
+
+// firstMayBeSlash reports whether the first character matched by re may be a slash.
+func firstMayBeSlash(re *syntax.Regexp) bool {
+	switch re.Op {
+	case syntax.OpLiteral:
+		if len(re.Rune) == 0 {
+			return true
+		}
+		return re.Rune[0] == '/'
+	case syntax.OpCharClass:
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i] <= '/' && '/' <= re.Rune[i+1] {
+				return true
+			}
+		}
+		return false
+	case syntax.OpCapture, syntax.OpPlus:
+		return firstMayBeSlash(re.Sub[0])
+	case syntax.OpConcat:
+		if len(re.Sub) == 0 {
+			return true
+		}
+		return firstMayBeSlash(re.Sub[0])
+	case syntax.OpAlternate:
+		for _, sub := range re.Sub {
+			if firstMayBeSlash(sub) {
+				return true
+			}
+		}
+		return false
+	default:
+		return true
+	}
+}
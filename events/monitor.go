@@ -0,0 +1,228 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/metrics"
+)
+
+// ConnectionState is the state of the connection to the Docker event stream.
+type ConnectionState string
+
+const (
+	// StateConnected means the event stream is open.
+	StateConnected ConnectionState = "connected"
+
+	// StateDisconnected means the event stream dropped and a reconnection is scheduled.
+	StateDisconnected ConnectionState = "disconnected"
+)
+
+// StateChange reports a change of the connection to the Docker event stream.
+type StateChange struct {
+	State ConnectionState
+
+	// Err is the error that closed the stream, when disconnected.
+	Err error
+
+	// Retry is the delay before the next connection attempt, when disconnected.
+	Retry time.Duration
+
+	// Since is the timestamp events are replayed from, when reconnected.
+	Since string
+}
+
+// String returns a log friendly description of the state change.
+func (c StateChange) String() string {
+	switch {
+	case c.State == StateDisconnected:
+		return fmt.Sprintf("Docker event stream disconnected: %v. Reconnecting in %s...", c.Err, c.Retry)
+	case c.Since != "":
+		return fmt.Sprintf("Connected to Docker event stream, replaying events since %s.", c.Since)
+	default:
+		return "Connected to Docker event stream."
+	}
+}
+
+// Backoff controls the delay between reconnection attempts to the Docker event stream. The
+// delay starts at Initial, doubles after every failed attempt and never exceeds Max.
+type Backoff struct {
+	Initial time.Duration
+	Max     time.Duration
+}
+
+// DefaultBackoff returns the backoff used by the watcher.
+func DefaultBackoff() Backoff {
+	return Backoff{Initial: time.Second, Max: 30 * time.Second}
+}
+
+// Delay returns the delay before the given reconnection attempt, starting at zero.
+func (b Backoff) Delay(attempt int) time.Duration {
+	delay := b.Initial
+	for i := 0; i < attempt && delay < b.Max; i++ {
+		delay *= 2
+	}
+	if delay > b.Max {
+		delay = b.Max
+	}
+	return delay
+}
+
+// recentEvents is the number of delivered events the cursor remembers to recognize duplicates.
+const recentEvents = 1024
+
+// cursor remembers the timestamp of the latest event seen, so a new stream can resume from it,
+// and the events delivered recently, so an event replayed by the new stream is not delivered
+// twice. Timestamps come from the daemon, whose clock may differ from the host's.
+type cursor struct {
+	lastNano int64
+	recent   map[string]struct{}
+	order    []string
+}
+
+// newCursor returns a cursor resuming from the given daemon time.
+func newCursor(nano int64) *cursor {
+	return &cursor{lastNano: nano, recent: make(map[string]struct{})}
+}
+
+// since returns the timestamp to resume the event stream from, in the "seconds.nanoseconds"
+// format accepted by the Since option.
+func (c *cursor) since() string {
+	return fmt.Sprintf("%d.%09d", c.lastNano/int64(time.Second), c.lastNano%int64(time.Second))
+}
+
+// advance records the event and reports whether it was not delivered before. Only an exact
+// duplicate of a recent event is rejected: events older than the latest one are delivered, as
+// the daemon may emit them out of order.
+func (c *cursor) advance(event events.Message) bool {
+	key := fmt.Sprintf("%d/%s/%s/%s", event.TimeNano, event.Type, event.Action, event.Actor.ID)
+	if _, delivered := c.recent[key]; delivered {
+		return false
+	}
+	c.recent[key] = struct{}{}
+	c.order = append(c.order, key)
+	if len(c.order) > recentEvents {
+		delete(c.recent, c.order[0])
+		c.order = c.order[1:]
+	}
+	if event.TimeNano > c.lastNano {
+		c.lastNano = event.TimeNano
+	}
+	return true
+}
+
+// daemonTime returns the current time of the daemon in nanoseconds, falling back to the host's
+// when the daemon does not report it.
+func daemonTime(cli dockerapi.Client, ctx context.Context) int64 {
+	info, err := cli.Info(ctx)
+	if err == nil {
+		if systemTime, err := time.Parse(time.RFC3339Nano, info.SystemTime); err == nil {
+			return systemTime.UnixNano()
+		}
+	}
+	return time.Now().UnixNano()
+}
+
+// MonitorContainerEvents sets up Docker event monitoring and returns channels for events and
+// connection state changes. When the event stream drops, it reconnects with backoff and replays
+// the events emitted since the last one seen, so no event is missed during a daemon restart.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context stopping the monitoring when canceled.
+// - backoff: The delays between reconnection attempts.
+//
+// Returns:
+// - <-chan events.Message: Channel for Docker container and image events, closed when ctx is canceled.
+// - <-chan StateChange: Channel for changes of the connection to the event stream.
+func MonitorContainerEvents(cli dockerapi.Client, ctx context.Context, backoff Backoff) (<-chan events.Message, <-chan StateChange) {
+	eventCh := make(chan events.Message)
+	stateCh := make(chan StateChange)
+
+	args := filters.NewArgs()
+	args.Add("type", "container")
+	args.Add("type", "image")
+	options := events.ListOptions{
+		Filters: args,
+	}
+
+	// Subscribe before returning so no event emitted after this call is missed. The daemon's clock
+	// stamps the events, so the stream resumes from its time until the first event is seen
+	position := newCursor(daemonTime(cli, ctx))
+	eventChan, eventErrChan := cli.Events(ctx, options)
+
+	go func() {
+		defer close(eventCh)
+		defer close(stateCh)
+
+		send := func(change StateChange) bool {
+			select {
+			case stateCh <- change:
+				return true
+			case <-ctx.Done():
+				return false
+			}
+		}
+
+		if !send(StateChange{State: StateConnected}) {
+			return
+		}
+
+		attempt := 0
+		for {
+			err := forwardEvents(ctx, eventChan, eventErrChan, eventCh, position, func() { attempt = 0 })
+			if ctx.Err() != nil {
+				return
+			}
+
+			delay := backoff.Delay(attempt)
+			attempt++
+			if !send(StateChange{State: StateDisconnected, Err: fmt.Errorf("error while receiving Docker events: %w", err), Retry: delay}) {
+				return
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+
+			options.Since = position.since()
+			eventChan, eventErrChan = cli.Events(ctx, options)
+			metrics.Reconnected()
+			if !send(StateChange{State: StateConnected, Since: options.Since}) {
+				return
+			}
+		}
+	}()
+
+	return eventCh, stateCh
+}
+
+// forwardEvents delivers the events of one stream that were not delivered before, until the
+// stream fails or ctx is canceled. received is called for every event read from the stream.
+func forwardEvents(ctx context.Context, eventChan <-chan events.Message, eventErrChan <-chan error, eventCh chan<- events.Message, position *cursor, received func()) error {
+	for {
+		select {
+		case event := <-eventChan:
+			received()
+			if !position.advance(event) {
+				continue
+			}
+			metrics.EventReceived(event)
+			select {
+			case eventCh <- event:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		case err := <-eventErrChan:
+			return err
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,157 @@
+package events
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+func receiveState(t *testing.T, stateCh <-chan StateChange) StateChange {
+	t.Helper()
+	select {
+	case change := <-stateCh:
+		return change
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for a connection state change")
+		return StateChange{}
+	}
+}
+
+func receiveEvent(t *testing.T, eventCh <-chan events.Message) events.Message {
+	t.Helper()
+	select {
+	case event := <-eventCh:
+		return event
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for an event")
+		return events.Message{}
+	}
+}
+
+// TestMonitorReconnectsAndReplays checks that a die event emitted while the event stream is down
+// is delivered once the monitor reconnects, and that events seen before are not delivered twice.
+func TestMonitorReconnectsAndReplays(t *testing.T) {
+	daemon := fake.NewDaemon()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventCh, stateCh := MonitorContainerEvents(daemon, ctx, Backoff{Initial: time.Millisecond, Max: 4 * time.Millisecond})
+	assert.Equal(t, StateChange{State: StateConnected}, receiveState(t, stateCh))
+
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-build"})
+	require.NoError(t, daemon.StartContainer(job))
+	assert.Equal(t, events.ActionCreate, receiveEvent(t, eventCh).Action)
+	assert.Equal(t, events.ActionStart, receiveEvent(t, eventCh).Action)
+
+	// The daemon restarts: the stream drops and the next connections are refused
+	daemon.RefuseConnections(2)
+	daemon.Disconnect(errors.New("unexpected EOF"))
+	require.NoError(t, daemon.ExitContainer(job, 0))
+
+	disconnected := receiveState(t, stateCh)
+	assert.Equal(t, StateDisconnected, disconnected.State)
+	assert.ErrorContains(t, disconnected.Err, "unexpected EOF")
+	assert.Equal(t, time.Millisecond, disconnected.Retry)
+
+	for _, retry := range []time.Duration{2 * time.Millisecond, 4 * time.Millisecond} {
+		assert.Equal(t, StateConnected, receiveState(t, stateCh).State)
+		refused := receiveState(t, stateCh)
+		assert.Equal(t, StateDisconnected, refused.State)
+		assert.Equal(t, retry, refused.Retry)
+	}
+
+	reconnected := receiveState(t, stateCh)
+	assert.Equal(t, StateConnected, reconnected.State)
+	assert.NotEmpty(t, reconnected.Since)
+
+	die := receiveEvent(t, eventCh)
+	assert.Equal(t, events.ActionDie, die.Action)
+	assert.Equal(t, job, die.Actor.ID)
+
+	// Events after the reconnection flow normally
+	other := daemon.CreateContainer(fake.ContainerSpec{Name: "other"})
+	created := receiveEvent(t, eventCh)
+	assert.Equal(t, events.ActionCreate, created.Action)
+	assert.Equal(t, other, created.Actor.ID)
+}
+
+func TestMonitorStopsOnCancel(t *testing.T) {
+	daemon := fake.NewDaemon()
+	ctx, cancel := context.WithCancel(context.Background())
+
+	eventCh, stateCh := MonitorContainerEvents(daemon, ctx, DefaultBackoff())
+	receiveState(t, stateCh)
+	cancel()
+
+	for range eventCh {
+	}
+	for range stateCh {
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	backoff := Backoff{Initial: time.Second, Max: 10 * time.Second}
+
+	assert.Equal(t, time.Second, backoff.Delay(0))
+	assert.Equal(t, 2*time.Second, backoff.Delay(1))
+	assert.Equal(t, 8*time.Second, backoff.Delay(3))
+	assert.Equal(t, 10*time.Second, backoff.Delay(4))
+	assert.Equal(t, 10*time.Second, backoff.Delay(100))
+}
+
+func TestCursor(t *testing.T) {
+	position := newCursor(1_000_000_000)
+	event := func(nano int64, action events.Action, id string) events.Message {
+		return events.Message{Type: events.ContainerEventType, Action: action, Actor: events.Actor{ID: id}, TimeNano: nano}
+	}
+
+	assert.True(t, position.advance(event(999_999_999, events.ActionStart, "a")))
+	assert.Equal(t, "1.000000000", position.since())
+	assert.True(t, position.advance(event(1_500_000_000, events.ActionStart, "a")))
+	assert.True(t, position.advance(event(1_500_000_000, events.ActionStart, "b")))
+	assert.False(t, position.advance(event(1_500_000_000, events.ActionStart, "a")))
+	assert.False(t, position.advance(event(999_999_999, events.ActionStart, "a")))
+	assert.Equal(t, "1.500000000", position.since())
+	assert.True(t, position.advance(event(1_200_000_000, events.ActionDie, "a")))
+	assert.Equal(t, "1.500000000", position.since())
+	assert.True(t, position.advance(event(2_000_000_001, events.ActionDie, "a")))
+	assert.Equal(t, "2.000000001", position.since())
+}
+
+// TestMonitorDaemonClockBehind checks that events stamped by a daemon whose clock is behind the
+// host's are delivered, and replayed from the daemon's time when the stream drops before any.
+func TestMonitorDaemonClockBehind(t *testing.T) {
+	daemon := fake.NewDaemon()
+	daemon.SetClockSkew(-time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	eventCh, stateCh := MonitorContainerEvents(daemon, ctx, Backoff{Initial: time.Millisecond, Max: time.Millisecond})
+	assert.Equal(t, StateConnected, receiveState(t, stateCh).State)
+
+	// The stream drops before any event, and a container is created meanwhile
+	daemon.RefuseConnections(1)
+	daemon.Disconnect(errors.New("unexpected EOF"))
+	first := daemon.CreateContainer(fake.ContainerSpec{Name: "first"})
+	for i := 0; i < 3; i++ {
+		receiveState(t, stateCh)
+	}
+	reconnected := receiveState(t, stateCh)
+	assert.Equal(t, StateConnected, reconnected.State)
+	assert.NotEmpty(t, reconnected.Since)
+
+	created := receiveEvent(t, eventCh)
+	assert.Equal(t, events.ActionCreate, created.Action)
+	assert.Equal(t, first, created.Actor.ID)
+
+	second := daemon.CreateContainer(fake.ContainerSpec{Name: "second"})
+	created = receiveEvent(t, eventCh)
+	assert.Equal(t, events.ActionCreate, created.Action)
+	assert.Equal(t, second, created.Actor.ID)
+}
@@ -0,0 +1,182 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/client"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/provider"
+)
+
+// StaleContainer is a job container found exited when reconciling.
+type StaleContainer struct {
+	ID    string
+	Name  string
+	State string
+
+	// FinishedAt is when the container exited, zero if the daemon did not report it.
+	FinishedAt time.Time
+}
+
+// StaleJob is a job whose containers exited before the watcher could see their die event.
+type StaleJob struct {
+	Job        provider.Job
+	Containers []StaleContainer
+	Failed     bool
+
+	// Delay is what was left of the grace period when the job was found, zero once it elapsed.
+	Delay time.Duration
+
+	// Submitted is false if the pool refused the cleanup because it is shutting down.
+	Submitted bool
+
+	policy cleanup.Policy
+}
+
+// Reconciliation reports the stale jobs found by Reconcile, in the order their containers were
+// listed.
+type Reconciliation struct {
+	Jobs []StaleJob
+}
+
+// Containers returns the number of stale job containers found.
+func (r Reconciliation) Containers() int {
+	count := 0
+	for _, job := range r.Jobs {
+		count += len(job.Containers)
+	}
+	return count
+}
+
+// Reconcile finds the job containers that exited while no watcher was running, whose die event
+// was therefore never seen, and submits the cleanup of their jobs. Jobs are cleaned up once the
+// grace period of their policy has elapsed since their last container exited: the cleanup of
+// jobs that exited long ago starts right away, while recent ones wait for what is left of it.
+// Containers already finished in the registry, and jobs it tracks as running, are left alone.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - prov: The CI provider identifying the jobs.
+// - matcher: The compiled job patterns to match against container names.
+// - opts: The options of the pool, giving the grace period of policies that do not set one.
+// - registry: The registry recording the resources owned by each job.
+// - pool: The worker pool cleaning up finished jobs.
+//
+// Returns:
+// - Reconciliation: The stale jobs found and whether their cleanup was submitted.
+// - error: An error if the containers could not be listed.
+func Reconcile(cli dockerapi.Client, ctx context.Context, prov provider.Provider, matcher *Matcher, opts cleanup.Options, registry *cleanup.Registry, pool *cleanup.Pool) (Reconciliation, error) {
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return Reconciliation{}, fmt.Errorf("failed to list containers: %w", err)
+	}
+
+	now := time.Now()
+	var stale []*StaleJob
+	byJob := make(map[string]*StaleJob)
+	for _, c := range containers {
+		if (c.State != "exited" && c.State != "dead") || len(c.Names) == 0 {
+			continue
+		}
+		match, matched := matcher.Match(c.Names[0])
+		if !matched {
+			continue
+		}
+		job, identified := prov.Job(c.ID, c.Names[0], c.Labels)
+		job = match.Apply(job, identified)
+
+		found, exists := byJob[job.ID]
+		if !exists && !registry.Resources(job.ID).Empty() {
+			// The job is still running, its remaining containers trigger the cleanup
+			continue
+		}
+		if !registry.Finish(c.ID) {
+			continue
+		}
+		if !exists {
+			found = &StaleJob{Job: job, policy: match.Policy}
+			byJob[job.ID] = found
+			stale = append(stale, found)
+		}
+
+		found.Containers = append(found.Containers, StaleContainer{
+			ID:         c.ID,
+			Name:       c.Names[0],
+			State:      c.State,
+			FinishedAt: finishedAt(cli, ctx, c),
+		})
+		found.Failed = found.Failed || ExitedWithFailure(c)
+		registry.Track(job.ID, c.ID, c.Labels)
+	}
+
+	// Helper and service containers are cleaned up with the job they were created for
+	for _, c := range containers {
+		if len(c.Names) == 0 {
+			continue
+		}
+		job, identified := prov.Job(c.ID, c.Names[0], c.Labels)
+		if _, exists := byJob[job.ID]; exists && identified {
+			registry.Add(job.ID, c.ID, fmt.Sprintf("created by %s for the job", prov.DisplayName()), c.Labels)
+		}
+	}
+
+	var reconciliation Reconciliation
+	for _, found := range stale {
+		found.Delay = remainingGrace(found.policy.Apply(opts).Delay, found.Containers, now)
+		policy := found.policy
+		delay := cleanup.Duration(found.Delay)
+		policy.GraceDelay = &delay
+
+		owned := registry.Resources(found.Job.ID)
+		owned.Failed = found.Failed
+		found.Submitted = pool.Submit(owned, policy)
+		if found.Submitted {
+			registry.Forget(found.Job.ID)
+		}
+		reconciliation.Jobs = append(reconciliation.Jobs, *found)
+	}
+	return reconciliation, nil
+}
+
+// finishedAt returns when the container exited, or the zero time if it cannot be inspected.
+func finishedAt(cli dockerapi.Client, ctx context.Context, c types.Container) time.Time {
+	containerJSON, err := cli.ContainerInspect(ctx, c.ID)
+	if err != nil {
+		if !client.IsErrNotFound(err) {
+			Logger().Warn("Failed to inspect container", cleanup.LogContainerID, c.ID, cleanup.ErrorAttr(err))
+		}
+		return time.Time{}
+	}
+	if containerJSON.ContainerJSONBase == nil || containerJSON.State == nil {
+		return time.Time{}
+	}
+	finished, err := time.Parse(time.RFC3339Nano, containerJSON.State.FinishedAt)
+	if err != nil {
+		return time.Time{}
+	}
+	return finished
+}
+
+// remainingGrace returns what is left at now of the grace period started when the last of the
+// containers exited. Containers whose exit time is unknown count as exited long ago.
+func remainingGrace(grace time.Duration, containers []StaleContainer, now time.Time) time.Duration {
+	var last time.Time
+	for _, c := range containers {
+		if c.FinishedAt.After(last) {
+			last = c.FinishedAt
+		}
+	}
+	if last.IsZero() {
+		return 0
+	}
+	if remaining := grace - now.Sub(last); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
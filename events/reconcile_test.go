@@ -0,0 +1,120 @@
+package events
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+	"job-detection.is/github-gitlab/provider"
+)
+
+func TestReconcileCleansUpStaleJobs(t *testing.T) {
+	daemon := sharedHost()
+	opts := testOptions()
+	opts.Delay = time.Minute
+
+	// A job that exited while the watcher was down, long enough ago for its grace period to elapse
+	daemon.AddNetwork("ci-job_default", map[string]string{"com.docker.compose.project": "ci-job"})
+	stale := daemon.CreateContainer(fake.ContainerSpec{
+		Name:     "runner-abc-project-1-concurrent-0-build",
+		Labels:   map[string]string{"com.docker.compose.project": "ci-job", "com.gitlab.ci.job.id": "1234"},
+		Networks: []string{"ci-job_default"},
+	})
+	require.NoError(t, daemon.StartContainer(stale))
+	require.NoError(t, daemon.ExitContainer(stale, 1))
+	require.NoError(t, daemon.AgeContainer(stale, time.Hour))
+
+	// A job still running
+	running := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-2-concurrent-1-build"})
+	require.NoError(t, daemon.StartContainer(running))
+
+	// An exited container that is not a job container
+	other := daemon.CreateContainer(fake.ContainerSpec{Name: "nginx"})
+	require.NoError(t, daemon.StartContainer(other))
+	require.NoError(t, daemon.ExitContainer(other, 0))
+	require.NoError(t, daemon.AgeContainer(other, time.Hour))
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+	pool := cleanup.NewPool(daemon, 2, opts, nil)
+	reconciliation, err := Reconcile(daemon, context.Background(), provider.GitLab{}, newMatcher(t, flowPatterns), opts, registry, pool)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, pool.Shutdown(ctx))
+
+	require.Len(t, reconciliation.Jobs, 1)
+	job := reconciliation.Jobs[0]
+	assert.Equal(t, "1234", job.Job.ID)
+	assert.True(t, job.Failed)
+	assert.True(t, job.Submitted)
+	assert.Zero(t, job.Delay)
+	require.Len(t, job.Containers, 1)
+	assert.Equal(t, stale, job.Containers[0].ID)
+	assert.WithinDuration(t, time.Now().Add(-time.Hour), job.Containers[0].FinishedAt, time.Minute)
+	assert.Equal(t, 1, reconciliation.Containers())
+
+	assert.False(t, daemon.HasContainer(stale))
+	assert.False(t, daemon.HasNetwork("ci-job_default"))
+	assert.Equal(t, "running", daemon.ContainerState(running))
+	assert.Equal(t, "exited", daemon.ContainerState(other))
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestReconcileSkipsKnownJobs(t *testing.T) {
+	daemon := fake.NewDaemon()
+
+	// A container whose die event was already handled
+	finished := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(finished))
+	require.NoError(t, daemon.ExitContainer(finished, 0))
+
+	// A job tracked as running, one of whose containers already exited
+	tracked := daemon.CreateContainer(fake.ContainerSpec{
+		Name:   "runner-abc-project-2-concurrent-1-build",
+		Labels: map[string]string{"com.gitlab.ci.job.id": "5678"},
+	})
+	require.NoError(t, daemon.StartContainer(tracked))
+	require.NoError(t, daemon.ExitContainer(tracked, 0))
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), nil)
+	registry.Finish(finished)
+	registry.Track("5678", "other", nil)
+
+	pool := cleanup.NewPool(daemon, 2, testOptions(), nil)
+	reconciliation, err := Reconcile(daemon, context.Background(), provider.GitLab{}, newMatcher(t, flowPatterns), testOptions(), registry, pool)
+	require.NoError(t, err)
+	require.NoError(t, pool.Shutdown(context.Background()))
+
+	assert.Empty(t, reconciliation.Jobs)
+	assert.True(t, daemon.HasContainer(finished))
+	assert.True(t, daemon.HasContainer(tracked))
+}
+
+func TestRemainingGrace(t *testing.T) {
+	now := time.Now()
+	tests := []struct {
+		name       string
+		finishedAt []time.Time
+		want       time.Duration
+	}{
+		{"elapsed", []time.Time{now.Add(-time.Hour)}, 0},
+		{"started", []time.Time{now.Add(-4 * time.Second)}, 6 * time.Second},
+		{"last container", []time.Time{now.Add(-time.Hour), now.Add(-2 * time.Second)}, 8 * time.Second},
+		{"unknown", []time.Time{{}}, 0},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var containers []StaleContainer
+			for _, finishedAt := range tc.finishedAt {
+				containers = append(containers, StaleContainer{FinishedAt: finishedAt})
+			}
+			assert.Equal(t, tc.want, remainingGrace(10*time.Second, containers, now))
+		})
+	}
+}
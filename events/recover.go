@@ -0,0 +1,127 @@
+package events
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi"
+	"job-detection.is/github-gitlab/store"
+)
+
+// Recover reconciles the jobs recorded by a previous run of the watcher with the containers
+// known to the daemon. Running jobs are matched against the job patterns again, and forgotten
+// if some of their containers survive but none of them matches anymore. Running jobs whose
+// containers were all removed are cleaned up with the default policy. Jobs whose containers are still alive are
+// tracked again, so that their die event triggers the cleanup. Jobs that finished while the
+// watcher was down, and jobs whose cleanup was requested, interrupted or failed, are submitted
+// to the pool.
+//
+// Parameters:
+// - cli: The Docker client instance.
+// - ctx: The context for API calls.
+// - st: The store recording the jobs.
+// - matcher: The compiled job patterns, giving the policy of the recovered jobs.
+// - registry: The registry recording the resources owned by each job.
+// - pool: The worker pool cleaning up finished jobs.
+//
+// Returns:
+// - int: The number of jobs submitted for cleanup.
+// - error: An error if the containers could not be listed.
+func Recover(cli dockerapi.Client, ctx context.Context, st *store.Store, matcher *Matcher, registry *cleanup.Registry, pool *cleanup.Pool) (int, error) {
+	jobs := st.Jobs()
+	if len(jobs) == 0 {
+		return 0, nil
+	}
+
+	containers, err := cli.ContainerList(ctx, container.ListOptions{All: true})
+	if err != nil {
+		return 0, fmt.Errorf("failed to list containers: %w", err)
+	}
+	byID := make(map[string]types.Container, len(containers))
+	for _, c := range containers {
+		byID[c.ID] = c
+	}
+
+	submitted := 0
+	for _, job := range jobs {
+		owned := job.Resources
+		policy := job.Policy
+		policy.Protection = matcher.DefaultPolicy().Protection
+
+		if job.State == store.StateRunning {
+			match, matched, surviving := recoveredMatch(owned, byID, matcher)
+			if surviving && !matched {
+				Logger().Info("Forgetting recorded job matching no job pattern", cleanup.LogJobID, job.ID)
+				st.Forget(job.ID)
+				continue
+			}
+			if !surviving {
+				// The runner removed the containers of the job while the watcher was down, so
+				// the rest of its resources are cleaned up with the default policy
+				match = Match{Policy: matcher.DefaultPolicy()}
+			}
+
+			if alive(owned, byID) {
+				Logger().Info("Resuming tracking of the job", cleanup.LogJobID, job.ID)
+				for containerID, reason := range owned.Containers {
+					if c, exists := byID[containerID]; exists {
+						registry.Restore(job.ID, containerID, reason, c.Labels)
+					}
+				}
+				registry.RestoreImages(owned)
+				continue
+			}
+
+			// The job finished while the watcher was down
+			Logger().Info("Job finished while the watcher was down, cleaning up", cleanup.LogJobID, job.ID)
+			policy = match.Policy
+			for containerID := range owned.Containers {
+				if c, exists := byID[containerID]; exists && ExitedWithFailure(c) {
+					owned.Failed = true
+				}
+			}
+		} else {
+			Logger().Info("Resuming cleanup of the job", cleanup.LogJobID, job.ID, "state", job.State, "attempts", job.Attempts)
+		}
+
+		// The destroy events of the containers removed by the cleanup must not trigger another one
+		for containerID := range owned.Containers {
+			registry.Finish(containerID)
+		}
+		if pool.Submit(owned, policy) {
+			submitted++
+		}
+	}
+	return submitted, nil
+}
+
+// alive reports whether any container of the job is still running or about to run.
+func alive(owned *cleanup.Resources, byID map[string]types.Container) bool {
+	for containerID := range owned.Containers {
+		if c, exists := byID[containerID]; exists && c.State != "exited" && c.State != "dead" {
+			return true
+		}
+	}
+	return false
+}
+
+// recoveredMatch matches the containers of the job still known to the daemon against the job
+// patterns, and returns the match of the first one matching, and whether any container of the job
+// is still known to the daemon.
+func recoveredMatch(owned *cleanup.Resources, byID map[string]types.Container, matcher *Matcher) (Match, bool, bool) {
+	surviving := false
+	for containerID := range owned.Containers {
+		c, exists := byID[containerID]
+		if !exists || len(c.Names) == 0 {
+			continue
+		}
+		surviving = true
+		if match, matched := matcher.Match(c.Names[0]); matched {
+			return match, true, true
+		}
+	}
+	return Match{}, false, surviving
+}
@@ -0,0 +1,195 @@
+package events
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+	"job-detection.is/github-gitlab/provider"
+	"job-detection.is/github-gitlab/store"
+)
+
+// recoverJobs runs Recover on a new pool and waits for the cleanups it submitted.
+func recoverJobs(t *testing.T, daemon *fake.Daemon, st *store.Store, registry *cleanup.Registry) int {
+	t.Helper()
+
+	pool := cleanup.NewPool(daemon, 2, testOptions(), st)
+	submitted, err := Recover(daemon, context.Background(), st, newMatcher(t, flowPatterns), registry, pool)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	require.NoError(t, pool.Shutdown(ctx))
+	return submitted
+}
+
+func TestRecoverCleansUpJobsFinishedWhileDown(t *testing.T) {
+	daemon := sharedHost()
+	st, err := store.Open(filepath.Join(t.TempDir(), "state.json"), nil)
+	require.NoError(t, err)
+
+	daemon.AddVolume("job-cache", map[string]string{"com.gitlab.ci.job.id": "1234"})
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(job))
+	st.Tracked("1234", provider.GitLab{}.JobLabel(), job, "job container", nil)
+
+	// The job exits while the watcher is down
+	require.NoError(t, daemon.ExitContainer(job, 0))
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)
+	assert.Equal(t, 1, recoverJobs(t, daemon, st, registry))
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.False(t, daemon.HasVolume("job-cache"))
+	assert.Empty(t, st.Jobs())
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestRecoverResumesInterruptedCleanups(t *testing.T) {
+	daemon := sharedHost()
+	st, err := store.Open(filepath.Join(t.TempDir(), "state.json"), nil)
+	require.NoError(t, err)
+
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(job))
+	require.NoError(t, daemon.ExitContainer(job, 0))
+
+	// The watcher crashed during the cleanup of the job
+	st.Tracked("1234", provider.GitLab{}.JobLabel(), job, "job container", nil)
+	st.Submitted(st.Jobs()[0].Resources, cleanup.Policy{})
+	st.Attempted("1234")
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)
+	assert.Equal(t, 1, recoverJobs(t, daemon, st, registry))
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.Empty(t, st.Jobs())
+	assertSharedHostIntact(t, daemon)
+}
+
+func TestRecoverTracksRunningJobs(t *testing.T) {
+	daemon := sharedHost()
+	st, err := store.Open(filepath.Join(t.TempDir(), "state.json"), nil)
+	require.NoError(t, err)
+
+	// A service container of the job, recorded before the restart, that the patterns do not match
+	service := daemon.CreateContainer(fake.ContainerSpec{Name: "postgres-service"})
+	require.NoError(t, daemon.StartContainer(service))
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(job))
+	st.Tracked(job, provider.GitLab{}.JobLabel(), job, "job container", nil)
+	st.Tracked(job, provider.GitLab{}.JobLabel(), service, "created for the job", nil)
+
+	// An image the job built and a tag it added to a base image, recorded before the restart
+	built := daemon.AddImage("registry.example.com/ci/app:job-1", 100, nil)
+	st.TrackedImage(job, provider.GitLab{}.JobLabel(), built, "built while the job was running")
+	base := daemon.AddImage("alpine:3", 100, nil)
+	require.NoError(t, daemon.TagImage(base, "myreg/alpine:ci"))
+	st.TrackedImageTag(job, provider.GitLab{}.JobLabel(), "myreg/alpine:ci", "tagged while the job was running")
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)
+	assert.Equal(t, 0, recoverJobs(t, daemon, st, registry))
+	assert.True(t, registry.Resources(job).HasContainer(service))
+	assert.Contains(t, registry.Resources(job).Images, built)
+	assert.Contains(t, registry.Resources(job).ImageTags, "myreg/alpine:ci")
+
+	eventCh := monitor(t, daemon)
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	runUntilDie(t, daemon, eventCh, provider.GitLab{}, newMatcher(t, flowPatterns), registry, testOptions(), job)
+
+	assert.False(t, daemon.HasContainer(job))
+	assert.False(t, daemon.HasContainer(service))
+	assert.False(t, daemon.HasImage(built))
+	assert.True(t, daemon.HasImage("alpine:3"))
+	assert.False(t, daemon.HasImage("myreg/alpine:ci"))
+	assertSharedHostIntact(t, daemon)
+}
+
+// TestRecoverForgetsUnmatchedJobs checks that a running job recorded by a previous run is
+// forgotten rather than cleaned up when none of its containers matches a job pattern.
+func TestRecoverForgetsUnmatchedJobs(t *testing.T) {
+	daemon := sharedHost()
+	st, err := store.Open(filepath.Join(t.TempDir(), "state.json"), nil)
+	require.NoError(t, err)
+
+	lint := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-lint"})
+	require.NoError(t, daemon.StartContainer(lint))
+	require.NoError(t, daemon.ExitContainer(lint, 0))
+	st.Tracked("1234", provider.GitLab{}.JobLabel(), lint, "created by GitLab for the job", nil)
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)
+	assert.Equal(t, 0, recoverJobs(t, daemon, st, registry))
+
+	assert.Equal(t, "exited", daemon.ContainerState(lint))
+	assert.False(t, registry.Tracks("1234"))
+	assert.Empty(t, st.Jobs())
+}
+
+// TestRecoverCleansUpJobsWhoseContainersWereRemoved checks that a running job whose containers
+// were all removed while the watcher was down has its other resources cleaned up.
+func TestRecoverCleansUpJobsWhoseContainersWereRemoved(t *testing.T) {
+	daemon := sharedHost()
+	st, err := store.Open(filepath.Join(t.TempDir(), "state.json"), nil)
+	require.NoError(t, err)
+
+	daemon.AddVolume("job-cache", jobLabels("1234"))
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build", Labels: jobLabels("1234")})
+	require.NoError(t, daemon.StartContainer(job))
+	st.Tracked("1234", provider.GitLab{}.JobLabel(), job, "job container", nil)
+
+	// The runner removes the job container while the watcher is down
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	require.NoError(t, daemon.ContainerRemove(context.Background(), job, container.RemoveOptions{}))
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)
+	assert.Equal(t, 1, recoverJobs(t, daemon, st, registry))
+
+	assert.False(t, daemon.HasVolume("job-cache"))
+	assert.Empty(t, st.Jobs())
+	assertSharedHostIntact(t, daemon)
+}
+
+// TestRecoverRetriesFailedCleanups checks that a failed cleanup stays in the store, counting its
+// attempts, until a cleanup after a restart succeeds.
+func TestRecoverRetriesFailedCleanups(t *testing.T) {
+	daemon := sharedHost()
+	st, err := store.Open(filepath.Join(t.TempDir(), "state.json"), nil)
+	require.NoError(t, err)
+
+	// The volume of the job is mounted by a container it does not own
+	daemon.AddVolume("job-cache", map[string]string{"com.gitlab.ci.job.id": "1234"})
+	debug := daemon.CreateContainer(fake.ContainerSpec{Name: "debug", Volumes: []string{"job-cache"}})
+	require.NoError(t, daemon.StartContainer(debug))
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "runner-abc-project-1-concurrent-0-build"})
+	require.NoError(t, daemon.StartContainer(job))
+	require.NoError(t, daemon.ExitContainer(job, 0))
+	st.Tracked("1234", provider.GitLab{}.JobLabel(), job, "job container", nil)
+
+	registry := cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)
+	assert.Equal(t, 1, recoverJobs(t, daemon, st, registry))
+	assert.False(t, daemon.HasContainer(job))
+	assert.True(t, daemon.HasVolume("job-cache"))
+	jobs := st.Jobs()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, store.StateFailed, jobs[0].State)
+	assert.Equal(t, 1, jobs[0].Attempts)
+
+	// Still failing after a restart
+	assert.Equal(t, 1, recoverJobs(t, daemon, st, cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)))
+	jobs = st.Jobs()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, store.StateFailed, jobs[0].State)
+	assert.Equal(t, 2, jobs[0].Attempts)
+
+	require.NoError(t, daemon.ContainerRemove(context.Background(), debug, container.RemoveOptions{Force: true}))
+	assert.Equal(t, 1, recoverJobs(t, daemon, st, cleanup.NewRegistry(provider.GitLab{}.JobLabel(), st)))
+	assert.False(t, daemon.HasVolume("job-cache"))
+	assert.Empty(t, st.Jobs())
+	assertSharedHostIntact(t, daemon)
+}
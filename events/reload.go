@@ -0,0 +1,224 @@
+package events
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+// reloadDelay lets editors finish writing the configuration file before it is reloaded.
+const reloadDelay = 100 * time.Millisecond
+
+// ConfigWatcher keeps the configuration loaded from a file up to date. A new configuration only
+// replaces the current one once it was loaded and validated, so a broken edit never stops the
+// detection of jobs. It is safe for concurrent use.
+type ConfigWatcher struct {
+	filename string
+	prepare  func(*Config) error
+	current  atomic.Pointer[Config]
+	mu       sync.Mutex
+}
+
+// NewConfigWatcher loads the configuration file.
+//
+// Parameters:
+// - filename: The path to the configuration file.
+// - prepare: Completes and validates every configuration loaded, before it is used.
+//
+// Returns:
+// - *ConfigWatcher: The watcher holding the loaded configuration.
+// - error: An error if the configuration could not be loaded or is invalid.
+func NewConfigWatcher(filename string, prepare func(*Config) error) (*ConfigWatcher, error) {
+	w := &ConfigWatcher{filename: filename, prepare: prepare}
+
+	config, err := w.load()
+	if err != nil {
+		return nil, err
+	}
+	w.current.Store(config)
+	return w, nil
+}
+
+// Config returns the current configuration. It must not be modified.
+func (w *ConfigWatcher) Config() *Config {
+	return w.current.Load()
+}
+
+// Reload loads the configuration file again and replaces the current configuration with it,
+// logging the job patterns added or removed and every other section that changed. The current configuration is kept if the new one could
+// not be loaded or is invalid.
+//
+// Returns:
+// - error: An error if the new configuration was rejected.
+func (w *ConfigWatcher) Reload() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	config, err := w.load()
+	if err != nil {
+		Logger().Error("Keeping the current config, failed to reload it", "config", w.filename, cleanup.ErrorAttr(err))
+		return err
+	}
+
+	previous := w.current.Swap(config)
+	added, removed := diffPatterns(previous.JobPatterns, config.JobPatterns)
+	sections := changedSections(previous, config)
+	if len(added) == 0 && len(removed) == 0 && len(sections) == 0 {
+		Logger().Info("Config reloaded without changes", "config", w.filename)
+		return nil
+	}
+	for _, pattern := range added {
+		Logger().Info("Config reloaded, added job pattern", "config", w.filename, cleanup.LogPattern, pattern)
+	}
+	for _, pattern := range removed {
+		Logger().Info("Config reloaded, removed job pattern", "config", w.filename, cleanup.LogPattern, pattern)
+	}
+	for _, section := range sections {
+		Logger().Info("Config reloaded, replaced section", "config", w.filename, "section", section)
+	}
+	return nil
+}
+
+// Start reloads the configuration in the background whenever the file changes or a signal is
+// received, until ctx is cancelled. The file is watched before Start returns. Changes are still
+// picked up on signals if the file cannot be watched.
+//
+// Parameters:
+// - ctx: The context ending the watch.
+// - signals: Signals requesting a reload, typically SIGHUP.
+func (w *ConfigWatcher) Start(ctx context.Context, signals <-chan os.Signal) {
+	// The directory is watched since editors often replace the file rather than write it
+	watcher, err := fsnotify.NewWatcher()
+	if err == nil {
+		if err = watcher.Add(filepath.Dir(w.filename)); err != nil {
+			watcher.Close()
+		}
+	}
+	if err != nil {
+		Logger().Warn("Failed to watch config, reloading on SIGHUP only", "config", w.filename, cleanup.ErrorAttr(err))
+		watcher = nil
+	}
+
+	go w.run(ctx, watcher, signals)
+}
+
+// run reloads the configuration on file events and signals until ctx is cancelled.
+func (w *ConfigWatcher) run(ctx context.Context, watcher *fsnotify.Watcher, signals <-chan os.Signal) {
+	var fileEvents <-chan fsnotify.Event
+	var fileErrors <-chan error
+	if watcher != nil {
+		defer watcher.Close()
+		fileEvents = watcher.Events
+		fileErrors = watcher.Errors
+	}
+
+	timer := time.NewTimer(reloadDelay)
+	timer.Stop()
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case sig := <-signals:
+			Logger().Info("Reloading config", "config", w.filename, "signal", sig.String())
+			_ = w.Reload()
+		case event := <-fileEvents:
+			if filepath.Clean(event.Name) != filepath.Clean(w.filename) {
+				continue
+			}
+			if event.Has(fsnotify.Write) || event.Has(fsnotify.Create) || event.Has(fsnotify.Rename) {
+				timer.Reset(reloadDelay)
+			}
+		case <-timer.C:
+			_ = w.Reload()
+		case err := <-fileErrors:
+			Logger().Error("Error watching config", "config", w.filename, cleanup.ErrorAttr(err))
+		}
+	}
+}
+
+// load loads and prepares the configuration file.
+func (w *ConfigWatcher) load() (*Config, error) {
+	config, err := LoadConfig(w.filename)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load config %s: %w", w.filename, err)
+	}
+	if w.prepare != nil {
+		if err := w.prepare(config); err != nil {
+			return nil, fmt.Errorf("invalid config %s: %w", w.filename, err)
+		}
+	}
+	return config, nil
+}
+
+// diffPatterns returns the patterns only present in next, then those only present in previous.
+func diffPatterns(previous, next []string) (added, removed []string) {
+	seen := make(map[string]struct{}, len(previous))
+	for _, pattern := range previous {
+		seen[pattern] = struct{}{}
+	}
+	kept := make(map[string]struct{}, len(next))
+	for _, pattern := range next {
+		kept[pattern] = struct{}{}
+		if _, exists := seen[pattern]; !exists {
+			added = append(added, pattern)
+		}
+	}
+	for _, pattern := range previous {
+		if _, exists := kept[pattern]; !exists {
+			removed = append(removed, pattern)
+		}
+	}
+	return added, removed
+}
+
+// changedSections returns the names of the reloadable sections that differ between the
+// configurations: the defaults, the policies of the job patterns kept, the protection rules, and
+// the gc, diskPressure and notifications settings. Job patterns added or removed are reported by
+// diffPatterns.
+func changedSections(previous, next *Config) []string {
+	var changed []string
+	for _, section := range []struct {
+		name           string
+		previous, next any
+	}{
+		{"defaults", previous.Defaults, next.Defaults},
+		{"policies", patternPolicies(previous, next), patternPolicies(next, previous)},
+		{"protect", previous.Protect, next.Protect},
+		{"gc", previous.GC, next.GC},
+		{"diskPressure", previous.DiskPressure, next.DiskPressure},
+		{"notifications", previous.Notifications, next.Notifications},
+	} {
+		previousJSON, previousErr := json.Marshal(section.previous)
+		nextJSON, nextErr := json.Marshal(section.next)
+		if previousErr != nil || nextErr != nil || !bytes.Equal(previousJSON, nextJSON) {
+			changed = append(changed, section.name)
+		}
+	}
+	return changed
+}
+
+// patternPolicies returns the policies of the job patterns of config that other has as well.
+func patternPolicies(config, other *Config) map[string]cleanup.Policy {
+	kept := make(map[string]struct{}, len(other.Patterns))
+	for _, pattern := range other.Patterns {
+		kept[pattern.Pattern] = struct{}{}
+	}
+	policies := make(map[string]cleanup.Policy)
+	for _, pattern := range config.Patterns {
+		if _, exists := kept[pattern.Pattern]; exists {
+			policies[pattern.Pattern] = pattern.Policy
+		}
+	}
+	return policies
+}
@@ -0,0 +1,124 @@
+package events
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+func writeConfig(t *testing.T, filename, content string) {
+	t.Helper()
+	require.NoError(t, os.WriteFile(filename, []byte(content), 0o600))
+}
+
+func TestConfigWatcherReload(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobPattern.json")
+	writeConfig(t, filename, `{"jobPattern": ["^/runner-.*-build$"]}`)
+
+	watcher, err := NewConfigWatcher(filename, (*Config).Validate)
+	require.NoError(t, err)
+	previous := watcher.Config()
+
+	// Invalid configurations keep the current one
+	writeConfig(t, filename, `{"jobPattern": ["^/runner-(.*-build$"]}`)
+	assert.ErrorContains(t, watcher.Reload(), "invalid job pattern 0")
+	writeConfig(t, filename, `{"jobPattern": []}`)
+	assert.ErrorContains(t, watcher.Reload(), "no job patterns configured")
+	assert.Same(t, previous, watcher.Config())
+
+	writeConfig(t, filename, `{"jobPattern": ["^/runner-.*-build$", "^/runner-.*-test$"]}`)
+	require.NoError(t, watcher.Reload())
+	_, matched := watcher.Config().Matcher().Match("/runner-abc-test")
+	assert.True(t, matched)
+
+	// The configuration in use is never modified
+	_, matched = previous.Matcher().Match("/runner-abc-test")
+	assert.False(t, matched)
+}
+
+// TestConfigWatcherReloadLogsChangedSections checks that a reload logs the job patterns added
+// and removed, and every other section it replaced.
+func TestConfigWatcherReloadLogsChangedSections(t *testing.T) {
+	var out syncBuffer
+	SetLogger(slog.New(slog.NewJSONHandler(&out, nil)))
+	t.Cleanup(func() { SetLogger(nil) })
+
+	filename := filepath.Join(t.TempDir(), "config.json")
+	writeConfig(t, filename, `{"version": 2, "jobPatterns": ["^/a$", "^/b$"], "gc": {"interval": "10m"}}`)
+	watcher, err := NewConfigWatcher(filename, (*Config).Validate)
+	require.NoError(t, err)
+
+	writeConfig(t, filename, `{"version": 2, "jobPatterns": ["^/a$", {"pattern": "^/b$", "policy": {"keepOnFailure": true}}]}`)
+	require.NoError(t, watcher.Reload())
+	writeConfig(t, filename, `{"version": 2, "jobPatterns": [{"pattern": "^/b$", "policy": {"keepOnFailure": true}}, "^/c$"], "protect": [{"name": "^prod-"}]}`)
+	require.NoError(t, watcher.Reload())
+	require.NoError(t, watcher.Reload())
+
+	var logged []string
+	for _, record := range out.records(t) {
+		entry := record["msg"].(string)
+		if section, ok := record["section"].(string); ok {
+			entry += " " + section
+		}
+		if pattern, ok := record[cleanup.LogPattern].(string); ok {
+			entry += " " + pattern
+		}
+		logged = append(logged, entry)
+	}
+	assert.Equal(t, []string{
+		"Config reloaded, replaced section policies",
+		"Config reloaded, replaced section gc",
+		"Config reloaded, added job pattern ^/c$",
+		"Config reloaded, removed job pattern ^/a$",
+		"Config reloaded, replaced section protect",
+		"Config reloaded without changes",
+	}, logged)
+}
+
+func TestConfigWatcherRun(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "jobPattern.json")
+	writeConfig(t, filename, `{"jobPattern": ["^/runner-.*-build$"]}`)
+
+	watcher, err := NewConfigWatcher(filename, (*Config).Validate)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	signals := make(chan os.Signal, 1)
+	watcher.Start(ctx, signals)
+
+	patterns := func() []string { return watcher.Config().JobPatterns }
+
+	// Written in place
+	writeConfig(t, filename, `{"jobPattern": ["^/runner-.*-test$"]}`)
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual([]string{"^/runner-.*-test$"}, patterns()) }, 5*time.Second, 10*time.Millisecond)
+
+	// Replaced by a rename, as editors do
+	replacement := filename + ".tmp"
+	writeConfig(t, replacement, `{"jobPattern": ["^/runner-.*-deploy$"]}`)
+	require.NoError(t, os.Rename(replacement, filename))
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual([]string{"^/runner-.*-deploy$"}, patterns()) }, 5*time.Second, 10*time.Millisecond)
+
+	// Requested by a signal
+	writeConfig(t, filename, `{"jobPattern": ["^/runner-.*-vet$"]}`)
+	signals <- syscall.SIGHUP
+	assert.Eventually(t, func() bool { return assert.ObjectsAreEqual([]string{"^/runner-.*-vet$"}, patterns()) }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDiffPatterns(t *testing.T) {
+	added, removed := diffPatterns([]string{"a", "b", "c"}, []string{"b", "d", "c"})
+	assert.Equal(t, []string{"d"}, added)
+	assert.Equal(t, []string{"a"}, removed)
+
+	added, removed = diffPatterns([]string{"a"}, []string{"a"})
+	assert.Empty(t, added)
+	assert.Empty(t, removed)
+}
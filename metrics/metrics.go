@@ -0,0 +1,256 @@
+// Package metrics exposes what the watcher detects and cleans up as Prometheus metrics. The
+// collectors are registered on Registry, which Serve exposes over HTTP.
+package metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+// namespace prefixes the name of every metric.
+const namespace = "job_detection"
+
+// Registry holds the collectors of the watcher, along with the Go runtime and process ones.
+var Registry = prometheus.NewRegistry()
+
+var (
+	eventsReceived = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "events_received_total",
+		Help:      "Docker events received, by type and action.",
+	}, []string{"type", "action"})
+
+	patternMatches = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "pattern_matches_total",
+		Help:      "Jobs tracked, by the job pattern their container matched.",
+	}, []string{"pattern"})
+
+	cleanupsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanups_started_total",
+		Help:      "Job cleanups taken off the queue by a worker.",
+	})
+
+	cleanupsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanups_completed_total",
+		Help:      "Job cleanups that acted on resources of the kind, by result: succeeded, or failed if any was left behind.",
+	}, []string{"kind", "result"})
+
+	cleanupDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "cleanup_duration_seconds",
+		Help:      "Duration of job cleanups, grace delay included, by result.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 15, 30, 60, 120, 300},
+	}, []string{"result"})
+
+	actionDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "resource_action_duration_seconds",
+		Help:      "Duration of the actions on single resources, retries included, by kind and action.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"kind", "action"})
+
+	resourcesRemoved = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "resources_removed_total",
+		Help:      "Resources removed by job cleanups, by kind.",
+	}, []string{"kind"})
+
+	retries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "cleanup_retries_total",
+		Help:      "Attempts at stopping or removing resources beyond the first one, by kind.",
+	}, []string{"kind"})
+
+	reconnects = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "event_stream_reconnects_total",
+		Help:      "Reconnections to the Docker event stream after it dropped.",
+	})
+
+	queue struct {
+		mu      sync.Mutex
+		pending func() int
+	}
+
+	queueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "cleanup_queue_depth",
+		Help:      "Job cleanups waiting for a worker.",
+	}, func() float64 {
+		queue.mu.Lock()
+		defer queue.mu.Unlock()
+		if queue.pending == nil {
+			return 0
+		}
+		return float64(queue.pending())
+	})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		eventsReceived,
+		patternMatches,
+		cleanupsStarted,
+		cleanupsCompleted,
+		cleanupDuration,
+		actionDuration,
+		resourcesRemoved,
+		retries,
+		reconnects,
+		queueDepth,
+	)
+}
+
+// EventReceived counts a Docker event delivered to the watcher.
+func EventReceived(event events.Message) {
+	eventsReceived.WithLabelValues(string(event.Type), string(event.Action)).Inc()
+}
+
+// PatternMatched counts a job tracked because its container matched the job pattern.
+func PatternMatched(pattern string) {
+	patternMatches.WithLabelValues(pattern).Inc()
+}
+
+// Reconnected counts a reconnection to the Docker event stream.
+func Reconnected() {
+	reconnects.Inc()
+}
+
+// ObservePool reports the cleanups the pool runs and the number of jobs waiting for a worker.
+// The queue depth follows the last pool observed.
+//
+// Parameters:
+// - pool: The pool cleaning up the jobs.
+func ObservePool(pool *cleanup.Pool) {
+	queue.mu.Lock()
+	queue.pending = pool.Pending
+	queue.mu.Unlock()
+
+	pool.OnStart(ObserveStart)
+	pool.OnReport(ObserveReport)
+}
+
+// ObserveStart counts a cleanup a worker took off the queue. Dry runs are not counted, since
+// they act on nothing.
+//
+// Parameters:
+// - jobID: The job ID of the cleanup.
+// - opts: The options the cleanup runs with.
+func ObserveStart(jobID string, opts cleanup.Options) {
+	if opts.DryRun {
+		return
+	}
+	cleanupsStarted.Inc()
+}
+
+// ObserveReport counts the cleanups, actions, removals and retries of the report. Dry runs are
+// not counted, since they act on nothing.
+//
+// Parameters:
+// - report: The report of a job cleanup.
+func ObserveReport(report *cleanup.Report) {
+	if report.DryRun {
+		return
+	}
+
+	result := "succeeded"
+	switch {
+	case report.Skipped != "":
+		result = "skipped"
+	case report.Failed():
+		result = "failed"
+	}
+	cleanupDuration.WithLabelValues(result).Observe(time.Duration(report.Duration).Seconds())
+
+	failed := make(map[cleanup.Kind]bool)
+	for _, resource := range report.Resources {
+		if resource.Result == cleanup.ResultSkipped {
+			continue
+		}
+		kind := string(resource.Kind)
+		if _, started := failed[resource.Kind]; !started {
+			failed[resource.Kind] = false
+		}
+
+		actionDuration.WithLabelValues(kind, string(resource.Action)).Observe(time.Duration(resource.Duration).Seconds())
+		if resource.Attempts > 1 {
+			retries.WithLabelValues(kind).Add(float64(resource.Attempts - 1))
+		}
+		switch {
+		case resource.Result == cleanup.ResultFailed:
+			failed[resource.Kind] = true
+		case resource.Action == cleanup.ActionRemove:
+			resourcesRemoved.WithLabelValues(kind).Inc()
+		}
+	}
+
+	for kind, kindFailed := range failed {
+		if kindFailed {
+			cleanupsCompleted.WithLabelValues(string(kind), "failed").Inc()
+		} else {
+			cleanupsCompleted.WithLabelValues(string(kind), "succeeded").Inc()
+		}
+	}
+}
+
+// Handler returns the HTTP handler exposing the metrics of Registry.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{Registry: Registry})
+}
+
+// Serve exposes the metrics on /metrics at the address until ctx is canceled. The address is
+// bound before returning, so that an address in use stops the watcher at startup.
+//
+// Parameters:
+// - ctx: The context stopping the server when canceled.
+// - addr: The address to listen on, such as ":9090".
+// - logger: Receives the errors of the server, nil to use slog.Default().
+//
+// Returns:
+// - net.Addr: The address the server listens on.
+// - error: An error if the address could not be bound.
+func Serve(ctx context.Context, addr string, logger *slog.Logger) (net.Addr, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	server := &http.Server{Handler: mux, ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := server.Shutdown(shutdownCtx); err != nil {
+			logger.Error("Failed to stop the metrics server", cleanup.ErrorAttr(err))
+		}
+	}()
+	go func() {
+		if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("Metrics server stopped", cleanup.ErrorAttr(err))
+		}
+	}()
+	return listener.Addr(), nil
+}
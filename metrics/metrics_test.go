@@ -0,0 +1,106 @@
+package metrics
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/api/types/events"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+func TestObserveReport(t *testing.T) {
+	report := &cleanup.Report{
+		JobID:    "1234",
+		Duration: cleanup.Duration(3 * time.Second),
+		Resources: []cleanup.ResourceReport{
+			{Kind: cleanup.KindContainers, Action: cleanup.ActionStop, Result: cleanup.ResultSucceeded, Attempts: 1},
+			{Kind: cleanup.KindContainers, Action: cleanup.ActionRemove, Result: cleanup.ResultSucceeded, Attempts: 2},
+			{Kind: cleanup.KindNetworks, Action: cleanup.ActionRemove, Result: cleanup.ResultFailed, Attempts: 3},
+			{Kind: cleanup.KindVolumes, Action: cleanup.ActionRemove, Result: cleanup.ResultSkipped},
+		},
+	}
+
+	before := map[string]float64{
+		"removed":   testutil.ToFloat64(resourcesRemoved.WithLabelValues("containers")),
+		"retries":   testutil.ToFloat64(retries.WithLabelValues("networks")),
+		"succeeded": testutil.ToFloat64(cleanupsCompleted.WithLabelValues("containers", "succeeded")),
+		"failed":    testutil.ToFloat64(cleanupsCompleted.WithLabelValues("networks", "failed")),
+		"volumes":   testutil.ToFloat64(cleanupsCompleted.WithLabelValues("volumes", "succeeded")),
+	}
+	ObserveReport(report)
+
+	// A dry run acts on nothing and is not counted
+	ObserveReport(&cleanup.Report{JobID: "5678", DryRun: true, Resources: []cleanup.ResourceReport{
+		{Kind: cleanup.KindContainers, Action: cleanup.ActionRemove, Result: cleanup.ResultPlanned},
+	}})
+
+	assert.Equal(t, before["removed"]+1, testutil.ToFloat64(resourcesRemoved.WithLabelValues("containers")))
+	assert.Equal(t, before["retries"]+2, testutil.ToFloat64(retries.WithLabelValues("networks")))
+	assert.Equal(t, before["succeeded"]+1, testutil.ToFloat64(cleanupsCompleted.WithLabelValues("containers", "succeeded")))
+	assert.Equal(t, before["failed"]+1, testutil.ToFloat64(cleanupsCompleted.WithLabelValues("networks", "failed")))
+	assert.Equal(t, before["volumes"], testutil.ToFloat64(cleanupsCompleted.WithLabelValues("volumes", "succeeded")), "only skipped volumes")
+}
+
+// TestObservePoolCountsStartedCleanups tests that a cleanup is counted as started when a worker
+// takes it off the queue, except in a dry run.
+func TestObservePoolCountsStartedCleanups(t *testing.T) {
+	for _, dryRun := range []bool{false, true} {
+		opts := cleanup.DefaultOptions()
+		opts.DryRun = dryRun
+		pool := cleanup.NewPool(fake.NewDaemon(), 1, opts, nil)
+		ObservePool(pool)
+
+		before := testutil.ToFloat64(cleanupsStarted)
+		assert.True(t, pool.Submit(cleanup.NewResources("1234"), cleanup.Policy{}))
+		require.NoError(t, pool.Shutdown(context.Background()))
+
+		if dryRun {
+			assert.Equal(t, before, testutil.ToFloat64(cleanupsStarted))
+		} else {
+			assert.Equal(t, before+1, testutil.ToFloat64(cleanupsStarted))
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	pool := cleanup.NewPool(fake.NewDaemon(), 1, cleanup.DefaultOptions(), nil)
+	defer pool.Shutdown(context.Background())
+	ObservePool(pool)
+
+	EventReceived(events.Message{Type: events.ContainerEventType, Action: events.ActionDie})
+	PatternMatched("^/runner-.*-build$")
+	Reconnected()
+
+	addr, err := Serve(ctx, "127.0.0.1:0", nil)
+	require.NoError(t, err)
+
+	resp, err := http.Get("http://" + addr.String() + "/metrics")
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	for _, want := range []string{
+		`job_detection_events_received_total{action="die",type="container"}`,
+		`job_detection_pattern_matches_total{pattern="^/runner-.*-build$"}`,
+		`job_detection_event_stream_reconnects_total`,
+		`job_detection_cleanup_queue_depth 0`,
+		`go_goroutines`,
+	} {
+		assert.Contains(t, string(body), want)
+	}
+
+	_, err = Serve(ctx, addr.String(), nil)
+	assert.ErrorContains(t, err, "failed to listen on")
+}
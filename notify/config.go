@@ -0,0 +1,150 @@
+package notify
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+const (
+	// DefaultRetries is the number of times a delivery is retried when it is not configured.
+	DefaultRetries = 3
+
+	// DefaultRepeatedFailures is the number of failed cleanups of a job in a row that sends
+	// EventRetriesExhausted when it is not configured.
+	DefaultRepeatedFailures = 3
+)
+
+// Formats lists the payload formats of webhooks.
+var Formats = []string{"generic", "slack", "teams"}
+
+// Config configures the webhooks notified of cleanup failures and leaked resources.
+type Config struct {
+	// Webhooks lists the webhooks to notify. None disables the notifications.
+	Webhooks []Webhook `json:"webhooks,omitempty"`
+
+	// Retries is the number of times a failed delivery is retried, DefaultRetries when unset.
+	Retries *int `json:"retries,omitempty"`
+
+	// RetryDelay is the time to wait before the first retry, doubled for every next one, one
+	// second when unset.
+	RetryDelay cleanup.Duration `json:"retryDelay,omitempty"`
+
+	// Timeout bounds each delivery attempt, ten seconds when unset.
+	Timeout cleanup.Duration `json:"timeout,omitempty"`
+
+	// RepeatedFailures is the number of failed cleanups of a job in a row that sends a
+	// retries_exhausted notification, DefaultRepeatedFailures when unset.
+	RepeatedFailures int `json:"repeatedFailures,omitempty"`
+}
+
+// Webhook is a URL receiving notifications as JSON POST requests.
+type Webhook struct {
+	URL string `json:"url"`
+
+	// Format is the payload format: generic, the default, slack or teams.
+	Format string `json:"format,omitempty"`
+
+	// Events lists the events sent to the webhook, all of them when empty.
+	Events []Event `json:"events,omitempty"`
+
+	// Template is a Go template of the payload, replacing the one of the format. It is executed
+	// with the Notification, and its json function encodes a value as JSON.
+	Template string `json:"template,omitempty"`
+
+	// Headers are added to every request, such as an Authorization header.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	template *template.Template
+}
+
+// Compile validates the settings and compiles the payload templates of the webhooks.
+//
+// Returns:
+// - error: An error naming the first invalid setting or webhook.
+func (c *Config) Compile() error {
+	if c.Retries != nil && *c.Retries < 0 {
+		return errors.New("retries must not be negative")
+	}
+	if c.RetryDelay < 0 || c.Timeout < 0 {
+		return errors.New("retryDelay and timeout must not be negative")
+	}
+	if c.RepeatedFailures < 0 {
+		return errors.New("repeatedFailures must not be negative")
+	}
+	for i := range c.Webhooks {
+		if err := c.Webhooks[i].compile(); err != nil {
+			return fmt.Errorf("invalid webhook %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// compile validates the webhook and compiles its payload template.
+func (w *Webhook) compile() error {
+	target, err := url.Parse(w.URL)
+	if err != nil || (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+		return fmt.Errorf("url %q must be an http or https URL", w.URL)
+	}
+
+	text := w.Template
+	if text == "" {
+		var known bool
+		text, known = formatTemplates[w.format()]
+		if !known {
+			return fmt.Errorf("unknown format %q, expected one of %s", w.Format, strings.Join(Formats, ", "))
+		}
+	}
+	for _, event := range w.Events {
+		if !event.valid() {
+			return fmt.Errorf("unknown event %q, expected one of %s", event, joinEvents(Events))
+		}
+	}
+
+	w.template, err = template.New(w.URL).Funcs(templateFuncs).Parse(text)
+	if err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	return nil
+}
+
+// format returns the payload format, generic when unset.
+func (w *Webhook) format() string {
+	if w.Format == "" {
+		return "generic"
+	}
+	return w.Format
+}
+
+// Receives reports whether the event is sent to the webhook.
+func (w *Webhook) Receives(event Event) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+// retries returns the number of times a failed delivery is retried.
+func (c *Config) retries() int {
+	if c.Retries == nil {
+		return DefaultRetries
+	}
+	return *c.Retries
+}
+
+// repeatedFailures returns the number of failed cleanups in a row that exhaust the retries.
+func (c *Config) repeatedFailures() int {
+	if c.RepeatedFailures == 0 {
+		return DefaultRepeatedFailures
+	}
+	return c.RepeatedFailures
+}
@@ -0,0 +1,371 @@
+// Package notify posts notifications to webhooks when the cleanup of a job fails, when its
+// cleanups keep failing and when the garbage collection finds resources whose cleanup was
+// missed, so that leaked resources are noticed before the disk fills up. Deliveries run in the
+// background and are retried with an exponential backoff.
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+// Event is what a notification reports.
+type Event string
+
+const (
+	// EventCleanupFailed reports a cleanup that left resources of the job behind.
+	EventCleanupFailed Event = "cleanup_failed"
+
+	// EventRetriesExhausted reports a job whose cleanups failed RepeatedFailures times in a row.
+	EventRetriesExhausted Event = "retries_exhausted"
+
+	// EventLeakDetected reports orphaned resources of a job removed by the garbage collection.
+	EventLeakDetected Event = "leak_detected"
+)
+
+// Events lists every event.
+var Events = []Event{EventCleanupFailed, EventRetriesExhausted, EventLeakDetected}
+
+// valid reports whether the event is known.
+func (e Event) valid() bool {
+	for _, event := range Events {
+		if event == e {
+			return true
+		}
+	}
+	return false
+}
+
+// joinEvents lists the events for error messages.
+func joinEvents(events []Event) string {
+	names := make([]string, 0, len(events))
+	for _, event := range events {
+		names = append(names, string(event))
+	}
+	return strings.Join(names, ", ")
+}
+
+const (
+	// defaultRetryDelay is the time to wait before the first retry when it is not configured.
+	defaultRetryDelay = time.Second
+
+	// maxRetryDelay bounds the time between two retries.
+	maxRetryDelay = time.Minute
+
+	// defaultTimeout bounds each delivery attempt when it is not configured.
+	defaultTimeout = 10 * time.Second
+)
+
+// formatTemplates are the payload templates of the formats.
+var formatTemplates = map[string]string{
+	"generic": `{{ json . }}`,
+	"slack":   `{"text": {{ json (printf "*%s*\n%s" .Title .Text) }}}`,
+	"teams":   `{"@type": "MessageCard", "@context": "https://schema.org/extensions", "themeColor": "D70000", "summary": {{ json .Title }}, "title": {{ json .Title }}, "text": {{ json .Text }}}`,
+}
+
+// templateFuncs are the functions available to payload templates.
+var templateFuncs = map[string]any{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Resource is a resource left behind or leaked by a job.
+type Resource struct {
+	Kind  cleanup.Kind `json:"kind"`
+	ID    string       `json:"id"`
+	Name  string       `json:"name"`
+	Error string       `json:"error,omitempty"`
+}
+
+// Notification is the payload of the generic format, and the data of payload templates.
+type Notification struct {
+	Event Event     `json:"event"`
+	Time  time.Time `json:"time"`
+
+	// Host is the host name of the watcher.
+	Host  string `json:"host"`
+	JobID string `json:"jobId"`
+
+	// Summary is the outcome of the cleanup, or what the garbage collection found.
+	Summary string `json:"summary"`
+
+	// Failures is the number of failed cleanups of the job in a row, as recorded in the state
+	// file. Zero when unknown.
+	Failures int `json:"failures,omitempty"`
+
+	Resources []Resource `json:"resources"`
+	Errors    []string   `json:"errors,omitempty"`
+}
+
+// Title returns a one-line description of the notification.
+func (n Notification) Title() string {
+	switch n.Event {
+	case EventRetriesExhausted:
+		return fmt.Sprintf("Cleanup of job %s failed %d times in a row on %s", n.JobID, n.Failures, n.Host)
+	case EventLeakDetected:
+		return fmt.Sprintf("Leaked resources of job %s found on %s", n.JobID, n.Host)
+	default:
+		return fmt.Sprintf("Cleanup of job %s failed on %s", n.JobID, n.Host)
+	}
+}
+
+// Text returns the summary followed by a line per resource.
+func (n Notification) Text() string {
+	lines := []string{n.Summary}
+	for _, resource := range n.Resources {
+		line := fmt.Sprintf("- %s %s", strings.TrimSuffix(string(resource.Kind), "s"), resource.Name)
+		if resource.ID != "" && resource.ID != resource.Name {
+			line += fmt.Sprintf(" (%s)", resource.ID)
+		}
+		if resource.Error != "" {
+			line += ": " + resource.Error
+		}
+		lines = append(lines, line)
+	}
+	return strings.Join(lines, "\n")
+}
+
+// Notifier sends notifications to the webhooks of the current configuration. It is safe for
+// concurrent use.
+type Notifier struct {
+	settings func() Config
+	host     string
+	now      func() time.Time
+	logger   *slog.Logger
+
+	wg       sync.WaitGroup
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// New returns a notifier sending notifications to the webhooks of the settings.
+//
+// Parameters:
+// - settings: Returns the current compiled settings, so that a reloaded configuration applies
+// to the next notifications.
+// - logger: Receives the failed deliveries, nil to use slog.Default().
+//
+// Returns:
+// - *Notifier: The notifier.
+func New(settings func() Config, logger *slog.Logger) *Notifier {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown host"
+	}
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &Notifier{
+		settings: settings,
+		host:     host,
+		now:      time.Now,
+		logger:   logger,
+		stop:     make(chan struct{}),
+	}
+}
+
+// ObserveReport notifies the failure of a cleanup, and the exhaustion of the retries once the
+// attempt of the report, as counted by the pool, reaches RepeatedFailures. The resources
+// removed by a collection of orphaned resources are notified as leaked, and those it failed to
+// remove as a failed cleanup. Dry runs and skipped cleanups are ignored.
+//
+// Parameters:
+// - report: The report of a job cleanup.
+func (n *Notifier) ObserveReport(report *cleanup.Report) {
+	if report.DryRun || report.Skipped != "" {
+		return
+	}
+	if report.Orphaned {
+		n.leaked(report)
+	}
+	if !report.Failed() {
+		return
+	}
+
+	notification := Notification{
+		Event:     EventCleanupFailed,
+		JobID:     report.JobID,
+		Summary:   report.Summary(),
+		Failures:  report.Attempt,
+		Resources: failed(report),
+	}
+	var joined interface{ Unwrap() []error }
+	if errors.As(report.Err(), &joined) {
+		for _, err := range joined.Unwrap() {
+			notification.Errors = append(notification.Errors, err.Error())
+		}
+	}
+	n.Notify(notification)
+
+	settings := n.settings()
+	if report.Attempt == settings.repeatedFailures() {
+		notification.Event = EventRetriesExhausted
+		n.Notify(notification)
+	}
+}
+
+// leaked notifies the orphaned resources the garbage collection removed, if any.
+func (n *Notifier) leaked(report *cleanup.Report) {
+	removed := []Resource{}
+	for _, resource := range report.Resources {
+		if resource.Action == cleanup.ActionRemove && resource.Result == cleanup.ResultSucceeded {
+			removed = append(removed, Resource{Kind: resource.Kind, ID: resource.ID, Name: resource.Name})
+		}
+	}
+	if len(removed) == 0 {
+		return
+	}
+	n.Notify(Notification{
+		Event:     EventLeakDetected,
+		JobID:     report.JobID,
+		Summary:   fmt.Sprintf("%d orphaned resources outlived their TTL and were removed", len(removed)),
+		Resources: removed,
+	})
+}
+
+// failed returns the resources the cleanup failed to act on.
+func failed(report *cleanup.Report) []Resource {
+	resources := []Resource{}
+	for _, resource := range report.Resources {
+		if resource.Result == cleanup.ResultFailed {
+			resources = append(resources, Resource{Kind: resource.Kind, ID: resource.ID, Name: resource.Name, Error: resource.Error})
+		}
+	}
+	return resources
+}
+
+// Notify sends the notification in the background to every webhook receiving its event.
+// Failed deliveries are logged.
+func (n *Notifier) Notify(notification Notification) {
+	if notification.Time.IsZero() {
+		notification.Time = n.now().UTC()
+	}
+	if notification.Host == "" {
+		notification.Host = n.host
+	}
+
+	settings := n.settings()
+	for i := range settings.Webhooks {
+		webhook := &settings.Webhooks[i]
+		if !webhook.Receives(notification.Event) {
+			continue
+		}
+
+		n.wg.Add(1)
+		go func() {
+			defer n.wg.Done()
+			if err := n.deliver(settings, webhook, notification); err != nil {
+				n.logger.Error("Failed to notify webhook", "event", notification.Event, cleanup.LogJobID, notification.JobID, "url", redact(webhook.URL), cleanup.ErrorAttr(err))
+			}
+		}()
+	}
+}
+
+// Shutdown waits for the pending deliveries. Retries are abandoned once ctx ends.
+//
+// Returns:
+// - error: The context error if ctx ended before every delivery completed.
+func (n *Notifier) Shutdown(ctx context.Context) error {
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		n.stopOnce.Do(func() { close(n.stop) })
+		return ctx.Err()
+	}
+}
+
+// deliver posts the payload of the notification to the webhook, retrying failed attempts with
+// an exponential backoff. Client errors other than 429 Too Many Requests are not retried.
+func (n *Notifier) deliver(settings Config, webhook *Webhook, notification Notification) error {
+	var payload bytes.Buffer
+	if err := webhook.template.Execute(&payload, notification); err != nil {
+		return fmt.Errorf("failed to render payload: %w", err)
+	}
+	if !json.Valid(payload.Bytes()) {
+		return errors.New("failed to render payload: the template did not produce valid JSON")
+	}
+
+	timeout := time.Duration(settings.Timeout)
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	delay := time.Duration(settings.RetryDelay)
+	if delay == 0 {
+		delay = defaultRetryDelay
+	}
+	client := &http.Client{Timeout: timeout}
+
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry bool
+		retry, err = post(client, webhook, payload.Bytes())
+		if err == nil || !retry || attempt == settings.retries() {
+			return err
+		}
+
+		select {
+		case <-n.stop:
+			return fmt.Errorf("abandoned after %d attempts: %w", attempt+1, err)
+		case <-time.After(delay):
+		}
+		delay = min(2*delay, maxRetryDelay)
+	}
+}
+
+// post makes a delivery attempt and reports whether a failure is worth retrying.
+func post(client *http.Client, webhook *Webhook, payload []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, webhook.URL, bytes.NewReader(payload))
+	if err != nil {
+		return false, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "job-detection")
+	for name, value := range webhook.Headers {
+		req.Header.Set(name, value)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		// The error names the URL, which may hold a secret token
+		return true, fmt.Errorf("failed to post notification: %w", errors.Unwrap(err))
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return false, nil
+	}
+	retry := resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests
+	return retry, fmt.Errorf("webhook responded %s", resp.Status)
+}
+
+// redact returns the URL without its path and query, which often hold the secret of a webhook.
+func redact(rawURL string) string {
+	if i := strings.Index(rawURL, "://"); i >= 0 {
+		if j := strings.IndexByte(rawURL[i+3:], '/'); j >= 0 {
+			return rawURL[:i+3+j] + "/…"
+		}
+	}
+	return rawURL
+}
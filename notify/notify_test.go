@@ -0,0 +1,424 @@
+package notify
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/docker/docker/errdefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/cleanup"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+// request is a request received by a test webhook.
+type request struct {
+	header http.Header
+	body   []byte
+}
+
+// webhookServer is a webhook answering with the given statuses in turn, then 200 OK, and
+// recording the requests it receives.
+type webhookServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	statuses []int
+	requests []request
+}
+
+func newWebhookServer(t *testing.T, statuses ...int) *webhookServer {
+	t.Helper()
+
+	server := &webhookServer{statuses: statuses}
+	server.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+
+		server.mu.Lock()
+		server.requests = append(server.requests, request{header: r.Header.Clone(), body: body})
+		status := http.StatusOK
+		if len(server.statuses) > 0 {
+			status, server.statuses = server.statuses[0], server.statuses[1:]
+		}
+		server.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+// received returns the requests received so far.
+func (s *webhookServer) received() []request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]request(nil), s.requests...)
+}
+
+// newTestNotifier returns a notifier with the compiled settings, retrying without delay.
+func newTestNotifier(t *testing.T, settings Config) *Notifier {
+	t.Helper()
+
+	if settings.RetryDelay == 0 {
+		settings.RetryDelay = cleanup.Duration(time.Millisecond)
+	}
+	require.NoError(t, settings.Compile())
+	notifier := New(func() Config { return settings }, nil)
+	notifier.host = "runner-1"
+	notifier.now = func() time.Time { return time.Date(2024, 8, 1, 12, 0, 0, 0, time.UTC) }
+	return notifier
+}
+
+// flush waits for the pending deliveries of the notifier.
+func flush(t *testing.T, notifier *Notifier) {
+	t.Helper()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	require.NoError(t, notifier.Shutdown(ctx))
+}
+
+// failedReport returns the report of a cleanup of the job that failed to remove a volume.
+func failedReport(jobID string, attempt int) *cleanup.Report {
+	return &cleanup.Report{
+		JobID:   jobID,
+		Attempt: attempt,
+		Resources: []cleanup.ResourceReport{
+			{Kind: cleanup.KindContainers, ID: "c1", Name: "runner-build", Action: cleanup.ActionRemove, Result: cleanup.ResultSucceeded},
+			{Kind: cleanup.KindVolumes, ID: "cache", Name: "cache", Action: cleanup.ActionRemove, Result: cleanup.ResultFailed, Error: "volume is in use"},
+		},
+	}
+}
+
+func TestDeliveryRetries(t *testing.T) {
+	testCases := []struct {
+		name     string
+		statuses []int
+		retries  int
+		requests int
+	}{
+		{name: "Success", statuses: nil, retries: 3, requests: 1},
+		{name: "Server errors then success", statuses: []int{http.StatusServiceUnavailable, http.StatusBadGateway}, retries: 3, requests: 3},
+		{name: "Rate limited then success", statuses: []int{http.StatusTooManyRequests}, retries: 3, requests: 2},
+		{name: "Retries exhausted", statuses: []int{500, 500, 500, 500}, retries: 2, requests: 3},
+		{name: "Client error is not retried", statuses: []int{http.StatusBadRequest}, retries: 3, requests: 1},
+		{name: "No retries", statuses: []int{500}, retries: 0, requests: 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newWebhookServer(t, tc.statuses...)
+			notifier := newTestNotifier(t, Config{Retries: &tc.retries, Webhooks: []Webhook{{URL: server.URL}}})
+
+			notifier.Notify(Notification{Event: EventCleanupFailed, JobID: "1234"})
+			flush(t, notifier)
+
+			assert.Len(t, server.received(), tc.requests)
+		})
+	}
+}
+
+func TestDeliveryHeaders(t *testing.T) {
+	server := newWebhookServer(t)
+	notifier := newTestNotifier(t, Config{Webhooks: []Webhook{{URL: server.URL, Headers: map[string]string{"Authorization": "Bearer secret"}}}})
+
+	notifier.Notify(Notification{Event: EventCleanupFailed, JobID: "1234"})
+	flush(t, notifier)
+
+	requests := server.received()
+	require.Len(t, requests, 1)
+	assert.Equal(t, "application/json", requests[0].header.Get("Content-Type"))
+	assert.Equal(t, "Bearer secret", requests[0].header.Get("Authorization"))
+}
+
+func TestPayloadFormats(t *testing.T) {
+	notification := Notification{
+		Event:     EventCleanupFailed,
+		JobID:     "1234",
+		Summary:   "1 succeeded, 1 failed in 2s",
+		Resources: []Resource{{Kind: cleanup.KindVolumes, ID: "cache", Name: "cache", Error: "volume is in use"}},
+	}
+	title := "Cleanup of job 1234 failed on runner-1"
+	text := "1 succeeded, 1 failed in 2s\n- volume cache: volume is in use"
+
+	testCases := []struct {
+		name     string
+		webhook  Webhook
+		expected map[string]any
+	}{
+		{
+			name:    "Generic",
+			webhook: Webhook{},
+			expected: map[string]any{
+				"event":     "cleanup_failed",
+				"time":      "2024-08-01T12:00:00Z",
+				"host":      "runner-1",
+				"jobId":     "1234",
+				"summary":   "1 succeeded, 1 failed in 2s",
+				"resources": []any{map[string]any{"kind": "volumes", "id": "cache", "name": "cache", "error": "volume is in use"}},
+			},
+		},
+		{
+			name:     "Slack",
+			webhook:  Webhook{Format: "slack"},
+			expected: map[string]any{"text": "*" + title + "*\n" + text},
+		},
+		{
+			name:    "Teams",
+			webhook: Webhook{Format: "teams"},
+			expected: map[string]any{
+				"@type":      "MessageCard",
+				"@context":   "https://schema.org/extensions",
+				"themeColor": "D70000",
+				"summary":    title,
+				"title":      title,
+				"text":       text,
+			},
+		},
+		{
+			name:     "Template",
+			webhook:  Webhook{Template: `{"job": {{ json .JobID }}, "kind": {{ json (index .Resources 0).Kind }}}`},
+			expected: map[string]any{"job": "1234", "kind": "volumes"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newWebhookServer(t)
+			tc.webhook.URL = server.URL
+			notifier := newTestNotifier(t, Config{Webhooks: []Webhook{tc.webhook}})
+
+			notifier.Notify(notification)
+			flush(t, notifier)
+
+			requests := server.received()
+			require.Len(t, requests, 1)
+			var payload map[string]any
+			require.NoError(t, json.Unmarshal(requests[0].body, &payload))
+			assert.Equal(t, tc.expected, payload)
+		})
+	}
+}
+
+// TestInvalidPayloadIsNotSent tests that a template producing invalid JSON is not delivered.
+func TestInvalidPayloadIsNotSent(t *testing.T) {
+	server := newWebhookServer(t)
+	notifier := newTestNotifier(t, Config{Webhooks: []Webhook{{URL: server.URL, Template: `job {{ .JobID }}`}}})
+
+	notifier.Notify(Notification{Event: EventCleanupFailed, JobID: "1234"})
+	flush(t, notifier)
+
+	assert.Empty(t, server.received())
+}
+
+// TestObserveReport tests that failed cleanups are notified, that retries_exhausted is sent
+// once when the attempt of a failed cleanup reaches RepeatedFailures, and that webhooks only
+// receive the events they subscribed to.
+func TestObserveReport(t *testing.T) {
+	all := newWebhookServer(t)
+	exhausted := newWebhookServer(t)
+	notifier := newTestNotifier(t, Config{
+		RepeatedFailures: 2,
+		Webhooks: []Webhook{
+			{URL: all.URL},
+			{URL: exhausted.URL, Events: []Event{EventRetriesExhausted}},
+		},
+	})
+
+	notifier.ObserveReport(&cleanup.Report{JobID: "1234", DryRun: true, Attempt: 1, Resources: failedReport("1234", 0).Resources})
+	notifier.ObserveReport(&cleanup.Report{JobID: "1234", Skipped: "job failed, resources kept for inspection", Attempt: 1})
+	notifier.ObserveReport(failedReport("1234", 1))
+	notifier.ObserveReport(&cleanup.Report{JobID: "1234", Attempt: 2})
+	notifier.ObserveReport(failedReport("1234", 1))
+	flush(t, notifier)
+	notifier.ObserveReport(failedReport("1234", 2))
+	flush(t, notifier)
+	notifier.ObserveReport(failedReport("1234", 3))
+	flush(t, notifier)
+
+	var events []Event
+	var last Notification
+	for _, request := range all.received() {
+		require.NoError(t, json.Unmarshal(request.body, &last))
+		events = append(events, last.Event)
+	}
+	// The notifications of a report are delivered concurrently, in any order
+	assert.ElementsMatch(t, []Event{EventCleanupFailed, EventCleanupFailed, EventCleanupFailed, EventRetriesExhausted, EventCleanupFailed}, events)
+	assert.Equal(t, EventCleanupFailed, last.Event)
+	assert.Equal(t, 3, last.Failures)
+	assert.Equal(t, []Resource{{Kind: cleanup.KindVolumes, ID: "cache", Name: "cache", Error: "volume is in use"}}, last.Resources)
+	assert.Equal(t, []string{"failed to remove volume cache: volume is in use"}, last.Errors)
+
+	requests := exhausted.received()
+	require.Len(t, requests, 1)
+	var notification Notification
+	require.NoError(t, json.Unmarshal(requests[0].body, &notification))
+	assert.Equal(t, EventRetriesExhausted, notification.Event)
+	assert.Equal(t, 2, notification.Failures)
+}
+
+// lockedVolumeDaemon fails the removal of every volume, like volumes the daemon refuses to remove.
+type lockedVolumeDaemon struct {
+	*fake.Daemon
+}
+
+func (d *lockedVolumeDaemon) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	return errdefs.Conflict(errors.New("volume is in use"))
+}
+
+// TestObserveReportWithoutJournal tests that retries_exhausted is sent when the pool has no
+// journal, counting the failed cleanups of the job in memory.
+func TestObserveReportWithoutJournal(t *testing.T) {
+	exhausted := newWebhookServer(t)
+	notifier := newTestNotifier(t, Config{
+		RepeatedFailures: 2,
+		Webhooks:         []Webhook{{URL: exhausted.URL, Events: []Event{EventRetriesExhausted}}},
+	})
+
+	daemon := &lockedVolumeDaemon{Daemon: fake.NewDaemon()}
+	daemon.AddVolume("cache", nil)
+	opts := cleanup.DefaultOptions()
+	opts.Delay, opts.RetryDelay, opts.RemoveRetries = 0, 0, 1
+	pool := cleanup.NewPool(daemon, 1, opts, nil)
+	pool.OnReport(notifier.ObserveReport)
+
+	owned := cleanup.NewResources("1234")
+	owned.Volumes["cache"] = "label com.github.ci.job.id=1234"
+	for i := 0; i < 3; i++ {
+		require.True(t, pool.Submit(owned, cleanup.Policy{}))
+		require.Eventually(t, func() bool { return !pool.Scheduled("1234") }, 5*time.Second, time.Millisecond)
+	}
+	require.NoError(t, pool.Shutdown(context.Background()))
+	flush(t, notifier)
+
+	requests := exhausted.received()
+	require.Len(t, requests, 1)
+	var notification Notification
+	require.NoError(t, json.Unmarshal(requests[0].body, &notification))
+	assert.Equal(t, EventRetriesExhausted, notification.Event)
+	assert.Equal(t, 2, notification.Failures)
+}
+
+// TestObserveOrphanedReport tests that the resources removed by the garbage collection are
+// notified as leaked, and those it failed to remove as a failed cleanup.
+func TestObserveOrphanedReport(t *testing.T) {
+	testCases := []struct {
+		name     string
+		report   *cleanup.Report
+		leaked   []Resource
+		failures []Resource
+	}{
+		{
+			name:   "Removed",
+			report: &cleanup.Report{JobID: "1234", Orphaned: true, Resources: failedReport("1234", 1).Resources[:1]},
+			leaked: []Resource{{Kind: cleanup.KindContainers, ID: "c1", Name: "runner-build"}},
+		},
+		{
+			name:     "Partially removed",
+			report:   &cleanup.Report{JobID: "1234", Orphaned: true, Attempt: 1, Resources: failedReport("1234", 1).Resources},
+			leaked:   []Resource{{Kind: cleanup.KindContainers, ID: "c1", Name: "runner-build"}},
+			failures: []Resource{{Kind: cleanup.KindVolumes, ID: "cache", Name: "cache", Error: "volume is in use"}},
+		},
+		{
+			name:     "Nothing removed",
+			report:   &cleanup.Report{JobID: "1234", Orphaned: true, Attempt: 1, Resources: failedReport("1234", 1).Resources[1:]},
+			failures: []Resource{{Kind: cleanup.KindVolumes, ID: "cache", Name: "cache", Error: "volume is in use"}},
+		},
+		{
+			name:   "Dry run",
+			report: &cleanup.Report{JobID: "1234", Orphaned: true, DryRun: true, Resources: []cleanup.ResourceReport{{Kind: cleanup.KindContainers, ID: "c1", Name: "runner-build", Action: cleanup.ActionRemove, Result: cleanup.ResultPlanned}}},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := newWebhookServer(t)
+			notifier := newTestNotifier(t, Config{Webhooks: []Webhook{{URL: server.URL}}})
+
+			notifier.ObserveReport(tc.report)
+			flush(t, notifier)
+
+			var leaked, failures []Resource
+			for _, request := range server.received() {
+				var notification Notification
+				require.NoError(t, json.Unmarshal(request.body, &notification))
+				assert.Equal(t, "1234", notification.JobID)
+				switch notification.Event {
+				case EventLeakDetected:
+					leaked = append(leaked, notification.Resources...)
+				case EventCleanupFailed:
+					failures = append(failures, notification.Resources...)
+				default:
+					t.Errorf("unexpected event %s", notification.Event)
+				}
+			}
+			assert.Equal(t, tc.leaked, leaked)
+			assert.Equal(t, tc.failures, failures)
+		})
+	}
+}
+
+// TestShutdownAbandonsRetries tests that Shutdown stops retrying deliveries once its context
+// ends.
+func TestShutdownAbandonsRetries(t *testing.T) {
+	server := newWebhookServer(t, 500, 500, 500, 500)
+	notifier := newTestNotifier(t, Config{RetryDelay: cleanup.Duration(time.Hour), Webhooks: []Webhook{{URL: server.URL}}})
+
+	notifier.Notify(Notification{Event: EventCleanupFailed, JobID: "1234"})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, notifier.Shutdown(ctx), context.DeadlineExceeded)
+
+	done := make(chan struct{})
+	go func() {
+		notifier.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("delivery still retrying after shutdown")
+	}
+	assert.Len(t, server.received(), 1)
+}
+
+func TestCompile(t *testing.T) {
+	negative := -1
+	testCases := []struct {
+		name   string
+		config Config
+		err    string
+	}{
+		{name: "Empty", config: Config{}},
+		{name: "Formats", config: Config{Webhooks: []Webhook{{URL: "https://example.com/a", Format: "slack"}, {URL: "http://example.com/b", Format: "teams"}}}},
+		{name: "Negative retries", config: Config{Retries: &negative}, err: "retries must not be negative"},
+		{name: "Negative timeout", config: Config{Timeout: cleanup.Duration(-time.Second)}, err: "retryDelay and timeout must not be negative"},
+		{name: "Relative url", config: Config{Webhooks: []Webhook{{URL: "/hook"}}}, err: `invalid webhook 0: url "/hook" must be an http or https URL`},
+		{name: "Unknown format", config: Config{Webhooks: []Webhook{{URL: "https://example.com", Format: "discord"}}}, err: `invalid webhook 0: unknown format "discord", expected one of generic, slack, teams`},
+		{name: "Unknown event", config: Config{Webhooks: []Webhook{{URL: "https://example.com", Events: []Event{"failed"}}}}, err: `unknown event "failed", expected one of cleanup_failed, retries_exhausted, leak_detected`},
+		{name: "Invalid template", config: Config{Webhooks: []Webhook{{URL: "https://example.com", Template: "{{ .JobID"}}}, err: "invalid webhook 0: invalid template"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			err := tc.config.Compile()
+			if tc.err == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+func TestRedact(t *testing.T) {
+	assert.Equal(t, "https://hooks.slack.com/…", redact("https://hooks.slack.com/services/T0/B0/secret"))
+	assert.Equal(t, "http://localhost:8080", redact("http://localhost:8080"))
+}
@@ -0,0 +1,36 @@
+package provider
+
+// GitHub is the provider for GitHub Actions runners.
+type GitHub struct{}
+
+// Name returns "github".
+func (GitHub) Name() string {
+	return "github"
+}
+
+// DisplayName returns "GitHub Actions".
+func (GitHub) DisplayName() string {
+	return "GitHub Actions"
+}
+
+// JobLabel returns the label set by workflows on the resources of a job.
+func (GitHub) JobLabel() string {
+	return "com.github.ci.job.id"
+}
+
+// Patterns matches the job and service containers created by the Actions runner, named after
+// the job's container network ID, the image and a random suffix.
+func (GitHub) Patterns() []string {
+	return []string{
+		"^/[0-9a-f]{32}_[^_]+_[0-9a-f]{6}$",
+	}
+}
+
+// Job returns the job labeled on the container, falling back to the container ID for containers
+// that are not labeled, so that each of them is still cleaned up as its own job.
+func (g GitHub) Job(containerID, name string, labels map[string]string) (Job, bool) {
+	if jobID := labels[g.JobLabel()]; jobID != "" {
+		return Job{ID: jobID}, true
+	}
+	return Job{ID: containerID}, false
+}
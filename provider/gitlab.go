@@ -0,0 +1,142 @@
+package provider
+
+import (
+	"regexp"
+	"strings"
+)
+
+// Labels set by GitLab Runner on the containers it creates for a job.
+const (
+	gitlabRunnerJobLabel      = "com.gitlab.gitlab-runner.job.id"
+	gitlabRunnerPipelineLabel = "com.gitlab.gitlab-runner.pipeline.id"
+	gitlabRunnerProjectLabel  = "com.gitlab.gitlab-runner.project.id"
+	gitlabRunnerStageLabel    = "com.gitlab.gitlab-runner.job.stage"
+	gitlabRunnerTypeLabel     = "com.gitlab.gitlab-runner.type"
+)
+
+// gitlabContainerName matches the names GitLab Runner gives to the containers of a job:
+// runner-<token>-project-<id>-concurrent-<n>-<hash>-<suffix>, where the suffix is the stage of a
+// build container, "predefined" for helper containers or the alias and index of a service.
+var gitlabContainerName = regexp.MustCompile(`^runner-(.+?)-project-(\d+)-concurrent-(\d+)-([0-9a-f]+)-(.+)$`)
+
+// GitLab is the provider for GitLab Runner with the Docker executor.
+type GitLab struct{}
+
+// GitLabContainer is the job metadata GitLab Runner encodes in the name and labels of a container.
+type GitLabContainer struct {
+	Runner     string
+	ProjectID  string
+	Concurrent string
+	Hash       string
+	Suffix     string
+	JobID      string
+	PipelineID string
+	Stage      string
+	Type       string
+}
+
+// ParseGitLabContainer extracts the job metadata of a container created by GitLab Runner. The
+// runner labels take precedence over the values derived from the name.
+//
+// Parameters:
+// - name: The name of the container, with or without its leading slash.
+// - labels: The labels of the container.
+//
+// Returns:
+// - GitLabContainer: The job metadata of the container.
+// - bool: True if the container was created by GitLab Runner.
+func ParseGitLabContainer(name string, labels map[string]string) (GitLabContainer, bool) {
+	var parsed GitLabContainer
+
+	match := gitlabContainerName.FindStringSubmatch(strings.TrimPrefix(name, "/"))
+	if match != nil {
+		parsed = GitLabContainer{
+			Runner:     match[1],
+			ProjectID:  match[2],
+			Concurrent: match[3],
+			Hash:       match[4],
+			Suffix:     match[5],
+			Stage:      match[5],
+		}
+	}
+
+	for label, field := range map[string]*string{
+		gitlabRunnerJobLabel:      &parsed.JobID,
+		gitlabRunnerPipelineLabel: &parsed.PipelineID,
+		gitlabRunnerProjectLabel:  &parsed.ProjectID,
+		gitlabRunnerStageLabel:    &parsed.Stage,
+		gitlabRunnerTypeLabel:     &parsed.Type,
+	} {
+		if value := labels[label]; value != "" {
+			*field = value
+		}
+	}
+
+	return parsed, match != nil || parsed.JobID != ""
+}
+
+// Identity returns the ID shared by every container of the job: the job ID if the runner labeled
+// it, otherwise the container name without its suffix, which GitLab Runner keeps for the build,
+// helper and service containers of the same job.
+func (c GitLabContainer) Identity() string {
+	if c.JobID != "" {
+		return c.JobID
+	}
+	return "runner-" + c.Runner + "-project-" + c.ProjectID + "-concurrent-" + c.Concurrent + "-" + c.Hash
+}
+
+// Fields returns the metadata of the job that is known.
+func (c GitLabContainer) Fields() map[string]string {
+	fields := make(map[string]string)
+	for key, value := range map[string]string{
+		"project":    c.ProjectID,
+		"concurrent": c.Concurrent,
+		"pipeline":   c.PipelineID,
+		"stage":      c.Stage,
+	} {
+		if value != "" {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// Name returns "gitlab".
+func (GitLab) Name() string {
+	return "gitlab"
+}
+
+// DisplayName returns "GitLab".
+func (GitLab) DisplayName() string {
+	return "GitLab"
+}
+
+// JobLabel returns the label set by pipelines on the resources of a job.
+func (GitLab) JobLabel() string {
+	return "com.gitlab.ci.job.id"
+}
+
+// Patterns matches the containers GitLab Runner creates for the stages of a job.
+func (GitLab) Patterns() []string {
+	return []string{
+		"^/runner-.*-project-.*-concurrent-.*-.*-build$",
+		"^/runner-.*-project-.*-concurrent-.*-.*-test$",
+		"^/runner-.*-project-.*-concurrent-.*-.*-deploy$",
+		"^/runner-.*-project-.*-concurrent-.*-.*-format$",
+		"^/runner-.*-project-.*-concurrent-.*-.*-vet$",
+		"^/runner-.*-project-.*-concurrent-.*-.*-security$",
+	}
+}
+
+// Job returns the job the container was created for. The job ID is read from the runner labels,
+// then from the label set by the pipeline, and is otherwise derived from the container name.
+func (g GitLab) Job(containerID, name string, labels map[string]string) (Job, bool) {
+	parsed, ok := ParseGitLabContainer(name, labels)
+	if parsed.JobID == "" {
+		parsed.JobID = labels[g.JobLabel()]
+	}
+	if !ok && parsed.JobID == "" {
+		return Job{ID: containerID}, false
+	}
+	return Job{ID: parsed.Identity(), Fields: parsed.Fields()}, true
+}
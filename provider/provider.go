@@ -0,0 +1,96 @@
+// Package provider describes the CI systems whose job containers are detected and cleaned up.
+// Each provider knows how its runner names job containers and labels the resources of a job, so
+// the events and cleanup packages stay shared across CI systems. Supporting a new CI system means
+// writing one Provider and adding it to the registered list.
+package provider
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Provider describes how a CI system runs jobs in Docker containers.
+type Provider interface {
+	// Name returns the identifier selecting the provider, such as "gitlab".
+	Name() string
+
+	// DisplayName returns the name of the CI system used in log messages.
+	DisplayName() string
+
+	// JobLabel returns the label carrying the job ID on resources created for a job.
+	JobLabel() string
+
+	// Patterns returns the default regular expressions matching the names of job containers.
+	Patterns() []string
+
+	// Job identifies the job a container was created for.
+	//
+	// Parameters:
+	// - containerID: The ID of the container.
+	// - name: The name of the container, with or without its leading slash.
+	// - labels: The labels of the container.
+	//
+	// Returns:
+	// - Job: The job of the container. Its ID is the container ID if the job is unknown.
+	// - bool: True if the container was created for a job of the provider.
+	Job(containerID, name string, labels map[string]string) (Job, bool)
+}
+
+// Job identifies the CI job a container was created for.
+type Job struct {
+	// ID groups the containers and resources of the job.
+	ID string
+
+	// Fields holds metadata about the job, such as its project, pipeline or stage.
+	Fields map[string]string
+}
+
+// String returns the job ID followed by its fields in alphabetical order.
+func (j Job) String() string {
+	if len(j.Fields) == 0 {
+		return j.ID
+	}
+
+	keys := make([]string, 0, len(j.Fields))
+	for key := range j.Fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	fields := make([]string, 0, len(keys))
+	for _, key := range keys {
+		fields = append(fields, key+"="+j.Fields[key])
+	}
+	return fmt.Sprintf("%s (%s)", j.ID, strings.Join(fields, " "))
+}
+
+// registered lists every supported provider.
+var registered = []Provider{
+	GitHub{},
+	GitLab{},
+}
+
+// Get returns the provider with the specified name.
+//
+// Returns:
+// - Provider: The provider.
+// - error: An error if no provider has this name.
+func Get(name string) (Provider, error) {
+	for _, p := range registered {
+		if p.Name() == name {
+			return p, nil
+		}
+	}
+	return nil, fmt.Errorf("unsupported provider %q, expected one of %v", name, Names())
+}
+
+// Names returns the names of the supported providers in alphabetical order.
+func Names() []string {
+	names := make([]string, 0, len(registered))
+	for _, p := range registered {
+		names = append(names, p.Name())
+	}
+	sort.Strings(names)
+	return names
+}
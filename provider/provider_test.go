@@ -0,0 +1,128 @@
+package provider
+
+import (
+	"regexp"
+	"slices"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGet(t *testing.T) {
+	for _, name := range Names() {
+		p, err := Get(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, p.Name())
+
+		for _, pattern := range p.Patterns() {
+			_, err := regexp.Compile(pattern)
+			assert.NoError(t, err, "pattern %s of provider %s", pattern, name)
+		}
+	}
+
+	_, err := Get("jenkins")
+	assert.ErrorContains(t, err, `unsupported provider "jenkins"`)
+}
+
+func TestJob(t *testing.T) {
+	testCases := []struct {
+		name       string
+		provider   Provider
+		container  string
+		labels     map[string]string
+		expected   Job
+		identified bool
+	}{
+		{
+			name:       "GitHub job label",
+			provider:   GitHub{},
+			container:  "/9f2c4e1b7a6d4c3e8b5a1f0e2d3c4b5a_node1620alpine_4e8a2f",
+			labels:     map[string]string{"com.github.ci.job.id": "1234"},
+			expected:   Job{ID: "1234"},
+			identified: true,
+		},
+		{
+			name:       "GitHub container without label",
+			provider:   GitHub{},
+			container:  "/9f2c4e1b7a6d4c3e8b5a1f0e2d3c4b5a_node1620alpine_4e8a2f",
+			expected:   Job{ID: "container"},
+			identified: false,
+		},
+		{
+			name:      "GitLab runner labels",
+			provider:  GitLab{},
+			container: "/runner-xyz12-project-42-concurrent-1-3f9c2a7d-build",
+			labels: map[string]string{
+				"com.gitlab.gitlab-runner.job.id":      "1234",
+				"com.gitlab.gitlab-runner.pipeline.id": "567",
+				"com.gitlab.gitlab-runner.project.id":  "42",
+				"com.gitlab.gitlab-runner.job.stage":   "test",
+			},
+			expected:   Job{ID: "1234", Fields: map[string]string{"project": "42", "concurrent": "1", "pipeline": "567", "stage": "test"}},
+			identified: true,
+		},
+		{
+			name:       "GitLab pipeline label",
+			provider:   GitLab{},
+			container:  "/runner-xyz12-project-42-concurrent-1-3f9c2a7d-build",
+			labels:     map[string]string{"com.gitlab.ci.job.id": "1234"},
+			expected:   Job{ID: "1234", Fields: map[string]string{"project": "42", "concurrent": "1", "stage": "build"}},
+			identified: true,
+		},
+		{
+			name:       "GitLab container name only",
+			provider:   GitLab{},
+			container:  "/runner-xyz12-project-42-concurrent-1-3f9c2a7d-predefined",
+			expected:   Job{ID: "runner-xyz12-project-42-concurrent-1-3f9c2a7d", Fields: map[string]string{"project": "42", "concurrent": "1", "stage": "predefined"}},
+			identified: true,
+		},
+		{
+			name:       "GitLab label of another provider",
+			provider:   GitLab{},
+			container:  "/postgres",
+			labels:     map[string]string{"com.github.ci.job.id": "1234"},
+			expected:   Job{ID: "container"},
+			identified: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			job, identified := tc.provider.Job("container", tc.container, tc.labels)
+			assert.Equal(t, tc.expected, job)
+			assert.Equal(t, tc.identified, identified)
+		})
+	}
+}
+
+func TestGitLabContainersOfAJobShareTheirIdentity(t *testing.T) {
+	prefix := "runner-xyz12-project-42-concurrent-1-3f9c2a7d-"
+
+	var ids []string
+	for _, suffix := range []string{"build", "predefined", "docker-0", "postgres-1"} {
+		parsed, ok := ParseGitLabContainer("/"+prefix+suffix, nil)
+		require.True(t, ok, suffix)
+		assert.Equal(t, suffix, parsed.Suffix)
+		ids = append(ids, parsed.Identity())
+	}
+	assert.Equal(t, []string{prefix[:len(prefix)-1]}, slices.Compact(ids))
+
+	// Another concurrent slot of the same runner runs another job
+	other, ok := ParseGitLabContainer("/runner-xyz12-project-42-concurrent-2-3f9c2a7d-build", nil)
+	require.True(t, ok)
+	assert.NotEqual(t, ids[0], other.Identity())
+}
+
+func TestJobString(t *testing.T) {
+	assert.Equal(t, "1234", Job{ID: "1234"}.String())
+	assert.Equal(t, "1234 (pipeline=567 stage=test)", Job{ID: "1234", Fields: map[string]string{"stage": "test", "pipeline": "567"}}.String())
+}
+
+func TestGitHubPatterns(t *testing.T) {
+	pattern := regexp.MustCompile(GitHub{}.Patterns()[0])
+
+	assert.True(t, pattern.MatchString("/9f2c4e1b7a6d4c3e8b5a1f0e2d3c4b5a_node1620alpine_4e8a2f"))
+	assert.False(t, pattern.MatchString("/runner-abc-project-1-concurrent-0-build"))
+	assert.False(t, pattern.MatchString("/postgres"))
+}
@@ -0,0 +1,286 @@
+// Package store keeps the jobs detected by the watcher in a local state file, so that jobs
+// started or finished while the watcher was down, and cleanups interrupted by a crash, are
+// resumed when it restarts. It implements cleanup.Journal.
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+// fileVersion is the version of the state file format.
+const fileVersion = 1
+
+// State is the lifecycle state of a job.
+type State string
+
+const (
+	// StateRunning is a job whose containers were detected and not yet finished.
+	StateRunning State = "running"
+
+	// StateFinished is a finished job whose cleanup was requested but not started.
+	StateFinished State = "finished"
+
+	// StateCleaning is a job being cleaned up. A job still in this state after a restart had its
+	// cleanup interrupted.
+	StateCleaning State = "cleaning"
+
+	// StateFailed is a job whose last cleanup left resources behind. It is cleaned up again
+	// after a restart.
+	StateFailed State = "failed"
+)
+
+// Job is a job recorded in the store. Jobs are removed once they were cleaned up, or forgotten
+// when they match no job pattern anymore.
+type Job struct {
+	ID            string             `json:"id"`
+	State         State              `json:"state"`
+	Resources     *cleanup.Resources `json:"resources"`
+	Policy        cleanup.Policy     `json:"policy"`
+	Attempts      int                `json:"attempts"`
+	DetectedAt    time.Time          `json:"detectedAt"`
+	FinishedAt    *time.Time         `json:"finishedAt,omitempty"`
+	LastAttemptAt *time.Time         `json:"lastAttemptAt,omitempty"`
+}
+
+// file is the content of the state file.
+type file struct {
+	Version int    `json:"version"`
+	Jobs    []*Job `json:"jobs"`
+}
+
+// Store records the lifecycle of jobs in a JSON file. Every change rewrites the file atomically,
+// so a crash leaves either the previous or the new state. It is safe for concurrent use.
+type Store struct {
+	mu     sync.Mutex
+	path   string
+	jobs   map[string]*Job
+	logger *slog.Logger
+}
+
+// Open loads the state file, or starts an empty store if it does not exist yet.
+//
+// Parameters:
+// - path: The path of the state file.
+// - logger: Receives the failures to save the state, nil to use slog.Default().
+//
+// Returns:
+// - *Store: The store holding the recorded jobs.
+// - error: An error if the file could not be read or decoded.
+func Open(path string, logger *slog.Logger) (*Store, error) {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	s := &Store{path: filepath.Clean(path), jobs: make(map[string]*Job), logger: logger}
+
+	data, err := os.ReadFile(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read state %s: %w", s.path, err)
+	}
+
+	var content file
+	if err := json.Unmarshal(data, &content); err != nil {
+		return nil, fmt.Errorf("failed to decode state %s: %w", s.path, err)
+	}
+	if content.Version != fileVersion {
+		return nil, fmt.Errorf("unsupported state %s version %d, expected %d", s.path, content.Version, fileVersion)
+	}
+	for _, job := range content.Jobs {
+		// Resources recorded by an older version may lack some kinds
+		if job.Resources == nil {
+			job.Resources = cleanup.NewResources(job.ID)
+		} else {
+			job.Resources = job.Resources.Clone()
+		}
+		s.jobs[job.ID] = job
+	}
+	return s, nil
+}
+
+// Jobs returns a copy of the recorded jobs, oldest first.
+func (s *Store) Jobs() []Job {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	jobs := make([]Job, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		copied := *job
+		copied.Resources = job.Resources.Clone()
+		jobs = append(jobs, copied)
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if !jobs[i].DetectedAt.Equal(jobs[j].DetectedAt) {
+			return jobs[i].DetectedAt.Before(jobs[j].DetectedAt)
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	return jobs
+}
+
+// Tracked records a container attributed to a running job.
+func (s *Store) Tracked(jobID, jobLabel, containerID, reason string, labels map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.job(jobID, jobLabel)
+	if job.Resources.HasContainer(containerID) {
+		return
+	}
+	job.Resources.AddContainer(containerID, reason, labels)
+	s.save()
+}
+
+// TrackedImage records an image built by or for a running job.
+func (s *Store) TrackedImage(jobID, jobLabel, imageID, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.job(jobID, jobLabel)
+	if _, exists := job.Resources.Images[imageID]; exists {
+		return
+	}
+	job.Resources.Images[imageID] = reason
+	s.save()
+}
+
+// TrackedImageTag records a tag a running job added to an image it did not build.
+func (s *Store) TrackedImageTag(jobID, jobLabel, tag, reason string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.job(jobID, jobLabel)
+	if _, exists := job.Resources.ImageTags[tag]; exists {
+		return
+	}
+	job.Resources.ImageTags[tag] = reason
+	s.save()
+}
+
+// Submitted records that the cleanup of the job was requested with the policy.
+func (s *Store) Submitted(owned *cleanup.Resources, policy cleanup.Policy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job := s.job(owned.JobID, owned.JobLabel)
+	job.Resources.Merge(owned)
+	job.Policy = policy
+	if job.State == StateRunning {
+		job.State = StateFinished
+		now := time.Now()
+		job.FinishedAt = &now
+	}
+	s.save()
+}
+
+// Attempted records that a cleanup of the job started, and returns the attempts of the job
+// across restarts, zero if the job is not recorded.
+func (s *Store) Attempted(jobID string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, exists := s.jobs[jobID]
+	if !exists {
+		return 0
+	}
+	job.State = StateCleaning
+	job.Attempts++
+	now := time.Now()
+	job.LastAttemptAt = &now
+	s.save()
+	return job.Attempts
+}
+
+// Failed records that the last cleanup of the job left resources behind. The job is kept, along
+// with its attempts, so that its cleanup is tried again after a restart.
+func (s *Store) Failed(jobID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	job, exists := s.jobs[jobID]
+	if !exists {
+		return
+	}
+	job.State = StateFailed
+	s.save()
+}
+
+// Completed forgets the job once it was cleaned up.
+func (s *Store) Completed(jobID string) {
+	s.Forget(jobID)
+}
+
+// Forget drops the job from the store.
+func (s *Store) Forget(jobID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.jobs[jobID]; !exists {
+		return
+	}
+	delete(s.jobs, jobID)
+	s.save()
+}
+
+// job returns the recorded job, recording it as running if it is not known yet.
+func (s *Store) job(jobID, jobLabel string) *Job {
+	job, exists := s.jobs[jobID]
+	if !exists {
+		job = &Job{ID: jobID, State: StateRunning, Resources: cleanup.NewResources(jobID), DetectedAt: time.Now()}
+		job.Resources.JobLabel = jobLabel
+		s.jobs[jobID] = job
+	}
+	return job
+}
+
+// save writes the jobs to the state file, logging failures since the jobs are still tracked in
+// memory.
+func (s *Store) save() {
+	if err := s.write(); err != nil {
+		s.logger.Error("Failed to save state", "path", s.path, cleanup.ErrorAttr(err))
+	}
+}
+
+// write replaces the state file with the current jobs.
+func (s *Store) write() error {
+	content := file{Version: fileVersion, Jobs: make([]*Job, 0, len(s.jobs))}
+	for _, job := range s.jobs {
+		content.Jobs = append(content.Jobs, job)
+	}
+	sort.Slice(content.Jobs, func(i, j int) bool { return content.Jobs[i].ID < content.Jobs[j].ID })
+
+	data, err := json.MarshalIndent(content, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".*.tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), s.path)
+}
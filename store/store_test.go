@@ -0,0 +1,117 @@
+package store
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"job-detection.is/github-gitlab/cleanup"
+)
+
+// TestStoreLifecycle tests that every step of a job's lifecycle survives reopening the store.
+func TestStoreLifecycle(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state.json")
+	st, err := Open(path, nil)
+	require.NoError(t, err)
+	assert.Empty(t, st.Jobs())
+
+	st.Tracked("1234", "com.gitlab.ci.job.id", "build", "job container", map[string]string{cleanup.ComposeProjectLabel: "ci-1234"})
+	st.Tracked("1234", "com.gitlab.ci.job.id", "helper", "created by GitLab for the job", nil)
+	st.Tracked("5678", "com.gitlab.ci.job.id", "test", "job container", nil)
+	st.TrackedImage("1234", "com.gitlab.ci.job.id", "sha256:built", "built while the job was running")
+	st.TrackedImageTag("1234", "com.gitlab.ci.job.id", "myreg/alpine:ci", "tagged while the job was running")
+
+	st, err = Open(path, nil)
+	require.NoError(t, err)
+	jobs := st.Jobs()
+	require.Len(t, jobs, 2)
+	assert.Equal(t, "1234", jobs[0].ID)
+	assert.Equal(t, StateRunning, jobs[0].State)
+	assert.Equal(t, "com.gitlab.ci.job.id", jobs[0].Resources.JobLabel)
+	assert.Equal(t, map[string]string{"build": "job container", "helper": "created by GitLab for the job"}, jobs[0].Resources.Containers)
+	assert.Contains(t, jobs[0].Resources.ComposeProjects, "ci-1234")
+	assert.Equal(t, map[string]string{"sha256:built": "built while the job was running"}, jobs[0].Resources.Images)
+	assert.Equal(t, map[string]string{"myreg/alpine:ci": "tagged while the job was running"}, jobs[0].Resources.ImageTags)
+
+	grace := cleanup.Duration(time.Minute)
+	owned := jobs[0].Resources
+	owned.Failed = true
+	st.Submitted(owned, cleanup.Policy{GraceDelay: &grace})
+	assert.Equal(t, 1, st.Attempted("1234"))
+
+	st, err = Open(path, nil)
+	require.NoError(t, err)
+	jobs = st.Jobs()
+	require.Len(t, jobs, 2)
+	assert.Equal(t, StateCleaning, jobs[0].State)
+	assert.Equal(t, 1, jobs[0].Attempts)
+	assert.True(t, jobs[0].Resources.Failed)
+	assert.NotNil(t, jobs[0].FinishedAt)
+	assert.NotNil(t, jobs[0].LastAttemptAt)
+	require.NotNil(t, jobs[0].Policy.GraceDelay)
+	assert.Equal(t, grace, *jobs[0].Policy.GraceDelay)
+
+	st.Failed("1234")
+	st, err = Open(path, nil)
+	require.NoError(t, err)
+	jobs = st.Jobs()
+	require.Len(t, jobs, 2)
+	assert.Equal(t, StateFailed, jobs[0].State)
+	assert.Equal(t, 1, jobs[0].Attempts)
+
+	st.Completed("1234")
+	st, err = Open(path, nil)
+	require.NoError(t, err)
+	jobs = st.Jobs()
+	require.Len(t, jobs, 1)
+	assert.Equal(t, "5678", jobs[0].ID)
+}
+
+func TestOpenRejectsInvalidState(t *testing.T) {
+	testCases := []struct {
+		name    string
+		content string
+		err     string
+	}{
+		{name: "Invalid JSON", content: `{"version": 1, "jobs": [`, err: "failed to decode state"},
+		{name: "Unsupported version", content: `{"version": 2, "jobs": []}`, err: "unsupported state"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "state.json")
+			require.NoError(t, os.WriteFile(path, []byte(tc.content), 0o600))
+
+			_, err := Open(path, nil)
+			assert.ErrorContains(t, err, tc.err)
+		})
+	}
+}
+
+// TestJobsAreCopies tests that changing the jobs returned does not change the store.
+func TestJobsAreCopies(t *testing.T) {
+	st, err := Open(filepath.Join(t.TempDir(), "state.json"), nil)
+	require.NoError(t, err)
+	st.Tracked("1234", cleanup.JobLabel, "build", "job container", nil)
+
+	jobs := st.Jobs()
+	jobs[0].Resources.AddContainer("other", "job container", nil)
+	assert.False(t, st.Jobs()[0].Resources.HasContainer("other"))
+}
+
+// TestSaveFailuresAreLogged tests that the failures to save the state reach the logger of the
+// store.
+func TestSaveFailuresAreLogged(t *testing.T) {
+	var out bytes.Buffer
+	st, err := Open(filepath.Join(t.TempDir(), "missing", "state.json"), slog.New(slog.NewTextHandler(&out, nil)))
+	require.NoError(t, err)
+
+	st.Tracked("1234", cleanup.JobLabel, "build", "job container", nil)
+	assert.Contains(t, out.String(), `msg="Failed to save state"`)
+	assert.Len(t, st.Jobs(), 1, "the job is still tracked in memory")
+}
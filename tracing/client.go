@@ -0,0 +1,159 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/api/types/container"
+	"github.com/docker/docker/api/types/events"
+	"github.com/docker/docker/api/types/filters"
+	"github.com/docker/docker/api/types/image"
+	"github.com/docker/docker/api/types/network"
+	"github.com/docker/docker/api/types/swarm"
+	"github.com/docker/docker/api/types/system"
+	"github.com/docker/docker/api/types/volume"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"job-detection.is/github-gitlab/dockerapi"
+)
+
+// resourceIDKey is the attribute identifying the resource a Docker API call acts on.
+const resourceIDKey = attribute.Key("docker.resource.id")
+
+// tracedClient starts a span around every call to the Docker API.
+type tracedClient struct {
+	cli dockerapi.Client
+}
+
+// Client returns cli with a span around every Docker API call, named after the method, such as
+// "docker.ContainerRemove". The event stream is not traced, since it lasts as long as the watcher.
+//
+// Parameters:
+// - cli: The Docker client instance.
+//
+// Returns:
+// - dockerapi.Client: The traced client.
+func Client(cli dockerapi.Client) dockerapi.Client {
+	return &tracedClient{cli: cli}
+}
+
+// start starts the span of a call to the method of the Docker API.
+func start(ctx context.Context, method string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	return Tracer().Start(ctx, "docker."+method, trace.WithSpanKind(trace.SpanKindClient), trace.WithAttributes(attrs...))
+}
+
+func (c *tracedClient) Events(ctx context.Context, options events.ListOptions) (<-chan events.Message, <-chan error) {
+	return c.cli.Events(ctx, options)
+}
+
+func (c *tracedClient) ContainerInspect(ctx context.Context, containerID string) (types.ContainerJSON, error) {
+	ctx, span := start(ctx, "ContainerInspect", resourceIDKey.String(containerID))
+	containerJSON, err := c.cli.ContainerInspect(ctx, containerID)
+	End(span, err)
+	return containerJSON, err
+}
+
+func (c *tracedClient) ContainerList(ctx context.Context, options container.ListOptions) ([]types.Container, error) {
+	ctx, span := start(ctx, "ContainerList")
+	containers, err := c.cli.ContainerList(ctx, options)
+	End(span, err)
+	return containers, err
+}
+
+func (c *tracedClient) ContainerStop(ctx context.Context, containerID string, options container.StopOptions) error {
+	ctx, span := start(ctx, "ContainerStop", resourceIDKey.String(containerID))
+	err := c.cli.ContainerStop(ctx, containerID, options)
+	End(span, err)
+	return err
+}
+
+func (c *tracedClient) ContainerRemove(ctx context.Context, containerID string, options container.RemoveOptions) error {
+	ctx, span := start(ctx, "ContainerRemove", resourceIDKey.String(containerID))
+	err := c.cli.ContainerRemove(ctx, containerID, options)
+	End(span, err)
+	return err
+}
+
+func (c *tracedClient) NetworkList(ctx context.Context, options network.ListOptions) ([]network.Summary, error) {
+	ctx, span := start(ctx, "NetworkList")
+	networks, err := c.cli.NetworkList(ctx, options)
+	End(span, err)
+	return networks, err
+}
+
+func (c *tracedClient) NetworkRemove(ctx context.Context, networkID string) error {
+	ctx, span := start(ctx, "NetworkRemove", resourceIDKey.String(networkID))
+	err := c.cli.NetworkRemove(ctx, networkID)
+	End(span, err)
+	return err
+}
+
+func (c *tracedClient) VolumeList(ctx context.Context, options volume.ListOptions) (volume.ListResponse, error) {
+	ctx, span := start(ctx, "VolumeList")
+	volumes, err := c.cli.VolumeList(ctx, options)
+	End(span, err)
+	return volumes, err
+}
+
+func (c *tracedClient) VolumeRemove(ctx context.Context, volumeID string, force bool) error {
+	ctx, span := start(ctx, "VolumeRemove", resourceIDKey.String(volumeID))
+	err := c.cli.VolumeRemove(ctx, volumeID, force)
+	End(span, err)
+	return err
+}
+
+func (c *tracedClient) ServiceList(ctx context.Context, options types.ServiceListOptions) ([]swarm.Service, error) {
+	ctx, span := start(ctx, "ServiceList")
+	services, err := c.cli.ServiceList(ctx, options)
+	End(span, err)
+	return services, err
+}
+
+func (c *tracedClient) ServiceRemove(ctx context.Context, serviceID string) error {
+	ctx, span := start(ctx, "ServiceRemove", resourceIDKey.String(serviceID))
+	err := c.cli.ServiceRemove(ctx, serviceID)
+	End(span, err)
+	return err
+}
+
+func (c *tracedClient) ImageList(ctx context.Context, options image.ListOptions) ([]image.Summary, error) {
+	ctx, span := start(ctx, "ImageList")
+	images, err := c.cli.ImageList(ctx, options)
+	End(span, err)
+	return images, err
+}
+
+func (c *tracedClient) ImageRemove(ctx context.Context, imageID string, options image.RemoveOptions) ([]image.DeleteResponse, error) {
+	ctx, span := start(ctx, "ImageRemove", resourceIDKey.String(imageID))
+	deleted, err := c.cli.ImageRemove(ctx, imageID, options)
+	End(span, err)
+	return deleted, err
+}
+
+func (c *tracedClient) ImagesPrune(ctx context.Context, pruneFilters filters.Args) (image.PruneReport, error) {
+	ctx, span := start(ctx, "ImagesPrune")
+	report, err := c.cli.ImagesPrune(ctx, pruneFilters)
+	End(span, err)
+	return report, err
+}
+
+func (c *tracedClient) BuildCachePrune(ctx context.Context, opts types.BuildCachePruneOptions) (*types.BuildCachePruneReport, error) {
+	ctx, span := start(ctx, "BuildCachePrune")
+	report, err := c.cli.BuildCachePrune(ctx, opts)
+	End(span, err)
+	return report, err
+}
+
+func (c *tracedClient) Info(ctx context.Context) (system.Info, error) {
+	ctx, span := start(ctx, "Info")
+	info, err := c.cli.Info(ctx)
+	End(span, err)
+	return info, err
+}
+
+func (c *tracedClient) DiskUsage(ctx context.Context, options types.DiskUsageOptions) (types.DiskUsage, error) {
+	ctx, span := start(ctx, "DiskUsage")
+	usage, err := c.cli.DiskUsage(ctx, options)
+	End(span, err)
+	return usage, err
+}
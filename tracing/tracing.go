@@ -0,0 +1,189 @@
+// Package tracing traces the lifecycle of jobs with OpenTelemetry: a span per job from its start
+// event to its completed cleanup, with the phases of the cleanup and the Docker API calls they
+// make as children. Spans go to the global tracer provider, which Setup configures; without it
+// nothing is recorded.
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/exporters/stdout/stdouttrace"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// Name is the name of the tracer, the instrumentation scope of every span of the watcher.
+const Name = "job-detection.is/github-gitlab"
+
+// Exporters lists the names accepted by Setup.
+var Exporters = []string{"none", "otlp", "stdout"}
+
+// Keys of the attributes of spans, named like the attributes of log records.
+const (
+	JobIDKey         = attribute.Key("job.id")
+	ContainerIDKey   = attribute.Key("container.id")
+	ContainerNameKey = attribute.Key("container.name")
+	PatternKey       = attribute.Key("job.pattern")
+)
+
+// Tracer returns the tracer of the watcher.
+func Tracer() trace.Tracer {
+	return otel.Tracer(Name)
+}
+
+// Setup installs the global tracer provider exporting spans with the named exporter: "otlp"
+// sends them over OTLP/HTTP to the endpoint of the OTEL_EXPORTER_OTLP_* variables, "stdout"
+// writes them to w, and "none" disables tracing.
+//
+// Parameters:
+// - ctx: The context of the exporter's connection.
+// - exporter: The name of the exporter, one of Exporters.
+// - w: Where the stdout exporter writes the spans, standard error rather than standard output so
+// that they do not corrupt the output of commands.
+//
+// Returns:
+// - func(context.Context) error: Flushes the pending spans and stops the provider.
+// - error: An error if the exporter is unknown or could not be created.
+func Setup(ctx context.Context, exporter string, w io.Writer) (func(context.Context) error, error) {
+	var spanExporter sdktrace.SpanExporter
+	var err error
+	switch exporter {
+	case "", "none":
+		return func(context.Context) error { return nil }, nil
+	case "otlp":
+		spanExporter, err = otlptracehttp.New(ctx)
+	case "stdout":
+		spanExporter, err = stdouttrace.New(stdouttrace.WithWriter(w))
+	default:
+		return nil, fmt.Errorf("invalid trace exporter %q, use none, otlp or stdout", exporter)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create %s trace exporter: %w", exporter, err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewWithAttributes(semconv.SchemaURL, semconv.ServiceName("job-detection")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to describe the trace resource: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(spanExporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	return provider.Shutdown, nil
+}
+
+// End records the error, if any, on the span and ends it.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// jobs holds the spans of the jobs started and not cleaned up yet.
+var jobs = struct {
+	mu    sync.Mutex
+	spans map[string]trace.Span
+}{spans: make(map[string]trace.Span)}
+
+// StartJob starts the span of the job, which lasts until EndJob. Starting a job whose span was
+// already started, such as when several of its containers match a job pattern, does nothing.
+//
+// Parameters:
+// - jobID: The ID of the job.
+// - attrs: Attributes describing the job, such as the container that started it.
+func StartJob(jobID string, attrs ...attribute.KeyValue) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	if _, exists := jobs.spans[jobID]; exists {
+		return
+	}
+	attrs = append([]attribute.KeyValue{JobIDKey.String(jobID)}, attrs...)
+	_, span := Tracer().Start(context.Background(), "job", trace.WithNewRoot(), trace.WithAttributes(attrs...))
+	jobs.spans[jobID] = span
+}
+
+// AddJobEvent records an event of the job, such as the exit of a container, on its span. It does
+// nothing if the span of the job was not started.
+func AddJobEvent(jobID, name string, attrs ...attribute.KeyValue) {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	if span, exists := jobs.spans[jobID]; exists {
+		span.AddEvent(name, trace.WithAttributes(attrs...))
+	}
+}
+
+// JobContext returns ctx carrying the span of the job, so that the spans started from it are
+// children of the job's span. ctx is returned unchanged if the span of the job was not started.
+func JobContext(ctx context.Context, jobID string) context.Context {
+	jobs.mu.Lock()
+	defer jobs.mu.Unlock()
+
+	if span, exists := jobs.spans[jobID]; exists {
+		return trace.ContextWithSpan(ctx, span)
+	}
+	return ctx
+}
+
+// errDropped fails the spans of the jobs evicted by EvictJobs.
+var errDropped = errors.New("job dropped before its cleanup completed")
+
+// EvictJobs ends the spans of the jobs that are neither running nor being cleaned up anymore,
+// such as jobs dropped before their cleanup was submitted, so that their spans do not pile up.
+//
+// Parameters:
+// - active: Reports whether the job is still running or being cleaned up. It is called without
+// holding the spans, so it may take the locks of the caller.
+//
+// Returns:
+// - int: The number of spans ended.
+func EvictJobs(active func(jobID string) bool) int {
+	jobs.mu.Lock()
+	jobIDs := make([]string, 0, len(jobs.spans))
+	for jobID := range jobs.spans {
+		jobIDs = append(jobIDs, jobID)
+	}
+	jobs.mu.Unlock()
+
+	evicted := 0
+	for _, jobID := range jobIDs {
+		if active(jobID) {
+			continue
+		}
+		jobs.mu.Lock()
+		span, exists := jobs.spans[jobID]
+		delete(jobs.spans, jobID)
+		jobs.mu.Unlock()
+
+		if exists {
+			End(span, errDropped)
+			evicted++
+		}
+	}
+	return evicted
+}
+
+// EndJob ends the span of the job once it has been cleaned up, failed if err is not nil. It does
+// nothing if the span of the job was not started.
+func EndJob(jobID string, err error) {
+	jobs.mu.Lock()
+	span, exists := jobs.spans[jobID]
+	delete(jobs.spans, jobID)
+	jobs.mu.Unlock()
+
+	if exists {
+		End(span, err)
+	}
+}
@@ -0,0 +1,127 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/docker/docker/api/types/container"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	"job-detection.is/github-gitlab/dockerapi/fake"
+)
+
+// recordSpans installs a tracer provider recording the ended spans in memory until the test ends.
+func recordSpans(t *testing.T) *tracetest.InMemoryExporter {
+	t.Helper()
+
+	exporter := tracetest.NewInMemoryExporter()
+	otel.SetTracerProvider(sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter)))
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+	return exporter
+}
+
+func TestClient(t *testing.T) {
+	exporter := recordSpans(t)
+
+	daemon := fake.NewDaemon()
+	job := daemon.CreateContainer(fake.ContainerSpec{Name: "job"})
+	cli := Client(daemon)
+
+	ctx, parent := Tracer().Start(context.Background(), "cleanup")
+	require.NoError(t, cli.ContainerRemove(ctx, job, container.RemoveOptions{Force: true}))
+	assert.Error(t, cli.ContainerRemove(ctx, "missing", container.RemoveOptions{Force: true}))
+	parent.End()
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	for i, want := range []struct {
+		id     string
+		status codes.Code
+	}{
+		{job, codes.Unset},
+		{"missing", codes.Error},
+	} {
+		span := spans[i]
+		assert.Equal(t, "docker.ContainerRemove", span.Name)
+		assert.Equal(t, parent.SpanContext().SpanID(), span.Parent.SpanID())
+		assert.Contains(t, span.Attributes, resourceIDKey.String(want.id))
+		assert.Equal(t, want.status, span.Status.Code)
+	}
+	assert.Len(t, spans[1].Events, 1, "the error is recorded")
+}
+
+func TestJobSpan(t *testing.T) {
+	exporter := recordSpans(t)
+
+	StartJob("1234", ContainerIDKey.String("abc"))
+	StartJob("1234", ContainerIDKey.String("def"))
+	AddJobEvent("1234", "container finished")
+
+	_, cleanup := Tracer().Start(JobContext(context.Background(), "1234"), "cleanup")
+	cleanup.End()
+	EndJob("1234", errors.New("network left behind"))
+
+	// The job is over, so the spans of another run are not children of it
+	_, unrelated := Tracer().Start(JobContext(context.Background(), "1234"), "cleanup")
+	unrelated.End()
+	EndJob("1234", nil)
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 3)
+	job := spans[1]
+	assert.Equal(t, "job", job.Name)
+	assert.Contains(t, job.Attributes, JobIDKey.String("1234"))
+	assert.Contains(t, job.Attributes, ContainerIDKey.String("abc"))
+	assert.Equal(t, codes.Error, job.Status.Code)
+	assert.Equal(t, "network left behind", job.Status.Description)
+	assert.Equal(t, "container finished", job.Events[0].Name)
+
+	assert.Equal(t, job.SpanContext.SpanID(), spans[0].Parent.SpanID())
+	assert.False(t, spans[2].Parent.IsValid())
+}
+
+func TestEvictJobs(t *testing.T) {
+	exporter := recordSpans(t)
+
+	StartJob("1234")
+	StartJob("5678")
+	assert.Equal(t, 1, EvictJobs(func(jobID string) bool { return jobID == "5678" }))
+	assert.Equal(t, 0, EvictJobs(func(jobID string) bool { return jobID == "5678" }))
+
+	spans := exporter.GetSpans()
+	require.Len(t, spans, 1)
+	assert.Contains(t, spans[0].Attributes, JobIDKey.String("1234"))
+	assert.Equal(t, codes.Error, spans[0].Status.Code)
+
+	// The active job keeps its span until its cleanup ends it
+	EndJob("5678", nil)
+	require.Len(t, exporter.GetSpans(), 2)
+}
+
+func TestSetup(t *testing.T) {
+	t.Cleanup(func() { otel.SetTracerProvider(noop.NewTracerProvider()) })
+
+	var out bytes.Buffer
+	shutdown, err := Setup(context.Background(), "stdout", &out)
+	require.NoError(t, err)
+
+	_, span := Tracer().Start(context.Background(), "job")
+	span.End()
+	require.NoError(t, shutdown(context.Background()))
+	assert.Contains(t, out.String(), `"Name":"job"`)
+	assert.Contains(t, out.String(), `"Value":"job-detection"`)
+
+	shutdown, err = Setup(context.Background(), "none", &out)
+	require.NoError(t, err)
+	assert.NoError(t, shutdown(context.Background()))
+
+	_, err = Setup(context.Background(), "jaeger", &out)
+	assert.ErrorContains(t, err, `invalid trace exporter "jaeger"`)
+}